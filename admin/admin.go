@@ -0,0 +1,428 @@
+// Package admin implements the HTTP admin interface of lemondb.
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/lemondb/capture"
+)
+
+// Server serves the admin endpoints on Addr, nothing is served if Addr is
+// empty.
+type Server struct {
+	// Addr is the host:port address of the admin interface.
+	Addr string
+	// Listen creates the listener on Addr, net.Listen by default. Such as
+	// upgrade.Upgrader.Listen, so the admin interface is handed over on
+	// upgrades.
+	Listen func(network, addr string) (net.Listener, error)
+	// Reload re-reads the configuration, if nil the reload endpoint is not
+	// available.
+	Reload func() error
+	// Proxies if not nil allows to list, start and stop the proxies.
+	Proxies Proxies
+	// Metrics if not nil is served on /metrics, such as a *metrics.Registry.
+	Metrics http.Handler
+	// Config if not nil returns the running configuration as YAML.
+	Config func() ([]byte, error)
+	// Drain if not nil starts draining the proxies, the process exits once
+	// they are drained. It must not block.
+	Drain func()
+	// Ready returns an error if the process should not get new clients, if
+	// nil the process is always ready.
+	Ready func() error
+	// Capture if not nil can be started and stopped on /capture.
+	Capture *capture.Capture
+
+	listener net.Listener
+}
+
+// Proxies are the proxies run by the process.
+type Proxies interface {
+	// Status returns the state of every proxy, running or not.
+	Status() []ProxyStatus
+	// StartProxy starts a stopped proxy.
+	StartProxy(name string) error
+	// StopProxy drains and stops a running proxy.
+	StopProxy(name string) error
+	// Connections returns the clients connected to the running proxies.
+	Connections() []ConnStatus
+	// Disconnect closes the client connection with the given id.
+	Disconnect(id uint64) error
+	// Backends returns the state of the backend of every running proxy.
+	Backends() []BackendStatus
+}
+
+// ProxyStatus is the state of a proxy.
+type ProxyStatus struct {
+	Name    string `json:"name"`
+	Listen  string `json:"listen"`
+	Backend string `json:"backend"`
+	Running bool   `json:"running"`
+	// Middlewares are the types of the pipeline, in order.
+	Middlewares []string `json:"middlewares"`
+}
+
+// ConnStatus is the state of a client connection.
+type ConnStatus struct {
+	Proxy string `json:"proxy"`
+	ID    uint64 `json:"id"`
+	Addr  string `json:"addr"`
+	// Age is how long the client has been connected.
+	Age Duration `json:"age"`
+	// Op, Namespace and Command describe the message being handled, Op is
+	// empty if the client is idle.
+	Op            string   `json:"op,omitempty"`
+	Namespace     string   `json:"ns,omitempty"`
+	Command       string   `json:"command,omitempty"`
+	OpDuration    Duration `json:"op_duration,omitempty"`
+	BytesReceived uint64   `json:"bytes_received"`
+	BytesSent     uint64   `json:"bytes_sent"`
+	User          string   `json:"user,omitempty"`
+	Subject       string   `json:"subject,omitempty"`
+	ServerAddr    string   `json:"server_addr"`
+}
+
+// BackendStatus is the state of the backend connections of a proxy.
+type BackendStatus struct {
+	Proxy         string `json:"proxy"`
+	Addr          string `json:"addr"`
+	Conns         int    `json:"conns"`
+	DialFailures  uint64 `json:"dial_failures"`
+	LastDialError string `json:"last_dial_error,omitempty"`
+	// LastDialErrorAt is empty if no dial ever failed.
+	LastDialErrorAt string `json:"last_dial_error_at,omitempty"`
+	// Healthy is the result of the last probe, it is always true if the
+	// backend is not probed.
+	Healthy        bool   `json:"healthy"`
+	LastProbe      string `json:"last_probe,omitempty"`
+	LastProbeError string `json:"last_probe_error,omitempty"`
+}
+
+// Duration is a time.Duration encoded as a string such as "1m30s".
+type Duration time.Duration
+
+// MarshalJSON encodes the duration rounded to milliseconds.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).Round(time.Millisecond).String())
+}
+
+// Handler returns the handler of the admin endpoints:
+//
+//	POST /reload                reloads the configuration.
+//	GET  /proxies               lists the proxies.
+//	POST /proxies/<name>/start  starts a stopped proxy.
+//	POST /proxies/<name>/stop   drains and stops a proxy.
+//	GET  /metrics               metrics in the Prometheus text format.
+//	GET  /connections           lists the client connections.
+//	POST /connections/<id>/kill closes a client connection.
+//	GET  /backends              shows the backend connections of every proxy.
+//	GET  /config                dumps the running configuration as YAML.
+//	POST /drain                 drains the proxies and exits.
+//	GET  /healthz               answers 200 while the process is alive.
+//	GET  /readyz                answers 200 if the process is ready for new
+//	                            clients, 503 otherwise.
+//	GET  /capture               shows the state of the traffic capture.
+//	POST /capture               starts a capture with the capture.Options
+//	                            given as JSON, replacing the running one.
+//	POST /capture/stop          stops the capture.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/capture", s.handleCapture)
+	mux.HandleFunc("/capture/stop", s.handleCaptureStop)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/connections", s.handleConnections)
+	mux.HandleFunc("/connections/", s.handleConnection)
+	mux.HandleFunc("/backends", s.handleBackends)
+	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/drain", s.handleDrain)
+	mux.HandleFunc("/reload", s.handleReload)
+	mux.HandleFunc("/proxies", s.handleProxies)
+	mux.HandleFunc("/proxies/", s.handleProxy)
+
+	return mux
+}
+
+// Start listens on Addr and serves the admin endpoints in the background.
+func (s *Server) Start() error {
+	if s.Addr == "" {
+		return nil
+	}
+
+	listen := s.Listen
+	if listen == nil {
+		listen = net.Listen
+	}
+
+	l, err := listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.listener = l
+	go http.Serve(l, s.Handler())
+	return nil
+}
+
+// Stop closes the listener.
+func (s *Server) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Reload == nil {
+		writeError(w, http.StatusNotFound, "reload is not available")
+		return
+	}
+
+	if err := s.Reload(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (s *Server) handleCapture(w http.ResponseWriter, r *http.Request) {
+	if s.Capture == nil {
+		writeError(w, http.StatusNotFound, "capture is not available")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, s.Capture.Status())
+	case "POST":
+		var opts capture.Options
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := s.Capture.Start(opts); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, s.Capture.Status())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) handleCaptureStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Capture == nil {
+		writeError(w, http.StatusNotFound, "capture is not available")
+		return
+	}
+
+	if err := s.Capture.Stop(); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.Ready != nil {
+		if err := s.Ready(); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Metrics == nil {
+		writeError(w, http.StatusNotFound, "metrics are not available")
+		return
+	}
+
+	s.Metrics.ServeHTTP(w, r)
+}
+
+func (s *Server) handleProxies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Proxies == nil {
+		writeError(w, http.StatusNotFound, "proxies are not available")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.Proxies.Status())
+}
+
+func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Proxies == nil {
+		writeError(w, http.StatusNotFound, "proxies are not available")
+		return
+	}
+
+	i := strings.LastIndex(r.URL.Path, "/")
+	name, action := strings.TrimPrefix(r.URL.Path[:i], "/proxies/"), r.URL.Path[i+1:]
+
+	var err error
+	switch action {
+	case "start":
+		err = s.Proxies.StartProxy(name)
+	case "stop":
+		err = s.Proxies.StopProxy(name)
+	default:
+		writeError(w, http.StatusNotFound, "unknown action "+action)
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Proxies == nil {
+		writeError(w, http.StatusNotFound, "proxies are not available")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.Proxies.Connections())
+}
+
+func (s *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Proxies == nil {
+		writeError(w, http.StatusNotFound, "proxies are not available")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/connections/"), "/")
+	if len(parts) != 2 || parts[1] != "kill" {
+		writeError(w, http.StatusNotFound, "unknown action")
+		return
+	}
+
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid connection id "+parts[0])
+		return
+	}
+
+	if err := s.Proxies.Disconnect(id); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (s *Server) handleBackends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Proxies == nil {
+		writeError(w, http.StatusNotFound, "proxies are not available")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.Proxies.Backends())
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Config == nil {
+		writeError(w, http.StatusNotFound, "config is not available")
+		return
+	}
+
+	b, err := s.Config()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(b)
+}
+
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.Drain == nil {
+		writeError(w, http.StatusNotFound, "drain is not available")
+		return
+	}
+
+	s.Drain()
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"ok": true})
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]interface{}{"ok": false, "error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
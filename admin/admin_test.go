@@ -0,0 +1,302 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcuadros/lemondb/capture"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type AdminSuite struct{}
+
+var _ = Suite(&AdminSuite{})
+
+func (s *AdminSuite) TestReload(c *C) {
+	var reloads int
+	srv := httptest.NewServer((&Server{
+		Reload: func() error { reloads++; return nil },
+	}).Handler())
+	defer srv.Close()
+
+	code, body := do(c, "POST", srv.URL+"/reload")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "{\"ok\":true}\n")
+	c.Assert(reloads, Equals, 1)
+}
+
+func (s *AdminSuite) TestReloadError(c *C) {
+	srv := httptest.NewServer((&Server{
+		Reload: func() error { return errors.New("foo") },
+	}).Handler())
+	defer srv.Close()
+
+	code, body := do(c, "POST", srv.URL+"/reload")
+	c.Assert(code, Equals, http.StatusInternalServerError)
+	c.Assert(body, Equals, "{\"error\":\"foo\",\"ok\":false}\n")
+}
+
+func (s *AdminSuite) TestReloadMethod(c *C) {
+	srv := httptest.NewServer((&Server{
+		Reload: func() error { return nil },
+	}).Handler())
+	defer srv.Close()
+
+	code, _ := do(c, "GET", srv.URL+"/reload")
+	c.Assert(code, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *AdminSuite) TestStartStop(c *C) {
+	srv := &Server{Addr: "127.0.0.1:0"}
+	c.Assert(srv.Start(), IsNil)
+	c.Assert(srv.Stop(), IsNil)
+
+	c.Assert((&Server{}).Start(), IsNil)
+}
+
+func (s *AdminSuite) TestProxies(c *C) {
+	proxies := &testProxies{}
+	srv := httptest.NewServer((&Server{Proxies: proxies}).Handler())
+	defer srv.Close()
+
+	code, body := do(c, "GET", srv.URL+"/proxies")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, `[{"name":"foo","listen":"localhost:7000","backend":"localhost:27017","running":true,"middlewares":["schema"]}]`+"\n")
+
+	code, _ = do(c, "POST", srv.URL+"/proxies/foo/stop")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(proxies.stopped, DeepEquals, []string{"foo"})
+
+	code, _ = do(c, "POST", srv.URL+"/proxies/foo/start")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(proxies.started, DeepEquals, []string{"foo"})
+
+	code, body = do(c, "POST", srv.URL+"/proxies/bar/start")
+	c.Assert(code, Equals, http.StatusConflict)
+	c.Assert(body, Equals, "{\"error\":\"unknown proxy bar\",\"ok\":false}\n")
+
+	code, _ = do(c, "POST", srv.URL+"/proxies/foo/restart")
+	c.Assert(code, Equals, http.StatusNotFound)
+}
+
+func (s *AdminSuite) TestProxiesNotAvailable(c *C) {
+	srv := httptest.NewServer((&Server{}).Handler())
+	defer srv.Close()
+
+	code, _ := do(c, "GET", srv.URL+"/proxies")
+	c.Assert(code, Equals, http.StatusNotFound)
+}
+
+type testProxies struct {
+	started, stopped []string
+	killed           []uint64
+}
+
+func (p *testProxies) Status() []ProxyStatus {
+	return []ProxyStatus{{
+		Name:        "foo",
+		Listen:      "localhost:7000",
+		Backend:     "localhost:27017",
+		Running:     true,
+		Middlewares: []string{"schema"},
+	}}
+}
+
+func (p *testProxies) StartProxy(name string) error {
+	if name != "foo" {
+		return errors.New("unknown proxy " + name)
+	}
+
+	p.started = append(p.started, name)
+	return nil
+}
+
+func (p *testProxies) StopProxy(name string) error {
+	p.stopped = append(p.stopped, name)
+	return nil
+}
+
+func (p *testProxies) Connections() []ConnStatus {
+	return []ConnStatus{{
+		Proxy:         "foo",
+		ID:            42,
+		Addr:          "127.0.0.1:1234",
+		Age:           Duration(90 * time.Second),
+		Op:            "QUERY",
+		Namespace:     "admin.$cmd",
+		Command:       "isMaster",
+		OpDuration:    Duration(1500 * time.Microsecond),
+		BytesReceived: 10,
+		BytesSent:     20,
+		User:          "bar@admin",
+		ServerAddr:    "127.0.0.1:27017",
+	}}
+}
+
+func (p *testProxies) Disconnect(id uint64) error {
+	if id != 42 {
+		return fmt.Errorf("unknown connection %d", id)
+	}
+
+	p.killed = append(p.killed, id)
+	return nil
+}
+
+func (p *testProxies) Backends() []BackendStatus {
+	return []BackendStatus{{Proxy: "foo", Addr: "localhost:27017", Conns: 1, Healthy: true}}
+}
+
+func (s *AdminSuite) TestConnections(c *C) {
+	proxies := &testProxies{}
+	srv := httptest.NewServer((&Server{Proxies: proxies}).Handler())
+	defer srv.Close()
+
+	code, body := do(c, "GET", srv.URL+"/connections")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, `[{"proxy":"foo","id":42,"addr":"127.0.0.1:1234","age":"1m30s",`+
+		`"op":"QUERY","ns":"admin.$cmd","command":"isMaster","op_duration":"2ms",`+
+		`"bytes_received":10,"bytes_sent":20,"user":"bar@admin","server_addr":"127.0.0.1:27017"}]`+"\n")
+
+	code, _ = do(c, "POST", srv.URL+"/connections/42/kill")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(proxies.killed, DeepEquals, []uint64{42})
+
+	code, body = do(c, "POST", srv.URL+"/connections/43/kill")
+	c.Assert(code, Equals, http.StatusNotFound)
+	c.Assert(body, Equals, "{\"error\":\"unknown connection 43\",\"ok\":false}\n")
+
+	code, _ = do(c, "POST", srv.URL+"/connections/foo/kill")
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	code, _ = do(c, "POST", srv.URL+"/connections/42")
+	c.Assert(code, Equals, http.StatusNotFound)
+}
+
+func (s *AdminSuite) TestBackends(c *C) {
+	srv := httptest.NewServer((&Server{Proxies: &testProxies{}}).Handler())
+	defer srv.Close()
+
+	code, body := do(c, "GET", srv.URL+"/backends")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, `[{"proxy":"foo","addr":"localhost:27017","conns":1,"dial_failures":0,"healthy":true}]`+"\n")
+}
+
+func (s *AdminSuite) TestConfig(c *C) {
+	srv := httptest.NewServer((&Server{
+		Config: func() ([]byte, error) { return []byte("proxies: []\n"), nil },
+	}).Handler())
+	defer srv.Close()
+
+	code, body := do(c, "GET", srv.URL+"/config")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "proxies: []\n")
+}
+
+func (s *AdminSuite) TestDrain(c *C) {
+	var drains int
+	srv := httptest.NewServer((&Server{Drain: func() { drains++ }}).Handler())
+	defer srv.Close()
+
+	code, _ := do(c, "GET", srv.URL+"/drain")
+	c.Assert(code, Equals, http.StatusMethodNotAllowed)
+
+	code, _ = do(c, "POST", srv.URL+"/drain")
+	c.Assert(code, Equals, http.StatusAccepted)
+	c.Assert(drains, Equals, 1)
+}
+
+func (s *AdminSuite) TestMetrics(c *C) {
+	srv := httptest.NewServer((&Server{
+		Metrics: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("foo_total 1\n"))
+		}),
+	}).Handler())
+	defer srv.Close()
+
+	code, body := do(c, "GET", srv.URL+"/metrics")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "foo_total 1\n")
+
+	srv = httptest.NewServer((&Server{}).Handler())
+	defer srv.Close()
+
+	code, _ = do(c, "GET", srv.URL+"/metrics")
+	c.Assert(code, Equals, http.StatusNotFound)
+}
+
+func do(c *C, method, url string) (int, string) {
+	req, err := http.NewRequest(method, url, nil)
+	c.Assert(err, IsNil)
+
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+
+	return res.StatusCode, string(b)
+}
+
+func (s *AdminSuite) TestHealth(c *C) {
+	var ready error
+	srv := httptest.NewServer((&Server{Ready: func() error { return ready }}).Handler())
+	defer srv.Close()
+
+	code, _ := do(c, "GET", srv.URL+"/healthz")
+	c.Assert(code, Equals, http.StatusOK)
+
+	code, _ = do(c, "GET", srv.URL+"/readyz")
+	c.Assert(code, Equals, http.StatusOK)
+
+	ready = errors.New("draining")
+	code, body := do(c, "GET", srv.URL+"/readyz")
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+	c.Assert(body, Equals, "{\"error\":\"draining\",\"ok\":false}\n")
+
+	code, _ = do(c, "GET", srv.URL+"/healthz")
+	c.Assert(code, Equals, http.StatusOK)
+}
+
+func (s *AdminSuite) TestCapture(c *C) {
+	cpt := &capture.Capture{Dir: c.MkDir()}
+	srv := httptest.NewServer((&Server{Capture: cpt}).Handler())
+	defer srv.Close()
+
+	code, body := do(c, "GET", srv.URL+"/capture")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, `{"running":false,"records":0,"errors":0}`+"\n")
+
+	res, err := http.Post(srv.URL+"/capture", "application/json",
+		strings.NewReader(`{"format": "jsonl", "namespaces": ["test.*"], "sample_rate": 0.1}`))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	status := cpt.Status()
+	c.Assert(status.Running, Equals, true)
+	c.Assert(status.Options.Format, Equals, capture.JSONLines)
+	c.Assert(status.Options.Namespaces, DeepEquals, []string{"test.*"})
+
+	res, err = http.Post(srv.URL+"/capture", "application/json", strings.NewReader(`{"format": "xml"}`))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+
+	code, _ = do(c, "POST", srv.URL+"/capture/stop")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(cpt.Status().Running, Equals, false)
+
+	code, _ = do(c, "POST", srv.URL+"/capture/stop")
+	c.Assert(code, Equals, http.StatusConflict)
+}
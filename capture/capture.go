@@ -0,0 +1,284 @@
+// Package capture records the messages handled by the proxies, along with
+// their replies, to rotating files. A capture is started and stopped at
+// runtime and can be limited to some namespaces, clients or a sample of the
+// messages.
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxSize  = 100 * 1024 * 1024
+	defaultMaxFiles = 5
+)
+
+var errNotStarted = errors.New("capture: not started")
+
+// Options describe what is captured and how.
+type Options struct {
+	// Format of the file, by default Binary.
+	Format Format `json:"format"`
+	// Namespaces if not empty limits the capture to the messages on these
+	// namespaces, patterns such as "test.*" are allowed.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Clients if not empty limits the capture to the clients connecting from
+	// these addresses, IPs or CIDRs.
+	Clients []string `json:"clients,omitempty"`
+	// SampleRate is the fraction of the matching messages captured, between
+	// 0 and 1. Zero captures all of them.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
+
+func (o *Options) validate() error {
+	if _, err := ParseFormat(string(o.Format)); err != nil {
+		return err
+	}
+
+	for _, ns := range o.Namespaces {
+		if _, err := path.Match(ns, ""); err != nil {
+			return fmt.Errorf("capture: invalid namespace pattern %q", ns)
+		}
+	}
+
+	if _, err := parseClients(o.Clients); err != nil {
+		return err
+	}
+
+	if o.SampleRate < 0 || o.SampleRate > 1 {
+		return fmt.Errorf("capture: sample_rate must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// Status is the state of a capture.
+type Status struct {
+	Running bool     `json:"running"`
+	File    string   `json:"file,omitempty"`
+	Options *Options `json:"options,omitempty"`
+	Records uint64   `json:"records"`
+	Errors  uint64   `json:"errors"`
+}
+
+// Capture writes the records to files in Dir. The zero value is ready to be
+// started, many proxies can share it.
+type Capture struct {
+	// Dir is where the capture files are created, by default the temporary
+	// directory.
+	Dir string
+	// MaxSize is the size of a file before it is rotated, by default 100MB.
+	MaxSize int64
+	// MaxFiles is how many rotated files are kept, by default 5.
+	MaxFiles int
+
+	mu      sync.RWMutex
+	opts    *Options
+	clients []*net.IPNet
+	file    *rotatingFile
+	records uint64
+	errors  uint64
+	rand    *rand.Rand
+}
+
+// Start starts a new capture, stopping the current one if any.
+func (c *Capture) Start(opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	opts.Format, _ = ParseFormat(string(opts.Format))
+	clients, _ := parseClients(opts.Clients)
+
+	dir := c.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	maxSize, maxFiles := c.MaxSize, c.MaxFiles
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+
+	if maxFiles <= 0 {
+		maxFiles = defaultMaxFiles
+	}
+
+	name := filepath.Join(dir, "capture-"+time.Now().Format("20060102-150405.000")+opts.Format.ext())
+	f, err := openRotatingFile(name, maxSize, maxFiles, opts.Format.header())
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file != nil {
+		c.file.Close()
+	}
+
+	c.opts, c.clients, c.file = &opts, clients, f
+	c.records, c.errors = 0, 0
+	if c.rand == nil {
+		c.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return nil
+}
+
+// Stop stops the current capture, closing its file.
+func (c *Capture) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return errNotStarted
+	}
+
+	err := c.file.Close()
+	c.file, c.opts, c.clients = nil, nil, nil
+	return err
+}
+
+// Status returns the state of the capture.
+func (c *Capture) Status() Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s := Status{Running: c.file != nil, Records: c.records, Errors: c.errors}
+	if c.file != nil {
+		opts := *c.opts
+		s.File, s.Options = c.file.path, &opts
+	}
+
+	return s
+}
+
+// Match returns true if a message on the namespace ns from the client addr
+// has to be captured, sampling included.
+func (c *Capture) Match(ns string, addr net.Addr) bool {
+	c.mu.RLock()
+	opts, clients := c.opts, c.clients
+	c.mu.RUnlock()
+
+	if opts == nil {
+		return false
+	}
+
+	if len(opts.Namespaces) > 0 && !matchNamespace(opts.Namespaces, ns) {
+		return false
+	}
+
+	if len(clients) > 0 && !matchClient(clients, addr) {
+		return false
+	}
+
+	if opts.SampleRate == 0 || opts.SampleRate == 1 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rand.Float64() < opts.SampleRate
+}
+
+// Record writes r to the current capture, it is dropped if the capture was
+// stopped or restarted meanwhile.
+func (c *Capture) Record(r *Record) error {
+	c.mu.RLock()
+	opts := c.opts
+	c.mu.RUnlock()
+
+	if opts == nil {
+		return errNotStarted
+	}
+
+	b, err := opts.Format.encode(r)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.opts != opts {
+		return errNotStarted
+	}
+
+	if err == nil {
+		_, err = c.file.Write(b)
+	}
+
+	if err != nil {
+		c.errors++
+		return err
+	}
+
+	c.records++
+	return nil
+}
+
+func matchNamespace(patterns []string, ns string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, ns); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchClient(clients []*net.IPNet, addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+
+		ip = net.ParseIP(host)
+	}
+
+	for _, n := range clients {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseClients parses IPs and CIDRs, an IP is a network with a single
+// address.
+func parseClients(clients []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range clients {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("capture: invalid client %q", s)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
@@ -0,0 +1,208 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type CaptureSuite struct{}
+
+var _ = Suite(&CaptureSuite{})
+
+func (s *CaptureSuite) TestBinary(c *C) {
+	cpt := &Capture{Dir: c.MkDir()}
+	c.Assert(cpt.Start(Options{Format: Binary}), IsNil)
+
+	rec := testRecord(c)
+	c.Assert(cpt.Record(rec), IsNil)
+	c.Assert(cpt.Record(&Record{Request: []byte("foo")}), IsNil)
+
+	file := cpt.Status().File
+	c.Assert(filepath.Ext(file), Equals, ".bin")
+	c.Assert(cpt.Stop(), IsNil)
+	c.Assert(cpt.Record(rec), Equals, errNotStarted)
+
+	f, err := os.Open(file)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	r, err := NewReader(f)
+	c.Assert(err, IsNil)
+
+	got, err := r.Next()
+	c.Assert(err, IsNil)
+	c.Assert(got.Time.Equal(rec.Time), Equals, true)
+	got.Time = rec.Time
+	c.Assert(got, DeepEquals, rec)
+
+	got, err = r.Next()
+	c.Assert(err, IsNil)
+	c.Assert(got.Request, DeepEquals, []byte("foo"))
+	c.Assert(got.Reply, IsNil)
+	c.Assert(got.RequestHeader(), IsNil)
+
+	_, err = r.Next()
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *CaptureSuite) TestNewReaderNotBinary(c *C) {
+	_, err := NewReader(bytes.NewBufferString("{\"time\": 1}\n"))
+	c.Assert(err, ErrorMatches, "capture: not a binary capture")
+}
+
+func (s *CaptureSuite) TestJSONLines(c *C) {
+	cpt := &Capture{Dir: c.MkDir()}
+	c.Assert(cpt.Start(Options{Format: JSONLines}), IsNil)
+	c.Assert(cpt.Record(testRecord(c)), IsNil)
+
+	file := cpt.Status().File
+	c.Assert(cpt.Stop(), IsNil)
+
+	b, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+
+	lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+	c.Assert(lines, HasLen, 1)
+
+	var rec struct {
+		ConnID    uint64  `json:"conn_id"`
+		LatencyMS float64 `json:"latency_ms"`
+		Request   struct {
+			Op        string                   `json:"op"`
+			Namespace string                   `json:"ns"`
+			Command   string                   `json:"command"`
+			Documents []map[string]interface{} `json:"documents"`
+		} `json:"request"`
+		Reply struct {
+			ResponseTo int32                    `json:"response_to"`
+			Documents  []map[string]interface{} `json:"documents"`
+		} `json:"reply"`
+	}
+
+	c.Assert(json.Unmarshal(lines[0], &rec), IsNil)
+	c.Assert(rec.ConnID, Equals, uint64(42))
+	c.Assert(rec.LatencyMS, Equals, 1.5)
+	c.Assert(rec.Request.Op, Equals, "QUERY")
+	c.Assert(rec.Request.Namespace, Equals, "admin.$cmd")
+	c.Assert(rec.Request.Command, Equals, "isMaster")
+	c.Assert(rec.Request.Documents, DeepEquals, []map[string]interface{}{{"isMaster": float64(1)}})
+	c.Assert(rec.Reply.ResponseTo, Equals, int32(7))
+	c.Assert(rec.Reply.Documents, DeepEquals, []map[string]interface{}{{"ok": float64(1)}})
+}
+
+func (s *CaptureSuite) TestRotation(c *C) {
+	cpt := &Capture{Dir: c.MkDir(), MaxSize: 300, MaxFiles: 2}
+	c.Assert(cpt.Start(Options{}), IsNil)
+	defer cpt.Stop()
+
+	rec := testRecord(c)
+	for i := 0; i < 10; i++ {
+		c.Assert(cpt.Record(rec), IsNil)
+	}
+
+	file := cpt.Status().File
+	matches, err := filepath.Glob(file + "*")
+	c.Assert(err, IsNil)
+	c.Assert(matches, DeepEquals, []string{file, file + ".1", file + ".2"})
+
+	for _, name := range matches {
+		f, err := os.Open(name)
+		c.Assert(err, IsNil)
+
+		r, err := NewReader(bufio.NewReader(f))
+		c.Assert(err, IsNil)
+
+		_, err = r.Next()
+		c.Assert(err, IsNil)
+		f.Close()
+	}
+}
+
+func (s *CaptureSuite) TestMatch(c *C) {
+	cpt := &Capture{Dir: c.MkDir()}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	c.Assert(cpt.Match("test.foo", addr), Equals, false)
+
+	c.Assert(cpt.Start(Options{
+		Namespaces: []string{"test.*", "admin.$cmd"},
+		Clients:    []string{"10.0.0.0/24", "127.0.0.1"},
+	}), IsNil)
+	defer cpt.Stop()
+
+	c.Assert(cpt.Match("test.foo", addr), Equals, true)
+	c.Assert(cpt.Match("admin.$cmd", addr), Equals, true)
+	c.Assert(cpt.Match("other.foo", addr), Equals, false)
+	c.Assert(cpt.Match("test.foo", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}), Equals, true)
+	c.Assert(cpt.Match("test.foo", &net.TCPAddr{IP: net.ParseIP("10.0.1.1")}), Equals, false)
+	c.Assert(cpt.Match("test.foo", &net.UnixAddr{Name: "/tmp/foo.sock"}), Equals, false)
+
+	c.Assert(cpt.Start(Options{SampleRate: 0.5}), IsNil)
+
+	var matched int
+	for i := 0; i < 1000; i++ {
+		if cpt.Match("test.foo", addr) {
+			matched++
+		}
+	}
+
+	c.Assert(matched > 300 && matched < 700, Equals, true, Commentf("matched %d", matched))
+}
+
+func (s *CaptureSuite) TestStartErrors(c *C) {
+	cpt := &Capture{Dir: c.MkDir()}
+	c.Assert(cpt.Start(Options{Format: "xml"}), ErrorMatches, `capture: unknown format "xml"`)
+	c.Assert(cpt.Start(Options{Namespaces: []string{"["}}), ErrorMatches, `capture: invalid namespace pattern "\["`)
+	c.Assert(cpt.Start(Options{Clients: []string{"foo"}}), ErrorMatches, `capture: invalid client "foo"`)
+	c.Assert(cpt.Start(Options{SampleRate: 2}), ErrorMatches, `capture: sample_rate must be between 0 and 1`)
+	c.Assert(cpt.Stop(), Equals, errNotStarted)
+	c.Assert(cpt.Status().Running, Equals, false)
+}
+
+func testRecord(c *C) *Record {
+	query, err := bson.Marshal(bson.M{"isMaster": 1})
+	c.Assert(err, IsNil)
+
+	q := &protocol.OpQuery{
+		MsgHeader:          &protocol.MsgHeader{RequestID: 7, OpCode: protocol.OpQueryCode},
+		FullCollectionName: protocol.CSString("admin.$cmd\x00"),
+		NumberToReturn:     -1,
+		Query:              query,
+	}
+
+	var req bytes.Buffer
+	_, err = q.WriteTo(&req)
+	c.Assert(err, IsNil)
+
+	reply := protocol.NewOpReplay(q, 8)
+	reply.AddDocument(bson.M{"ok": 1})
+
+	var rep bytes.Buffer
+	_, err = reply.WriteTo(&rep)
+	c.Assert(err, IsNil)
+
+	return &Record{
+		Time:       time.Unix(1500000000, 42),
+		Proxy:      "main",
+		ConnID:     42,
+		ClientAddr: "127.0.0.1:1234",
+		Request:    req.Bytes(),
+		Reply:      rep.Bytes(),
+		Latency:    1500 * time.Microsecond,
+	}
+}
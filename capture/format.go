@@ -0,0 +1,188 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Format is how the records are written.
+type Format string
+
+const (
+	// Binary keeps the messages as they were on the wire, so they can be
+	// replayed exactly. It is read back with Reader.
+	Binary Format = "binary"
+	// JSONLines writes a JSON object per line with the messages decoded,
+	// meant to be read by people and tools such as jq.
+	JSONLines Format = "jsonl"
+)
+
+// binaryMagic starts every binary capture file.
+var binaryMagic = []byte("LMDBCAP1")
+
+// maxBinaryRecord is the largest record accepted by Reader, twice the
+// maximum message size of mongo plus the fixed fields.
+const maxBinaryRecord = 2*48*1024*1024 + 1024
+
+var errRecordTooLarge = errors.New("capture: record too large")
+
+// ParseFormat returns the Format called name.
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case Binary, JSONLines:
+		return Format(name), nil
+	case "":
+		return Binary, nil
+	}
+
+	return "", fmt.Errorf("capture: unknown format %q", name)
+}
+
+// header returns what has to be written at the start of every file.
+func (f Format) header() []byte {
+	if f == Binary {
+		return binaryMagic
+	}
+
+	return nil
+}
+
+// ext is the extension of the files.
+func (f Format) ext() string {
+	if f == Binary {
+		return ".bin"
+	}
+
+	return ".jsonl"
+}
+
+// encode returns the record in the format.
+func (f Format) encode(r *Record) ([]byte, error) {
+	if f == JSONLines {
+		b, err := json.Marshal(newJSONRecord(r))
+		if err != nil {
+			return nil, err
+		}
+
+		return append(b, '\n'), nil
+	}
+
+	return encodeBinary(r), nil
+}
+
+// encodeBinary writes the record as a little endian uint32 length followed by
+// the time, conn id and latency as int64 and the proxy, client address,
+// request and reply prefixed by their uint32 length.
+func encodeBinary(r *Record) []byte {
+	size := 4 + 8*3 + 4*4 + len(r.Proxy) + len(r.ClientAddr) + len(r.Request) + len(r.Reply)
+	b := make([]byte, 0, size)
+
+	b = appendUint32(b, uint32(size-4))
+	b = appendUint64(b, uint64(r.Time.UnixNano()))
+	b = appendUint64(b, r.ConnID)
+	b = appendUint64(b, uint64(r.Latency))
+	for _, field := range [][]byte{[]byte(r.Proxy), []byte(r.ClientAddr), r.Request, r.Reply} {
+		b = appendUint32(b, uint32(len(field)))
+		b = append(b, field...)
+	}
+
+	return b
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// Reader reads the records of a binary capture.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader checks the header of the capture and returns a reader of its
+// records.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, fmt.Errorf("capture: reading header: %s", err)
+	}
+
+	if string(magic) != string(binaryMagic) {
+		return nil, fmt.Errorf("capture: not a binary capture")
+	}
+
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next record, io.EOF once there are no more.
+func (r *Reader) Next() (*Record, error) {
+	var size uint32
+	if err := binary.Read(r.r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+
+	if size > maxBinaryRecord {
+		return nil, errRecordTooLarge
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return decodeBinary(b)
+}
+
+func decodeBinary(b []byte) (*Record, error) {
+	le := binary.LittleEndian
+	if len(b) < 8*3 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	rec := &Record{
+		Time:    time.Unix(0, int64(le.Uint64(b))),
+		ConnID:  le.Uint64(b[8:]),
+		Latency: time.Duration(le.Uint64(b[16:])),
+	}
+
+	b = b[24:]
+	fields := make([][]byte, 4)
+	for i := range fields {
+		if len(b) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		n := le.Uint32(b)
+		b = b[4:]
+		if uint32(len(b)) < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		fields[i], b = b[:n], b[n:]
+	}
+
+	rec.Proxy, rec.ClientAddr = string(fields[0]), string(fields[1])
+	rec.Request, rec.Reply = fields[2], fields[3]
+	if len(rec.Reply) == 0 {
+		rec.Reply = nil
+	}
+
+	return rec, nil
+}
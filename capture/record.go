@@ -0,0 +1,151 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Record is a message sent by a client and the reply written back to it.
+type Record struct {
+	// Time is when the message was read.
+	Time       time.Time
+	Proxy      string
+	ConnID     uint64
+	ClientAddr string
+	// Request is the whole message as read from the client, header
+	// included.
+	Request []byte
+	// Reply is everything written to the client while handling the message,
+	// empty for the messages without response.
+	Reply []byte
+	// Latency is how long the message took to be handled.
+	Latency time.Duration
+}
+
+// RequestHeader decodes the request, nil is returned if it is not a valid
+// message.
+func (r *Record) RequestHeader() *protocol.MsgHeader {
+	return decodeMessage(r.Request)
+}
+
+// ReplyHeader decodes the reply, nil is returned if there is no reply or it is
+// not a valid message.
+func (r *Record) ReplyHeader() *protocol.MsgHeader {
+	return decodeMessage(r.Reply)
+}
+
+func decodeMessage(b []byte) *protocol.MsgHeader {
+	if len(b) < protocol.HeaderLen {
+		return nil
+	}
+
+	h, err := protocol.ReadMsgHeader(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+
+	return h
+}
+
+// jsonRecord is how a Record is written in the JSON-lines format, with the
+// messages decoded.
+type jsonRecord struct {
+	Time       time.Time    `json:"time"`
+	Proxy      string       `json:"proxy,omitempty"`
+	ConnID     uint64       `json:"conn_id"`
+	ClientAddr string       `json:"client_addr"`
+	LatencyMS  float64      `json:"latency_ms"`
+	Request    *jsonMessage `json:"request"`
+	Reply      *jsonMessage `json:"reply,omitempty"`
+}
+
+type jsonMessage struct {
+	Op         string            `json:"op"`
+	RequestID  int32             `json:"request_id"`
+	ResponseTo int32             `json:"response_to,omitempty"`
+	Namespace  string            `json:"ns,omitempty"`
+	Command    string            `json:"command,omitempty"`
+	Flags      int32             `json:"flags,omitempty"`
+	Skip       int32             `json:"skip,omitempty"`
+	Return     int32             `json:"return,omitempty"`
+	CursorID   int64             `json:"cursor_id,omitempty"`
+	Documents  []json.RawMessage `json:"documents,omitempty"`
+	Length     int32             `json:"length"`
+}
+
+func newJSONRecord(r *Record) *jsonRecord {
+	return &jsonRecord{
+		Time:       r.Time,
+		Proxy:      r.Proxy,
+		ConnID:     r.ConnID,
+		ClientAddr: r.ClientAddr,
+		LatencyMS:  float64(r.Latency) / float64(time.Millisecond),
+		Request:    newJSONMessage(r.RequestHeader()),
+		Reply:      newJSONMessage(r.ReplyHeader()),
+	}
+}
+
+func newJSONMessage(h *protocol.MsgHeader) *jsonMessage {
+	if h == nil {
+		return nil
+	}
+
+	m := &jsonMessage{
+		Op:         h.OpCode.String(),
+		RequestID:  h.RequestID,
+		ResponseTo: h.ResponseTo,
+		Length:     h.MessageLength,
+	}
+
+	m.Namespace, m.Command = protocol.ParseRequest(h.OpCode, h.Message)
+
+	switch h.OpCode {
+	case protocol.OpQueryCode:
+		q, err := protocol.ReadOpQuery(h, bytes.NewReader(h.Message))
+		if err != nil {
+			return m
+		}
+
+		m.Flags, m.Skip, m.Return = q.Flags, q.NumberToSkip, q.NumberToReturn
+		m.Documents = jsonDocuments(q.Query, q.ReturnFieldsSelector)
+	case protocol.OpReplyCode:
+		r, err := protocol.ReadOpReply(h, bytes.NewReader(h.Message))
+		if err != nil {
+			return m
+		}
+
+		m.Flags, m.CursorID = r.ResponseFlags, r.CursorID
+		m.Documents = jsonDocuments(r.Documents...)
+	}
+
+	return m
+}
+
+// jsonDocuments converts the documents to JSON, the empty ones are skipped.
+func jsonDocuments(docs ...protocol.Document) []json.RawMessage {
+	var out []json.RawMessage
+	for _, d := range docs {
+		if len(d) == 0 {
+			continue
+		}
+
+		var v interface{}
+		if err := bson.Unmarshal(d, &v); err != nil {
+			continue
+		}
+
+		b, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
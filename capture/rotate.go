@@ -0,0 +1,84 @@
+package capture
+
+import (
+	"fmt"
+	"os"
+)
+
+// rotatingFile writes to path until it reaches maxSize, then it is renamed to
+// path.1, the previous path.1 to path.2 and so on, keeping up to maxFiles
+// old files. Every new file starts with header.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	header   []byte
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int, header []byte) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles, header: header}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	r.f, r.size = f, 0
+	if len(r.header) == 0 {
+		return nil
+	}
+
+	n, err := f.Write(r.header)
+	r.size += int64(n)
+	return err
+}
+
+// Write writes b whole to the current file, rotating before if b doesn't fit.
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	if r.maxSize > 0 && r.size > int64(len(r.header)) && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	if r.maxFiles > 0 {
+		os.Remove(r.name(r.maxFiles))
+		for i := r.maxFiles - 1; i > 0; i-- {
+			os.Rename(r.name(i), r.name(i+1))
+		}
+
+		if err := os.Rename(r.path, r.name(1)); err != nil {
+			return err
+		}
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) name(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
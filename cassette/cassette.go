@@ -0,0 +1,330 @@
+// Package cassette records the replies of a mongo server to a file and serves
+// them back later, so the tests that need a server can run without one. The
+// requests are matched by their content, normalized so the fields that change
+// from one run to another, such as the session ids or the ObjectIds, do not
+// matter.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// IgnoredFields are the fields of the requests not taken into account to
+// match them, at any depth.
+var IgnoredFields = []string{
+	"$clusterTime",
+	"lsid",
+	"txnNumber",
+}
+
+// Interaction is a request and the reply recorded for it.
+type Interaction struct {
+	// Key is the normalized request.
+	Key string `json:"key"`
+	// Reply is the whole reply message, header included.
+	Reply []byte `json:"reply"`
+}
+
+// Cassette is a list of interactions. A request is replied with the
+// interactions recorded for the same key in the order they were recorded,
+// once they are exhausted the last one is repeated.
+type Cassette struct {
+	mu           sync.Mutex
+	interactions []*Interaction
+	played       map[string]int
+}
+
+// New returns an empty cassette.
+func New() *Cassette {
+	return &Cassette{played: make(map[string]int)}
+}
+
+// Load reads a cassette written by Save.
+func Load(file string) (*Cassette, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var f cassetteFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("cassette: %s: %s", file, err)
+	}
+
+	c := New()
+	c.interactions = f.Interactions
+	return c, nil
+}
+
+// Exists tells if there is a cassette at file.
+func Exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// Save writes the cassette to file, creating its directory if needed.
+func (c *Cassette) Save(file string) error {
+	c.mu.Lock()
+	b, err := json.MarshalIndent(&cassetteFile{Interactions: c.interactions}, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append(b, '\n'), 0644)
+}
+
+// Len returns the number of interactions.
+func (c *Cassette) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.interactions)
+}
+
+type cassetteFile struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+func (c *Cassette) record(key string, reply []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.interactions = append(c.interactions, &Interaction{Key: key, Reply: reply})
+}
+
+// play returns the next reply recorded for key, false if there is none.
+func (c *Cassette) play(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var last *Interaction
+	n := c.played[key]
+	for _, i := range c.interactions {
+		if i.Key != key {
+			continue
+		}
+
+		if n == 0 {
+			c.played[key]++
+			return i.Reply, true
+		}
+
+		n--
+		last = i
+	}
+
+	if last == nil {
+		return nil, false
+	}
+
+	return last.Reply, true
+}
+
+// Key returns the normalized request used to match it with the recorded
+// ones: the opcode, the namespace and, for the queries, the skip, the limit
+// and the query document without the IgnoredFields, ObjectIds, dates and
+// timestamps by their type. The order of the top-level fields does not
+// matter, the order of the subdocuments does, as it does for a sort or the
+// key of an index.
+func Key(h *protocol.MsgHeader) (string, error) {
+	ns, _ := protocol.ParseRequest(h.OpCode, h.Message)
+
+	switch h.OpCode {
+	case protocol.OpQueryCode:
+		q, err := protocol.ReadOpQuery(h, bytes.NewReader(h.Message))
+		if err != nil {
+			return "", err
+		}
+
+		query, err := normalizeDocument(q.Query)
+		if err != nil {
+			return "", err
+		}
+
+		fields, err := normalizeDocument(q.ReturnFieldsSelector)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s %s skip=%d return=%d %s %s",
+			h.OpCode, ns, q.NumberToSkip, q.NumberToReturn, query, fields), nil
+	case protocol.OpGetMoreCode:
+		// the cursor id is the same in every run, as it comes from the
+		// recorded replies.
+		if len(h.Message) < 12 {
+			return "", fmt.Errorf("cassette: invalid %s", h.OpCode)
+		}
+
+		return fmt.Sprintf("%s %s %x", h.OpCode, ns, h.Message[len(h.Message)-12:]), nil
+	}
+
+	return "", fmt.Errorf("cassette: %s has no reply", h.OpCode)
+}
+
+func normalizeDocument(d protocol.Document) (string, error) {
+	if len(d) == 0 {
+		return "{}", nil
+	}
+
+	// the subdocuments are decoded as bson.D too, keeping their order.
+	var doc bson.D
+	if err := bson.Unmarshal(d, &doc); err != nil {
+		return "", err
+	}
+
+	top := normalize(doc).(document)
+	sort.Sort(byName(top))
+
+	b, err := encodeJSON(top)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// document is a normalized bson.D, encoded to JSON in its order.
+type document bson.D
+
+func (d document) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range d {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		name, err := encodeJSON(e.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := encodeJSON(e.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type byName document
+
+func (d byName) Len() int           { return len(d) }
+func (d byName) Less(i, j int) bool { return d[i].Name < d[j].Name }
+func (d byName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// encodeJSON encodes v without escaping the HTML characters, such as the
+// ones of "<ObjectId>".
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func isIgnored(field string) bool {
+	for _, f := range IgnoredFields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		d := make(document, 0, len(v))
+		for _, e := range v {
+			if !isIgnored(e.Name) {
+				d = append(d, bson.DocElem{Name: e.Name, Value: normalize(e.Value)})
+			}
+		}
+
+		return d
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = normalize(e)
+		}
+
+		return l
+	case bson.ObjectId:
+		return "<ObjectId>"
+	case time.Time:
+		return "<Date>"
+	case bson.MongoTimestamp:
+		return "<Timestamp>"
+	case []byte:
+		return fmt.Sprintf("<Binary %x>", v)
+	case bson.Binary:
+		return fmt.Sprintf("<Binary %d %x>", v.Kind, v.Data)
+	}
+
+	return v
+}
+
+// keys returns the distinct keys of the cassette, sorted.
+func (c *Cassette) keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var keys []string
+	for _, i := range c.interactions {
+		if !seen[i.Key] {
+			seen[i.Key] = true
+			keys = append(keys, i.Key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// closest returns the recorded key sharing the longest prefix with key, to
+// help finding why a request was not matched.
+func (c *Cassette) closest(key string) string {
+	var best string
+	var bestLen int
+	for _, k := range c.keys() {
+		n := 0
+		for n < len(k) && n < len(key) && k[n] == key[n] {
+			n++
+		}
+
+		if n > bestLen || best == "" {
+			best, bestLen = k, n
+		}
+	}
+
+	return best
+}
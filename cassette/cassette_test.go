@@ -0,0 +1,223 @@
+package cassette
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type CassetteSuite struct{}
+
+var _ = Suite(&CassetteSuite{})
+
+func (s *CassetteSuite) TestRecordAndPlay(c *C) {
+	rec := &Recorder{Dialer: counterServer(), Cassette: New()}
+	conn, err := rec.Dial("mongo", time.Second)
+	c.Assert(err, IsNil)
+
+	count := bson.D{{Name: "count", Value: "foo"}}
+	c.Assert(roundTrip(c, conn, 1, count)["n"], Equals, 1)
+	insert(c, conn)
+	c.Assert(roundTrip(c, conn, 2, count)["n"], Equals, 2)
+	conn.Close()
+	c.Assert(rec.Cassette.Len(), Equals, 2)
+
+	file := filepath.Join(c.MkDir(), "cassettes", "test.json")
+	c.Assert(rec.Cassette.Save(file), IsNil)
+	c.Assert(Exists(file), Equals, true)
+
+	cst, err := Load(file)
+	c.Assert(err, IsNil)
+
+	p := &Player{Cassette: cst}
+	conn, err = p.Dial("", 0)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	insert(c, conn)
+	c.Assert(roundTrip(c, conn, 10, count)["n"], Equals, 1)
+	c.Assert(roundTrip(c, conn, 11, count)["n"], Equals, 2)
+	// once exhausted the last reply is repeated.
+	c.Assert(roundTrip(c, conn, 12, count)["n"], Equals, 2)
+}
+
+func (s *CassetteSuite) TestPlayNotRecorded(c *C) {
+	cst := New()
+	cst.record("QUERY test.$cmd skip=0 return=-1 {\"count\":\"foo\"} {}", nil)
+
+	p := &Player{Cassette: cst}
+	conn, err := p.Dial("", 0)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	r := roundTrip(c, conn, 1, bson.D{{Name: "count", Value: "bar"}})
+	c.Assert(r["$err"], Equals, "cassette: no reply recorded for "+
+		"QUERY test.$cmd skip=0 return=-1 {\"count\":\"bar\"} {}, "+
+		"the closest recorded is QUERY test.$cmd skip=0 return=-1 {\"count\":\"foo\"} {}")
+}
+
+func (s *CassetteSuite) TestPlayOutage(c *C) {
+	rec := &Recorder{Dialer: counterServer(), Cassette: New()}
+	conn, err := rec.Dial("mongo", time.Second)
+	c.Assert(err, IsNil)
+
+	count := bson.D{{Name: "count", Value: "foo"}}
+	c.Assert(roundTrip(c, conn, 1, count)["n"], Equals, 1)
+	conn.Close()
+
+	p := &Player{Cassette: rec.Cassette}
+	conn, err = p.Dial("", 0)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	p.Outage()
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+
+	_, err = p.Dial("", 0)
+	c.Assert(err, Equals, ErrOutage)
+
+	p.Restore()
+	conn, err = p.Dial("", 0)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	c.Assert(roundTrip(c, conn, 2, count)["n"], Equals, 1)
+}
+
+func (s *CassetteSuite) TestKey(c *C) {
+	a := key(c, bson.D{
+		{Name: "insert", Value: "foo"},
+		{Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: bson.NewObjectId()}, {Name: "at", Value: time.Now()}}}},
+		{Name: "lsid", Value: bson.M{"id": 1}},
+	})
+
+	b := key(c, bson.D{
+		{Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: bson.NewObjectId()}, {Name: "at", Value: time.Unix(0, 0)}}}},
+		{Name: "insert", Value: "foo"},
+		{Name: "lsid", Value: bson.M{"id": 2}},
+	})
+
+	c.Assert(a, Equals, b)
+	c.Assert(a, Equals, `QUERY test.$cmd skip=0 return=-1 {"documents":[{"_id":"<ObjectId>","at":"<Date>"}],"insert":"foo"} {}`)
+	c.Assert(key(c, bson.D{{Name: "insert", Value: "bar"}}), Not(Equals), a)
+
+	_, err := Key(&protocol.MsgHeader{OpCode: protocol.OpInsertCode})
+	c.Assert(err, ErrorMatches, "cassette: INSERT has no reply")
+}
+
+func (s *CassetteSuite) TestKey_SubdocumentOrder(c *C) {
+	sort := func(fields ...string) string {
+		var d bson.D
+		for _, f := range fields {
+			d = append(d, bson.DocElem{Name: f, Value: 1})
+		}
+
+		return key(c, bson.D{
+			{Name: "find", Value: "foo"},
+			{Name: "sort", Value: d},
+		})
+	}
+
+	c.Assert(sort("a", "b"), Equals, `QUERY test.$cmd skip=0 return=-1 {"find":"foo","sort":{"a":1,"b":1}} {}`)
+	c.Assert(sort("b", "a"), Equals, `QUERY test.$cmd skip=0 return=-1 {"find":"foo","sort":{"b":1,"a":1}} {}`)
+}
+
+// counterServer returns a Dialer of a server replying to every query with
+// the number of queries received.
+func counterServer() Dialer {
+	n := 0
+	return dialerFunc(func() net.Conn {
+		client, server := net.Pipe()
+		go serve(server, func(h *protocol.MsgHeader) ([]byte, error) {
+			if h.OpCode != protocol.OpQueryCode {
+				return nil, nil
+			}
+
+			n++
+			r := protocol.NewOpReplay(h, 1)
+			r.AddDocument(bson.M{"ok": 1, "n": n})
+
+			var buf bytes.Buffer
+			_, err := r.WriteTo(&buf)
+			return buf.Bytes(), err
+		})
+
+		return client
+	})
+}
+
+type dialerFunc func() net.Conn
+
+func (f dialerFunc) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return f(), nil
+}
+
+func query(c *C, id int32, cmd bson.D) *protocol.MsgHeader {
+	doc, err := bson.Marshal(cmd)
+	c.Assert(err, IsNil)
+
+	q := &protocol.OpQuery{
+		MsgHeader:          &protocol.MsgHeader{RequestID: id, OpCode: protocol.OpQueryCode},
+		FullCollectionName: protocol.CSString("test.$cmd\x00"),
+		NumberToReturn:     -1,
+		Query:              doc,
+	}
+
+	var buf bytes.Buffer
+	_, err = q.WriteTo(&buf)
+	c.Assert(err, IsNil)
+
+	h, err := protocol.ReadMsgHeader(&buf)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func key(c *C, cmd bson.D) string {
+	k, err := Key(query(c, 1, cmd))
+	c.Assert(err, IsNil)
+	return k
+}
+
+func roundTrip(c *C, conn net.Conn, id int32, cmd bson.D) bson.M {
+	_, err := query(c, id, cmd).WriteTo(conn)
+	c.Assert(err, IsNil)
+
+	h, err := protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(h.ResponseTo, Equals, id)
+
+	r, err := protocol.ReadOpReply(h, bytes.NewReader(h.Message))
+	c.Assert(err, IsNil)
+	c.Assert(r.Documents, HasLen, 1)
+
+	var doc bson.M
+	c.Assert(bson.Unmarshal(r.Documents[0], &doc), IsNil)
+	return doc
+}
+
+func insert(c *C, conn net.Conn) {
+	body := []byte{0, 0, 0, 0}
+	body = append(body, "test.foo\x00"...)
+	body = append(body, 5, 0, 0, 0, 0)
+
+	h := &protocol.MsgHeader{
+		MessageLength: int32(protocol.HeaderLen + len(body)),
+		RequestID:     100,
+		OpCode:        protocol.OpInsertCode,
+		Message:       body,
+	}
+
+	_, err := h.WriteTo(conn)
+	c.Assert(err, IsNil)
+}
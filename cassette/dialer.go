@@ -0,0 +1,196 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+// Dialer opens the connections to the server, it matches the Dialer of the
+// proxy package.
+type Dialer interface {
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// Recorder is a Dialer that connects to the real server with Dialer and
+// records its replies into Cassette.
+type Recorder struct {
+	Dialer   Dialer
+	Cassette *Cassette
+}
+
+// Dial connects to the server, the messages written to the returned
+// connection are forwarded one by one and their replies recorded.
+func (r *Recorder) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	server, err := r.Dialer.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client, conn := net.Pipe()
+	go func() {
+		defer server.Close()
+		serve(conn, func(h *protocol.MsgHeader) ([]byte, error) {
+			return r.roundTrip(server, h)
+		})
+	}()
+
+	return client, nil
+}
+
+func (r *Recorder) roundTrip(server net.Conn, h *protocol.MsgHeader) ([]byte, error) {
+	if _, err := h.WriteTo(server); err != nil {
+		return nil, err
+	}
+
+	if !h.OpCode.HasResponse() {
+		return nil, nil
+	}
+
+	reply, err := protocol.ReadMsgHeader(server)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := reply.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+
+	key, err := Key(h)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Cassette.record(key, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// ErrOutage is returned by Player.Dial during an outage.
+var ErrOutage = errors.New("cassette: server unavailable")
+
+// Player is a Dialer that replies the messages with the ones recorded in
+// Cassette, no server is needed. The requests not recorded are replied with a
+// query failure naming the closest recorded request.
+type Player struct {
+	Cassette *Cassette
+
+	// mu guards conns and down.
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	down  bool
+}
+
+// Dial returns a connection served from the cassette, the address is
+// ignored. It fails with ErrOutage while the server is down.
+func (p *Player) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.down {
+		return nil, ErrOutage
+	}
+
+	if p.conns == nil {
+		p.conns = make(map[net.Conn]struct{})
+	}
+
+	client, conn := net.Pipe()
+	p.conns[conn] = struct{}{}
+	go func() {
+		serve(conn, p.reply)
+
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+	}()
+
+	return client, nil
+}
+
+// Outage simulates the server going away: the open connections are closed
+// and the new ones refused until Restore is called.
+func (p *Player) Outage() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.down = true
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+// Restore ends the outage started by Outage.
+func (p *Player) Restore() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.down = false
+}
+
+func (p *Player) reply(h *protocol.MsgHeader) ([]byte, error) {
+	if !h.OpCode.HasResponse() {
+		return nil, nil
+	}
+
+	key, err := Key(h)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, ok := p.Cassette.play(key)
+	if !ok {
+		return notRecorded(h, key, p.Cassette.closest(key))
+	}
+
+	// the reply is to the request being played, not the recorded one.
+	reply = append([]byte(nil), reply...)
+	if len(reply) >= protocol.HeaderLen {
+		binary.LittleEndian.PutUint32(reply[8:], uint32(h.RequestID))
+	}
+
+	return reply, nil
+}
+
+func notRecorded(h *protocol.MsgHeader, key, closest string) ([]byte, error) {
+	msg := fmt.Sprintf("cassette: no reply recorded for %s", key)
+	if closest != "" {
+		msg += fmt.Sprintf(", the closest recorded is %s", closest)
+	}
+
+	var buf bytes.Buffer
+	_, err := protocol.NewOpReplyError(h, 0, 0, msg).WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+// serve reads the messages of conn and writes back what reply returns for
+// each one, until conn or reply fail.
+func serve(conn net.Conn, reply func(h *protocol.MsgHeader) ([]byte, error)) {
+	defer conn.Close()
+
+	for {
+		h, err := protocol.ReadMsgHeader(conn)
+		if err != nil {
+			return
+		}
+
+		b, err := reply(h)
+		if err != nil {
+			return
+		}
+
+		if len(b) == 0 {
+			continue
+		}
+
+		if _, err := conn.Write(b); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/lemondb/memdb"
+	"github.com/mcuadros/lemondb/middlewares"
+	"github.com/mcuadros/lemondb/proxy"
+)
+
+const (
+	unixScheme   = "unix://"
+	memoryScheme = "memory://"
+
+	defaultProbeInterval = 10 * time.Second
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewProxy returns the proxy described by the config, Log, Metrics and Listen
+// are left for the caller.
+func (p *Proxy) NewProxy() (*proxy.Proxy, error) {
+	m, err := p.NewPipeline()
+	if err != nil {
+		return nil, err
+	}
+
+	px := &proxy.Proxy{
+		Name:              p.Name,
+		ProxyAddr:         p.Listen,
+		MongoAddr:         p.Backend,
+		MessageTimeout:    p.Timeouts.Message,
+		ClientIdleTimeout: p.Timeouts.ClientIdle,
+		DialTimeout:       p.Timeouts.Dial,
+		QueueTimeout:      p.Timeouts.Queue,
+		DrainTimeout:      p.Timeouts.Drain,
+		MaxClients:        p.Limits.MaxClients,
+		MaxClientsPerIP:   p.Limits.MaxClientsPerIP,
+		MaxInFlight:       p.Limits.MaxInFlight,
+		MaxQueue:          p.Limits.MaxQueue,
+		DialRetries:       p.Dial.Retries,
+		DialBackoff:       p.Dial.Backoff,
+		ProbeTimeout:      p.HealthCheck.Timeout,
+		Middleware:        m,
+	}
+
+	if !p.HealthCheck.Disabled {
+		px.ProbeInterval = p.HealthCheck.Interval
+		if px.ProbeInterval == 0 {
+			px.ProbeInterval = defaultProbeInterval
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(p.Backend, unixScheme):
+		px.MongoAddr = strings.TrimPrefix(p.Backend, unixScheme)
+		px.Dialer = &proxy.UnixDialer{}
+	case strings.HasPrefix(p.Backend, memoryScheme):
+		px.MongoAddr = strings.TrimPrefix(p.Backend, memoryScheme)
+		px.Dialer = memdb.Named(px.MongoAddr)
+	case p.BackendTLS != nil:
+		px.Dialer = &proxy.TLSDialer{
+			CAFile:             p.BackendTLS.CAFile,
+			CertFile:           p.BackendTLS.CertFile,
+			KeyFile:            p.BackendTLS.KeyFile,
+			ServerName:         p.BackendTLS.ServerName,
+			InsecureSkipVerify: p.BackendTLS.InsecureSkipVerify,
+		}
+	}
+
+	if px.TLS, err = p.TLS.newTLSConfig(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range p.Listeners {
+		cfg := proxy.ListenerConfig{
+			Network:        l.Network,
+			Addr:           l.Addr,
+			Mode:           os.FileMode(l.Mode),
+			ProxyProtocol:  l.ProxyProtocol,
+			TrustedProxies: l.TrustedProxies,
+		}
+
+		if cfg.TLS, err = l.TLS.newTLSConfig(); err != nil {
+			return nil, err
+		}
+
+		px.Listeners = append(px.Listeners, cfg)
+	}
+
+	return px, nil
+}
+
+func (t *TLS) newTLSConfig() (*proxy.TLSConfig, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	v, err := tlsVersion(t.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	suites, err := cipherSuites(t.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxy.TLSConfig{
+		CertFile:     t.CertFile,
+		KeyFile:      t.KeyFile,
+		ClientCAFile: t.ClientCAFile,
+		MinVersion:   v,
+		CipherSuites: suites,
+	}, nil
+}
+
+func tlsVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	n, ok := tlsVersions[v]
+	if !ok {
+		return 0, fmt.Errorf("unsupported min_version %q", v)
+	}
+
+	return n, nil
+}
+
+// cipherSuites returns the ids of the named suites, only the secure suites
+// of TLS 1.2 and earlier are accepted, the ones of TLS 1.3 are not
+// configurable.
+func cipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	known := cipherSuiteIDs()
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %q", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func cipherSuiteIDs() map[string]uint16 {
+	ids := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		for _, v := range s.SupportedVersions {
+			if v < tls.VersionTLS13 {
+				ids[s.Name] = s.ID
+				break
+			}
+		}
+	}
+
+	return ids
+}
+
+// NewPipeline builds the middlewares of the proxy from the registry, the
+// messages are proxied after the last one.
+func (p *Proxy) NewPipeline() (middlewares.Middleware, error) {
+	steps := make([]middlewares.Step, len(p.Middlewares))
+	for i, m := range p.Middlewares {
+		steps[i] = middlewares.Step{Type: m.Type, Options: middlewares.Options(m.Options)}
+	}
+
+	return middlewares.Build(steps)
+}
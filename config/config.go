@@ -0,0 +1,410 @@
+// Package config reads the configuration file of lemondb, describing the
+// proxies to run and the middlewares handling their messages.
+//
+// A configuration with a single proxy looks like:
+//
+//	proxies:
+//	  - name: main
+//	    listen: localhost:7000
+//	    backend: localhost:27017
+//	    timeouts:
+//	      message: 2m
+//	      client_idle: 60m
+//	    limits:
+//	      max_clients: 1000
+//	    middlewares:
+//	      - type: schema
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the whole configuration file.
+type Config struct {
+	Proxies []Proxy `yaml:"proxies"`
+}
+
+// Proxy describes a proxy and its middleware pipeline.
+type Proxy struct {
+	// Name identifies the proxy in the logs and metrics, by default the
+	// listen address.
+	Name string `yaml:"name"`
+	// Listen is the host:port address for the client connections.
+	Listen string `yaml:"listen"`
+	// Backend is the address of the mongo server, a host:port address,
+	// unix:///path/to/socket or memory://name for the in-memory store shared
+	// with the memory middlewares of the same name.
+	Backend string `yaml:"backend"`
+	// BackendTLS if not nil the connections to the backend use TLS.
+	BackendTLS *BackendTLS `yaml:"backend_tls,omitempty"`
+	// TLS if not nil the client connections on Listen are expected to be TLS.
+	TLS *TLS `yaml:"tls,omitempty"`
+	// Listeners are additional addresses for the client connections.
+	Listeners []Listener `yaml:"listeners,omitempty"`
+	Timeouts  Timeouts   `yaml:"timeouts,omitempty"`
+	Limits    Limits     `yaml:"limits,omitempty"`
+	// Dial describes how the failed connections to the backend are retried.
+	Dial Dial `yaml:"dial,omitempty"`
+	// HealthCheck describes the probes of the backend, by default it is
+	// probed every 10 seconds.
+	HealthCheck HealthCheck `yaml:"health_check,omitempty"`
+	// Middlewares is the pipeline handling every message, the first one gets
+	// the messages and they are proxied after the last one.
+	Middlewares []Middleware `yaml:"middlewares,omitempty"`
+}
+
+// Listener is an additional address for the client connections.
+type Listener struct {
+	// Network is "tcp" or "unix", by default "tcp".
+	Network string `yaml:"network"`
+	// Addr is a host:port address for tcp or the socket path for unix.
+	Addr string `yaml:"addr"`
+	// Mode is the file mode of the unix socket, by default 0666.
+	Mode           uint32   `yaml:"mode,omitempty"`
+	TLS            *TLS     `yaml:"tls,omitempty"`
+	ProxyProtocol  bool     `yaml:"proxy_protocol,omitempty"`
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+}
+
+// TLS describes how the TLS connections of the clients are terminated.
+type TLS struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// MinVersion is one of "1.0", "1.1", "1.2" or "1.3", by default "1.2".
+	MinVersion string `yaml:"min_version"`
+	// CipherSuites are the names of the enabled cipher suites, such as
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", by default the Go ones. The
+	// TLS 1.3 suites can't be configured.
+	CipherSuites []string `yaml:"cipher_suites,omitempty"`
+}
+
+// BackendTLS describes the TLS connections to the backend.
+type BackendTLS struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Timeouts of a proxy, a zero value means the proxy default.
+type Timeouts struct {
+	Message    time.Duration `yaml:"message"`
+	ClientIdle time.Duration `yaml:"client_idle"`
+	Dial       time.Duration `yaml:"dial"`
+	Queue      time.Duration `yaml:"queue"`
+	Drain      time.Duration `yaml:"drain"`
+}
+
+// Dial of a proxy, a zero value means the proxy default.
+type Dial struct {
+	// Retries is how many times a connection to the backend is tried.
+	Retries int `yaml:"retries,omitempty"`
+	// Backoff is the sleep after the first failed try, doubled after every
+	// other one.
+	Backoff time.Duration `yaml:"backoff,omitempty"`
+}
+
+// Limits of a proxy, a zero value means no limit.
+type Limits struct {
+	MaxClients      int `yaml:"max_clients"`
+	MaxClientsPerIP int `yaml:"max_clients_per_ip"`
+	MaxInFlight     int `yaml:"max_in_flight"`
+	MaxQueue        int `yaml:"max_queue"`
+}
+
+// HealthCheck configures the probes of the backend, a zero value means the
+// default.
+type HealthCheck struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	// Disabled turns off the probes, the backend is always considered
+	// healthy.
+	Disabled bool `yaml:"disabled,omitempty"`
+}
+
+// Middleware is a step of the pipeline.
+type Middleware struct {
+	// Type is the name of the middleware in the registry, such as "schema".
+	Type string `yaml:"type"`
+	// Options are specific to each middleware type.
+	Options map[string]interface{} `yaml:"options,omitempty"`
+}
+
+// Load reads and validates the configuration file at path.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return c, nil
+}
+
+// Parse decodes and validates a configuration, any unknown field is an
+// error.
+func Parse(b []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Validate checks the configuration, filling the default names of the
+// proxies. The error returned points to the offending proxy.
+func (c *Config) Validate() error {
+	if len(c.Proxies) == 0 {
+		return fmt.Errorf("config: no proxies defined")
+	}
+
+	names := make(map[string]bool)
+	addrs := make(map[string]string)
+	for i := range c.Proxies {
+		p := &c.Proxies[i]
+		if p.Name == "" {
+			p.Name = p.Listen
+		}
+
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("config: proxies[%d] (%s): %s", i, p.Name, err)
+		}
+
+		if names[p.Name] {
+			return fmt.Errorf("config: proxies[%d]: duplicated name %q", i, p.Name)
+		}
+
+		names[p.Name] = true
+		for _, addr := range p.addrs() {
+			if other, ok := addrs[addr]; ok {
+				return fmt.Errorf(
+					"config: proxies[%d] (%s): %s already used by %s", i, p.Name, addr, other,
+				)
+			}
+
+			addrs[addr] = p.Name
+		}
+	}
+
+	return nil
+}
+
+func (p *Proxy) validate() error {
+	if p.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+
+	if err := validateHostPort("listen", p.Listen); err != nil {
+		return err
+	}
+
+	if p.Backend == "" {
+		return fmt.Errorf("backend is required")
+	}
+
+	switch {
+	case strings.HasPrefix(p.Backend, memoryScheme):
+		if p.Backend == memoryScheme {
+			return fmt.Errorf("backend: the memory store needs a name")
+		}
+
+		if p.BackendTLS != nil {
+			return fmt.Errorf("backend_tls is not valid for a memory backend")
+		}
+	case !strings.HasPrefix(p.Backend, unixScheme):
+		if err := validateHostPort("backend", p.Backend); err != nil {
+			return err
+		}
+	}
+
+	if p.TLS != nil {
+		if err := p.TLS.validate(); err != nil {
+			return fmt.Errorf("tls: %s", err)
+		}
+	}
+
+	if p.BackendTLS != nil {
+		if err := p.BackendTLS.validate(); err != nil {
+			return fmt.Errorf("backend_tls: %s", err)
+		}
+	}
+
+	for i, l := range p.Listeners {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listeners[%d]: %s", i, err)
+		}
+	}
+
+	if err := p.Timeouts.validate(); err != nil {
+		return fmt.Errorf("timeouts: %s", err)
+	}
+
+	if err := p.Limits.validate(); err != nil {
+		return fmt.Errorf("limits: %s", err)
+	}
+
+	if p.Dial.Retries < 0 || p.Dial.Backoff < 0 {
+		return fmt.Errorf("dial: retries and backoff can't be negative")
+	}
+
+	if p.HealthCheck.Interval < 0 || p.HealthCheck.Timeout < 0 {
+		return fmt.Errorf("health_check: interval and timeout can't be negative")
+	}
+
+	_, err := p.NewPipeline()
+	return err
+}
+
+// addrs returns every address the proxy listens on as network://addr.
+func (p *Proxy) addrs() []string {
+	addrs := []string{"tcp://" + p.Listen}
+	for _, l := range p.Listeners {
+		addrs = append(addrs, l.network()+"://"+l.Addr)
+	}
+
+	return addrs
+}
+
+func (l *Listener) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+
+	return l.Network
+}
+
+func (l *Listener) validate() error {
+	if l.Addr == "" {
+		return fmt.Errorf("addr is required")
+	}
+
+	switch l.network() {
+	case "tcp", "tcp4", "tcp6":
+		if err := validateHostPort("addr", l.Addr); err != nil {
+			return err
+		}
+
+		if l.Mode != 0 {
+			return fmt.Errorf("mode is only valid for unix sockets")
+		}
+	case "unix":
+		if l.ProxyProtocol {
+			return fmt.Errorf("proxy_protocol is only valid for tcp")
+		}
+	default:
+		return fmt.Errorf("unsupported network %q", l.Network)
+	}
+
+	if l.ProxyProtocol && len(l.TrustedProxies) == 0 {
+		return fmt.Errorf("proxy_protocol requires trusted_proxies")
+	}
+
+	for _, cidr := range l.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("trusted_proxies: %s", err)
+		}
+	}
+
+	if l.TLS != nil {
+		if err := l.TLS.validate(); err != nil {
+			return fmt.Errorf("tls: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (t *TLS) validate() error {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("cert_file and key_file are required")
+	}
+
+	if _, err := tlsVersion(t.MinVersion); err != nil {
+		return err
+	}
+
+	if _, err := cipherSuites(t.CipherSuites); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *BackendTLS) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be given together")
+	}
+
+	return nil
+}
+
+func (t *Timeouts) validate() error {
+	for name, d := range map[string]time.Duration{
+		"message":     t.Message,
+		"client_idle": t.ClientIdle,
+		"dial":        t.Dial,
+		"queue":       t.Queue,
+		"drain":       t.Drain,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+
+	return nil
+}
+
+func (l *Limits) validate() error {
+	for name, n := range map[string]int{
+		"max_clients":        l.MaxClients,
+		"max_clients_per_ip": l.MaxClientsPerIP,
+		"max_in_flight":      l.MaxInFlight,
+		"max_queue":          l.MaxQueue,
+	} {
+		if n < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+
+	if l.MaxQueue > 0 && l.MaxInFlight == 0 {
+		return fmt.Errorf("max_queue requires max_in_flight")
+	}
+
+	return nil
+}
+
+func validateHostPort(field, addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%s: %s", field, err)
+	}
+
+	return nil
+}
+
+// NeedsRestart returns true if newer changes anything besides the middlewares,
+// those changes can't be applied to a running proxy.
+func (p *Proxy) NeedsRestart(newer *Proxy) bool {
+	a, b := *p, *newer
+	a.Middlewares, b.Middlewares = nil, nil
+
+	return !reflect.DeepEqual(a, b)
+}
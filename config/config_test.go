@@ -0,0 +1,244 @@
+package config
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mcuadros/lemondb/memdb"
+	"github.com/mcuadros/lemondb/middlewares"
+	"github.com/mcuadros/lemondb/proxy"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type ConfigSuite struct{}
+
+var _ = Suite(&ConfigSuite{})
+
+const fixture = `
+proxies:
+  - name: main
+    listen: localhost:7000
+    backend: localhost:27017
+    tls:
+      cert_file: server.pem
+      key_file: server.key
+      min_version: "1.3"
+      cipher_suites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256]
+    listeners:
+      - network: unix
+        addr: /tmp/lemondb.sock
+        mode: 0660
+    timeouts:
+      message: 30s
+      client_idle: 10m
+    limits:
+      max_clients: 100
+      max_in_flight: 10
+      max_queue: 5
+    dial:
+      retries: 3
+      backoff: 100ms
+    middlewares:
+      - type: schema
+      - type: proxy
+  - listen: localhost:7001
+    backend: unix:///tmp/mongodb-27017.sock
+    health_check:
+      disabled: true
+`
+
+func (s *ConfigSuite) TestParse(c *C) {
+	cfg, err := Parse([]byte(fixture))
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Proxies, HasLen, 2)
+
+	p := cfg.Proxies[0]
+	c.Assert(p.Name, Equals, "main")
+	c.Assert(p.Timeouts.Message, Equals, 30*time.Second)
+	c.Assert(p.Timeouts.ClientIdle, Equals, 10*time.Minute)
+	c.Assert(p.Listeners[0].Mode, Equals, uint32(0660))
+	c.Assert(p.Middlewares, HasLen, 2)
+	c.Assert(p.Middlewares[0].Type, Equals, "schema")
+
+	c.Assert(cfg.Proxies[1].Name, Equals, "localhost:7001")
+}
+
+func (s *ConfigSuite) TestLoad(c *C) {
+	path := filepath.Join(c.MkDir(), "lemondb.yml")
+	c.Assert(ioutil.WriteFile(path, []byte(fixture), 0644), IsNil)
+
+	cfg, err := Load(path)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Proxies, HasLen, 2)
+}
+
+func (s *ConfigSuite) TestLoadNotFound(c *C) {
+	_, err := Load(filepath.Join(c.MkDir(), "lemondb.yml"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *ConfigSuite) TestParseErrors(c *C) {
+	for _, t := range []struct {
+		config string
+		err    string
+	}{
+		{"", "config: no proxies defined"},
+		{"proxies:\n  - listen: localhost:7000\n    foo: bar", "(?s).*field foo not found.*"},
+		{"proxies:\n  - backend: localhost:27017", `config: proxies\[0\] \(\): listen is required`},
+		{"proxies:\n  - listen: localhost:7000", `config: proxies\[0\] \(localhost:7000\): backend is required`},
+		{"proxies:\n  - listen: localhost\n    backend: localhost:27017", `.*listen: .*missing port.*`},
+		{"proxies:\n  - listen: localhost:7000\n    backend: \"memory://\"", `.*backend: the memory store needs a name`},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    tls: {cert_file: a.pem}",
+			`.*tls: cert_file and key_file are required`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    tls: {cert_file: a.pem, key_file: a.key, min_version: \"2\"}",
+			`.*tls: unsupported min_version "2"`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    tls: {cert_file: a.pem, key_file: a.key, cipher_suites: [TLS_FOO]}",
+			`.*tls: unsupported cipher suite "TLS_FOO"`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    tls: {cert_file: a.pem, key_file: a.key, cipher_suites: [TLS_AES_128_GCM_SHA256]}",
+			`.*tls: unsupported cipher suite "TLS_AES_128_GCM_SHA256"`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    dial: {retries: -1}",
+			`.*dial: retries and backoff can't be negative`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    timeouts: {message: -1s}",
+			`.*timeouts: message can't be negative`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    health_check: {interval: -1s}",
+			`.*health_check: interval and timeout can't be negative`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    limits: {max_queue: 1}",
+			`.*limits: max_queue requires max_in_flight`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    listeners: [{network: udp, addr: foo}]",
+			`.*listeners\[0\]: unsupported network "udp"`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    listeners: [{addr: \"localhost:7001\", proxy_protocol: true}]",
+			`.*listeners\[0\]: proxy_protocol requires trusted_proxies`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    middlewares: [{type: foo}]",
+			`.*middlewares\[0\] \(foo\): unknown middleware "foo"`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    middlewares: [{type: proxy}, {type: schema}]",
+			`.*middlewares\[0\] \(proxy\): proxy must be the last middleware`,
+		},
+		{
+			"proxies:\n  - listen: localhost:7000\n    backend: localhost:27017\n    middlewares: [{options: {foo: bar}}]",
+			`.*middlewares\[0\]: type is required`,
+		},
+		{
+			"proxies:\n  - {name: a, listen: \"localhost:7000\", backend: \"localhost:27017\"}\n  - {name: a, listen: \"localhost:7001\", backend: \"localhost:27017\"}",
+			`config: proxies\[1\]: duplicated name "a"`,
+		},
+		{
+			"proxies:\n  - {name: a, listen: \"localhost:7000\", backend: \"localhost:27017\"}\n  - {name: b, listen: \"localhost:7000\", backend: \"localhost:27017\"}",
+			`config: proxies\[1\] \(b\): tcp://localhost:7000 already used by a`,
+		},
+	} {
+		_, err := Parse([]byte(t.config))
+		c.Assert(err, ErrorMatches, t.err, Commentf("config: %s", t.config))
+	}
+}
+
+func (s *ConfigSuite) TestNewProxy(c *C) {
+	cfg, err := Parse([]byte(fixture))
+	c.Assert(err, IsNil)
+
+	p, err := cfg.Proxies[0].NewProxy()
+	c.Assert(err, IsNil)
+	c.Assert(p.ProxyAddr, Equals, "localhost:7000")
+	c.Assert(p.MongoAddr, Equals, "localhost:27017")
+	c.Assert(p.MessageTimeout, Equals, 30*time.Second)
+	c.Assert(p.MaxInFlight, Equals, 10)
+	c.Assert(p.TLS.MinVersion, Equals, uint16(tls.VersionTLS13))
+	c.Assert(p.TLS.CipherSuites, DeepEquals, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256})
+	c.Assert(p.DialRetries, Equals, 3)
+	c.Assert(p.DialBackoff, Equals, 100*time.Millisecond)
+	c.Assert(p.Listeners, HasLen, 1)
+	c.Assert(p.Listeners[0].Mode, Equals, os.FileMode(0660))
+	c.Assert(p.ProbeInterval, Equals, 10*time.Second)
+
+	schema, ok := p.Middleware.(*middlewares.SchemaMiddleware)
+	c.Assert(ok, Equals, true)
+	c.Assert(schema.PrevMiddleware, FitsTypeOf, &middlewares.ProxyMiddleware{})
+
+	p, err = cfg.Proxies[1].NewProxy()
+	c.Assert(err, IsNil)
+	c.Assert(p.MongoAddr, Equals, "/tmp/mongodb-27017.sock")
+	c.Assert(p.Dialer, FitsTypeOf, &proxy.UnixDialer{})
+	c.Assert(p.ProbeInterval, Equals, time.Duration(0))
+	c.Assert(p.Middleware, FitsTypeOf, &middlewares.ProxyMiddleware{})
+}
+
+func (s *ConfigSuite) TestNewProxyMemory(c *C) {
+	cfg, err := Parse([]byte("proxies:\n  - listen: localhost:7000\n    backend: memory://test-config\n    middlewares: [{type: memory, options: {name: test-config}}]"))
+	c.Assert(err, IsNil)
+
+	p, err := cfg.Proxies[0].NewProxy()
+	c.Assert(err, IsNil)
+	c.Assert(p.MongoAddr, Equals, "test-config")
+	c.Assert(p.Dialer, Equals, memdb.Named("test-config"))
+	c.Assert(p.Middleware.(*middlewares.MemoryMiddleware).Store, Equals, memdb.Named("test-config"))
+}
+
+func (s *ConfigSuite) TestNewPipelineOptions(c *C) {
+	p := &Proxy{Middlewares: []Middleware{
+		{Type: "proxy", Options: map[string]interface{}{"foo": 1}},
+	}}
+
+	_, err := p.NewPipeline()
+	c.Assert(err, ErrorMatches, `middlewares\[0\] \(proxy\): unknown options: foo`)
+}
+
+func (s *ConfigSuite) TestNeedsRestart(c *C) {
+	cfg, err := Parse([]byte(fixture))
+	c.Assert(err, IsNil)
+
+	newer, err := Parse([]byte(fixture))
+	c.Assert(err, IsNil)
+
+	p, n := &cfg.Proxies[0], &newer.Proxies[0]
+	c.Assert(p.NeedsRestart(n), Equals, false)
+
+	n.Middlewares = n.Middlewares[1:]
+	c.Assert(p.NeedsRestart(n), Equals, false)
+
+	n.Limits.MaxClients = 42
+	c.Assert(p.NeedsRestart(n), Equals, true)
+}
+
+func (s *ConfigSuite) TestMarshal(c *C) {
+	cfg, err := Parse([]byte(fixture))
+	c.Assert(err, IsNil)
+
+	b, err := yaml.Marshal(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Not(Matches), `(?s).*backend_tls.*`)
+
+	parsed, err := Parse(b)
+	c.Assert(err, IsNil)
+	c.Assert(parsed, DeepEquals, cfg)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mcuadros/lemondb/admin"
+	"github.com/mcuadros/lemondb/capture"
+	"github.com/mcuadros/lemondb/config"
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/metrics"
+	"github.com/mcuadros/lemondb/proxy"
+
+	"gopkg.in/yaml.v2"
+)
+
+var errDraining = errors.New("draining")
+
+// proxyGroup runs the proxies of the configuration, each one can be started
+// and stopped on its own. A stopped proxy is built again from its config when
+// started.
+type proxyGroup struct {
+	log     logging.Logger
+	metrics *metrics.Registry
+	capture *capture.Capture
+	listen  proxy.ListenFunc
+
+	mu       sync.Mutex
+	proxies  []*groupProxy
+	draining bool
+	// removing are the proxies removed by a reload, still draining.
+	removing sync.WaitGroup
+}
+
+type groupProxy struct {
+	config config.Proxy
+	// proxy is nil while stopped.
+	proxy *proxy.Proxy
+	// stopping is true while the previous proxy drains.
+	stopping bool
+}
+
+// add registers a proxy, it is started along with the group.
+func (g *proxyGroup) add(cfg config.Proxy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.proxies = append(g.proxies, &groupProxy{config: cfg})
+}
+
+// Start starts every proxy not running yet.
+func (g *proxyGroup) Start() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, gp := range g.proxies {
+		if err := g.start(gp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop closes every running proxy right away, Drain should be called before
+// to give the clients a chance to finish.
+func (g *proxyGroup) Stop() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var first error
+	for _, gp := range g.proxies {
+		if gp.proxy == nil {
+			continue
+		}
+
+		if err := gp.proxy.Close(); err != nil && first == nil {
+			first = err
+		}
+
+		gp.proxy = nil
+	}
+
+	return first
+}
+
+// Drain drains every running proxy at the same time, each one for up to its
+// DrainTimeout, and waits for the proxies removed by a reload.
+func (g *proxyGroup) Drain() error {
+	g.mu.Lock()
+	g.draining = true
+	g.mu.Unlock()
+
+	proxies := g.Proxies()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(proxies))
+	for _, p := range proxies {
+		g.log.Info("draining proxy", "proxy", p.Name, "timeout", p.DrainTimeout)
+
+		wg.Add(1)
+		go func(p *proxy.Proxy) {
+			defer wg.Done()
+			errs <- p.Drain(p.DrainTimeout)
+		}(p)
+	}
+
+	wg.Wait()
+	g.removing.Wait()
+	close(errs)
+
+	var first error
+	for err := range errs {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Proxies returns the running proxies.
+func (g *proxyGroup) Proxies() []*proxy.Proxy {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var proxies []*proxy.Proxy
+	for _, gp := range g.proxies {
+		if gp.proxy != nil {
+			proxies = append(proxies, gp.proxy)
+		}
+	}
+
+	return proxies
+}
+
+// Status returns the state of every proxy, running or not.
+func (g *proxyGroup) Status() []admin.ProxyStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	status := make([]admin.ProxyStatus, 0, len(g.proxies))
+	for _, gp := range g.proxies {
+		types := make([]string, len(gp.config.Middlewares))
+		for i, m := range gp.config.Middlewares {
+			types[i] = m.Type
+		}
+
+		status = append(status, admin.ProxyStatus{
+			Name:        gp.config.Name,
+			Listen:      gp.config.Listen,
+			Backend:     gp.config.Backend,
+			Running:     gp.proxy != nil,
+			Middlewares: types,
+		})
+	}
+
+	return status
+}
+
+// Connections returns the clients of every running proxy.
+func (g *proxyGroup) Connections() []admin.ConnStatus {
+	now := time.Now()
+	conns := []admin.ConnStatus{}
+	for _, p := range g.Proxies() {
+		for _, c := range p.Clients() {
+			cs := admin.ConnStatus{
+				Proxy:         p.Name,
+				ID:            c.ID,
+				Addr:          c.Addr,
+				Age:           admin.Duration(now.Sub(c.Connected)),
+				Op:            c.Op,
+				Namespace:     c.Namespace,
+				Command:       c.Command,
+				BytesReceived: c.BytesReceived,
+				BytesSent:     c.BytesSent,
+				User:          c.User,
+				Subject:       c.Subject,
+				ServerAddr:    c.ServerAddr,
+			}
+
+			if c.Op != "" {
+				cs.OpDuration = admin.Duration(now.Sub(c.OpStarted))
+			}
+
+			conns = append(conns, cs)
+		}
+	}
+
+	return conns
+}
+
+// Disconnect closes the client with the given id, whatever its proxy.
+func (g *proxyGroup) Disconnect(id uint64) error {
+	for _, p := range g.Proxies() {
+		if p.Disconnect(id) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown connection %d", id)
+}
+
+// Backends returns the state of the backend of every running proxy.
+func (g *proxyGroup) Backends() []admin.BackendStatus {
+	backends := []admin.BackendStatus{}
+	for _, p := range g.Proxies() {
+		b := p.Backend()
+		bs := admin.BackendStatus{
+			Proxy:         p.Name,
+			Addr:          b.Addr,
+			Conns:         b.Conns,
+			DialFailures:  b.DialFailures,
+			LastDialError: b.LastDialError,
+		}
+
+		if !b.LastDialErrorAt.IsZero() {
+			bs.LastDialErrorAt = b.LastDialErrorAt.Format(time.RFC3339)
+		}
+
+		if b.Probed {
+			bs.Healthy = b.Healthy
+			bs.LastProbe = b.LastProbe.Format(time.RFC3339)
+			bs.LastProbeError = b.LastProbeError
+		} else {
+			bs.Healthy = p.Healthy()
+		}
+
+		backends = append(backends, bs)
+	}
+
+	return backends
+}
+
+// Ready returns an error while draining or if no running proxy has a healthy
+// backend.
+func (g *proxyGroup) Ready() error {
+	g.mu.Lock()
+	draining := g.draining
+	g.mu.Unlock()
+
+	if draining {
+		return errDraining
+	}
+
+	for _, p := range g.Proxies() {
+		if p.Healthy() {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no healthy backend")
+}
+
+// Config returns the configuration of every proxy as YAML, with the
+// middlewares currently in use.
+func (g *proxyGroup) Config() ([]byte, error) {
+	g.mu.Lock()
+	cfg := &config.Config{}
+	for _, gp := range g.proxies {
+		cfg.Proxies = append(cfg.Proxies, gp.config)
+	}
+	g.mu.Unlock()
+
+	return yaml.Marshal(cfg)
+}
+
+// StartProxy starts the proxy called name.
+func (g *proxyGroup) StartProxy(name string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.draining {
+		return errDraining
+	}
+
+	gp, err := g.find(name)
+	if err != nil {
+		return err
+	}
+
+	if gp.proxy != nil {
+		return fmt.Errorf("proxy %s is already running", name)
+	}
+
+	if gp.stopping {
+		return fmt.Errorf("proxy %s is still stopping", name)
+	}
+
+	return g.start(gp)
+}
+
+// StopProxy drains and stops the proxy called name.
+func (g *proxyGroup) StopProxy(name string) error {
+	g.mu.Lock()
+	gp, err := g.find(name)
+	if err == nil && gp.proxy == nil {
+		err = fmt.Errorf("proxy %s is not running", name)
+	}
+
+	if err != nil {
+		g.mu.Unlock()
+		return err
+	}
+
+	p := gp.proxy
+	gp.proxy, gp.stopping = nil, true
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		gp.stopping = false
+		g.mu.Unlock()
+	}()
+
+	g.log.Info("stopping proxy", "proxy", p.Name, "timeout", p.DrainTimeout)
+	return p.Drain(p.DrainTimeout)
+}
+
+// update applies a new configuration: the middlewares of the running proxies
+// are replaced, the new proxies started and the removed ones drained in the
+// background. Any other change needs a restart. Nothing is changed if any
+// pipeline fails to build, any new proxy fails to start or the group is
+// draining.
+func (g *proxyGroup) update(cfg *config.Config) error {
+	configs := make(map[string]*config.Proxy)
+	pipelines := make(map[string]proxy.Middleware)
+	for i := range cfg.Proxies {
+		pc := &cfg.Proxies[i]
+		m, err := pc.NewPipeline()
+		if err != nil {
+			return fmt.Errorf("proxy %s: %s", pc.Name, err)
+		}
+
+		configs[pc.Name], pipelines[pc.Name] = pc, m
+	}
+
+	g.mu.Lock()
+
+	// the proxies started or removed now would not be drained.
+	if g.draining {
+		g.mu.Unlock()
+		return errDraining
+	}
+
+	var kept, removed, added []*groupProxy
+	for _, gp := range g.proxies {
+		if _, ok := pipelines[gp.config.Name]; ok {
+			kept = append(kept, gp)
+		} else {
+			removed = append(removed, gp)
+		}
+	}
+
+	for _, pc := range cfg.Proxies {
+		if _, err := g.find(pc.Name); err != nil {
+			added = append(added, &groupProxy{config: pc})
+		}
+	}
+
+	if err := g.startAdded(added, removed); err != nil {
+		g.mu.Unlock()
+		return err
+	}
+
+	// SetMiddleware waits for the messages in flight, so it is called once
+	// the group is unlocked.
+	replaced := make(map[*proxy.Proxy]proxy.Middleware)
+	for _, gp := range kept {
+		pc := configs[gp.config.Name]
+		if gp.config.NeedsRestart(pc) {
+			g.log.Warn("only the middlewares are reloaded, a restart is required for the other changes", "proxy", pc.Name)
+		}
+
+		gp.config.Middlewares = pc.Middlewares
+		if gp.proxy != nil {
+			replaced[gp.proxy] = pipelines[pc.Name]
+		}
+	}
+
+	g.proxies = append(kept, added...)
+	for _, gp := range removed {
+		if gp.proxy != nil {
+			g.drainRemoved(gp.proxy)
+		}
+	}
+	g.mu.Unlock()
+
+	for p, m := range replaced {
+		p.SetMiddleware(m)
+	}
+
+	return nil
+}
+
+// startAdded starts the added proxies, the removed ones stop listening before
+// so their addresses can be reused. If any proxy fails to start, the ones
+// started are closed and the removed ones listen again.
+func (g *proxyGroup) startAdded(added, removed []*groupProxy) error {
+	if len(added) == 0 {
+		return nil
+	}
+
+	for _, gp := range removed {
+		if gp.proxy == nil {
+			continue
+		}
+
+		if err := gp.proxy.Unlisten(); err != nil {
+			g.log.Error("error closing the listeners of removed proxy", "proxy", gp.config.Name, "err", err)
+		}
+	}
+
+	for i, gp := range added {
+		g.log.Info("starting new proxy", "proxy", gp.config.Name)
+		err := g.start(gp)
+		if err == nil {
+			continue
+		}
+
+		for _, gp := range added[:i] {
+			gp.proxy.Close()
+			gp.proxy = nil
+		}
+
+		for _, gp := range removed {
+			if gp.proxy == nil {
+				continue
+			}
+
+			if err := gp.proxy.Start(); err != nil {
+				g.log.Error("error listening again on removed proxy", "proxy", gp.config.Name, "err", err)
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// drainRemoved drains a proxy no longer in the configuration without
+// blocking, Drain waits for it.
+func (g *proxyGroup) drainRemoved(p *proxy.Proxy) {
+	g.log.Info("removing proxy", "proxy", p.Name, "timeout", p.DrainTimeout)
+
+	g.removing.Add(1)
+	go func() {
+		defer g.removing.Done()
+
+		if err := p.Drain(p.DrainTimeout); err != nil {
+			g.log.Error("error stopping removed proxy", "proxy", p.Name, "err", err)
+		}
+	}()
+}
+
+func (g *proxyGroup) start(gp *groupProxy) error {
+	if gp.proxy != nil {
+		return nil
+	}
+
+	p, err := gp.config.NewProxy()
+	if err != nil {
+		return fmt.Errorf("proxy %s: %s", gp.config.Name, err)
+	}
+
+	p.Log = g.log
+	p.Metrics = g.metrics
+	p.Capture = g.capture
+	p.Listen = g.listen
+	if err := p.Start(); err != nil {
+		return fmt.Errorf("proxy %s: %s", gp.config.Name, err)
+	}
+
+	gp.proxy = p
+	return nil
+}
+
+func (g *proxyGroup) find(name string) (*groupProxy, error) {
+	for _, gp := range g.proxies {
+		if gp.config.Name == name {
+			return gp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown proxy %s", name)
+}
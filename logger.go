@@ -1,16 +1,17 @@
 package main
 
-import "log"
+import (
+	"fmt"
 
-// stdLogger provides a logger backed by the standard library logger. This is a
-// placeholder until we can open source our logger.
-type stdLogger struct{}
+	"github.com/mcuadros/lemondb/logging"
+)
 
-func (l *stdLogger) Error(args ...interface{})                 { log.Print(args...) }
-func (l *stdLogger) Errorf(format string, args ...interface{}) { log.Printf(format, args...) }
-func (l *stdLogger) Warn(args ...interface{})                  { log.Print(args...) }
-func (l *stdLogger) Warnf(format string, args ...interface{})  { log.Printf(format, args...) }
-func (l *stdLogger) Info(args ...interface{})                  { log.Print(args...) }
-func (l *stdLogger) Infof(format string, args ...interface{})  { log.Printf(format, args...) }
-func (l *stdLogger) Debug(args ...interface{})                 { log.Print(args...) }
-func (l *stdLogger) Debugf(format string, args ...interface{}) { log.Printf(format, args...) }
+// startstopLogger adapts a logging.Logger to the printf style logger of
+// startstop.
+type startstopLogger struct {
+	logging.Logger
+}
+
+func (l startstopLogger) Debugf(format string, args ...interface{}) {
+	l.Debug(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const timeFormat = time.RFC3339Nano
+
+var (
+	// JSONEncoder writes every line as a JSON object.
+	JSONEncoder Encoder = jsonEncoder{}
+	// LogfmtEncoder writes every line as key=value pairs.
+	LogfmtEncoder Encoder = logfmtEncoder{}
+)
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(buf *bytes.Buffer, e *Entry) {
+	buf.WriteString(`{"time":`)
+	writeJSON(buf, e.Time.Format(timeFormat))
+	buf.WriteString(`,"level":`)
+	writeJSON(buf, e.Level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(buf, e.Message)
+
+	for _, f := range e.Fields {
+		buf.WriteByte(',')
+		writeJSON(buf, f.Key)
+		buf.WriteByte(':')
+		writeJSON(buf, jsonValue(f.Value))
+	}
+
+	buf.WriteByte('}')
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(timeFormat)
+	case error:
+		return v.Error()
+	case json.Marshaler:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+
+	buf.Write(b)
+}
+
+type logfmtEncoder struct{}
+
+func (logfmtEncoder) Encode(buf *bytes.Buffer, e *Entry) {
+	buf.WriteString("time=")
+	buf.WriteString(e.Time.Format(timeFormat))
+	buf.WriteString(" level=")
+	buf.WriteString(e.Level.String())
+	buf.WriteString(" msg=")
+	writeLogfmt(buf, e.Message)
+
+	for _, f := range e.Fields {
+		buf.WriteByte(' ')
+		writeLogfmt(buf, f.Key)
+		buf.WriteByte('=')
+		writeLogfmt(buf, logfmtValue(f.Value))
+	}
+}
+
+func logfmtValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return v
+	case time.Time:
+		return v.Format(timeFormat)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return fmt.Sprint(v)
+}
+
+// writeLogfmt writes s quoted if needed.
+func writeLogfmt(buf *bytes.Buffer, s string) {
+	if needsQuote(s) {
+		buf.WriteString(strconv.Quote(s))
+		return
+	}
+
+	buf.WriteString(s)
+}
+
+func needsQuote(s string) bool {
+	if s == "" {
+		return true
+	}
+
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,177 @@
+// Package logging is a leveled logger with key/value fields, the lines are
+// written as JSON or logfmt.
+//
+//	log := logging.New(os.Stderr, logging.LogfmtEncoder, logging.InfoLevel)
+//	log = log.With("conn_id", 42, "client_addr", "10.0.0.1:4242")
+//	log.Info("client connected", "tls", true)
+//
+// writes:
+//
+//	time=2015-06-01T10:00:00Z level=info msg="client connected" conn_id=42 client_addr=10.0.0.1:4242 tls=true
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger logs messages with key/value fields, kv is a list of alternated keys
+// and values.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	// With returns a logger adding the given fields to every line.
+	With(kv ...interface{}) Logger
+}
+
+// Level is the severity of a line.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+
+	if strings.EqualFold(name, "warning") {
+		return WarnLevel, nil
+	}
+
+	return 0, fmt.Errorf("logging: unknown level %q", name)
+}
+
+// Field is a key/value pair of a line.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Entry is a line to be encoded.
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// Encoder writes an entry as a single line.
+type Encoder interface {
+	Encode(buf *bytes.Buffer, e *Entry)
+}
+
+// NewEncoder returns the encoder called name, "json" or "logfmt".
+func NewEncoder(name string) (Encoder, error) {
+	switch name {
+	case "json":
+		return JSONEncoder, nil
+	case "logfmt":
+		return LogfmtEncoder, nil
+	}
+
+	return nil, fmt.Errorf("logging: unknown format %q", name)
+}
+
+// Discard is a logger that logs nothing.
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debug(msg string, kv ...interface{}) {}
+func (discard) Info(msg string, kv ...interface{})  {}
+func (discard) Warn(msg string, kv ...interface{})  {}
+func (discard) Error(msg string, kv ...interface{}) {}
+func (d discard) With(kv ...interface{}) Logger     { return d }
+
+// output is shared by a logger and every logger created from it with With.
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	enc   Encoder
+	level Level
+	buf   bytes.Buffer
+	now   func() time.Time
+}
+
+type logger struct {
+	out    *output
+	fields []Field
+}
+
+// New returns a logger writing to w the lines of the given level or above.
+func New(w io.Writer, enc Encoder, level Level) Logger {
+	return &logger{out: &output{w: w, enc: enc, level: level, now: time.Now}}
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(DebugLevel, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(InfoLevel, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(WarnLevel, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(ErrorLevel, msg, kv) }
+
+func (l *logger) With(kv ...interface{}) Logger {
+	fields := make([]Field, len(l.fields), len(l.fields)+len(kv)/2+1)
+	copy(fields, l.fields)
+
+	return &logger{out: l.out, fields: appendFields(fields, kv)}
+}
+
+func (l *logger) log(level Level, msg string, kv []interface{}) {
+	if level < l.out.level {
+		return
+	}
+
+	e := &Entry{
+		Time:    l.out.now(),
+		Level:   level,
+		Message: msg,
+		Fields:  appendFields(l.fields[:len(l.fields):len(l.fields)], kv),
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+
+	l.out.buf.Reset()
+	l.out.enc.Encode(&l.out.buf, e)
+	l.out.buf.WriteByte('\n')
+	l.out.w.Write(l.out.buf.Bytes())
+}
+
+// appendFields converts the alternated keys and values to fields, a missing
+// value is reported as such instead of being dropped.
+func appendFields(fields []Field, kv []interface{}) []Field {
+	for i := 0; i < len(kv); i += 2 {
+		f := Field{Key: fmt.Sprint(kv[i]), Value: "(MISSING)"}
+		if i+1 < len(kv) {
+			f.Value = kv[i+1]
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields
+}
@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type LoggingSuite struct{}
+
+var _ = Suite(&LoggingSuite{})
+
+func newTestLogger(enc Encoder, level Level) (Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf, enc, level).(*logger)
+	l.out.now = func() time.Time {
+		return time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+	}
+
+	return l, &buf
+}
+
+func (s *LoggingSuite) TestLogfmt(c *C) {
+	log, buf := newTestLogger(LogfmtEncoder, DebugLevel)
+	log.Info("client connected", "conn_id", 42, "client_addr", "10.0.0.1:4242", "err", errors.New("foo bar"))
+
+	c.Assert(buf.String(), Equals, `time=2015-06-01T10:00:00Z level=info msg="client connected" `+
+		`conn_id=42 client_addr=10.0.0.1:4242 err="foo bar"`+"\n")
+}
+
+func (s *LoggingSuite) TestJSON(c *C) {
+	log, buf := newTestLogger(JSONEncoder, DebugLevel)
+	log.Warn("slow", "duration", 1500*time.Millisecond, "ok", true, "n", 3)
+
+	c.Assert(buf.String(), Equals, `{"time":"2015-06-01T10:00:00Z","level":"warn","msg":"slow",`+
+		`"duration":"1.5s","ok":true,"n":3}`+"\n")
+}
+
+func (s *LoggingSuite) TestLevel(c *C) {
+	log, buf := newTestLogger(LogfmtEncoder, WarnLevel)
+	log.Debug("foo")
+	log.Info("foo")
+	c.Assert(buf.Len(), Equals, 0)
+
+	log.Error("foo")
+	c.Assert(buf.String(), Matches, ".*level=error msg=foo\n")
+}
+
+func (s *LoggingSuite) TestWith(c *C) {
+	log, buf := newTestLogger(LogfmtEncoder, DebugLevel)
+	conn := log.With("conn_id", 1)
+	other := log.With("conn_id", 2)
+
+	conn.Info("foo", "op", "query")
+	c.Assert(buf.String(), Matches, ".*msg=foo conn_id=1 op=query\n")
+
+	buf.Reset()
+	other.With("ns", "test.foo").Info("bar")
+	c.Assert(buf.String(), Matches, ".*msg=bar conn_id=2 ns=test.foo\n")
+
+	buf.Reset()
+	conn.Info("baz")
+	c.Assert(buf.String(), Matches, ".*msg=baz conn_id=1\n")
+}
+
+func (s *LoggingSuite) TestMissingValue(c *C) {
+	log, buf := newTestLogger(LogfmtEncoder, DebugLevel)
+	log.Info("foo", "bar")
+
+	c.Assert(buf.String(), Matches, `.*msg=foo bar=\(MISSING\)`+"\n")
+}
+
+func (s *LoggingSuite) TestParseLevel(c *C) {
+	l, err := ParseLevel("DEBUG")
+	c.Assert(err, IsNil)
+	c.Assert(l, Equals, DebugLevel)
+
+	l, err = ParseLevel("warning")
+	c.Assert(err, IsNil)
+	c.Assert(l, Equals, WarnLevel)
+
+	_, err = ParseLevel("foo")
+	c.Assert(err, ErrorMatches, `logging: unknown level "foo"`)
+}
+
+func (s *LoggingSuite) TestNewEncoder(c *C) {
+	enc, err := NewEncoder("json")
+	c.Assert(err, IsNil)
+	c.Assert(enc, Equals, JSONEncoder)
+
+	_, err = NewEncoder("xml")
+	c.Assert(err, ErrorMatches, `logging: unknown format "xml"`)
+}
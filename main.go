@@ -8,46 +8,207 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/mcuadros/lemondb/admin"
+	"github.com/mcuadros/lemondb/capture"
+	"github.com/mcuadros/lemondb/config"
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/metrics"
 	"github.com/mcuadros/lemondb/middlewares"
 	"github.com/mcuadros/lemondb/proxy"
+	"github.com/mcuadros/lemondb/upgrade"
 
-	"github.com/facebookgo/gangliamr"
 	"github.com/facebookgo/inject"
 	"github.com/facebookgo/startstop"
-	"github.com/facebookgo/stats"
 )
 
 func main() {
-	if err := Main(); err != nil {
+	run := Main
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		run = func() error { return Replay(os.Args[2:]) }
+	}
+
+	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// proxyFlags describe the default proxy, the one run without -config.
+var proxyFlags = map[string]bool{
+	"message_timeout":     true,
+	"client_idle_timeout": true,
+	"tls_cert":            true,
+	"tls_key":             true,
+	"tls_client_ca":       true,
+	"unix_socket":         true,
+	"unix_socket_mode":    true,
+	"max_clients":         true,
+	"max_clients_per_ip":  true,
+	"max_in_flight":       true,
+	"max_queue":           true,
+	"drain_timeout":       true,
+}
+
+// checkConfigFlags fails if any flag of the default proxy is given along with
+// -config, they would be ignored.
+func checkConfigFlags() error {
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil && proxyFlags[f.Name] {
+			err = fmt.Errorf("-%s can't be used with -config, set it in the file", f.Name)
+		}
+	})
+
+	return err
+}
+
 func Main() error {
+	configFile := flag.String("config", "", "yaml file describing the proxies, the flags of the default proxy can't be given with it")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit")
+	listMiddlewares := flag.Bool("list-middlewares", false, "print the middlewares available to the pipelines and exit")
+	logLevel := flag.String("log-level", "info", "minimum level of the logged lines: debug, info, warn or error")
+	logFormat := flag.String("log-format", "logfmt", "format of the logged lines: logfmt or json")
+	adminAddr := flag.String("admin_addr", "", "address of the http admin interface and the /metrics endpoint, disabled if empty")
 	messageTimeout := flag.Duration("message_timeout", 2*time.Minute, "timeout for one message to be proxied")
 	clientIdleTimeout := flag.Duration("client_idle_timeout", 60*time.Minute, "idle timeout for client connections")
+	tlsCert := flag.String("tls_cert", "", "certificate file for the client connections, enables tls")
+	tlsKey := flag.String("tls_key", "", "key file for the client connections")
+	tlsClientCA := flag.String("tls_client_ca", "", "ca bundle to verify the client certificates")
+	unixSocket := flag.String("unix_socket", "", "path of a unix domain socket to listen on besides the tcp address")
+	unixSocketMode := flag.Uint("unix_socket_mode", 0660, "file mode of the unix domain socket")
+	maxClients := flag.Int("max_clients", 0, "maximum number of connected clients, 0 means no limit")
+	maxClientsPerIP := flag.Int("max_clients_per_ip", 0, "maximum number of connected clients from the same address, 0 means no limit")
+	maxInFlight := flag.Int("max_in_flight", 0, "maximum number of messages handled at the same time, 0 means no limit")
+	maxQueue := flag.Int("max_queue", 0, "number of messages waiting when max_in_flight is reached")
+	captureDir := flag.String("capture_dir", os.TempDir(), "directory of the traffic captures started from the admin interface")
+	captureMaxSize := flag.Int64("capture_max_size", 100, "size in MB of a capture file before it is rotated")
+	captureMaxFiles := flag.Int("capture_max_files", 5, "number of rotated capture files kept")
+	drainTimeout := flag.Duration("drain_timeout", 30*time.Second, "how long to wait for the clients to finish their messages on shutdown")
 
 	flag.Parse()
 
-	replicaSet := proxy.Proxy{
-		Log:               &stdLogger{},
-		ProxyAddr:         "localhost:7000",
-		MongoAddr:         "localhost:27017",
-		MessageTimeout:    *messageTimeout,
-		ClientIdleTimeout: *clientIdleTimeout,
-		Middleware: &middlewares.SchemaMiddleware{
-			&middlewares.ProxyMiddleware{},
+	if *configFile != "" {
+		if err := checkConfigFlags(); err != nil {
+			return err
+		}
+	}
+
+	if *listMiddlewares {
+		for _, name := range middlewares.Names() {
+			fmt.Println(name)
+		}
+
+		return nil
+	}
+
+	var cfg *config.Config
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			return err
+		}
+	} else {
+		p := config.Proxy{
+			Listen:  "localhost:7000",
+			Backend: "localhost:27017",
+			Timeouts: config.Timeouts{
+				Message:    *messageTimeout,
+				ClientIdle: *clientIdleTimeout,
+				Drain:      *drainTimeout,
+			},
+			Limits: config.Limits{
+				MaxClients:      *maxClients,
+				MaxClientsPerIP: *maxClientsPerIP,
+				MaxInFlight:     *maxInFlight,
+				MaxQueue:        *maxQueue,
+			},
+			Middlewares: []config.Middleware{{Type: "schema"}},
+		}
+
+		if *unixSocket != "" {
+			p.Listeners = append(p.Listeners, config.Listener{
+				Network: "unix",
+				Addr:    *unixSocket,
+				Mode:    uint32(*unixSocketMode),
+			})
+		}
+
+		if *tlsCert != "" {
+			p.TLS = &config.TLS{
+				CertFile:     *tlsCert,
+				KeyFile:      *tlsKey,
+				ClientCAFile: *tlsClientCA,
+			}
+		}
+
+		cfg = &config.Config{Proxies: []config.Proxy{p}}
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if *checkConfig {
+		if err := checkConfigFiles(cfg); err != nil {
+			return err
+		}
+
+		fmt.Println("configuration ok")
+		return nil
+	}
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+
+	encoder, err := logging.NewEncoder(*logFormat)
+	if err != nil {
+		return err
+	}
+
+	log := logging.New(os.Stderr, encoder, level)
+
+	upgrader, err := upgrade.New()
+	if err != nil {
+		return err
+	}
+
+	registry := metrics.NewRegistry()
+	cpt := &capture.Capture{
+		Dir:      *captureDir,
+		MaxSize:  *captureMaxSize * 1024 * 1024,
+		MaxFiles: *captureMaxFiles,
+	}
+
+	group := &proxyGroup{log: log, metrics: registry, capture: cpt, listen: upgrader.Listen}
+	registerStats(group)
+	for _, p := range cfg.Proxies {
+		group.add(p)
+	}
+
+	reload := &reloader{file: *configFile, log: log, group: group}
+	drain := make(chan struct{}, 1)
+	adminServer := &admin.Server{
+		Addr:    *adminAddr,
+		Listen:  upgrader.Listen,
+		Reload:  reload.Reload,
+		Proxies: group,
+		Metrics: registry,
+		Config:  group.Config,
+		Ready:   group.Ready,
+		Capture: cpt,
+		Drain: func() {
+			select {
+			case drain <- struct{}{}:
+			default:
+			}
 		},
 	}
 
-	var statsClient stats.HookClient
-	var log stdLogger
 	var graph inject.Graph
-	err := graph.Provide(
-		&inject.Object{Value: &log},
-		&inject.Object{Value: &replicaSet},
-		&inject.Object{Value: &statsClient},
+	err = graph.Provide(
+		&inject.Object{Value: group},
+		&inject.Object{Value: adminServer},
 	)
 	if err != nil {
 		return err
@@ -56,26 +217,90 @@ func Main() error {
 		return err
 	}
 	objects := graph.Objects()
-
-	// Temporarily setup the metrics against a test registry.
-	gregistry := gangliamr.NewTestRegistry()
-	for _, o := range objects {
-		if rmO, ok := o.Value.(registerMetrics); ok {
-			rmO.RegisterMetrics(gregistry)
-		}
+	if err := startstop.Start(objects, startstopLogger{log}); err != nil {
+		return err
 	}
-	if err := startstop.Start(objects, &log); err != nil {
+	defer startstop.Stop(objects, startstopLogger{log})
+
+	if err := upgrader.Ready(); err != nil {
 		return err
 	}
-	defer startstop.Stop(objects, &log)
 
 	ch := make(chan os.Signal, 2)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
-	<-ch
-	signal.Stop(ch)
-	return nil
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+	defer signal.Stop(ch)
+
+wait:
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-ch:
+		case <-drain:
+			log.Info("drain requested from the admin interface")
+			break wait
+		}
+
+		switch sig {
+		case syscall.SIGHUP:
+			reload.Reload()
+		case syscall.SIGUSR2:
+			process, err := upgrader.Upgrade()
+			if err != nil {
+				log.Error("error upgrading", "err", err)
+				continue
+			}
+
+			log.Info("upgraded", "pid", process.Pid)
+			break wait
+		default:
+			break wait
+		}
+	}
+
+	// The first signal drains the proxies, a second one stops them right away.
+	drained := make(chan error, 1)
+	go func() { drained <- group.Drain() }()
+
+	for {
+		select {
+		case err := <-drained:
+			return err
+		case sig := <-ch:
+			if sig == syscall.SIGHUP {
+				continue
+			}
+
+			log.Info("stopping the proxies without waiting for the clients")
+			return group.Stop()
+		}
+	}
 }
 
-type registerMetrics interface {
-	RegisterMetrics(r *gangliamr.Registry)
+// checkConfigFiles builds the proxies of the configuration and loads the
+// files referenced by them, so a dry run also catches missing or invalid
+// certificates.
+func checkConfigFiles(cfg *config.Config) error {
+	for _, pc := range cfg.Proxies {
+		p, err := pc.NewProxy()
+		if err != nil {
+			return fmt.Errorf("proxy %s: %s", pc.Name, err)
+		}
+
+		configs := []*proxy.TLSConfig{p.TLS}
+		for _, l := range p.Listeners {
+			configs = append(configs, l.TLS)
+		}
+
+		for _, t := range configs {
+			if t == nil {
+				continue
+			}
+
+			if err := t.Reload(); err != nil {
+				return fmt.Errorf("proxy %s: %s", pc.Name, err)
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,863 @@
+package memdb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mcuadros/lemondb/query"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	codeInvalidOptions       = 72
+	codeIndexOptionsConflict = 85
+	codeNamespaceExists      = 48
+
+	// the wire version of mongo 3.4, the drivers use the commands with it
+	// instead of the legacy opcodes, but not OP_MSG.
+	maxWireVersion = 5
+	version        = "3.4.0"
+
+	maxBsonObjectSize   = 16 * 1024 * 1024
+	maxMessageSizeBytes = 48000000
+	maxWriteBatchSize   = 1000
+)
+
+type command func(s *Store, db string, cmd bson.D) (bson.D, error)
+
+// commands are the supported commands by name, a few are accepted in lower
+// case as the old drivers send them.
+var commands = map[string]command{
+	"isMaster":        (*Store).isMaster,
+	"ismaster":        (*Store).isMaster,
+	"buildInfo":       (*Store).buildInfo,
+	"buildinfo":       (*Store).buildInfo,
+	"ping":            (*Store).ok,
+	"whatsmyuri":      (*Store).whatsMyURI,
+	"getLastError":    (*Store).getLastError,
+	"getlasterror":    (*Store).getLastError,
+	"getnonce":        (*Store).getNonce,
+	"listDatabases":   (*Store).listDatabases,
+	"dropDatabase":    (*Store).dropDatabase,
+	"insert":          (*Store).insertCmd,
+	"update":          (*Store).updateCmd,
+	"delete":          (*Store).deleteCmd,
+	"find":            (*Store).findCmd,
+	"getMore":         (*Store).getMoreCmd,
+	"killCursors":     (*Store).killCursorsCmd,
+	"count":           (*Store).countCmd,
+	"aggregate":       (*Store).aggregateCmd,
+	"distinct":        (*Store).distinctCmd,
+	"create":          (*Store).createCmd,
+	"drop":            (*Store).dropCmd,
+	"listCollections": (*Store).listCollectionsCmd,
+	"createIndexes":   (*Store).createIndexesCmd,
+	"listIndexes":     (*Store).listIndexesCmd,
+	"dropIndexes":     (*Store).dropIndexesCmd,
+	"deleteIndexes":   (*Store).dropIndexesCmd,
+}
+
+// Run runs a command on the database db and returns its reply, the failed
+// commands are replied with ok: 0 and the error.
+func (s *Store) Run(db string, cmd bson.D) bson.D {
+	reply, err := s.run(db, cmd)
+	if err != nil {
+		return bson.D{
+			{Name: "ok", Value: 0.0},
+			{Name: "errmsg", Value: err.Error()},
+			{Name: "code", Value: errorCode(err)},
+		}
+	}
+
+	return append(reply, bson.DocElem{Name: "ok", Value: 1.0})
+}
+
+func (s *Store) run(db string, cmd bson.D) (bson.D, error) {
+	if len(cmd) == 0 {
+		return nil, errorf(codeFailedToParse, "empty command")
+	}
+
+	// the commands sent through a mongos are wrapped with their read
+	// preference.
+	if cmd[0].Name == "$query" || cmd[0].Name == "query" {
+		if q, ok := cmd[0].Value.(bson.D); ok {
+			cmd = q
+		}
+	}
+
+	c, ok := commands[cmd[0].Name]
+	if !ok {
+		return nil, errorf(codeCommandNotFound, "no such command: '%s'", cmd[0].Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkVirtual(db, cmd); err != nil {
+		return nil, err
+	}
+
+	return c(s, db, cmd)
+}
+
+func (s *Store) ok(db string, cmd bson.D) (bson.D, error) {
+	return bson.D{}, nil
+}
+
+func (s *Store) isMaster(db string, cmd bson.D) (bson.D, error) {
+	return bson.D{
+		{Name: "ismaster", Value: true},
+		{Name: "maxBsonObjectSize", Value: maxBsonObjectSize},
+		{Name: "maxMessageSizeBytes", Value: maxMessageSizeBytes},
+		{Name: "maxWriteBatchSize", Value: maxWriteBatchSize},
+		{Name: "localTime", Value: time.Now()},
+		{Name: "minWireVersion", Value: 0},
+		{Name: "maxWireVersion", Value: maxWireVersion},
+		{Name: "readOnly", Value: false},
+	}, nil
+}
+
+func (s *Store) buildInfo(db string, cmd bson.D) (bson.D, error) {
+	return bson.D{
+		{Name: "version", Value: version},
+		{Name: "gitVersion", Value: "lemondb"},
+		{Name: "versionArray", Value: []interface{}{3, 4, 0, 0}},
+		{Name: "bits", Value: 64},
+		{Name: "maxBsonObjectSize", Value: maxBsonObjectSize},
+	}, nil
+}
+
+func (s *Store) whatsMyURI(db string, cmd bson.D) (bson.D, error) {
+	return bson.D{{Name: "you", Value: "0.0.0.0:0"}}, nil
+}
+
+// getLastError has nothing to report, the legacy writes are applied right
+// away and their errors dropped.
+func (s *Store) getLastError(db string, cmd bson.D) (bson.D, error) {
+	return bson.D{{Name: "n", Value: 0}, {Name: "err", Value: nil}}, nil
+}
+
+func (s *Store) getNonce(db string, cmd bson.D) (bson.D, error) {
+	return bson.D{{Name: "nonce", Value: bson.NewObjectId().Hex()}}, nil
+}
+
+func (s *Store) listDatabases(db string, cmd bson.D) (bson.D, error) {
+	seen := make(map[string]bool)
+	var names []string
+	for ns := range s.collections {
+		if d, _ := splitNamespace(ns); !seen[d] {
+			seen[d] = true
+			names = append(names, d)
+		}
+	}
+
+	sort.Strings(names)
+	dbs := make([]interface{}, len(names))
+	for i, name := range names {
+		dbs[i] = bson.D{
+			{Name: "name", Value: name},
+			{Name: "sizeOnDisk", Value: 0},
+			{Name: "empty", Value: false},
+		}
+	}
+
+	return bson.D{{Name: "databases", Value: dbs}, {Name: "totalSize", Value: 0}}, nil
+}
+
+func (s *Store) dropDatabase(db string, cmd bson.D) (bson.D, error) {
+	for _, ns := range s.namespaces(db) {
+		delete(s.collections, ns)
+		s.changed = true
+	}
+
+	return bson.D{{Name: "dropped", Value: db}}, nil
+}
+
+func (s *Store) insertCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := docsArg(cmd, "documents")
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := s.virtuals[ns]; ok {
+		if err := v.Insert(&InsertRequest{Namespace: ns, Documents: copyDocs(docs)}); err != nil {
+			return writeReply(bson.D{{Name: "n", Value: 0}}, []interface{}{writeError(0, err)}), nil
+		}
+
+		return bson.D{{Name: "n", Value: len(docs)}}, nil
+	}
+
+	n, writeErrors := 0, []interface{}{}
+	ordered := orderedArg(cmd)
+	for i, doc := range docs {
+		if err := s.insert(ns, doc); err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered {
+				break
+			}
+
+			continue
+		}
+
+		n++
+	}
+
+	return writeReply(bson.D{{Name: "n", Value: n}}, writeErrors), nil
+}
+
+func (s *Store) updateCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	updates, err := docsArg(cmd, "updates")
+	if err != nil {
+		return nil, err
+	}
+
+	n, modified := 0, 0
+	upserted, writeErrors := []interface{}{}, []interface{}{}
+	ordered := orderedArg(cmd)
+	for i, u := range updates {
+		q, _ := docArg(u, "q")
+		up, _ := docArg(u, "u")
+		upsert, _ := get(u, "upsert")
+		multi, _ := get(u, "multi")
+
+		r, err := s.update(ns, q, up, truthy(upsert), truthy(multi))
+		if r != nil {
+			n += r.matched
+			modified += r.modified
+			if r.upserted != nil {
+				n++
+				upserted = append(upserted, bson.D{{Name: "index", Value: i}, {Name: "_id", Value: r.upserted}})
+			}
+		}
+
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered {
+				break
+			}
+		}
+	}
+
+	reply := bson.D{{Name: "n", Value: n}, {Name: "nModified", Value: modified}}
+	if len(upserted) > 0 {
+		reply = append(reply, bson.DocElem{Name: "upserted", Value: upserted})
+	}
+
+	return writeReply(reply, writeErrors), nil
+}
+
+func (s *Store) deleteCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	deletes, err := docsArg(cmd, "deletes")
+	if err != nil {
+		return nil, err
+	}
+
+	n, writeErrors := 0, []interface{}{}
+	ordered := orderedArg(cmd)
+	for i, d := range deletes {
+		q, _ := docArg(d, "q")
+		limit, _ := get(d, "limit")
+
+		removed, err := s.remove(ns, q, int(toInt64(limit)))
+		n += removed
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered {
+				break
+			}
+		}
+	}
+
+	return writeReply(bson.D{{Name: "n", Value: n}}, writeErrors), nil
+}
+
+func (s *Store) findCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &findQuery{}
+	if q.filter, err = docArg(cmd, "filter"); err != nil {
+		return nil, err
+	}
+
+	if q.sort, err = docArg(cmd, "sort"); err != nil {
+		return nil, err
+	}
+
+	if q.projection, err = docArg(cmd, "projection"); err != nil {
+		return nil, err
+	}
+
+	if q.skip, err = intArg(cmd, "skip"); err != nil {
+		return nil, err
+	}
+
+	limit, err := intArg(cmd, "limit")
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize, err := intArg(cmd, "batchSize")
+	if err != nil {
+		return nil, err
+	}
+
+	single, _ := get(cmd, "singleBatch")
+	if limit < 0 {
+		limit, single = -limit, true
+	}
+
+	q.limit = limit
+	it, err := s.findIter(ns, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if truthy(single) {
+		docs, err := readAll(it)
+		if err != nil {
+			return nil, err
+		}
+
+		return cursorReply(ns, 0, "firstBatch", docs), nil
+	}
+
+	// a batchSize of 0 opens the cursor without returning anything.
+	var id int64
+	var batch []bson.D
+	if _, ok := get(cmd, "batchSize"); ok && batchSize == 0 {
+		id, err = s.openEmptyCursor(ns, it)
+	} else {
+		id, batch, err = s.openCursor(ns, it, batchSize)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cursorReply(ns, id, "firstBatch", batch), nil
+}
+
+func (s *Store) getMoreCmd(db string, cmd bson.D) (bson.D, error) {
+	id, ok := cmd[0].Value.(int64)
+	if !ok {
+		return nil, errorf(codeTypeMismatch, "getMore needs a long cursor id")
+	}
+
+	coll, _ := get(cmd, "collection")
+	name, ok := coll.(string)
+	if !ok {
+		return nil, errorf(codeTypeMismatch, "getMore needs the collection name")
+	}
+
+	batchSize, err := intArg(cmd, "batchSize")
+	if err != nil {
+		return nil, err
+	}
+
+	ns := db + "." + name
+	id, batch, err := s.nextBatch(id, ns, batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return cursorReply(ns, id, "nextBatch", batch), nil
+}
+
+func (s *Store) killCursorsCmd(db string, cmd bson.D) (bson.D, error) {
+	v, _ := get(cmd, "cursors")
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errorf(codeTypeMismatch, "killCursors needs an array of cursors")
+	}
+
+	ids := make([]int64, 0, len(list))
+	for _, id := range list {
+		ids = append(ids, toInt64(id))
+	}
+
+	killed, notFound := s.killCursors(ids)
+	if killed == nil {
+		killed = []interface{}{}
+	}
+
+	if notFound == nil {
+		notFound = []interface{}{}
+	}
+
+	return bson.D{
+		{Name: "cursorsKilled", Value: killed},
+		{Name: "cursorsNotFound", Value: notFound},
+		{Name: "cursorsAlive", Value: []interface{}{}},
+		{Name: "cursorsUnknown", Value: []interface{}{}},
+	}, nil
+}
+
+func (s *Store) countCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &findQuery{}
+	if q.filter, err = docArg(cmd, "query"); err != nil {
+		return nil, err
+	}
+
+	if q.skip, err = intArg(cmd, "skip"); err != nil {
+		return nil, err
+	}
+
+	limit, err := intArg(cmd, "limit")
+	if err != nil {
+		return nil, err
+	}
+
+	if limit < 0 {
+		limit = -limit
+	}
+
+	v, ok := s.virtuals[ns]
+	if !ok {
+		q.limit = limit
+		docs, err := s.find(ns, q)
+		if err != nil {
+			return nil, err
+		}
+
+		return bson.D{{Name: "n", Value: len(docs)}}, nil
+	}
+
+	n, err := v.Count(&CountRequest{Namespace: ns, Filter: q.filter})
+	if err != nil {
+		return nil, err
+	}
+
+	if n -= q.skip; n < 0 {
+		n = 0
+	}
+
+	if limit > 0 && n > limit {
+		n = limit
+	}
+
+	return bson.D{{Name: "n", Value: n}}, nil
+}
+
+func (s *Store) aggregateCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := s.virtuals[ns]
+	if !ok {
+		return nil, errorf(codeCommandNotSupported, "aggregate is only supported by the virtual collections")
+	}
+
+	pipeline, err := docsArg(cmd, "pipeline")
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := v.Aggregate(&AggregateRequest{Namespace: ns, Pipeline: pipeline})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.cursorCmdReply(ns, cmd, &shapeIter{it: it})
+}
+
+func (s *Store) distinctCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	k, _ := get(cmd, "key")
+	key, ok := k.(string)
+	if !ok {
+		return nil, errorf(codeTypeMismatch, "distinct needs a string key")
+	}
+
+	filter, err := docArg(cmd, "query")
+	if err != nil {
+		return nil, err
+	}
+
+	docs, _, err := s.match(ns, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []interface{}{}
+	for _, d := range docs {
+		for _, v := range pathValues(d, key) {
+			// the arrays are counted by their elements.
+			if _, ok := v.([]interface{}); ok {
+				continue
+			}
+
+			if !containsValue(values, v) {
+				values = append(values, copyValue(v))
+			}
+		}
+	}
+
+	return bson.D{{Name: "values", Value: values}}, nil
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, e := range values {
+		if compare(e, v) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Store) createCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if c, _ := s.collection(ns, false); c != nil {
+		return nil, errorf(codeNamespaceExists, "collection already exists. NS: %s", ns)
+	}
+
+	if _, err := s.collection(ns, true); err != nil {
+		return nil, err
+	}
+
+	return bson.D{}, nil
+}
+
+func (s *Store) dropCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	c, _ := s.collection(ns, false)
+	if c == nil {
+		return nil, errorf(codeNamespaceNotFound, "ns not found")
+	}
+
+	delete(s.collections, ns)
+	s.changed = true
+	return bson.D{{Name: "ns", Value: ns}, {Name: "nIndexesWas", Value: len(c.indexes)}}, nil
+}
+
+func (s *Store) listCollectionsCmd(db string, cmd bson.D) (bson.D, error) {
+	filter, err := docArg(cmd, "filter")
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := query.CompileBSON(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// the virtual collections are listed too, without indexes.
+	names := s.namespaces(db)
+	for ns := range s.virtuals {
+		if d, _ := splitNamespace(ns); d == db && s.collections[ns] == nil {
+			names = append(names, ns)
+		}
+	}
+
+	sort.Strings(names)
+	var docs []bson.D
+	for _, ns := range names {
+		_, name := splitNamespace(ns)
+		info := bson.D{
+			{Name: "name", Value: name},
+			{Name: "type", Value: "collection"},
+			{Name: "options", Value: bson.D{}},
+			{Name: "info", Value: bson.D{{Name: "readOnly", Value: false}}},
+		}
+
+		if _, ok := s.virtuals[ns]; !ok {
+			info = append(info, bson.DocElem{Name: "idIndex", Value: s.collections[ns].indexes[0].spec(ns)})
+		}
+
+		if m.MatchBSON(info) {
+			docs = append(docs, info)
+		}
+	}
+
+	return s.cursorCmdReply(db+".$cmd.listCollections", cmd, NewIter(docs))
+}
+
+func (s *Store) createIndexesCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	specs, err := docsArg(cmd, "indexes")
+	if err != nil {
+		return nil, err
+	}
+
+	created, _ := s.collection(ns, false)
+	c, err := s.collection(ns, true)
+	if err != nil {
+		return nil, err
+	}
+
+	before := len(c.indexes)
+	for _, spec := range specs {
+		idx, err := parseIndex(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.addIndex(ns, idx); err != nil {
+			return nil, err
+		}
+	}
+
+	s.changed = true
+	return bson.D{
+		{Name: "createdCollectionAutomatically", Value: created == nil},
+		{Name: "numIndexesBefore", Value: before},
+		{Name: "numIndexesAfter", Value: len(c.indexes)},
+	}, nil
+}
+
+func parseIndex(spec bson.D) (*index, error) {
+	key, err := docArg(spec, "key")
+	if err != nil || len(key) == 0 {
+		return nil, errorf(codeFailedToParse, "the index key has to be a non empty document")
+	}
+
+	name, _ := get(spec, "name")
+	idx := &index{key: key}
+	if idx.name, _ = name.(string); idx.name == "" {
+		return nil, errorf(codeFailedToParse, "the index has to have a name")
+	}
+
+	unique, _ := get(spec, "unique")
+	sparse, _ := get(spec, "sparse")
+	idx.unique, idx.sparse = truthy(unique), truthy(sparse)
+	return idx, nil
+}
+
+// addIndex adds the index to the collection, an index with the same name and
+// key is ignored. The documents have to satisfy a unique index.
+func (c *collection) addIndex(ns string, idx *index) error {
+	for _, other := range c.indexes {
+		if other.name != idx.name && compare(other.key, idx.key) != 0 {
+			continue
+		}
+
+		if other.name == idx.name && compare(other.key, idx.key) == 0 && other.unique == idx.unique {
+			return nil
+		}
+
+		return errorf(codeIndexOptionsConflict, "index with name: %s already exists with different options", other.name)
+	}
+
+	if idx.unique {
+		check := &collection{indexes: []*index{idx}}
+		for i, d := range c.docs {
+			check.docs = c.docs[:i]
+			if err := check.checkUnique(ns, d, -1); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.indexes = append(c.indexes, idx)
+	return nil
+}
+
+func (s *Store) listIndexesCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	c, _ := s.collection(ns, false)
+	if c == nil {
+		return nil, errorf(codeNamespaceNotFound, "ns does not exist: %s", ns)
+	}
+
+	docs := make([]bson.D, len(c.indexes))
+	for i, idx := range c.indexes {
+		docs[i] = idx.spec(ns)
+	}
+
+	return s.cursorCmdReply(db+".$cmd.listIndexes."+ns[len(db)+1:], cmd, NewIter(docs))
+}
+
+func (s *Store) dropIndexesCmd(db string, cmd bson.D) (bson.D, error) {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	c, _ := s.collection(ns, false)
+	if c == nil {
+		return nil, errorf(codeNamespaceNotFound, "ns not found")
+	}
+
+	was := len(c.indexes)
+	target, _ := get(cmd, "index")
+	if target == "*" {
+		c.indexes = c.indexes[:1]
+		s.changed = true
+		return bson.D{{Name: "nIndexesWas", Value: was}}, nil
+	}
+
+	for i, idx := range c.indexes {
+		key, isKey := target.(bson.D)
+		if idx.name != target && !(isKey && compare(idx.key, key) == 0) {
+			continue
+		}
+
+		if idx.name == idIndex {
+			return nil, errorf(codeInvalidOptions, "cannot drop _id index")
+		}
+
+		c.indexes = append(c.indexes[:i], c.indexes[i+1:]...)
+		s.changed = true
+		return bson.D{{Name: "nIndexesWas", Value: was}}, nil
+	}
+
+	return nil, errorf(codeIndexNotFound, "index not found with name [%v]", target)
+}
+
+// cursorCmdReply replies the documents of the list and aggregate commands,
+// in batches as asked by the cursor option.
+func (s *Store) cursorCmdReply(ns string, cmd bson.D, it Iter) (bson.D, error) {
+	opts, err := docArg(cmd, "cursor")
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+
+	batchSize, err := intArg(opts, "batchSize")
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+
+	id, batch, err := s.openCursor(ns, it, batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return cursorReply(ns, id, "firstBatch", batch), nil
+}
+
+func cursorReply(ns string, id int64, field string, docs []bson.D) bson.D {
+	batch := make([]interface{}, len(docs))
+	for i, d := range docs {
+		batch[i] = d
+	}
+
+	return bson.D{{Name: "cursor", Value: bson.D{
+		{Name: field, Value: batch},
+		{Name: "id", Value: id},
+		{Name: "ns", Value: ns},
+	}}}
+}
+
+func writeError(i int, err error) bson.D {
+	return bson.D{
+		{Name: "index", Value: i},
+		{Name: "code", Value: errorCode(err)},
+		{Name: "errmsg", Value: err.Error()},
+	}
+}
+
+func writeReply(reply bson.D, writeErrors []interface{}) bson.D {
+	if len(writeErrors) > 0 {
+		reply = append(reply, bson.DocElem{Name: "writeErrors", Value: writeErrors})
+	}
+
+	return reply
+}
+
+// collectionArg returns the namespace of the collection named by the first
+// field of the command.
+func collectionArg(db string, cmd bson.D) (string, error) {
+	name, ok := cmd[0].Value.(string)
+	if !ok || name == "" {
+		return "", errorf(codeInvalidNamespace, "collection name has invalid type %s", typeName(cmd[0].Value))
+	}
+
+	return db + "." + name, nil
+}
+
+func docArg(cmd bson.D, name string) (bson.D, error) {
+	v, ok := get(cmd, name)
+	if !ok || v == nil {
+		return nil, nil
+	}
+
+	d, ok := v.(bson.D)
+	if !ok {
+		return nil, errorf(codeTypeMismatch, "%s has to be a document", name)
+	}
+
+	return d, nil
+}
+
+func docsArg(cmd bson.D, name string) ([]bson.D, error) {
+	v, _ := get(cmd, name)
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errorf(codeTypeMismatch, "%s has to be an array", name)
+	}
+
+	docs := make([]bson.D, len(list))
+	for i, e := range list {
+		if docs[i], ok = e.(bson.D); !ok {
+			return nil, errorf(codeTypeMismatch, "%s has to be an array of documents", name)
+		}
+	}
+
+	return docs, nil
+}
+
+func intArg(cmd bson.D, name string) (int, error) {
+	v, ok := get(cmd, name)
+	if !ok || v == nil {
+		return 0, nil
+	}
+
+	if !isNumber(v) {
+		return 0, errorf(codeTypeMismatch, "%s has to be a number", name)
+	}
+
+	return int(toInt64(v)), nil
+}
+
+func orderedArg(cmd bson.D) bool {
+	v, ok := get(cmd, "ordered")
+	return !ok || truthy(v)
+}
@@ -0,0 +1,55 @@
+package memdb
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+var (
+	namedMu sync.Mutex
+	named   = make(map[string]*Store)
+)
+
+// Named returns the store registered with name, creating it the first time,
+// so the same data is shared by everyone using the name.
+func Named(name string) *Store {
+	namedMu.Lock()
+	defer namedMu.Unlock()
+
+	s, ok := named[name]
+	if !ok {
+		s = NewStore()
+		named[name] = s
+	}
+
+	return s
+}
+
+// Dial returns a connection served by the store, as if it was a mongo
+// server, the address and timeout are ignored. It makes the Store a
+// proxy.Dialer.
+func (s *Store) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	client, server := net.Pipe()
+	go s.Serve(server)
+
+	return client, nil
+}
+
+// Serve handles the messages read from conn until it is closed or an error
+// happens.
+func (s *Store) Serve(conn net.Conn) error {
+	defer conn.Close()
+	for {
+		h, err := protocol.ReadMsgHeader(conn)
+		if err != nil {
+			return err
+		}
+
+		if err := s.Handle(h, conn); err != nil {
+			return err
+		}
+	}
+}
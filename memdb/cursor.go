@@ -0,0 +1,117 @@
+package memdb
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultBatchSize is the size of the first batch when the client doesn't
+// ask for one, as mongo does.
+const defaultBatchSize = 101
+
+// cursor holds the documents of a query not returned yet.
+type cursor struct {
+	ns string
+	it Iter
+	// next is the document read ahead to know if the cursor is exhausted,
+	// done is true once there is none.
+	next bson.D
+	done bool
+}
+
+func newCursor(ns string, it Iter) *cursor {
+	c := &cursor{ns: ns, it: it}
+	c.advance()
+	return c
+}
+
+func (c *cursor) advance() {
+	c.next = nil
+	c.done = !c.it.Next(&c.next)
+}
+
+// batch returns up to n documents, all the left ones if n is zero. Once the
+// cursor is exhausted its iterator is closed and the error that stopped it
+// returned.
+func (c *cursor) batch(n int) ([]bson.D, error) {
+	var docs []bson.D
+	for !c.done && (n <= 0 || len(docs) < n) {
+		docs = append(docs, c.next)
+		c.advance()
+	}
+
+	if c.done {
+		return docs, c.it.Close()
+	}
+
+	return docs, nil
+}
+
+// readAll returns all the documents of it.
+func readAll(it Iter) ([]bson.D, error) {
+	return newCursor("", it).batch(0)
+}
+
+// openCursor returns the first batch of it, if more are left they are kept
+// in a cursor and its id returned. A zero batchSize returns the default one.
+func (s *Store) openCursor(ns string, it Iter, batchSize int) (int64, []bson.D, error) {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	c := newCursor(ns, it)
+	docs, err := c.batch(batchSize)
+	if err != nil || c.done {
+		return 0, docs, err
+	}
+
+	s.lastCursor++
+	s.cursors[s.lastCursor] = c
+	return s.lastCursor, docs, nil
+}
+
+// openEmptyCursor opens a cursor with all the documents of it, without
+// returning any.
+func (s *Store) openEmptyCursor(ns string, it Iter) (int64, error) {
+	c := newCursor(ns, it)
+	if c.done {
+		return 0, c.it.Close()
+	}
+
+	s.lastCursor++
+	s.cursors[s.lastCursor] = c
+	return s.lastCursor, nil
+}
+
+// nextBatch returns the next documents of a cursor, all of them if batchSize
+// is zero. The cursor id returned is zero once it is exhausted.
+func (s *Store) nextBatch(id int64, ns string, batchSize int) (int64, []bson.D, error) {
+	c, ok := s.cursors[id]
+	if !ok || (ns != "" && c.ns != ns) {
+		return 0, nil, errorf(codeCursorNotFound, "cursor id %d not found", id)
+	}
+
+	batch, err := c.batch(batchSize)
+	if err != nil || c.done {
+		delete(s.cursors, id)
+		return 0, batch, err
+	}
+
+	return id, batch, nil
+}
+
+// killCursors closes the cursors and returns the ids of the ones that
+// existed.
+func (s *Store) killCursors(ids []int64) (killed, notFound []interface{}) {
+	for _, id := range ids {
+		if c, ok := s.cursors[id]; ok {
+			c.it.Close()
+			delete(s.cursors, id)
+			killed = append(killed, id)
+			continue
+		}
+
+		notFound = append(notFound, id)
+	}
+
+	return killed, notFound
+}
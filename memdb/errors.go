@@ -0,0 +1,53 @@
+package memdb
+
+import (
+	"fmt"
+
+	"github.com/mcuadros/lemondb/query"
+	"github.com/mcuadros/lemondb/update"
+)
+
+// The error codes of mongo returned by the commands.
+const (
+	codeBadValue                  = 2
+	codeFailedToParse             = 9
+	codeTypeMismatch              = 14
+	codeNamespaceNotFound         = 26
+	codeIndexNotFound             = 27
+	codeCursorNotFound            = 43
+	codeCommandNotFound           = 59
+	codeInvalidNamespace          = 73
+	codeCommandNotSupported       = 115
+	codeCommandNotSupportedOnView = 166
+	codeDuplicateKey              = 11000
+	codeUnrecognizedStage         = 40324
+)
+
+// Error is a failed command, replied as ok: 0 with its code and message.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func errorf(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// errorCode returns the code of err, or a generic one for errors not
+// returned by the commands.
+func errorCode(err error) int {
+	switch e := err.(type) {
+	case *Error:
+		return e.Code
+	case *query.Error:
+		return e.Code
+	case *update.Error:
+		return e.Code
+	}
+
+	return 1
+}
@@ -0,0 +1,297 @@
+package memdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The flags of the legacy write messages.
+const (
+	insertContinueOnError = 1
+	updateUpsert          = 1
+	updateMulti           = 2
+	deleteSingle          = 1
+)
+
+// Handle replies a message read from a client, the messages without reply
+// are applied and nothing is written to w.
+func (s *Store) Handle(h *protocol.MsgHeader, w io.Writer) error {
+	switch h.OpCode {
+	case protocol.OpQueryCode:
+		return s.handleQuery(h, w)
+	case protocol.OpGetMoreCode:
+		return s.handleGetMore(h, w)
+	case protocol.OpKillCursorsCode:
+		return s.handleKillCursors(h)
+	case protocol.OpInsertCode, protocol.OpUpdateCode, protocol.OpDeleteCode:
+		return s.handleWrite(h)
+	}
+
+	return fmt.Errorf("memdb: unsupported message %s", h.OpCode)
+}
+
+func (s *Store) handleQuery(h *protocol.MsgHeader, w io.Writer) error {
+	q, err := protocol.ReadOpQuery(h, bytes.NewReader(h.Message))
+	if err != nil {
+		return err
+	}
+
+	var doc bson.D
+	if err := bson.Unmarshal(q.Query, &doc); err != nil {
+		return s.reply(h, w, protocol.QueryFailure, 0, queryError(err))
+	}
+
+	ns := q.FullCollectionName.String()
+	db, coll := splitNamespace(ns)
+	if coll == "$cmd" {
+		return s.reply(h, w, 0, 0, s.Run(db, doc))
+	}
+
+	fq := &findQuery{filter: doc, skip: int(q.NumberToSkip)}
+	if len(doc) > 0 && (doc[0].Name == "$query" || doc[0].Name == "query") {
+		fq.filter, _ = docArg(doc, doc[0].Name)
+		if fq.sort, err = docArg(doc, "$orderby"); err != nil {
+			return s.reply(h, w, protocol.QueryFailure, 0, queryError(err))
+		}
+	}
+
+	if len(q.ReturnFieldsSelector) > 0 {
+		if err := bson.Unmarshal(q.ReturnFieldsSelector, &fq.projection); err != nil {
+			return s.reply(h, w, protocol.QueryFailure, 0, queryError(err))
+		}
+	}
+
+	// a negative or 1 numberToReturn asks for a single batch, closing the
+	// cursor.
+	n := int(q.NumberToReturn)
+	single := n < 0 || n == 1
+	if n < 0 {
+		n = -n
+	}
+
+	if single {
+		fq.limit = n
+	}
+
+	s.mu.Lock()
+	var docs []bson.D
+	var id int64
+	it, err := s.findIter(ns, fq)
+	if err == nil && single {
+		docs, err = readAll(it)
+	} else if err == nil {
+		id, docs, err = s.openCursor(ns, it, n)
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		return s.reply(h, w, protocol.QueryFailure, 0, queryError(err))
+	}
+
+	return s.reply(h, w, 0, id, documents(docs)...)
+}
+
+func (s *Store) handleGetMore(h *protocol.MsgHeader, w io.Writer) error {
+	r := &body{b: h.Message}
+	r.int32()
+	ns := r.cstring()
+	n := r.int32()
+	id := r.int64()
+	if r.err != nil {
+		return r.err
+	}
+
+	s.mu.Lock()
+	id, docs, err := s.nextBatch(id, ns, int(n))
+	s.mu.Unlock()
+
+	if err != nil {
+		return s.reply(h, w, protocol.CursorNotFound, 0)
+	}
+
+	return s.reply(h, w, 0, id, documents(docs)...)
+}
+
+func (s *Store) handleKillCursors(h *protocol.MsgHeader) error {
+	r := &body{b: h.Message}
+	r.int32()
+	n := r.int32()
+
+	var ids []int64
+	for i := int32(0); i < n && r.err == nil; i++ {
+		ids = append(ids, r.int64())
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	s.mu.Lock()
+	s.killCursors(ids)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// handleWrite applies the legacy write messages, their errors are dropped as
+// getLastError doesn't report them.
+func (s *Store) handleWrite(h *protocol.MsgHeader) error {
+	r := &body{b: h.Message}
+	var flags int32
+	if h.OpCode == protocol.OpInsertCode {
+		flags = r.int32()
+	} else {
+		r.int32()
+	}
+
+	ns := r.cstring()
+	if h.OpCode != protocol.OpInsertCode {
+		flags = r.int32()
+	}
+
+	var docs []bson.D
+	for r.err == nil && len(r.b) > 0 {
+		docs = append(docs, r.document())
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the virtual collections only take the inserts.
+	if v, ok := s.virtuals[ns]; ok {
+		if h.OpCode == protocol.OpInsertCode {
+			v.Insert(&InsertRequest{Namespace: ns, Documents: copyDocs(docs)})
+		}
+
+		return nil
+	}
+
+	switch h.OpCode {
+	case protocol.OpInsertCode:
+		for _, d := range docs {
+			if err := s.insert(ns, d); err != nil && flags&insertContinueOnError == 0 {
+				break
+			}
+		}
+	case protocol.OpUpdateCode:
+		if len(docs) == 2 {
+			s.update(ns, docs[0], docs[1], flags&updateUpsert != 0, flags&updateMulti != 0)
+		}
+	case protocol.OpDeleteCode:
+		if len(docs) == 1 {
+			limit := 0
+			if flags&deleteSingle != 0 {
+				limit = 1
+			}
+
+			s.remove(ns, docs[0], limit)
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) reply(h *protocol.MsgHeader, w io.Writer, flags int32, cursorID int64, docs ...interface{}) error {
+	r := protocol.NewOpReplay(h, atomic.AddInt32(&s.lastReply, 1))
+	r.ResponseFlags, r.CursorID = flags, cursorID
+	for _, d := range docs {
+		if err := r.AddDocument(d); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.WriteTo(w)
+	return err
+}
+
+func queryError(err error) bson.D {
+	return bson.D{{Name: "$err", Value: err.Error()}, {Name: "code", Value: errorCode(err)}}
+}
+
+func documents(docs []bson.D) []interface{} {
+	out := make([]interface{}, len(docs))
+	for i, d := range docs {
+		out[i] = d
+	}
+
+	return out
+}
+
+// body reads the fields of a message body, the first error is kept and the
+// following reads return zero values.
+type body struct {
+	b   []byte
+	err error
+}
+
+func (r *body) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *body) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.LittleEndian.Uint32(b))
+	}
+
+	return 0
+}
+
+func (r *body) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.LittleEndian.Uint64(b))
+	}
+
+	return 0
+}
+
+func (r *body) cstring() string {
+	i := bytes.IndexByte(r.b, 0)
+	if i < 0 {
+		r.next(len(r.b) + 1)
+		return ""
+	}
+
+	b := r.next(i + 1)
+	return string(b[:i])
+}
+
+func (r *body) document() bson.D {
+	if len(r.b) < 4 {
+		r.next(4)
+		return nil
+	}
+
+	b := r.next(int(binary.LittleEndian.Uint32(r.b)))
+	if b == nil {
+		return nil
+	}
+
+	var d bson.D
+	if err := bson.Unmarshal(b, &d); err != nil {
+		r.err = err
+	}
+
+	return d
+}
@@ -0,0 +1,395 @@
+package memdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type StoreSuite struct {
+	store *Store
+}
+
+var _ = Suite(&StoreSuite{})
+
+func (s *StoreSuite) SetUpTest(c *C) {
+	s.store = NewStore()
+}
+
+// run runs a command expected to succeed.
+func (s *StoreSuite) run(c *C, cmd bson.D) bson.M {
+	reply := s.store.Run("test", cmd)
+	c.Assert(reply.Map()["ok"], Equals, 1.0, Commentf("%v", reply))
+	return reply.Map()
+}
+
+func (s *StoreSuite) insert(c *C, docs ...interface{}) {
+	s.run(c, bson.D{{Name: "insert", Value: "coll"}, {Name: "documents", Value: docs}})
+}
+
+func (s *StoreSuite) find(c *C, cmd ...bson.DocElem) []interface{} {
+	reply := s.run(c, append(bson.D{{Name: "find", Value: "coll"}}, cmd...))
+	return reply["cursor"].(bson.D).Map()["firstBatch"].([]interface{})
+}
+
+func (s *StoreSuite) TestInsertFind(c *C) {
+	s.insert(c, bson.D{{Name: "a", Value: 1}}, bson.D{{Name: "_id", Value: 2}, {Name: "a", Value: 2}})
+
+	docs := s.find(c)
+	c.Assert(docs, HasLen, 2)
+	c.Assert(docs[0].(bson.D)[0].Name, Equals, "_id")
+	c.Assert(docs[0].(bson.D)[0].Value, FitsTypeOf, bson.ObjectId(""))
+	c.Assert(docs[1], DeepEquals, bson.D{{Name: "_id", Value: 2}, {Name: "a", Value: 2}})
+}
+
+func (s *StoreSuite) TestFindSortSkipLimitProjection(c *C) {
+	for i := 0; i < 5; i++ {
+		s.insert(c, bson.D{{Name: "_id", Value: i}, {Name: "a", Value: i % 2}, {Name: "b", Value: i}})
+	}
+
+	docs := s.find(c,
+		bson.DocElem{Name: "filter", Value: bson.D{{Name: "b", Value: bson.D{{Name: "$gte", Value: 1}}}}},
+		bson.DocElem{Name: "sort", Value: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: -1}}},
+		bson.DocElem{Name: "skip", Value: 1},
+		bson.DocElem{Name: "limit", Value: 2},
+		bson.DocElem{Name: "projection", Value: bson.D{{Name: "b", Value: 1}, {Name: "_id", Value: 0}}},
+	)
+
+	c.Assert(docs, DeepEquals, []interface{}{
+		bson.D{{Name: "b", Value: 2}},
+		bson.D{{Name: "b", Value: 3}},
+	})
+}
+
+func (s *StoreSuite) TestFindOperators(c *C) {
+	s.insert(c,
+		bson.D{{Name: "_id", Value: 1}, {Name: "tags", Value: []interface{}{"a", "b"}}},
+		bson.D{{Name: "_id", Value: 2}, {Name: "tags", Value: []interface{}{"b"}}},
+	)
+
+	docs := s.find(c, bson.DocElem{Name: "filter", Value: bson.D{
+		{Name: "tags", Value: bson.D{{Name: "$size", Value: 2}, {Name: "$all", Value: []interface{}{"b"}}}},
+	}})
+
+	c.Assert(docs, HasLen, 1)
+	c.Assert(docs[0].(bson.D)[0].Value, Equals, 1)
+
+	reply := s.store.Run("test", bson.D{{Name: "find", Value: "coll"}, {Name: "filter", Value: bson.D{
+		{Name: "tags", Value: bson.D{{Name: "$foo", Value: 1}}},
+	}}}).Map()
+
+	c.Assert(reply["ok"], Equals, 0.0)
+	c.Assert(reply["code"], Equals, codeBadValue)
+}
+
+func (s *StoreSuite) TestUpdate(c *C) {
+	s.insert(c, bson.D{{Name: "_id", Value: 1}, {Name: "n", Value: 1}}, bson.D{{Name: "_id", Value: 2}, {Name: "n", Value: 1}})
+
+	reply := s.run(c, bson.D{{Name: "update", Value: "coll"}, {Name: "updates", Value: []interface{}{
+		bson.D{
+			{Name: "q", Value: bson.D{{Name: "n", Value: 1}}},
+			{Name: "u", Value: bson.D{{Name: "$inc", Value: bson.D{{Name: "n", Value: 1}}}}},
+			{Name: "multi", Value: true},
+		},
+		bson.D{
+			{Name: "q", Value: bson.D{{Name: "_id", Value: 3}}},
+			{Name: "u", Value: bson.D{{Name: "$set", Value: bson.D{{Name: "n", Value: 5}}}}},
+			{Name: "upsert", Value: true},
+		},
+	}}})
+
+	c.Assert(reply["n"], Equals, 3)
+	c.Assert(reply["nModified"], Equals, 2)
+	c.Assert(reply["upserted"], HasLen, 1)
+
+	c.Assert(s.find(c), DeepEquals, []interface{}{
+		bson.D{{Name: "_id", Value: 1}, {Name: "n", Value: 2}},
+		bson.D{{Name: "_id", Value: 2}, {Name: "n", Value: 2}},
+		bson.D{{Name: "_id", Value: 3}, {Name: "n", Value: 5}},
+	})
+}
+
+func (s *StoreSuite) TestUpdatePositional(c *C) {
+	s.insert(c, bson.D{{Name: "_id", Value: 1}, {Name: "grades", Value: []interface{}{80, 85, 90}}})
+
+	reply := s.run(c, bson.D{{Name: "update", Value: "coll"}, {Name: "updates", Value: []interface{}{
+		bson.D{
+			{Name: "q", Value: bson.D{{Name: "grades", Value: 85}}},
+			{Name: "u", Value: bson.D{{Name: "$set", Value: bson.D{{Name: "grades.$", Value: 82}}}}},
+		},
+	}}})
+
+	c.Assert(reply["nModified"], Equals, 1)
+	c.Assert(s.find(c), DeepEquals, []interface{}{
+		bson.D{{Name: "_id", Value: 1}, {Name: "grades", Value: []interface{}{80, 82, 90}}},
+	})
+
+	reply = s.run(c, bson.D{{Name: "update", Value: "coll"}, {Name: "updates", Value: []interface{}{
+		bson.D{
+			{Name: "q", Value: bson.D{{Name: "_id", Value: 1}}},
+			{Name: "u", Value: bson.D{{Name: "$set", Value: bson.D{{Name: "_id", Value: 2}}}}},
+		},
+	}}})
+
+	c.Assert(reply["writeErrors"], HasLen, 1)
+	we := reply["writeErrors"].([]interface{})[0].(bson.D).Map()
+	c.Assert(we["code"], Equals, 66)
+}
+
+func (s *StoreSuite) TestDuplicateKey(c *C) {
+	s.insert(c, bson.D{{Name: "_id", Value: 1}})
+
+	reply := s.run(c, bson.D{{Name: "insert", Value: "coll"}, {Name: "documents", Value: []interface{}{
+		bson.D{{Name: "_id", Value: 1}},
+	}}})
+
+	c.Assert(reply["n"], Equals, 0)
+	we := reply["writeErrors"].([]interface{})[0].(bson.D).Map()
+	c.Assert(we["code"], Equals, codeDuplicateKey)
+}
+
+func (s *StoreSuite) TestUnknownCommand(c *C) {
+	reply := s.store.Run("test", bson.D{{Name: "foo", Value: 1}}).Map()
+	c.Assert(reply["ok"], Equals, 0.0)
+	c.Assert(reply["code"], Equals, codeCommandNotFound)
+}
+
+func (s *StoreSuite) TestGetMore(c *C) {
+	for i := 0; i < 5; i++ {
+		s.insert(c, bson.D{{Name: "_id", Value: i}})
+	}
+
+	reply := s.run(c, bson.D{{Name: "find", Value: "coll"}, {Name: "batchSize", Value: 2}})
+	cursor := reply["cursor"].(bson.D).Map()
+	c.Assert(cursor["firstBatch"], HasLen, 2)
+
+	id := cursor["id"].(int64)
+	c.Assert(id, Not(Equals), int64(0))
+
+	reply = s.run(c, bson.D{{Name: "getMore", Value: id}, {Name: "collection", Value: "coll"}})
+	cursor = reply["cursor"].(bson.D).Map()
+	c.Assert(cursor["nextBatch"], HasLen, 3)
+	c.Assert(cursor["id"], Equals, int64(0))
+
+	reply = s.store.Run("test", bson.D{{Name: "getMore", Value: id}, {Name: "collection", Value: "coll"}}).Map()
+	c.Assert(reply["code"], Equals, codeCursorNotFound)
+}
+
+func (s *StoreSuite) TestLegacyMessages(c *C) {
+	buf := bytes.NewBuffer(nil)
+	insert := &protocol.MsgHeader{RequestID: 1, OpCode: protocol.OpInsertCode}
+	insert.Message = append(insert.Message, 0, 0, 0, 0)
+	insert.Message = append(insert.Message, "test.coll\x00"...)
+	for i := 0; i < 3; i++ {
+		b, err := bson.Marshal(bson.D{{Name: "_id", Value: i}})
+		c.Assert(err, IsNil)
+		insert.Message = append(insert.Message, b...)
+	}
+
+	c.Assert(s.store.Handle(insert, buf), IsNil)
+	c.Assert(buf.Len(), Equals, 0)
+
+	query := &protocol.OpQuery{
+		MsgHeader:          &protocol.MsgHeader{RequestID: 2, OpCode: protocol.OpQueryCode},
+		FullCollectionName: protocol.CSString("test.coll\x00"),
+		NumberToReturn:     2,
+	}
+
+	query.Query, _ = bson.Marshal(bson.D{{Name: "$query", Value: bson.D{}}, {Name: "$orderby", Value: bson.D{{Name: "_id", Value: -1}}}})
+	msg := bytes.NewBuffer(nil)
+	_, err := query.WriteTo(msg)
+	c.Assert(err, IsNil)
+	h, err := protocol.ReadMsgHeader(msg)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.store.Handle(h, buf), IsNil)
+	h, err = protocol.ReadMsgHeader(buf)
+	c.Assert(err, IsNil)
+	reply, err := protocol.ReadOpReply(h, bytes.NewReader(h.Message))
+	c.Assert(err, IsNil)
+	c.Assert(reply.MsgHeader.ResponseTo, Equals, int32(2))
+	c.Assert(reply.CursorID, Not(Equals), int64(0))
+	c.Assert(reply.Documents, HasLen, 2)
+
+	var first bson.M
+	c.Assert(bson.Unmarshal(reply.Documents[0], &first), IsNil)
+	c.Assert(first["_id"], Equals, 2)
+}
+
+func (s *StoreSuite) TestSnapshot(c *C) {
+	s.insert(c, bson.D{{Name: "_id", Value: 1}, {Name: "sub", Value: bson.D{{Name: "a", Value: 1}}}})
+	s.run(c, bson.D{{Name: "createIndexes", Value: "coll"}, {Name: "indexes", Value: []interface{}{
+		bson.D{{Name: "key", Value: bson.D{{Name: "sub.a", Value: 1}}}, {Name: "name", Value: "sub_a"}, {Name: "unique", Value: true}},
+	}}})
+
+	dir, err := ioutil.TempDir("", "memdb")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "snapshot.bson")
+	c.Assert(s.store.SaveFile(file), IsNil)
+
+	loaded := NewStore()
+	c.Assert(loaded.LoadFile(file), IsNil)
+	c.Assert(loaded.collections["test.coll"].docs, DeepEquals, s.store.collections["test.coll"].docs)
+	for i, idx := range s.store.collections["test.coll"].indexes {
+		c.Assert(*loaded.collections["test.coll"].indexes[i], DeepEquals, *idx)
+	}
+
+	c.Assert(NewStore().LoadFile(filepath.Join(dir, "missing")), IsNil)
+}
+
+func (s *StoreSuite) TestPersist(c *C) {
+	dir := c.MkDir()
+	first, second := filepath.Join(dir, "first.bson"), filepath.Join(dir, "second.bson")
+
+	s.insert(c, bson.D{{Name: "_id", Value: 1}})
+	c.Assert(s.store.SaveFile(first), IsNil)
+
+	store := NewStore()
+	p, err := store.Persist(first, time.Hour, nil)
+	c.Assert(err, IsNil)
+	c.Assert(store.collections["test.coll"].docs, HasLen, 1)
+
+	// the callers with the same options share it
+	shared, err := store.Persist(first, time.Hour, nil)
+	c.Assert(err, IsNil)
+	c.Assert(shared, Equals, p)
+
+	store.Run("test", bson.D{{Name: "insert", Value: "coll"}, {Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: 2}}}}})
+	c.Assert(shared.Stop(), IsNil)
+	c.Assert(s.loadDocs(c, first), HasLen, 1)
+
+	// a new path replaces it, saving to the previous one
+	replaced, err := store.Persist(second, time.Hour, nil)
+	c.Assert(err, IsNil)
+	c.Assert(replaced != p, Equals, true)
+	c.Assert(s.loadDocs(c, first), HasLen, 2)
+	c.Assert(p.Stop(), IsNil)
+
+	store.Run("test", bson.D{{Name: "insert", Value: "coll"}, {Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: 3}}}}})
+	c.Assert(replaced.Stop(), IsNil)
+	c.Assert(s.loadDocs(c, second), HasLen, 3)
+	c.Assert(replaced.Stop(), IsNil)
+}
+
+func (s *StoreSuite) TestPersistInterval(c *C) {
+	file := filepath.Join(c.MkDir(), "snapshot.bson")
+
+	p, err := s.store.Persist(file, 10*time.Millisecond, nil)
+	c.Assert(err, IsNil)
+	defer p.Stop()
+
+	s.insert(c, bson.D{{Name: "_id", Value: 1}})
+	for i := 0; i < 100 && len(s.loadDocs(c, file)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(s.loadDocs(c, file), HasLen, 1)
+}
+
+// loadDocs returns the documents of test.coll in the snapshot at file.
+func (s *StoreSuite) loadDocs(c *C, file string) []bson.D {
+	store := NewStore()
+	c.Assert(store.LoadFile(file), IsNil)
+	if coll, ok := store.collections["test.coll"]; ok {
+		return coll.docs
+	}
+
+	return nil
+}
+
+func (s *StoreSuite) mountFlags(c *C) {
+	s.store.Mount("test.flags", Documents(func() ([]bson.D, error) {
+		var docs []bson.D
+		for i := 0; i < 5; i++ {
+			docs = append(docs, bson.D{{Name: "_id", Value: i}, {Name: "on", Value: i%2 == 0}})
+		}
+
+		return docs, nil
+	}))
+}
+
+func (s *StoreSuite) TestVirtualFind(c *C) {
+	s.mountFlags(c)
+
+	reply := s.run(c, bson.D{
+		{Name: "find", Value: "flags"},
+		{Name: "filter", Value: bson.D{{Name: "on", Value: true}}},
+		{Name: "sort", Value: bson.D{{Name: "_id", Value: -1}}},
+		{Name: "skip", Value: 1},
+		{Name: "projection", Value: bson.D{{Name: "on", Value: 0}}},
+		{Name: "batchSize", Value: 1},
+	})
+
+	cursor := reply["cursor"].(bson.D).Map()
+	c.Assert(cursor["firstBatch"], DeepEquals, []interface{}{bson.D{{Name: "_id", Value: 2}}})
+
+	id := cursor["id"].(int64)
+	c.Assert(id, Not(Equals), int64(0))
+
+	reply = s.run(c, bson.D{{Name: "getMore", Value: id}, {Name: "collection", Value: "flags"}})
+	cursor = reply["cursor"].(bson.D).Map()
+	c.Assert(cursor["nextBatch"], DeepEquals, []interface{}{bson.D{{Name: "_id", Value: 0}}})
+	c.Assert(cursor["id"], Equals, int64(0))
+
+	reply = s.run(c, bson.D{{Name: "count", Value: "flags"}, {Name: "query", Value: bson.D{{Name: "on", Value: true}}}, {Name: "skip", Value: 1}})
+	c.Assert(reply["n"], Equals, 2)
+}
+
+func (s *StoreSuite) TestVirtualAggregate(c *C) {
+	s.mountFlags(c)
+
+	reply := s.run(c, bson.D{
+		{Name: "aggregate", Value: "flags"},
+		{Name: "pipeline", Value: []interface{}{
+			bson.D{{Name: "$match", Value: bson.D{{Name: "on", Value: false}}}},
+			bson.D{{Name: "$count", Value: "off"}},
+		}},
+		{Name: "cursor", Value: bson.D{}},
+	})
+
+	cursor := reply["cursor"].(bson.D).Map()
+	c.Assert(cursor["firstBatch"], DeepEquals, []interface{}{bson.D{{Name: "off", Value: 2}}})
+
+	reply = s.store.Run("test", bson.D{
+		{Name: "aggregate", Value: "flags"},
+		{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$group", Value: bson.D{}}}}},
+		{Name: "cursor", Value: bson.D{}},
+	}).Map()
+
+	c.Assert(reply["code"], Equals, codeUnrecognizedStage)
+}
+
+func (s *StoreSuite) TestVirtualUnsupported(c *C) {
+	s.mountFlags(c)
+
+	reply := s.run(c, bson.D{{Name: "insert", Value: "flags"}, {Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: 9}}}}})
+	c.Assert(reply["n"], Equals, 0)
+	we := reply["writeErrors"].([]interface{})[0].(bson.D).Map()
+	c.Assert(we["code"], Equals, codeCommandNotSupportedOnView)
+
+	reply = s.store.Run("test", bson.D{{Name: "drop", Value: "flags"}}).Map()
+	c.Assert(reply["code"], Equals, codeCommandNotSupportedOnView)
+
+	s.insert(c, bson.D{{Name: "_id", Value: 1}})
+	reply = s.run(c, bson.D{{Name: "listCollections", Value: 1}})
+	batch := reply["cursor"].(bson.D).Map()["firstBatch"].([]interface{})
+	c.Assert(batch, HasLen, 2)
+	c.Assert(batch[0].(bson.D).Map()["name"], Equals, "coll")
+	c.Assert(batch[1].(bson.D).Map()["name"], Equals, "flags")
+
+	s.store.Unmount("test.flags")
+	c.Assert(s.run(c, bson.D{{Name: "find", Value: "flags"}})["cursor"].(bson.D).Map()["firstBatch"], HasLen, 0)
+}
@@ -0,0 +1,310 @@
+package memdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// snapshotCollection is how a collection is saved, a snapshot is a stream of
+// them, one BSON document per collection.
+type snapshotCollection struct {
+	Namespace string   `bson:"ns"`
+	Indexes   []bson.D `bson:"indexes"`
+	Docs      []bson.D `bson:"docs"`
+}
+
+// Save writes all the collections to w.
+func (s *Store) Save(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.save(w)
+}
+
+func (s *Store) save(w io.Writer) error {
+	var names []string
+	for ns := range s.collections {
+		names = append(names, ns)
+	}
+
+	sort.Strings(names)
+	for _, ns := range names {
+		c := s.collections[ns]
+		sc := &snapshotCollection{Namespace: ns, Docs: c.docs}
+		for _, idx := range c.indexes {
+			sc.Indexes = append(sc.Indexes, idx.spec(ns))
+		}
+
+		b, err := bson.Marshal(sc)
+		if err != nil {
+			return fmt.Errorf("memdb: saving %s: %s", ns, err)
+		}
+
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load reads the collections saved by Save, replacing the ones with the same
+// namespace.
+func (s *Store) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	loaded := make(map[string]*collection)
+	for {
+		b, err := readDocument(br)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("memdb: loading snapshot: %s", err)
+		}
+
+		var sc snapshotCollection
+		if err := bson.Unmarshal(b, &sc); err != nil {
+			return fmt.Errorf("memdb: loading snapshot: %s", err)
+		}
+
+		c := &collection{docs: sc.Docs}
+		for _, spec := range sc.Indexes {
+			idx, err := parseIndex(spec)
+			if err != nil {
+				return fmt.Errorf("memdb: loading %s: %s", sc.Namespace, err)
+			}
+
+			// the spec of the _id index doesn't say it is unique.
+			idx.unique = idx.unique || idx.name == idIndex
+			c.indexes = append(c.indexes, idx)
+		}
+
+		if len(c.indexes) == 0 {
+			c.indexes = newCollection().indexes
+		}
+
+		loaded[sc.Namespace] = c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ns, c := range loaded {
+		s.collections[ns] = c
+	}
+
+	return nil
+}
+
+// readDocument reads a whole BSON document from r, io.EOF is returned only
+// if there is nothing left.
+func readDocument(r io.Reader) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.LittleEndian.Uint32(l[:]))
+	if n < 5 {
+		return nil, fmt.Errorf("invalid document length %d", n)
+	}
+
+	b := make([]byte, n)
+	copy(b, l[:])
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// SaveFile saves the store to path, it is written to a temporary file first
+// and renamed so a crash never leaves a partial snapshot.
+func (s *Store) SaveFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	s.mu.Lock()
+	err = s.save(w)
+	if err == nil {
+		s.changed = false
+	}
+	s.mu.Unlock()
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		s.markChanged()
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFile loads the snapshot at path, a missing file is not an error.
+func (s *Store) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	return s.Load(f)
+}
+
+func (s *Store) markChanged() {
+	s.mu.Lock()
+	s.changed = true
+	s.mu.Unlock()
+}
+
+// Persister saves a store to a snapshot file every interval, see Persist.
+type Persister struct {
+	store    *Store
+	path     string
+	interval time.Duration
+	onError  func(error)
+	// refs is the number of users not stopped yet, guarded by the persistMu
+	// of the store.
+	refs int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Persist loads the snapshot at path, if no snapshot was loaded into the
+// store yet, and then saves the store to it every interval, if anything
+// changed, until the returned Persister is stopped. A store is saved by one
+// Persister at a time: the callers with the same path and interval share it,
+// and a different path or interval replaces it, saving the store one last
+// time to the previous path. The errors saving are passed to onError if it
+// is not nil.
+func (s *Store) Persist(path string, interval time.Duration, onError func(error)) (*Persister, error) {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	if p := s.persister; p != nil && p.path == path && p.interval == interval {
+		p.refs++
+		return p, nil
+	}
+
+	if !s.loaded {
+		if err := s.LoadFile(path); err != nil {
+			return nil, err
+		}
+
+		s.loaded = true
+	}
+
+	if old := s.persister; old != nil {
+		if err := old.halt(); err != nil && old.onError != nil {
+			old.onError(err)
+		}
+	}
+
+	p := &Persister{
+		store:    s,
+		path:     path,
+		interval: interval,
+		onError:  onError,
+		refs:     1,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	s.persister = p
+	go p.run()
+
+	return p, nil
+}
+
+// Stop releases the Persister, once every caller of Persist sharing it has
+// stopped it the store is saved one last time, if anything changed. Stopping
+// a Persister replaced by another one does nothing.
+func (p *Persister) Stop() error {
+	s := p.store
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	if p.refs == 0 {
+		return nil
+	}
+
+	p.refs--
+	if p.refs > 0 {
+		return nil
+	}
+
+	s.persister = nil
+	return p.halt()
+}
+
+// halt stops saving and saves the store, it must be called with the
+// persistMu of the store held.
+func (p *Persister) halt() error {
+	p.refs = 0
+	close(p.stop)
+	<-p.done
+
+	return p.store.saveChanged(p.path)
+}
+
+func (p *Persister) run() {
+	defer close(p.done)
+
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := p.store.saveChanged(p.path); err != nil && p.onError != nil {
+				p.onError(err)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// saveChanged saves the store to path if anything changed since the last
+// save.
+func (s *Store) saveChanged(path string) error {
+	s.mu.Lock()
+	changed := s.changed
+	s.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	return s.SaveFile(path)
+}
@@ -0,0 +1,496 @@
+// Package memdb implements a subset of mongo in memory: the CRUD commands,
+// the indexes as far as their uniqueness, the cursors and the commands of the
+// handshake, enough for the drivers to run their tests against it. The data
+// can be saved to a snapshot file and loaded back.
+package memdb
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mcuadros/lemondb/query"
+	"github.com/mcuadros/lemondb/update"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const idIndex = "_id_"
+
+// Store is an in-memory database, safe for concurrent use. The zero value is
+// not ready, NewStore has to be used.
+type Store struct {
+	mu          sync.Mutex
+	collections map[string]*collection
+	virtuals    map[string]VirtualCollection
+	cursors     map[int64]*cursor
+	lastCursor  int64
+	lastReply   int32
+	// changed is true if anything was written since the last snapshot.
+	changed bool
+
+	persistMu sync.Mutex
+	persister *Persister
+	// loaded is true once a snapshot was loaded by Persist.
+	loaded bool
+}
+
+type collection struct {
+	docs    []bson.D
+	indexes []*index
+}
+
+type index struct {
+	name   string
+	key    bson.D
+	unique bool
+	sparse bool
+}
+
+// NewStore returns an empty store.
+func NewStore() *Store {
+	return &Store{
+		collections: make(map[string]*collection),
+		virtuals:    make(map[string]VirtualCollection),
+		cursors:     make(map[int64]*cursor),
+	}
+}
+
+// splitNamespace splits "db.collection" in its database and collection.
+func splitNamespace(ns string) (db, coll string) {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) == 1 {
+		return ns, ""
+	}
+
+	return parts[0], parts[1]
+}
+
+func newCollection() *collection {
+	return &collection{indexes: []*index{{name: idIndex, key: bson.D{{Name: "_id", Value: 1}}, unique: true}}}
+}
+
+// collection returns the collection of the namespace, nil if it doesn't
+// exist and create is false.
+func (s *Store) collection(ns string, create bool) (*collection, error) {
+	if c, ok := s.collections[ns]; ok {
+		return c, nil
+	}
+
+	if !create {
+		return nil, nil
+	}
+
+	db, name := splitNamespace(ns)
+	if db == "" || name == "" || strings.Contains(db, " ") || strings.HasPrefix(name, "$") {
+		return nil, errorf(codeInvalidNamespace, "invalid namespace: %s", ns)
+	}
+
+	c := newCollection()
+	s.collections[ns] = c
+	s.changed = true
+	return c, nil
+}
+
+// namespaces returns the sorted namespaces of the database.
+func (s *Store) namespaces(db string) []string {
+	var names []string
+	for ns := range s.collections {
+		if d, _ := splitNamespace(ns); d == db {
+			names = append(names, ns)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// insert adds a document, an ObjectId is given as _id to the documents
+// without it.
+func (s *Store) insert(ns string, doc bson.D) error {
+	c, err := s.collection(ns, true)
+	if err != nil {
+		return err
+	}
+
+	doc = copyDoc(doc)
+	if _, ok := get(doc, "_id"); !ok {
+		doc = append(bson.D{{Name: "_id", Value: bson.NewObjectId()}}, doc...)
+	}
+
+	if err := c.checkUnique(ns, doc, -1); err != nil {
+		return err
+	}
+
+	c.docs = append(c.docs, doc)
+	s.changed = true
+	return nil
+}
+
+// checkUnique fails if doc has the same key than another document, skip is
+// the position of the document being replaced.
+func (c *collection) checkUnique(ns string, doc bson.D, skip int) error {
+	for _, idx := range c.indexes {
+		if !idx.unique {
+			continue
+		}
+
+		key, ok := idx.values(doc)
+		if !ok && idx.sparse {
+			continue
+		}
+
+		for i, other := range c.docs {
+			if i == skip {
+				continue
+			}
+
+			if otherKey, _ := idx.values(other); compare(key, otherKey) == 0 {
+				return errorf(codeDuplicateKey, "E11000 duplicate key error collection: %s index: %s dup key: %s", ns, idx.name, formatKey(key))
+			}
+		}
+	}
+
+	return nil
+}
+
+// values returns the values of the fields of the index in doc, false if none
+// of them is present.
+func (idx *index) values(doc bson.D) ([]interface{}, bool) {
+	values := make([]interface{}, len(idx.key))
+	found := false
+	for i, k := range idx.key {
+		v, ok := lookup(doc, k.Name)
+		values[i], found = v, found || ok
+	}
+
+	return values, found
+}
+
+func (idx *index) spec(ns string) bson.D {
+	spec := bson.D{
+		{Name: "v", Value: 2},
+		{Name: "key", Value: idx.key},
+		{Name: "name", Value: idx.name},
+		{Name: "ns", Value: ns},
+	}
+
+	if idx.unique && idx.name != idIndex {
+		spec = append(spec, bson.DocElem{Name: "unique", Value: true})
+	}
+
+	if idx.sparse {
+		spec = append(spec, bson.DocElem{Name: "sparse", Value: true})
+	}
+
+	return spec
+}
+
+func formatKey(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = ": " + formatValue(v)
+	}
+
+	return "{ " + strings.Join(parts, ", ") + " }"
+}
+
+// findQuery is what selects and shapes the documents of a find.
+type findQuery struct {
+	filter     bson.D
+	sort       bson.D
+	projection bson.D
+	skip       int
+	// limit is the maximum number of documents, zero means no limit.
+	limit int
+}
+
+// find returns copies of the documents matching the query.
+func (s *Store) find(ns string, q *findQuery) ([]bson.D, error) {
+	docs, _, err := s.match(ns, q.filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(q.sort) > 0 {
+		if err := sortDocs(docs, q.sort); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.skip > 0 {
+		if q.skip >= len(docs) {
+			return nil, nil
+		}
+
+		docs = docs[q.skip:]
+	}
+
+	if q.limit > 0 && q.limit < len(docs) {
+		docs = docs[:q.limit]
+	}
+
+	project, err := compileProjection(q.projection)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]bson.D, len(docs))
+	for i, d := range docs {
+		out[i] = project(copyDoc(d))
+	}
+
+	return out, nil
+}
+
+// match returns the stored documents matching the filter and their
+// positions, the documents are not copied.
+func (s *Store) match(ns string, filter bson.D) ([]bson.D, []int, error) {
+	m, err := query.CompileBSON(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, _ := s.collection(ns, false)
+	if c == nil {
+		return nil, nil, nil
+	}
+
+	var docs []bson.D
+	var pos []int
+	for i, d := range c.docs {
+		if m.MatchBSON(d) {
+			docs, pos = append(docs, d), append(pos, i)
+		}
+	}
+
+	return docs, pos, nil
+}
+
+// updateResult is the outcome of an update statement.
+type updateResult struct {
+	matched  int
+	modified int
+	// upserted is the _id of the inserted document, if any.
+	upserted interface{}
+}
+
+// update applies spec to the first document matching the filter, or to all
+// of them if multi. If none matches and upsert is true a document is
+// inserted.
+func (s *Store) update(ns string, filter, spec bson.D, upsert, multi bool) (*updateResult, error) {
+	u, err := update.CompileBSON(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if multi && u.IsReplacement() && len(spec) > 0 {
+		return nil, errorf(codeFailedToParse, "multi update only works with $ operators")
+	}
+
+	docs, pos, err := s.match(ns, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &updateResult{}
+	if len(docs) == 0 {
+		if !upsert {
+			return r, nil
+		}
+
+		doc, err := u.ApplyBSON(upsertBase(filter), &update.Options{Upsert: true})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.insert(ns, doc); err != nil {
+			return nil, err
+		}
+
+		c, _ := s.collection(ns, false)
+		r.upserted, _ = get(c.docs[len(c.docs)-1], "_id")
+		return r, nil
+	}
+
+	if !multi {
+		docs, pos = docs[:1], pos[:1]
+	}
+
+	c, _ := s.collection(ns, false)
+	for i, doc := range docs {
+		updated, err := u.ApplyBSON(doc, &update.Options{Filter: filter})
+		if err != nil {
+			return r, err
+		}
+
+		r.matched++
+		if compare(doc, updated) == 0 {
+			continue
+		}
+
+		if err := c.checkUnique(ns, updated, pos[i]); err != nil {
+			return r, err
+		}
+
+		c.docs[pos[i]] = updated
+		r.modified++
+		s.changed = true
+	}
+
+	return r, nil
+}
+
+// upsertBase returns the document an upsert starts from: the fields of the
+// filter compared by equality.
+func upsertBase(filter bson.D) bson.D {
+	doc := bson.D{}
+	for _, e := range filter {
+		if strings.HasPrefix(e.Name, "$") {
+			continue
+		}
+
+		v := e.Value
+		if d, ok := v.(bson.D); ok && len(d) > 0 && strings.HasPrefix(d[0].Name, "$") {
+			if d[0].Name != "$eq" || len(d) != 1 {
+				continue
+			}
+
+			v = d[0].Value
+		}
+
+		doc, _ = setPath(doc, e.Name, copyValue(v))
+	}
+
+	return doc
+}
+
+// remove deletes the documents matching the filter, up to limit if it is
+// not zero.
+func (s *Store) remove(ns string, filter bson.D, limit int) (int, error) {
+	_, pos, err := s.match(ns, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	if limit > 0 && len(pos) > limit {
+		pos = pos[:limit]
+	}
+
+	if len(pos) == 0 {
+		return 0, nil
+	}
+
+	c, _ := s.collection(ns, false)
+	removed := make(map[int]bool, len(pos))
+	for _, p := range pos {
+		removed[p] = true
+	}
+
+	docs := c.docs[:0]
+	for i, d := range c.docs {
+		if !removed[i] {
+			docs = append(docs, d)
+		}
+	}
+
+	c.docs = docs
+	s.changed = true
+	return len(pos), nil
+}
+
+// sortDocs sorts the documents by the fields of spec, 1 ascending and -1
+// descending.
+func sortDocs(docs []bson.D, spec bson.D) error {
+	dirs := make([]int, len(spec))
+	for i, e := range spec {
+		switch toFloat(e.Value) {
+		case 1:
+			dirs[i] = 1
+		case -1:
+			dirs[i] = -1
+		default:
+			return errorf(codeBadValue, "bad sort specification for %s", e.Name)
+		}
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		for k, e := range spec {
+			a, _ := lookup(docs[i], e.Name)
+			b, _ := lookup(docs[j], e.Name)
+			if c := compare(a, b); c != 0 {
+				return c*dirs[k] < 0
+			}
+		}
+
+		return false
+	})
+
+	return nil
+}
+
+// compileProjection returns a function shaping the documents as the
+// projection asks, including or excluding the given fields. The _id is
+// included unless excluded explicitly.
+func compileProjection(spec bson.D) (func(bson.D) bson.D, error) {
+	if len(spec) == 0 {
+		return func(d bson.D) bson.D { return d }, nil
+	}
+
+	include, exclude := []string{}, []string{}
+	excludeID := false
+	for _, e := range spec {
+		if !truthy(e.Value) {
+			if e.Name == "_id" {
+				excludeID = true
+				continue
+			}
+
+			exclude = append(exclude, e.Name)
+			continue
+		}
+
+		if isNumber(e.Value) || e.Value == true {
+			if e.Name != "_id" {
+				include = append(include, e.Name)
+			}
+
+			continue
+		}
+
+		return nil, errorf(codeBadValue, "unsupported projection option: %s", e.Name)
+	}
+
+	if len(include) > 0 && len(exclude) > 0 {
+		return nil, errorf(codeBadValue, "projection cannot have a mix of inclusion and exclusion")
+	}
+
+	if len(include) == 0 {
+		if excludeID {
+			exclude = append(exclude, "_id")
+		}
+
+		return func(d bson.D) bson.D {
+			for _, f := range exclude {
+				d = unsetPath(d, f)
+			}
+
+			return d
+		}, nil
+	}
+
+	if !excludeID {
+		include = append([]string{"_id"}, include...)
+	}
+
+	return func(d bson.D) bson.D {
+		out := bson.D{}
+		for _, f := range include {
+			if v, ok := lookup(d, f); ok {
+				out, _ = setPath(out, f, v)
+			}
+		}
+
+		return out
+	}, nil
+}
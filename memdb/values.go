@@ -0,0 +1,333 @@
+package memdb
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/lemondb/query"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The documents are kept as bson.D, as decoded by mgo: the nested documents
+// are bson.D too, the arrays []interface{}, the int32 int and the int64 int64.
+
+// lookup returns the value at the dotted path, the numeric parts index the
+// arrays.
+func lookup(doc bson.D, path string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch cur := v.(type) {
+		case bson.D:
+			var ok bool
+			if v, ok = get(cur, part); !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(cur) {
+				return nil, false
+			}
+
+			v = cur[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// pathValues returns the values found at the dotted path, looking into the
+// documents of the arrays. The arrays found at the end of the path are
+// returned along with their elements.
+func pathValues(doc bson.D, path string) []interface{} {
+	var values []interface{}
+	walk(doc, strings.Split(path, "."), &values)
+	return values
+}
+
+func walk(v interface{}, parts []string, values *[]interface{}) {
+	if len(parts) == 0 {
+		*values = append(*values, v)
+		if l, ok := v.([]interface{}); ok {
+			*values = append(*values, l...)
+		}
+
+		return
+	}
+
+	switch cur := v.(type) {
+	case bson.D:
+		if child, ok := get(cur, parts[0]); ok {
+			walk(child, parts[1:], values)
+		}
+	case []interface{}:
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i >= 0 && i < len(cur) {
+				walk(cur[i], parts[1:], values)
+			}
+
+			return
+		}
+
+		for _, e := range cur {
+			if d, ok := e.(bson.D); ok {
+				walk(d, parts, values)
+			}
+		}
+	}
+}
+
+// get returns the value of a field of doc.
+func get(doc bson.D, name string) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Name == name {
+			return e.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// set sets the value of a field of doc, appending it if it doesn't exist.
+func set(doc bson.D, name string, value interface{}) bson.D {
+	for i := range doc {
+		if doc[i].Name == name {
+			doc[i].Value = value
+			return doc
+		}
+	}
+
+	return append(doc, bson.DocElem{Name: name, Value: value})
+}
+
+// setPath sets the value at the dotted path, creating the missing documents.
+func setPath(doc bson.D, path string, value interface{}) (bson.D, error) {
+	parts := strings.SplitN(path, ".", 2)
+	if len(parts) == 1 {
+		return set(doc, path, value), nil
+	}
+
+	child, _ := get(doc, parts[0])
+	switch c := child.(type) {
+	case nil:
+		sub, err := setPath(bson.D{}, parts[1], value)
+		if err != nil {
+			return nil, err
+		}
+
+		return set(doc, parts[0], sub), nil
+	case bson.D:
+		sub, err := setPath(c, parts[1], value)
+		if err != nil {
+			return nil, err
+		}
+
+		return set(doc, parts[0], sub), nil
+	case []interface{}:
+		rest := strings.SplitN(parts[1], ".", 2)
+		i, err := strconv.Atoi(rest[0])
+		if err != nil || i < 0 {
+			return nil, errorf(codeBadValue, "cannot create field '%s' in element {%s: %s}", rest[0], parts[0], typeName(c))
+		}
+
+		for len(c) <= i {
+			c = append(c, nil)
+		}
+
+		if len(rest) == 1 {
+			c[i] = value
+		} else {
+			sub, _ := c[i].(bson.D)
+			if c[i] != nil && sub == nil {
+				return nil, errorf(codeBadValue, "cannot create field '%s' in element {%s: %s}", rest[1], rest[0], typeName(c[i]))
+			}
+
+			if c[i], err = setPath(sub, rest[1], value); err != nil {
+				return nil, err
+			}
+		}
+
+		return set(doc, parts[0], c), nil
+	}
+
+	return nil, errorf(codeBadValue, "cannot create field '%s' in element {%s: %s}", parts[1], parts[0], typeName(child))
+}
+
+// unsetPath removes the field at the dotted path, the array elements are set
+// to null instead.
+func unsetPath(doc bson.D, path string) bson.D {
+	parts := strings.SplitN(path, ".", 2)
+	if len(parts) == 1 {
+		for i := range doc {
+			if doc[i].Name == path {
+				return append(doc[:i:i], doc[i+1:]...)
+			}
+		}
+
+		return doc
+	}
+
+	child, _ := get(doc, parts[0])
+	switch c := child.(type) {
+	case bson.D:
+		return set(doc, parts[0], unsetPath(c, parts[1]))
+	case []interface{}:
+		rest := strings.SplitN(parts[1], ".", 2)
+		i, err := strconv.Atoi(rest[0])
+		if err != nil || i < 0 || i >= len(c) {
+			return doc
+		}
+
+		if len(rest) == 1 {
+			c[i] = nil
+		} else if sub, ok := c[i].(bson.D); ok {
+			c[i] = unsetPath(sub, rest[1])
+		}
+	}
+
+	return doc
+}
+
+// copyValue returns a deep copy of v, so the stored documents are never
+// shared with the replies or the requests.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		return copyDoc(v)
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = copyValue(e)
+		}
+
+		return l
+	}
+
+	return v
+}
+
+func copyDocs(docs []bson.D) []bson.D {
+	c := make([]bson.D, len(docs))
+	for i, d := range docs {
+		c[i] = copyDoc(d)
+	}
+
+	return c
+}
+
+func copyDoc(doc bson.D) bson.D {
+	c := make(bson.D, len(doc))
+	for i, e := range doc {
+		c[i] = bson.DocElem{Name: e.Name, Value: copyValue(e.Value)}
+	}
+
+	return c
+}
+
+// compare returns -1, 0 or 1 if a is less, equal or greater than b, in the
+// order of mongo.
+func compare(a, b interface{}) int {
+	return query.Compare(a, b)
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+
+	return math.NaN()
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+
+	return 0
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, float64:
+		return true
+	}
+
+	return false
+}
+
+// truthy tells if v is true as a boolean option.
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	}
+
+	if isNumber(v) {
+		return toFloat(v) != 0
+	}
+
+	return true
+}
+
+// typeName is the name of the type of v used in the error messages.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case int, int32:
+		return "int"
+	case int64:
+		return "long"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case bson.D, bson.M:
+		return "object"
+	case []interface{}:
+		return "array"
+	case bool:
+		return "bool"
+	case bson.ObjectId:
+		return "objectId"
+	case time.Time:
+		return "date"
+	}
+
+	return "unknown"
+}
+
+// formatValue formats v for the error messages.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case nil:
+		return "null"
+	case bson.ObjectId:
+		return "ObjectId('" + v.Hex() + "')"
+	}
+
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,391 @@
+package memdb
+
+import (
+	"bytes"
+
+	"github.com/mcuadros/lemondb/protocol"
+	"github.com/mcuadros/lemondb/query"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// VirtualCollection is a collection served by Go code instead of being
+// stored, such as the configuration of an application or the state of a
+// process. The store applies the skip, limit and projection of the queries
+// to the documents returned and keeps the cursors of the clients. The
+// operations not supported return an error, an *Error to reply a code.
+type VirtualCollection interface {
+	// Find returns the documents matching the filter in the sort order.
+	Find(r *FindRequest) (Iter, error)
+	// Count returns the number of documents matching the filter.
+	Count(r *CountRequest) (int, error)
+	// Aggregate returns the result of the pipeline.
+	Aggregate(r *AggregateRequest) (Iter, error)
+	// Insert adds documents, the _id isn't set if missing.
+	Insert(r *InsertRequest) error
+}
+
+// FindRequest is a query, the skip, limit and projection are applied by the
+// store.
+type FindRequest struct {
+	Namespace string
+	Filter    bson.D
+	Sort      bson.D
+}
+
+// CountRequest is a count, the skip and limit are applied by the store.
+type CountRequest struct {
+	Namespace string
+	Filter    bson.D
+}
+
+// AggregateRequest is an aggregate command.
+type AggregateRequest struct {
+	Namespace string
+	Pipeline  []bson.D
+}
+
+// InsertRequest are the documents of an insert command or message.
+type InsertRequest struct {
+	Namespace string
+	Documents []bson.D
+}
+
+// Iter iterates the documents returned by a VirtualCollection, as mgo.Iter
+// does. The store never calls it concurrently.
+type Iter interface {
+	// Next sets doc to the next document, it returns false once there is
+	// none or the iteration failed.
+	Next(doc *bson.D) bool
+	// Close releases the iterator and returns the error that stopped it.
+	Close() error
+}
+
+// NewIter returns an iterator over docs.
+func NewIter(docs []bson.D) Iter {
+	return &sliceIter{docs: docs}
+}
+
+type sliceIter struct {
+	docs []bson.D
+}
+
+func (i *sliceIter) Next(doc *bson.D) bool {
+	if len(i.docs) == 0 {
+		return false
+	}
+
+	*doc, i.docs = i.docs[0], i.docs[1:]
+	return true
+}
+
+func (i *sliceIter) Close() error {
+	return nil
+}
+
+// shapeIter skips, limits and projects the documents of a virtual
+// collection, copying them so the collection can reuse its own. A nil
+// project returns them as they are.
+type shapeIter struct {
+	it          Iter
+	skip, limit int
+	read        int
+	project     func(bson.D) bson.D
+}
+
+func (i *shapeIter) Next(doc *bson.D) bool {
+	for ; i.skip > 0; i.skip-- {
+		var d bson.D
+		if !i.it.Next(&d) {
+			return false
+		}
+	}
+
+	if i.limit > 0 && i.read >= i.limit {
+		return false
+	}
+
+	var d bson.D
+	if !i.it.Next(&d) {
+		return false
+	}
+
+	i.read++
+	if *doc = copyDoc(d); i.project != nil {
+		*doc = i.project(*doc)
+	}
+
+	return true
+}
+
+func (i *shapeIter) Close() error {
+	return i.it.Close()
+}
+
+// Mount serves the virtual collection c as the namespace ns, replacing any
+// other mounted there. The documents stored in ns, if any, are hidden until
+// it is unmounted.
+func (s *Store) Mount(ns string, c VirtualCollection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.virtuals[ns] = c
+}
+
+// Unmount stops serving the virtual collection mounted as ns.
+func (s *Store) Unmount(ns string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.virtuals, ns)
+}
+
+// IsVirtual tells if the message is for a virtual collection or one of its
+// cursors, the messages it can't parse are not.
+func (s *Store) IsVirtual(h *protocol.MsgHeader) bool {
+	ns, command := protocol.ParseRequest(h.OpCode, h.Message)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case h.OpCode == protocol.OpKillCursorsCode:
+		r := &body{b: h.Message}
+		r.int32()
+		n := r.int32()
+		for i := int32(0); i < n && r.err == nil; i++ {
+			if _, ok := s.cursors[r.int64()]; ok && r.err == nil {
+				return true
+			}
+		}
+
+		return false
+	case command == "":
+		_, ok := s.virtuals[ns]
+		return ok
+	}
+
+	db, _ := splitNamespace(ns)
+	q, err := protocol.ReadOpQuery(h, bytes.NewReader(h.Message))
+	if err != nil {
+		return false
+	}
+
+	cmd, err := q.Query.ToBSON()
+	if err != nil || len(cmd) == 0 {
+		return false
+	}
+
+	if cmd[0].Name == "$query" || cmd[0].Name == "query" {
+		if cmd, _ = cmd[0].Value.(bson.D); len(cmd) == 0 {
+			return false
+		}
+	}
+
+	if cmd[0].Name == "getMore" {
+		coll, _ := get(cmd, "collection")
+		name, _ := coll.(string)
+		_, ok := s.virtuals[db+"."+name]
+		return ok
+	}
+
+	name, _ := cmd[0].Value.(string)
+	_, ok := s.virtuals[db+"."+name]
+	return ok
+}
+
+// virtualCommands are the commands the virtual collections support, the
+// others fail on them.
+var virtualCommands = map[string]bool{
+	"find":        true,
+	"count":       true,
+	"aggregate":   true,
+	"insert":      true,
+	"getMore":     true,
+	"killCursors": true,
+}
+
+// checkVirtual fails if the command is for a virtual collection and it
+// doesn't support it.
+func (s *Store) checkVirtual(db string, cmd bson.D) error {
+	ns, err := collectionArg(db, cmd)
+	if err != nil {
+		return nil
+	}
+
+	if _, ok := s.virtuals[ns]; ok && !virtualCommands[cmd[0].Name] {
+		return errorf(codeCommandNotSupportedOnView, "namespace %s is a virtual collection, %s is not supported", ns, cmd[0].Name)
+	}
+
+	return nil
+}
+
+// findIter returns the documents of a query, from a virtual collection or
+// the stored ones.
+func (s *Store) findIter(ns string, q *findQuery) (Iter, error) {
+	v, ok := s.virtuals[ns]
+	if !ok {
+		docs, err := s.find(ns, q)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewIter(docs), nil
+	}
+
+	project, err := compileProjection(q.projection)
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := v.Find(&FindRequest{Namespace: ns, Filter: q.filter, Sort: q.sort})
+	if err != nil {
+		return nil, err
+	}
+
+	return &shapeIter{it: it, skip: q.skip, limit: q.limit, project: project}, nil
+}
+
+// Documents is a read only virtual collection of the documents returned by
+// the function, called on every request. The filters, the sorts and the
+// pipelines are evaluated in memory, the pipelines can have $match, $sort,
+// $skip, $limit, $project and $count stages.
+type Documents func() ([]bson.D, error)
+
+// Find returns the documents matching the filter.
+func (f Documents) Find(r *FindRequest) (Iter, error) {
+	docs, err := f.match(r.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Sort) > 0 {
+		if err := sortDocs(docs, r.Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewIter(docs), nil
+}
+
+// Count returns the number of documents matching the filter.
+func (f Documents) Count(r *CountRequest) (int, error) {
+	docs, err := f.match(r.Filter)
+	return len(docs), err
+}
+
+// Aggregate runs the pipeline on the documents.
+func (f Documents) Aggregate(r *AggregateRequest) (Iter, error) {
+	docs, err := f()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stage := range r.Pipeline {
+		if len(stage) != 1 {
+			return nil, errorf(codeBadValue, "a pipeline stage specification object must contain exactly one field")
+		}
+
+		if docs, err = runStage(docs, stage[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewIter(docs), nil
+}
+
+// Insert fails, the documents are read only.
+func (f Documents) Insert(r *InsertRequest) error {
+	return errorf(codeCommandNotSupportedOnView, "namespace %s is read only", r.Namespace)
+}
+
+func (f Documents) match(filter bson.D) ([]bson.D, error) {
+	docs, err := f()
+	if err != nil {
+		return nil, err
+	}
+
+	return filterDocs(docs, filter)
+}
+
+func filterDocs(docs []bson.D, filter bson.D) ([]bson.D, error) {
+	m, err := query.CompileBSON(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []bson.D
+	for _, d := range docs {
+		if m.MatchBSON(d) {
+			out = append(out, d)
+		}
+	}
+
+	return out, nil
+}
+
+func runStage(docs []bson.D, stage bson.DocElem) ([]bson.D, error) {
+	switch stage.Name {
+	case "$match":
+		filter, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, errorf(codeBadValue, "the match filter must be an expression in an object")
+		}
+
+		return filterDocs(docs, filter)
+	case "$sort":
+		spec, ok := stage.Value.(bson.D)
+		if !ok || len(spec) == 0 {
+			return nil, errorf(codeBadValue, "the $sort key specification must be an object")
+		}
+
+		// the documents returned by the function are not sorted in place.
+		docs = append([]bson.D(nil), docs...)
+		return docs, sortDocs(docs, spec)
+	case "$skip", "$limit":
+		if !isNumber(stage.Value) || toInt64(stage.Value) < 0 {
+			return nil, errorf(codeBadValue, "%s needs a positive number", stage.Name)
+		}
+
+		n := int(toInt64(stage.Value))
+		if n > len(docs) {
+			n = len(docs)
+		}
+
+		if stage.Name == "$skip" {
+			return docs[n:], nil
+		}
+
+		return docs[:n], nil
+	case "$project":
+		spec, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, errorf(codeBadValue, "$project specification must be an object")
+		}
+
+		project, err := compileProjection(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		out := make([]bson.D, len(docs))
+		for i, d := range docs {
+			out[i] = project(copyDoc(d))
+		}
+
+		return out, nil
+	case "$count":
+		name, ok := stage.Value.(string)
+		if !ok || name == "" {
+			return nil, errorf(codeBadValue, "the count field must be a non-empty string")
+		}
+
+		if len(docs) == 0 {
+			return nil, nil
+		}
+
+		return []bson.D{{{Name: name, Value: len(docs)}}}, nil
+	}
+
+	return nil, errorf(codeUnrecognizedStage, "Unrecognized pipeline stage name: '%s'", stage.Name)
+}
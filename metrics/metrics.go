@@ -0,0 +1,357 @@
+// Package metrics keeps counters, gauges and histograms with labels and
+// writes them in the Prometheus text exposition format:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the latency histograms, in seconds.
+var DefaultBuckets = []float64{
+	.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// Registry holds the metrics of the process. Every metric is created once, any
+// later call with the same name returns the existing one, so many proxies can
+// share a metric, each one with its own labels.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the counter called name, creating it if needed.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.family(name, help, "counter", labels, nil)}
+}
+
+// Gauge returns the gauge called name, creating it if needed.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.family(name, help, "gauge", labels, nil)}
+}
+
+// Histogram returns the histogram called name, creating it if needed with
+// the given bucket upper bounds, DefaultBuckets if nil.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	return &Histogram{r.family(name, help, "histogram", labels, buckets)}
+}
+
+func (r *Registry) family(name, help, typ string, labels []string, buckets []float64) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s registered twice with different type or labels", name))
+		}
+
+		return f
+	}
+
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+
+	r.families[name] = f
+	return f
+}
+
+// WriteTo writes every metric in the Prometheus text format, sorted by name
+// and labels.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	var families []*family
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, f := range families {
+		f.write(cw)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics, so the registry can be mounted as /metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ f *family }
+
+// Inc adds one to the counter with the given label values.
+func (c *Counter) Inc(labels ...string) { c.Add(1, labels...) }
+
+// Add adds v to the counter with the given label values.
+func (c *Counter) Add(v float64, labels ...string) {
+	s := c.f.get(labels)
+	s.mu.Lock()
+	s.value += v
+	s.mu.Unlock()
+}
+
+// Value returns the current value for the given label values.
+func (c *Counter) Value(labels ...string) float64 { return c.f.get(labels).load() }
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ f *family }
+
+// Set sets the gauge with the given label values.
+func (g *Gauge) Set(v float64, labels ...string) {
+	s := g.f.get(labels)
+	s.mu.Lock()
+	s.value = v
+	s.mu.Unlock()
+}
+
+// Value returns the current value for the given label values.
+func (g *Gauge) Value(labels ...string) float64 { return g.f.get(labels).load() }
+
+// Histogram counts observations in buckets.
+type Histogram struct{ f *family }
+
+// Observe records v for the given label values.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	s := h.f.get(labels)
+	i := sort.SearchFloat64s(h.f.buckets, v)
+
+	s.mu.Lock()
+	s.counts[i]++
+	s.value += v
+	s.mu.Unlock()
+}
+
+// Count returns how many values were observed for the given label values.
+func (h *Histogram) Count(labels ...string) uint64 {
+	s := h.f.get(labels)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n uint64
+	for _, c := range s.counts {
+		n += c
+	}
+
+	return n
+}
+
+// OtherLabel replaces the values of a label beyond its LabelLimit.
+const OtherLabel = "_other"
+
+// LabelLimit bounds the distinct values of a label coming from the clients,
+// such as the namespaces, so they can't blow up the number of series.
+type LabelLimit struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// NewLabelLimit returns a limit of max distinct values.
+func NewLabelLimit(max int) *LabelLimit {
+	return &LabelLimit{max: max, seen: make(map[string]bool)}
+}
+
+// Value returns v if it was already seen or there is still room for it,
+// otherwise OtherLabel.
+func (l *LabelLimit) Value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen[v] {
+		return v
+	}
+
+	if len(l.seen) >= l.max {
+		return OtherLabel
+	}
+
+	l.seen[v] = true
+	return v
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+
+	mu    sync.Mutex
+	value float64
+	// counts has a count per bucket plus the +Inf one, for histograms.
+	counts []uint64
+}
+
+func (s *series) load() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.value
+}
+
+func (f *family) get(labels []string) *series {
+	if len(labels) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d labels, got %d", f.name, len(f.labels), len(labels)))
+	}
+
+	key := strings.Join(labels, "\xff")
+	f.mu.RLock()
+	s, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s, ok := f.series[key]; ok {
+		return s
+	}
+
+	s = &series{labels: append([]string(nil), labels...)}
+	if f.typ == "histogram" {
+		s.counts = make([]uint64, len(f.buckets)+1)
+	}
+
+	f.series[key] = s
+	return s
+}
+
+func (f *family) write(w io.Writer) {
+	f.mu.RLock()
+	var all []*series
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.RUnlock()
+
+	if len(all) == 0 {
+		return
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labels, "\xff") < strings.Join(all[j].labels, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	for _, s := range all {
+		s.mu.Lock()
+		if f.typ == "histogram" {
+			f.writeHistogram(w, s)
+		} else {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelPairs(s.labels, "", ""), formatFloat(s.value))
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (f *family) writeHistogram(w io.Writer, s *series) {
+	var count uint64
+	for i, c := range s.counts {
+		count += c
+
+		le := math.Inf(1)
+		if i < len(f.buckets) {
+			le = f.buckets[i]
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelPairs(s.labels, "le", formatFloat(le)), count)
+	}
+
+	fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelPairs(s.labels, "", ""), formatFloat(s.value))
+	fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labelPairs(s.labels, "", ""), count)
+}
+
+func (f *family) labelPairs(values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
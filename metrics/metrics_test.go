@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestWriteTo(c *C) {
+	r := NewRegistry()
+	r.Counter("requests_total", "Requests.", "proxy", "op").Add(2, "a", "QUERY")
+	r.Counter("requests_total", "Requests.", "proxy", "op").Inc("a", "INSERT")
+	r.Gauge("clients", "Clients\nconnected.").Set(3)
+
+	h := r.Histogram("duration_seconds", "Duration.", []float64{.1, 1}, "proxy")
+	h.Observe(.05, `b"\`)
+	h.Observe(.5, `b"\`)
+	h.Observe(5, `b"\`)
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, `# HELP clients Clients\nconnected.
+# TYPE clients gauge
+clients 3
+# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{proxy="b\"\\",le="0.1"} 1
+duration_seconds_bucket{proxy="b\"\\",le="1"} 2
+duration_seconds_bucket{proxy="b\"\\",le="+Inf"} 3
+duration_seconds_sum{proxy="b\"\\"} 5.55
+duration_seconds_count{proxy="b\"\\"} 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{proxy="a",op="INSERT"} 1
+requests_total{proxy="a",op="QUERY"} 2
+`)
+
+	c.Assert(h.Count(`b"\`), Equals, uint64(3))
+}
+
+func (s *MetricsSuite) TestRegistryConflict(c *C) {
+	r := NewRegistry()
+	r.Counter("foo", "", "proxy")
+
+	c.Assert(func() { r.Gauge("foo", "", "proxy") }, PanicMatches, "metrics: foo registered twice .*")
+	c.Assert(func() { r.Counter("foo", "") }, PanicMatches, "metrics: foo registered twice .*")
+	c.Assert(func() { r.Counter("foo", "", "proxy").Inc() }, PanicMatches, "metrics: foo expects 1 labels, got 0")
+}
+
+func (s *MetricsSuite) TestServeHTTP(c *C) {
+	r := NewRegistry()
+	r.Counter("foo_total", "Foo.").Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(w.Header().Get("Content-Type"), Equals, "text/plain; version=0.0.4")
+	c.Assert(w.Body.String(), Matches, `(?s).*\nfoo_total 1\n`)
+}
+
+func (s *MetricsSuite) TestLabelLimit(c *C) {
+	l := NewLabelLimit(2)
+	c.Assert(l.Value("a"), Equals, "a")
+	c.Assert(l.Value("b"), Equals, "b")
+	c.Assert(l.Value("c"), Equals, OtherLabel)
+	c.Assert(l.Value("a"), Equals, "a")
+}
@@ -0,0 +1,125 @@
+package middlewares
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/memdb"
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+// defaultSnapshotInterval is how often the snapshot is saved if the interval
+// is not configured.
+const defaultSnapshotInterval = 30 * time.Second
+
+// MemoryMiddleware answers all the messages from an in-memory store, it is a
+// terminal middleware and the backend is never used. The stores are shared
+// by name, so the data survives the reloads.
+type MemoryMiddleware struct {
+	Store *memdb.Store
+	// Snapshot if not empty is the file the store is loaded from on Start
+	// and saved to every SnapshotInterval until Stop.
+	Snapshot         string
+	SnapshotInterval time.Duration
+
+	persister *memdb.Persister
+}
+
+func init() {
+	Register("memory", func(opts Options, next Middleware) (Middleware, error) {
+		if next != nil {
+			return nil, fmt.Errorf("memory must be the last middleware")
+		}
+
+		return newMemoryMiddleware(opts)
+	})
+}
+
+func newMemoryMiddleware(opts Options) (*MemoryMiddleware, error) {
+	name, snapshot, interval := "default", "", defaultSnapshotInterval
+	var unknown []string
+	for k, v := range opts {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("option %s has to be a string", k)
+		}
+
+		switch k {
+		case "name":
+			name = s
+		case "snapshot":
+			snapshot = s
+		case "snapshot_interval":
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid snapshot_interval %q", s)
+			}
+
+			interval = d
+		default:
+			unknown = append(unknown, k)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown options: %s", strings.Join(unknown, ", "))
+	}
+
+	return &MemoryMiddleware{
+		Store:            memdb.Named(name),
+		Snapshot:         snapshot,
+		SnapshotInterval: interval,
+	}, nil
+}
+
+// Start loads the snapshot, if any, and starts saving the store to it.
+func (m *MemoryMiddleware) Start(log logging.Logger) error {
+	if m.Snapshot == "" {
+		return nil
+	}
+
+	interval := m.SnapshotInterval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+
+	log = log.With("snapshot", m.Snapshot)
+	p, err := m.Store.Persist(m.Snapshot, interval, func(err error) {
+		log.Error("error saving snapshot", "err", err)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	m.persister = p
+	return nil
+}
+
+// Stop stops saving the store, it is saved one last time if it is not saved
+// by anyone else.
+func (m *MemoryMiddleware) Stop() error {
+	if m.persister == nil {
+		return nil
+	}
+
+	return m.persister.Stop()
+}
+
+func (m *MemoryMiddleware) Handle(
+	msg protocol.Message,
+	c io.ReadWriter,
+	s io.ReadWriter,
+) error {
+	h, ok := msg.(*protocol.MsgHeader)
+	if !ok {
+		return fmt.Errorf("memory: unexpected message %T", msg)
+	}
+
+	return m.Store.Handle(h, c)
+}
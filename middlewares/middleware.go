@@ -0,0 +1,53 @@
+package middlewares
+
+import (
+	"io"
+
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+// Middleware handles a message from the client, the same interface as
+// proxy.Middleware, it is declared again here since this package can't depend
+// on the proxy.
+type Middleware interface {
+	Handle(m protocol.Message, c io.ReadWriter, s io.ReadWriter) error
+}
+
+// needsBody returns true if the middleware needs the body of the message, any
+// middleware not declaring it with a NeedsBody method is expected to need it.
+func needsBody(m Middleware, h *protocol.MsgHeader) bool {
+	if s, ok := m.(interface {
+		NeedsBody(h *protocol.MsgHeader) bool
+	}); ok {
+		return s.NeedsBody(h)
+	}
+
+	return true
+}
+
+// Service is implemented by the middlewares with work of their own, such as
+// saving snapshots, the same interface as proxy.Service. The middlewares
+// calling a next one start and stop it along with themselves.
+type Service interface {
+	Start(log logging.Logger) error
+	Stop() error
+}
+
+// start starts the middleware if it is a Service.
+func start(m Middleware, log logging.Logger) error {
+	if s, ok := m.(Service); ok {
+		return s.Start(log)
+	}
+
+	return nil
+}
+
+// stop stops the middleware if it is a Service.
+func stop(m Middleware) error {
+	if s, ok := m.(Service); ok {
+		return s.Stop()
+	}
+
+	return nil
+}
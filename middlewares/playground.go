@@ -2,14 +2,24 @@ package middlewares
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 
+	"github.com/mcuadros/lemondb/logging"
 	"github.com/mcuadros/lemondb/protocol"
 )
 
 type PlaygroundMiddleware struct {
-	PrevMiddleware *ProxyMiddleware
+	PrevMiddleware Middleware
+}
+
+func init() {
+	Register("playground", func(opts Options, next Middleware) (Middleware, error) {
+		if err := noOptions(opts); err != nil {
+			return nil, err
+		}
+
+		return &PlaygroundMiddleware{PrevMiddleware: orProxy(next)}, nil
+	})
 }
 
 func (m *PlaygroundMiddleware) Handle(
@@ -20,7 +30,6 @@ func (m *PlaygroundMiddleware) Handle(
 	if msg.GetOpCode() == protocol.OpQueryCode {
 		h := msg.(*protocol.MsgHeader)
 		query, _ := protocol.ReadOpQuery(h, bytes.NewReader(h.Message))
-		fmt.Println(query.String())
 
 		if query.FullCollectionName.String() == "test.foo" {
 			op := protocol.NewOpReplay(query, 1111111)
@@ -33,3 +42,19 @@ func (m *PlaygroundMiddleware) Handle(
 
 	return m.PrevMiddleware.Handle(msg, c, s)
 }
+
+// NeedsBody returns true for the queries, any other message is streamed if the
+// previous middleware allows it.
+func (m *PlaygroundMiddleware) NeedsBody(h *protocol.MsgHeader) bool {
+	return h.OpCode == protocol.OpQueryCode || needsBody(m.PrevMiddleware, h)
+}
+
+// Start starts the previous middleware.
+func (m *PlaygroundMiddleware) Start(log logging.Logger) error {
+	return start(m.PrevMiddleware, log)
+}
+
+// Stop stops the previous middleware.
+func (m *PlaygroundMiddleware) Stop() error {
+	return stop(m.PrevMiddleware)
+}
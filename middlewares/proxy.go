@@ -1,6 +1,7 @@
 package middlewares
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/mcuadros/lemondb/protocol"
@@ -8,6 +9,20 @@ import (
 
 type ProxyMiddleware struct{}
 
+func init() {
+	Register("proxy", func(opts Options, next Middleware) (Middleware, error) {
+		if next != nil {
+			return nil, fmt.Errorf("proxy must be the last middleware")
+		}
+
+		if err := noOptions(opts); err != nil {
+			return nil, err
+		}
+
+		return &ProxyMiddleware{}, nil
+	})
+}
+
 // proxyMessage proxies a message, possibly it's response, and possibly a
 // follow up call.
 func (m *ProxyMiddleware) Handle(
@@ -15,7 +30,7 @@ func (m *ProxyMiddleware) Handle(
 	c io.ReadWriter,
 	s io.ReadWriter,
 ) error {
-	if err := msg.WriteTo(s); err != nil {
+	if _, err := msg.WriteTo(s); err != nil {
 		return err
 	}
 
@@ -28,3 +43,8 @@ func (m *ProxyMiddleware) Handle(
 
 	return nil
 }
+
+// NeedsBody returns false, the messages are proxied without looking into them.
+func (m *ProxyMiddleware) NeedsBody(h *protocol.MsgHeader) bool {
+	return false
+}
@@ -0,0 +1,129 @@
+package middlewares
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Options are the options of a middleware as decoded from the configuration.
+type Options map[string]interface{}
+
+// Factory builds a middleware calling next after it. next is nil for the last
+// middleware of a pipeline, the middlewares that are not terminal are
+// expected to proxy the messages in that case.
+type Factory func(opts Options, next Middleware) (Middleware, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a middleware available by name to the pipelines. It panics
+// if called twice with the same name or if factory is nil.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("middlewares: Register factory is nil")
+	}
+
+	if _, dup := registry[name]; dup {
+		panic("middlewares: Register called twice for " + name)
+	}
+
+	registry[name] = factory
+}
+
+// Names returns the sorted names of the registered middlewares.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// New builds the middleware registered as name.
+func New(name string, opts Options, next Middleware) (Middleware, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown middleware %q", name)
+	}
+
+	return factory(opts, next)
+}
+
+// Step is a middleware of a pipeline, the name it is registered with and its
+// options.
+type Step struct {
+	Type    string
+	Options Options
+}
+
+// NewPipeline chains the middlewares registered with the given names, the
+// first one gets the messages. The messages are proxied after the last one,
+// an empty pipeline just proxies them.
+func NewPipeline(names ...string) (Middleware, error) {
+	steps := make([]Step, len(names))
+	for i, name := range names {
+		steps[i].Type = name
+	}
+
+	return Build(steps)
+}
+
+// Build chains the middlewares of the steps, the same as NewPipeline, with
+// their options.
+func Build(steps []Step) (Middleware, error) {
+	var next Middleware
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if step.Type == "" {
+			return nil, fmt.Errorf("middlewares[%d]: type is required", i)
+		}
+
+		m, err := New(step.Type, step.Options, next)
+		if err != nil {
+			return nil, fmt.Errorf("middlewares[%d] (%s): %s", i, step.Type, err)
+		}
+
+		next = m
+	}
+
+	return orProxy(next), nil
+}
+
+// orProxy returns next, or a ProxyMiddleware at the end of the pipeline.
+func orProxy(next Middleware) Middleware {
+	if next == nil {
+		return &ProxyMiddleware{}
+	}
+
+	return next
+}
+
+// noOptions fails if any option is given, for the middlewares without them.
+func noOptions(opts Options) error {
+	if len(opts) == 0 {
+		return nil
+	}
+
+	var names []string
+	for name := range opts {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return fmt.Errorf("unknown options: %s", strings.Join(names, ", "))
+}
@@ -0,0 +1,177 @@
+package middlewares
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/memdb"
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type RegistrySuite struct{}
+
+var _ = Suite(&RegistrySuite{})
+
+func (s *RegistrySuite) TestNames(c *C) {
+	names := Names()
+	c.Assert(names, DeepEquals, []string{"memory", "playground", "proxy", "schema", "virtual"})
+}
+
+func (s *RegistrySuite) TestRegister(c *C) {
+	Register("test-register", func(opts Options, next Middleware) (Middleware, error) {
+		return &testMiddleware{opts: opts, next: next}, nil
+	})
+	defer unregister("test-register")
+
+	m, err := New("test-register", Options{"foo": "bar"}, &ProxyMiddleware{})
+	c.Assert(err, IsNil)
+	c.Assert(m.(*testMiddleware).opts["foo"], Equals, "bar")
+	c.Assert(m.(*testMiddleware).next, FitsTypeOf, &ProxyMiddleware{})
+}
+
+func (s *RegistrySuite) TestRegisterTwice(c *C) {
+	c.Assert(func() { Register("proxy", nil) }, PanicMatches, ".*factory is nil")
+	c.Assert(func() {
+		Register("proxy", func(Options, Middleware) (Middleware, error) { return nil, nil })
+	}, PanicMatches, ".*called twice for proxy")
+}
+
+func (s *RegistrySuite) TestNewUnknown(c *C) {
+	_, err := New("foo", nil, nil)
+	c.Assert(err, ErrorMatches, `unknown middleware "foo"`)
+}
+
+func (s *RegistrySuite) TestNewOptions(c *C) {
+	_, err := New("schema", Options{"foo": 1, "bar": 2}, nil)
+	c.Assert(err, ErrorMatches, `unknown options: bar, foo`)
+}
+
+func (s *RegistrySuite) TestNewMemory(c *C) {
+	m, err := New("memory", Options{"name": "test-registry"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(m.(*MemoryMiddleware).Store, Equals, memdb.Named("test-registry"))
+
+	_, err = New("memory", nil, &ProxyMiddleware{})
+	c.Assert(err, ErrorMatches, "memory must be the last middleware")
+
+	_, err = New("memory", Options{"snapshot_interval": "foo"}, nil)
+	c.Assert(err, ErrorMatches, `invalid snapshot_interval "foo"`)
+
+	_, err = New("memory", Options{"foo": "bar"}, nil)
+	c.Assert(err, ErrorMatches, "unknown options: foo")
+}
+
+func (s *RegistrySuite) TestMemorySnapshot(c *C) {
+	file := filepath.Join(c.MkDir(), "snapshot.bson")
+	saved := memdb.NewStore()
+	saved.Run("test", bson.D{{Name: "insert", Value: "coll"}, {Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: 1}}}}})
+	c.Assert(saved.SaveFile(file), IsNil)
+
+	m, err := New("memory", Options{"name": "test-snapshot", "snapshot": file, "snapshot_interval": "1h"}, nil)
+	c.Assert(err, IsNil)
+
+	// nothing is loaded until the pipeline is started
+	store := m.(*MemoryMiddleware).Store
+	c.Assert(count(store), Equals, 0)
+
+	pipeline := &SchemaMiddleware{PrevMiddleware: m}
+	c.Assert(pipeline.Start(logging.Discard), IsNil)
+	c.Assert(count(store), Equals, 1)
+
+	store.Run("test", bson.D{{Name: "insert", Value: "coll"}, {Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: 2}}}}})
+	c.Assert(pipeline.Stop(), IsNil)
+
+	loaded := memdb.NewStore()
+	c.Assert(loaded.LoadFile(file), IsNil)
+	c.Assert(count(loaded), Equals, 2)
+}
+
+func count(store *memdb.Store) int {
+	reply := store.Run("test", bson.D{{Name: "count", Value: "coll"}}).Map()
+	return reply["n"].(int)
+}
+
+func (s *RegistrySuite) TestNewVirtual(c *C) {
+	RegisterCollection("test.registered", memdb.Documents(func() ([]bson.D, error) {
+		return nil, nil
+	}))
+	defer delete(collections, "test.registered")
+
+	m, err := New("virtual", Options{"collections": map[interface{}]interface{}{
+		"test.flags": []interface{}{
+			map[interface{}]interface{}{"on": true, "_id": "search"},
+		},
+	}}, nil)
+
+	c.Assert(err, IsNil)
+	v := m.(*VirtualMiddleware)
+	c.Assert(v.Next, FitsTypeOf, &ProxyMiddleware{})
+
+	reply := v.Store.Run("test", bson.D{{Name: "find", Value: "flags"}}).Map()
+	c.Assert(reply["cursor"].(bson.D).Map()["firstBatch"], DeepEquals, []interface{}{
+		bson.D{{Name: "_id", Value: "search"}, {Name: "on", Value: true}},
+	})
+
+	reply = v.Store.Run("test", bson.D{{Name: "count", Value: "registered"}}).Map()
+	c.Assert(reply["n"], Equals, 0)
+
+	_, err = New("virtual", Options{"collections": map[interface{}]interface{}{"test.flags": 1}}, nil)
+	c.Assert(err, ErrorMatches, "collection test.flags has to be a list of documents")
+
+	_, err = New("virtual", Options{"foo": "bar"}, nil)
+	c.Assert(err, ErrorMatches, "unknown options: foo")
+}
+
+func (s *RegistrySuite) TestNewPipeline(c *C) {
+	m, err := NewPipeline("playground", "schema")
+	c.Assert(err, IsNil)
+
+	playground := m.(*PlaygroundMiddleware)
+	schema := playground.PrevMiddleware.(*SchemaMiddleware)
+	c.Assert(schema.PrevMiddleware, FitsTypeOf, &ProxyMiddleware{})
+
+	m, err = NewPipeline()
+	c.Assert(err, IsNil)
+	c.Assert(m, FitsTypeOf, &ProxyMiddleware{})
+}
+
+func (s *RegistrySuite) TestNewPipelineProxyNotLast(c *C) {
+	_, err := NewPipeline("proxy", "schema")
+	c.Assert(err, ErrorMatches, `middlewares\[0\] \(proxy\): proxy must be the last middleware`)
+}
+
+func (s *RegistrySuite) TestBuild(c *C) {
+	m, err := Build([]Step{{Type: "memory", Options: Options{"name": "test-build"}}})
+	c.Assert(err, IsNil)
+	c.Assert(m.(*MemoryMiddleware).Store, Equals, memdb.Named("test-build"))
+
+	_, err = Build([]Step{{Type: "schema"}, {Options: Options{"foo": "bar"}}})
+	c.Assert(err, ErrorMatches, `middlewares\[1\]: type is required`)
+
+	_, err = Build([]Step{{Type: "proxy", Options: Options{"foo": 1}}})
+	c.Assert(err, ErrorMatches, `middlewares\[0\] \(proxy\): unknown options: foo`)
+}
+
+type testMiddleware struct {
+	opts Options
+	next Middleware
+}
+
+func (m *testMiddleware) Handle(protocol.Message, io.ReadWriter, io.ReadWriter) error {
+	return nil
+}
+
+func unregister(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	delete(registry, name)
+}
@@ -4,11 +4,22 @@ import (
 	"bytes"
 	"io"
 
+	"github.com/mcuadros/lemondb/logging"
 	"github.com/mcuadros/lemondb/protocol"
 )
 
 type SchemaMiddleware struct {
-	PrevMiddleware *ProxyMiddleware
+	PrevMiddleware Middleware
+}
+
+func init() {
+	Register("schema", func(opts Options, next Middleware) (Middleware, error) {
+		if err := noOptions(opts); err != nil {
+			return nil, err
+		}
+
+		return &SchemaMiddleware{PrevMiddleware: orProxy(next)}, nil
+	})
 }
 
 func (m *SchemaMiddleware) Handle(
@@ -28,10 +39,27 @@ func (m *SchemaMiddleware) Handle(
 					WriteErrors: []protocol.WriteError{{0, 42, "foo bar"}},
 				})
 
-				return op.WriteTo(c)
+				_, err := op.WriteTo(c)
+				return err
 			}
 		}
 	}
 
 	return m.PrevMiddleware.Handle(msg, c, s)
 }
+
+// NeedsBody returns true for the queries, any other message is streamed if the
+// previous middleware allows it.
+func (m *SchemaMiddleware) NeedsBody(h *protocol.MsgHeader) bool {
+	return h.OpCode == protocol.OpQueryCode || needsBody(m.PrevMiddleware, h)
+}
+
+// Start starts the previous middleware.
+func (m *SchemaMiddleware) Start(log logging.Logger) error {
+	return start(m.PrevMiddleware, log)
+}
+
+// Stop stops the previous middleware.
+func (m *SchemaMiddleware) Stop() error {
+	return stop(m.PrevMiddleware)
+}
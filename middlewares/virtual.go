@@ -0,0 +1,200 @@
+package middlewares
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/memdb"
+	"github.com/mcuadros/lemondb/protocol"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// VirtualMiddleware answers the messages for the virtual collections mounted
+// in its store, the rest are handled by the next middleware. The store does
+// the batching, the cursors, the limits, the skips and the projections.
+type VirtualMiddleware struct {
+	Store *memdb.Store
+	Next  Middleware
+}
+
+var (
+	collectionsMu sync.Mutex
+	collections   = make(map[string]memdb.VirtualCollection)
+)
+
+func init() {
+	Register("virtual", func(opts Options, next Middleware) (Middleware, error) {
+		return newVirtualMiddleware(opts, orProxy(next))
+	})
+}
+
+// RegisterCollection mounts c as the namespace ns in the virtual middlewares
+// built after it is called, the same as Register it is meant to be called
+// before the proxies are started.
+func RegisterCollection(ns string, c memdb.VirtualCollection) {
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+
+	collections[ns] = c
+}
+
+func newVirtualMiddleware(opts Options, next Middleware) (*VirtualMiddleware, error) {
+	store := memdb.NewStore()
+
+	collectionsMu.Lock()
+	for ns, c := range collections {
+		store.Mount(ns, c)
+	}
+	collectionsMu.Unlock()
+
+	var unknown []string
+	for k, v := range opts {
+		if k != "collections" {
+			unknown = append(unknown, k)
+			continue
+		}
+
+		static, err := staticCollections(v)
+		if err != nil {
+			return nil, err
+		}
+
+		for ns, docs := range static {
+			store.Mount(ns, staticDocuments(docs))
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown options: %s", strings.Join(unknown, ", "))
+	}
+
+	return &VirtualMiddleware{Store: store, Next: next}, nil
+}
+
+// staticCollections reads the collections option, the documents of every
+// namespace as decoded from the configuration.
+func staticCollections(v interface{}) (map[string][]bson.D, error) {
+	spec, ok := toBSON(v).(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("option collections has to be a map of namespaces")
+	}
+
+	out := make(map[string][]bson.D, len(spec))
+	for _, e := range spec {
+		list, ok := e.Value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("collection %s has to be a list of documents", e.Name)
+		}
+
+		for _, d := range list {
+			doc, ok := d.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("collection %s has to be a list of documents", e.Name)
+			}
+
+			out[e.Name] = append(out[e.Name], doc)
+		}
+	}
+
+	return out, nil
+}
+
+// toBSON converts the maps of the configuration into documents, with their
+// keys sorted but the _id first.
+func toBSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, v := range v {
+			m[fmt.Sprint(k)] = v
+		}
+
+		return toBSON(m)
+	case map[string]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i] == "_id" || keys[j] == "_id" {
+				return keys[i] == "_id"
+			}
+
+			return keys[i] < keys[j]
+		})
+
+		doc := make(bson.D, len(keys))
+		for i, k := range keys {
+			doc[i] = bson.DocElem{Name: k, Value: toBSON(v[k])}
+		}
+
+		return doc
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = toBSON(e)
+		}
+
+		return out
+	}
+
+	return v
+}
+
+func staticDocuments(docs []bson.D) memdb.Documents {
+	return func() ([]bson.D, error) {
+		return docs, nil
+	}
+}
+
+func (m *VirtualMiddleware) Handle(
+	msg protocol.Message,
+	c io.ReadWriter,
+	s io.ReadWriter,
+) error {
+	h, ok := msg.(*protocol.MsgHeader)
+	if !ok || !m.Store.IsVirtual(h) {
+		return m.Next.Handle(msg, c, s)
+	}
+
+	if err := m.Store.Handle(h, c); err != nil {
+		return err
+	}
+
+	// the cursors of the backend may be killed in the same message, it
+	// ignores the ids it doesn't know.
+	if h.OpCode == protocol.OpKillCursorsCode {
+		return m.Next.Handle(msg, c, s)
+	}
+
+	return nil
+}
+
+// NeedsBody returns true for the messages that may be for a virtual
+// collection, any other message is streamed if the next middleware allows it.
+func (m *VirtualMiddleware) NeedsBody(h *protocol.MsgHeader) bool {
+	switch h.OpCode {
+	case protocol.OpQueryCode, protocol.OpGetMoreCode, protocol.OpKillCursorsCode,
+		protocol.OpInsertCode, protocol.OpUpdateCode, protocol.OpDeleteCode:
+		return true
+	}
+
+	return needsBody(m.Next, h)
+}
+
+// Start starts the next middleware.
+func (m *VirtualMiddleware) Start(log logging.Logger) error {
+	return start(m.Next, log)
+}
+
+// Stop stops the next middleware.
+func (m *VirtualMiddleware) Stop() error {
+	return stop(m.Next)
+}
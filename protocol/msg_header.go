@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
 )
 
 const HeaderLen = 16
@@ -22,7 +23,23 @@ type MsgHeader struct {
 	Message []byte
 }
 
+// ReadMsgHeader reads a whole message, header and body.
 func ReadMsgHeader(r io.Reader) (*MsgHeader, error) {
+	m, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.ReadBody(r); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ReadHeader reads only the standard header of a message, the body is left
+// in the reader.
+func ReadHeader(r io.Reader) (*MsgHeader, error) {
 	var err error
 	m := &MsgHeader{}
 
@@ -44,32 +61,39 @@ func ReadMsgHeader(r io.Reader) (*MsgHeader, error) {
 	}
 
 	m.OpCode = OpCode(op)
+	return m, nil
+}
 
-	l := m.MessageLength - HeaderLen
-	if l > 0 {
-		b := make([]byte, l)
-		if _, err := io.ReadFull(r, b); err != nil {
-			return nil, err
-		}
-
-		m.Message = b
+// BodyLen returns the length of the message body.
+func (m *MsgHeader) BodyLen() int64 {
+	l := int64(m.MessageLength) - HeaderLen
+	if l < 0 {
+		return 0
 	}
 
-	return m, nil
+	return l
 }
 
-func (m *MsgHeader) WriteTo(w io.Writer) error {
-	if _, err := w.Write(m.toWire()); err != nil {
-		return err
+// ReadBody reads the body of the message from r into Message.
+func (m *MsgHeader) ReadBody(r io.Reader) error {
+	l := m.BodyLen()
+	if l == 0 {
+		return nil
 	}
 
-	if _, err := w.Write(m.Message); err != nil {
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
 		return err
 	}
 
+	m.Message = b
 	return nil
 }
 
+func (m *MsgHeader) WriteTo(w io.Writer) (int64, error) {
+	return writeAll(w, m.toWire(), m.Message)
+}
+
 // ToWire converts the MsgHeader to the wire protocol
 func (m MsgHeader) toWire() []byte {
 	w := bytes.NewBuffer([]byte{})
@@ -82,6 +106,55 @@ func (m MsgHeader) toWire() []byte {
 	return w.Bytes()
 }
 
+// Namespace returns the full collection name of the message, an empty string
+// is returned for the messages without one or if the body was not read.
+func (m *MsgHeader) Namespace() string {
+	ns, _ := ParseRequest(m.OpCode, m.Message)
+	return ns
+}
+
+// ParseRequest returns the full collection name of a message and, for the
+// commands sent as an OP_QUERY on the $cmd collection, the command name. The
+// body can be just a prefix of the message body, any value not fully in it
+// is returned empty.
+func ParseRequest(op OpCode, body []byte) (ns, command string) {
+	switch op {
+	case OpQueryCode, OpInsertCode, OpUpdateCode, OpDeleteCode, OpGetMoreCode:
+	default:
+		return "", ""
+	}
+
+	// every one of them starts with an int32 followed by the namespace.
+	if len(body) < 5 {
+		return "", ""
+	}
+
+	i := bytes.IndexByte(body[4:], 0)
+	if i < 0 {
+		return "", ""
+	}
+
+	ns = string(body[4 : 4+i])
+	if op != OpQueryCode || !strings.HasSuffix(ns, ".$cmd") {
+		return ns, ""
+	}
+
+	// numberToSkip and numberToReturn, then the document length and the type
+	// of its first element, followed by the element name.
+	doc := body[4+i+1:]
+	if len(doc) < 8+4+1 || doc[12] == 0 {
+		return ns, ""
+	}
+
+	name := doc[13:]
+	j := bytes.IndexByte(name, 0)
+	if j < 0 {
+		return ns, ""
+	}
+
+	return ns, string(name[:j])
+}
+
 func (m *MsgHeader) GetOpCode() OpCode {
 	return m.OpCode
 }
@@ -29,6 +29,58 @@ func (s *ProtocolSuite) TestReadMsgHeader(c *C) {
 	c.Assert(h.OpCode, Equals, OpQueryCode)
 }
 
+func (s *ProtocolSuite) TestReadHeader(c *C) {
+	fixture, _ := hex.DecodeString("880000009900000000000000d4070000")
+	fixture = append(fixture, bytes.Repeat([]byte("0"), 120)...)
+
+	r := bytes.NewReader(fixture)
+
+	h, err := ReadHeader(r)
+	c.Assert(err, IsNil)
+	c.Assert(h.MessageLength, Equals, int32(136))
+	c.Assert(h.BodyLen(), Equals, int64(120))
+	c.Assert(h.Message, HasLen, 0)
+	c.Assert(r.Len(), Equals, 120)
+
+	err = h.ReadBody(r)
+	c.Assert(err, IsNil)
+	c.Assert(h.Message, HasLen, 120)
+	c.Assert(r.Len(), Equals, 0)
+}
+
+func (s *ProtocolSuite) TestMsgHeader_Namespace(c *C) {
+	h := &MsgHeader{OpCode: OpQueryCode, Message: []byte("\x00\x00\x00\x00test.foo\x00\x05")}
+	c.Assert(h.Namespace(), Equals, "test.foo")
+
+	h.OpCode = OpReplyCode
+	c.Assert(h.Namespace(), Equals, "")
+
+	h = &MsgHeader{OpCode: OpQueryCode}
+	c.Assert(h.Namespace(), Equals, "")
+
+	h = &MsgHeader{OpCode: OpInsertCode, Message: []byte("\x00\x00\x00\x00test")}
+	c.Assert(h.Namespace(), Equals, "")
+}
+
+func (s *ProtocolSuite) TestParseRequest(c *C) {
+	cmd := "\x00\x00\x00\x00admin.$cmd\x00\x00\x00\x00\x00\xff\xff\xff\xff\x13\x00\x00\x00\x10isMaster\x00\x01\x00\x00\x00\x00"
+	ns, command := ParseRequest(OpQueryCode, []byte(cmd))
+	c.Assert(ns, Equals, "admin.$cmd")
+	c.Assert(command, Equals, "isMaster")
+
+	ns, command = ParseRequest(OpQueryCode, []byte(cmd[:30]))
+	c.Assert(ns, Equals, "admin.$cmd")
+	c.Assert(command, Equals, "")
+
+	ns, command = ParseRequest(OpQueryCode, []byte("\x00\x00\x00\x00test.foo\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05\x00\x00\x00\x00"))
+	c.Assert(ns, Equals, "test.foo")
+	c.Assert(command, Equals, "")
+
+	ns, command = ParseRequest(OpReplyCode, []byte(cmd))
+	c.Assert(ns, Equals, "")
+	c.Assert(command, Equals, "")
+}
+
 func (s *ProtocolSuite) TestMsgHeader_toWire(c *C) {
 	h := &MsgHeader{
 		MessageLength: 136,
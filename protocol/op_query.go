@@ -54,19 +54,11 @@ func ReadOpQuery(h *MsgHeader, r io.Reader) (*OpQuery, error) {
 	return op, nil
 }
 
-func (op *OpQuery) WriteTo(w io.Writer) error {
+func (op *OpQuery) WriteTo(w io.Writer) (int64, error) {
 	content := op.toWire()
 	op.MsgHeader.MessageLength = int32(len(content)) + HeaderLen
 
-	if _, err := w.Write(op.MsgHeader.toWire()); err != nil {
-		return err
-	}
-
-	if _, err := w.Write(content); err != nil {
-		return err
-	}
-
-	return nil
+	return writeAll(w, op.MsgHeader.toWire(), content)
 }
 
 // toWire converts the MsgHeader to the wire protocol
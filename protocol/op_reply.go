@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 
 	"gopkg.in/mgo.v2/bson"
@@ -37,6 +38,25 @@ func NewOpReplay(req Message, requestID int32) *OpReply {
 	}
 }
 
+// Response flags of an OpReply:
+// http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/#op-reply
+const (
+	CursorNotFound   = int32(1)
+	QueryFailure     = int32(2)
+	ShardConfigStale = int32(4)
+	AwaitCapable     = int32(8)
+)
+
+// NewOpReplyError returns an OpReply to req flagged as QueryFailure and with
+// an ErrorResult as only document.
+func NewOpReplyError(req Message, requestID int32, code int32, msg string) *OpReply {
+	op := NewOpReplay(req, requestID)
+	op.ResponseFlags = QueryFailure
+	op.AddDocument(&ErrorResult{Err: msg, Message: msg, Code: code})
+
+	return op
+}
+
 func ReadOpReply(h *MsgHeader, r io.Reader) (*OpReply, error) {
 	var err error
 	op := &OpReply{MsgHeader: h}
@@ -56,14 +76,25 @@ func ReadOpReply(h *MsgHeader, r io.Reader) (*OpReply, error) {
 		return nil, err
 	}
 
-	op.Documents = make([]Document, op.NumberReturned)
+	if op.NumberReturned < 0 {
+		return nil, fmt.Errorf("protocol: invalid number of documents %d", op.NumberReturned)
+	}
+
+	// the number of documents comes from the wire, so the slice grows as
+	// they are read instead of being allocated upfront.
+	op.Documents = make([]Document, 0)
 	for i := 0; i < int(op.NumberReturned); i++ {
 		var doc Document
-		if err = readDocument(r, &doc); err != nil && err != io.EOF {
+		err = readDocument(r, &doc)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
 			return nil, err
 		}
 
-		op.Documents[i] = doc
+		op.Documents = append(op.Documents, doc)
 	}
 
 	return op, nil
@@ -80,19 +111,11 @@ func (op *OpReply) AddDocument(d interface{}) error {
 	return nil
 }
 
-func (op *OpReply) WriteTo(w io.Writer) error {
+func (op *OpReply) WriteTo(w io.Writer) (int64, error) {
 	content := op.toWire()
 	op.MsgHeader.MessageLength = int32(len(content)) + HeaderLen
 
-	if _, err := w.Write(op.MsgHeader.toWire()); err != nil {
-		return err
-	}
-
-	if _, err := w.Write(content); err != nil {
-		return err
-	}
-
-	return nil
+	return writeAll(w, op.MsgHeader.toWire(), content)
 }
 
 // toWire converts the MsgHeader to the wire protocol
@@ -17,7 +17,7 @@ func (s *ProtocolSuite) TestNewOpReplay(c *C) {
 	op.AddDocument(map[string]string{"foo": "bar"})
 
 	b := bytes.NewBuffer([]byte{})
-	err := op.WriteTo(b)
+	_, err := op.WriteTo(b)
 	c.Assert(err, IsNil)
 	c.Assert(hex.EncodeToString(b.Bytes()), Equals, fixtureOpReplyWithHeader)
 }
@@ -39,3 +39,24 @@ func (s *ProtocolSuite) TestOpReply_FromWire(c *C) {
 
 	c.Assert(hex.EncodeToString(op.toWire()), Equals, fixtureOpReply)
 }
+
+func (s *ProtocolSuite) TestReadOpReplyInvalidCount(c *C) {
+	fixture := []byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff")
+	_, err := ReadOpReply(&MsgHeader{}, bytes.NewReader(fixture))
+	c.Assert(err, ErrorMatches, "protocol: invalid number of documents -1")
+}
+
+func (s *ProtocolSuite) TestNewOpReplyError(c *C) {
+	op := NewOpReplyError(&MsgHeader{RequestID: 198}, 42, 9001, "foo")
+	c.Assert(op.ResponseFlags, Equals, QueryFailure)
+	c.Assert(op.MsgHeader.ResponseTo, Equals, int32(198))
+	c.Assert(op.MsgHeader.RequestID, Equals, int32(42))
+	c.Assert(op.Documents, HasLen, 1)
+
+	b, err := op.Documents[0].ToBSON()
+	c.Assert(err, IsNil)
+	c.Assert(b.Map()["ok"], Equals, 0)
+	c.Assert(b.Map()["$err"], Equals, "foo")
+	c.Assert(b.Map()["errmsg"], Equals, "foo")
+	c.Assert(b.Map()["code"], Equals, 9001)
+}
@@ -66,7 +66,7 @@ const (
 )
 
 type Message interface {
-	WriteTo(w io.Writer) error
+	WriteTo(w io.Writer) (int64, error)
 	GetOpCode() OpCode
 	GetMsgHeader() *MsgHeader
 	String() string
@@ -107,6 +107,15 @@ type WriteResult struct {
 	WriteErrors   []WriteError `bson:"writeErrors"`
 }
 
+// ErrorResult is the document returned for failed queries and commands, it
+// fills both the legacy $err field and the errmsg used by commands.
+type ErrorResult struct {
+	Result  int32  `bson:"ok"`
+	Err     string `bson:"$err"`
+	Message string `bson:"errmsg"`
+	Code    int32  `bson:"code"`
+}
+
 type WriteError struct {
 	Index   int32
 	Code    int32
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// StreamedMessage is a message whose body has not been read, instead it is
+// copied straight from Body when the message is written.
+type StreamedMessage struct {
+	*MsgHeader
+	// Body is the reader holding the body, only MsgHeader.BodyLen bytes are
+	// read from it.
+	Body io.Reader
+
+	consumed int64
+}
+
+// WriteTo writes the header and streams the body to w, it can be called
+// only once.
+func (m *StreamedMessage) WriteTo(w io.Writer) (int64, error) {
+	written, err := writeAll(w, m.MsgHeader.toWire())
+	if err != nil {
+		return written, err
+	}
+
+	n := m.BodyLen() - m.consumed
+	m.consumed = m.BodyLen()
+
+	copied, err := copyN(w, m.Body, n)
+	return written + copied, err
+}
+
+// Discard reads and drops the part of the body not written yet, so the next
+// message can be read from Body.
+func (m *StreamedMessage) Discard() error {
+	n := m.BodyLen() - m.consumed
+	m.consumed = m.BodyLen()
+	if n == 0 {
+		return nil
+	}
+
+	_, err := copyN(ioutil.Discard, m.Body, n)
+	return err
+}
@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *ProtocolSuite) TestStreamedMessage_WriteTo(c *C) {
+	h := &MsgHeader{MessageLength: HeaderLen + 3, RequestID: 42, OpCode: OpInsertCode}
+	r := bytes.NewBufferString("foobar")
+
+	m := &StreamedMessage{MsgHeader: h, Body: r}
+
+	var w bytes.Buffer
+	_, err := m.WriteTo(&w)
+	c.Assert(err, IsNil)
+	c.Assert(w.Bytes()[:HeaderLen], DeepEquals, h.toWire())
+	c.Assert(w.String()[HeaderLen:], Equals, "foo")
+	c.Assert(r.String(), Equals, "bar")
+
+	c.Assert(m.Discard(), IsNil)
+	c.Assert(r.String(), Equals, "bar")
+}
+
+func (s *ProtocolSuite) TestStreamedMessage_Discard(c *C) {
+	h := &MsgHeader{MessageLength: HeaderLen + 3, OpCode: OpInsertCode}
+	r := bytes.NewBufferString("foobar")
+
+	m := &StreamedMessage{MsgHeader: h, Body: r}
+	c.Assert(m.Discard(), IsNil)
+	c.Assert(r.String(), Equals, "bar")
+}
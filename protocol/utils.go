@@ -5,23 +5,123 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"net"
+	"sync"
 )
 
 var errWrite = errors.New("incorrect number of bytes written")
 
-// copyMessage copies reads & writes an entire message.
+// CopyMessage copies reads & writes an entire message, the body is streamed
+// so only a small buffer is used no matter the message size.
 func CopyMessage(w io.Writer, r io.Reader) error {
-	h, err := ReadMsgHeader(r)
+	h, err := ReadHeader(r)
 	if err != nil {
 		return err
 	}
-	if err := h.WriteTo(w); err != nil {
-		return err
-	}
 
+	m := &StreamedMessage{MsgHeader: h, Body: r}
+	_, err = m.WriteTo(w)
 	return err
 }
 
+// copyBufferSize is the size of the buffers used to stream message bodies.
+const copyBufferSize = 16 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} { return make([]byte, copyBufferSize) },
+}
+
+// TCPWrapper is implemented by the wrappers of a TCP connection, such as the
+// proxy clients, so the bodies copied between two TCP connections go straight
+// from one to the other, spliced by the kernel.
+type TCPWrapper interface {
+	// TCPConn returns the connection wrapped, nil if it is not a TCP one.
+	TCPConn() *net.TCPConn
+	// Buffered returns the number of bytes read from the connection but not
+	// from the wrapper, they are read from the wrapper before the connection.
+	Buffered() int
+	// Spliced counts the bytes read from or written to the connection
+	// without the wrapper.
+	Spliced(read, written int64)
+}
+
+// copyN copies n bytes from r to w. Between two TCP connections, or their
+// wrappers, the bytes are spliced with io.CopyN, else a pooled buffer is used.
+func copyN(w io.Writer, r io.Reader, n int64) (int64, error) {
+	src, dst := tcpConn(r), tcpConn(w)
+	if src == nil || dst == nil {
+		return copyBuffer(w, r, n)
+	}
+
+	var written int64
+	if wr, ok := r.(TCPWrapper); ok && wr.Buffered() > 0 {
+		buffered := int64(wr.Buffered())
+		if buffered > n {
+			buffered = n
+		}
+
+		var err error
+		if written, err = copyBuffer(w, r, buffered); err != nil {
+			return written, err
+		}
+	}
+
+	spliced, err := io.CopyN(dst, src, n-written)
+	if wr, ok := r.(TCPWrapper); ok {
+		wr.Spliced(spliced, 0)
+	}
+
+	if ww, ok := w.(TCPWrapper); ok {
+		ww.Spliced(0, spliced)
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return written + spliced, err
+}
+
+func tcpConn(v interface{}) *net.TCPConn {
+	switch c := v.(type) {
+	case *net.TCPConn:
+		return c
+	case TCPWrapper:
+		return c.TCPConn()
+	}
+
+	return nil
+}
+
+// copyBuffer copies n bytes from r to w using a pooled buffer.
+func copyBuffer(w io.Writer, r io.Reader, n int64) (int64, error) {
+	buf := copyBuffers.Get().([]byte)
+	defer copyBuffers.Put(buf)
+
+	// hiding any ReadFrom method of w, it would allocate its own buffer, the
+	// copies that can be spliced are done by copyN.
+	written, err := io.CopyBuffer(struct{ io.Writer }{w}, io.LimitReader(r, n), buf)
+	if err == nil && written < n {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return written, err
+}
+
+// writeAll writes the parts of a message to w, returning the bytes written.
+func writeAll(w io.Writer, parts ...[]byte) (int64, error) {
+	var written int64
+	for _, p := range parts {
+		n, err := w.Write(p)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
 func readDocument(r io.Reader, d *Document) error {
 	var size int32
 	if err := readInt32(r, &size); err != nil {
@@ -1,9 +1,11 @@
 package protocol
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"io"
+	"net"
 
 	. "gopkg.in/check.v1"
 )
@@ -109,3 +111,108 @@ type testWriter struct {
 }
 
 func (t testWriter) Write(b []byte) (int, error) { return t.write(b) }
+
+func (s *ProtocolSuite) TestCopyMessageLarge(c *C) {
+	body := bytes.Repeat([]byte("foo"), 1024*1024)
+	msg := MsgHeader{MessageLength: int32(HeaderLen + len(body)), RequestID: 42}
+	r := bytes.NewBuffer(append(msg.toWire(), body...))
+	r.WriteString("next")
+
+	var w bytes.Buffer
+	err := CopyMessage(&w, r)
+	c.Assert(err, IsNil)
+	c.Assert(w.Len(), Equals, HeaderLen+len(body))
+	c.Assert(bytes.Equal(w.Bytes()[HeaderLen:], body), Equals, true)
+	c.Assert(r.String(), Equals, "next")
+}
+
+func (s *ProtocolSuite) TestCopyMessageShortBody(c *C) {
+	msg := MsgHeader{MessageLength: HeaderLen + 10}
+	r := bytes.NewBuffer(append(msg.toWire(), "foo"...))
+
+	var w bytes.Buffer
+	err := CopyMessage(&w, r)
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+}
+
+func (s *ProtocolSuite) TestCopyMessageSpliced(c *C) {
+	src, dst := tcpPair(c), tcpPair(c)
+	defer src[0].Close()
+	defer src[1].Close()
+	defer dst[0].Close()
+	defer dst[1].Close()
+
+	body := bytes.Repeat([]byte("foo"), 64*1024)
+	msg := MsgHeader{MessageLength: int32(HeaderLen + len(body)), RequestID: 42}
+	go src[0].Write(append(msg.toWire(), body...))
+
+	r := &testTCPWrapper{conn: src[1], reader: bufio.NewReaderSize(src[1], 1024)}
+	_, err := r.reader.Peek(HeaderLen + 10)
+	c.Assert(err, IsNil)
+
+	w := &testTCPWrapper{conn: dst[0]}
+	done := make(chan error, 1)
+	go func() { done <- CopyMessage(w, r) }()
+
+	out := make([]byte, HeaderLen+len(body))
+	_, err = io.ReadFull(dst[1], out)
+	c.Assert(err, IsNil)
+	c.Assert(<-done, IsNil)
+	c.Assert(bytes.Equal(out[HeaderLen:], body), Equals, true)
+
+	// the bytes buffered are read through the wrapper, the rest spliced.
+	c.Assert(r.splicedRead > 0, Equals, true)
+	c.Assert(r.read+r.splicedRead, Equals, int64(HeaderLen+len(body)))
+	c.Assert(w.written, Equals, r.read)
+	c.Assert(w.splicedWritten, Equals, r.splicedRead)
+}
+
+// testTCPWrapper wraps a TCP connection with a buffer, as the proxy clients.
+type testTCPWrapper struct {
+	conn   *net.TCPConn
+	reader *bufio.Reader
+
+	read, written               int64
+	splicedRead, splicedWritten int64
+}
+
+func (w *testTCPWrapper) Read(b []byte) (int, error) {
+	n, err := w.reader.Read(b)
+	w.read += int64(n)
+	return n, err
+}
+
+func (w *testTCPWrapper) Write(b []byte) (int, error) {
+	n, err := w.conn.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *testTCPWrapper) TCPConn() *net.TCPConn { return w.conn }
+
+func (w *testTCPWrapper) Buffered() int {
+	if w.reader == nil {
+		return 0
+	}
+
+	return w.reader.Buffered()
+}
+
+func (w *testTCPWrapper) Spliced(read, written int64) {
+	w.splicedRead += read
+	w.splicedWritten += written
+}
+
+func tcpPair(c *C) [2]*net.TCPConn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	c.Assert(err, IsNil)
+
+	server, err := l.Accept()
+	c.Assert(err, IsNil)
+
+	return [2]*net.TCPConn{client.(*net.TCPConn), server.(*net.TCPConn)}
+}
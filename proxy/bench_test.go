@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+func BenchmarkProxy_RoundTrip(b *testing.B) {
+	p := newPipeProxy(echoBackend)
+	if err := p.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkRoundTrip(b, conn)
+	}
+}
+
+func BenchmarkProxy_RoundTripParallel(b *testing.B) {
+	p := newPipeProxy(echoBackend)
+	if err := p.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer p.Stop()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("tcp", p.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+
+		for pb.Next() {
+			benchmarkRoundTrip(b, conn)
+		}
+	})
+}
+
+// BenchmarkProxy_ReadMessage measures the read loop of a client alone, without
+// the network or the backend, only the message is allocated and no goroutine
+// is started.
+func BenchmarkProxy_ReadMessage(b *testing.B) {
+	p := &Proxy{Log: logging.Discard}
+	p.init()
+
+	wire := bytes.NewBuffer(nil)
+	if _, err := benchmarkQuery.WriteTo(wire); err != nil {
+		b.Fatal(err)
+	}
+
+	c := newClient(&repeatConn{msg: wire.Bytes()}, p.log)
+	c.reader = bufio.NewReaderSize(c.Conn, clientReadBufferSize)
+	goroutines := runtime.NumGoroutine()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, _, _, err := p.readMessage(c)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if err := discardBody(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+	if n := runtime.NumGoroutine(); n > goroutines {
+		b.Fatalf("%d goroutines started reading the messages", n-goroutines)
+	}
+}
+
+// repeatConn is a connection reading the same message forever.
+type repeatConn struct {
+	net.Conn
+	msg []byte
+	off int
+}
+
+func (c *repeatConn) Read(b []byte) (int, error) {
+	n := copy(b, c.msg[c.off:])
+	c.off = (c.off + n) % len(c.msg)
+	return n, nil
+}
+
+func (c *repeatConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+}
+
+func (c *repeatConn) SetDeadline(time.Time) error     { return nil }
+func (c *repeatConn) SetReadDeadline(time.Time) error { return nil }
+func (c *repeatConn) Close() error                    { return nil }
+
+var benchmarkQuery = &protocol.MsgHeader{
+	MessageLength: protocol.HeaderLen + 64,
+	OpCode:        protocol.OpQueryCode,
+	Message:       make([]byte, 64),
+}
+
+func benchmarkRoundTrip(b *testing.B, conn net.Conn) {
+	if _, err := benchmarkQuery.WriteTo(conn); err != nil {
+		b.Fatal(err)
+	}
+
+	if _, err := protocol.ReadMsgHeader(conn); err != nil {
+		b.Fatal(err)
+	}
+}
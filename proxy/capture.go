@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/mcuadros/lemondb/capture"
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+// captureClient is handed to the middleware instead of the client while a
+// message is captured, keeping a copy of everything written to the client.
+type captureClient struct {
+	*Client
+	reply bytes.Buffer
+}
+
+func (c *captureClient) Write(b []byte) (int, error) {
+	n, err := c.Client.Write(b)
+	c.reply.Write(b[:n])
+	return n, err
+}
+
+// handleCapture handles a message whose body was fully read and records it
+// along with the reply.
+func (p *Proxy) handleCapture(mw Middleware, h *protocol.MsgHeader, c *Client, s net.Conn, start time.Time) error {
+	var req bytes.Buffer
+	h.WriteTo(&req)
+
+	cc := &captureClient{Client: c}
+	err := mw.Handle(h, cc, s)
+
+	rec := &capture.Record{
+		Time:       start,
+		Proxy:      p.Name,
+		ConnID:     c.id,
+		ClientAddr: c.RemoteAddr().String(),
+		Request:    req.Bytes(),
+		Reply:      cc.reply.Bytes(),
+		Latency:    time.Since(start),
+	}
+
+	if err := p.Capture.Record(rec); err != nil {
+		c.log.Debug("message not captured", "err", err)
+	}
+
+	return err
+}
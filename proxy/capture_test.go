@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/mcuadros/lemondb/capture"
+
+	. "gopkg.in/check.v1"
+)
+
+type CaptureSuite struct{}
+
+var _ = Suite(&CaptureSuite{})
+
+func (s *CaptureSuite) TestProxy_Capture(c *C) {
+	cpt := &capture.Capture{Dir: c.MkDir()}
+	c.Assert(cpt.Start(capture.Options{}), IsNil)
+
+	p := newPipeProxy(echoBackend)
+	p.Name = "foo"
+	p.Capture = cpt
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	writeTestQuery(c, conn)
+
+	// the message is recorded after the reply is written.
+	for i := 0; i < 100 && cpt.Status().Records == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status := cpt.Status()
+	c.Assert(status.Records, Equals, uint64(1))
+	c.Assert(cpt.Stop(), IsNil)
+
+	writeTestQuery(c, conn)
+
+	f, err := os.Open(status.File)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	r, err := capture.NewReader(f)
+	c.Assert(err, IsNil)
+
+	rec, err := r.Next()
+	c.Assert(err, IsNil)
+	c.Assert(rec.Proxy, Equals, "foo")
+	c.Assert(rec.ClientAddr, Equals, conn.LocalAddr().String())
+	c.Assert(rec.ConnID, Not(Equals), uint64(0))
+	c.Assert(rec.RequestHeader().Message, DeepEquals, []byte("foo"))
+	c.Assert(rec.ReplyHeader().Message, DeepEquals, []byte("foo"))
+
+	_, err = r.Next()
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *CaptureSuite) TestProxy_CaptureFilter(c *C) {
+	cpt := &capture.Capture{Dir: c.MkDir()}
+	c.Assert(cpt.Start(capture.Options{Namespaces: []string{"test.*"}}), IsNil)
+	defer cpt.Stop()
+
+	p := newPipeProxy(echoBackend)
+	p.Capture = cpt
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	writeTestQuery(c, conn)
+	c.Assert(cpt.Status().Records, Equals, uint64(0))
+}
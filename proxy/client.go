@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+// lastClientID is the id of the last accepted client, of any proxy.
+var lastClientID uint64
+
+// Client is a client connection accepted by the proxy. It is handed to the
+// middlewares as the client io.ReadWriter, so they can find out who is on the
+// other side. Since the middlewares should not depend on this package they
+// are expected to use an interface, as example:
+//
+//	if id, ok := c.(interface{ Subject() string }); ok {
+//		allowed = id.Subject() == "CN=reporting"
+//	}
+type Client struct {
+	net.Conn
+	id        uint64
+	connected time.Time
+	log       logging.Logger
+	tls       *tls.ConnectionState
+	server    net.Conn
+	reader    *bufio.Reader
+
+	// received and sent count the bytes read from and written to the client,
+	// reported up to the values in the last call to traffic.
+	received, sent             uint64
+	reportedRecv, reportedSent uint64
+
+	mu   sync.Mutex
+	idle bool
+	// op, current and opStarted describe the message being handled.
+	op        protocol.OpCode
+	current   request
+	opStarted time.Time
+	user      string
+}
+
+func newClient(c net.Conn, log logging.Logger) *Client {
+	id := atomic.AddUint64(&lastClientID, 1)
+	return &Client{
+		Conn:      c,
+		id:        id,
+		connected: time.Now(),
+		log:       log.With("conn_id", id),
+	}
+}
+
+// ID returns the id of the connection, unique in the process.
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
+// Read reads from the connection through the client buffer.
+func (c *Client) Read(b []byte) (n int, err error) {
+	if c.reader == nil {
+		n, err = c.Conn.Read(b)
+	} else {
+		n, err = c.reader.Read(b)
+	}
+
+	atomic.AddUint64(&c.received, uint64(n))
+	return n, err
+}
+
+// Write writes to the connection.
+func (c *Client) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.sent, uint64(n))
+	return n, err
+}
+
+// TCPConn returns the connection if it is a TCP one, so the message bodies
+// can be spliced to and from the server.
+func (c *Client) TCPConn() *net.TCPConn {
+	tc, _ := c.Conn.(*net.TCPConn)
+	return tc
+}
+
+// Buffered returns the number of bytes read from the connection but not from
+// the client yet.
+func (c *Client) Buffered() int {
+	if c.reader == nil {
+		return 0
+	}
+
+	return c.reader.Buffered()
+}
+
+// Spliced counts the bytes copied straight from and to the connection.
+func (c *Client) Spliced(read, written int64) {
+	atomic.AddUint64(&c.received, uint64(read))
+	atomic.AddUint64(&c.sent, uint64(written))
+}
+
+// traffic returns the bytes received and sent since the previous call.
+func (c *Client) traffic() (received, sent uint64) {
+	recv, snt := atomic.LoadUint64(&c.received), atomic.LoadUint64(&c.sent)
+	received, sent = recv-c.reportedRecv, snt-c.reportedSent
+	c.reportedRecv, c.reportedSent = recv, snt
+
+	return received, sent
+}
+
+// peekRequest looks for the namespace and command of a message whose header
+// was just read, without consuming the body.
+func (c *Client) peekRequest(h *protocol.MsgHeader) request {
+	n := h.BodyLen()
+	if n > requestPeekSize {
+		n = requestPeekSize
+	}
+
+	body, _ := c.reader.Peek(int(n))
+
+	var r request
+	r.ns, r.command = protocol.ParseRequest(h.OpCode, body)
+	r.user = authUser(h, body, r)
+	return r
+}
+
+// waitIdle marks the client as idle for up to timeout, false is returned if
+// the proxy is already closed.
+func (c *Client) waitIdle(closed <-chan struct{}, timeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-closed:
+		return false
+	default:
+	}
+
+	c.idle = true
+	c.SetReadDeadline(time.Now().Add(timeout))
+	return true
+}
+
+// wakeUp marks the client as busy, giving it timeout to read the message.
+func (c *Client) wakeUp(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.idle = false
+	c.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// wakeUpIfIdle makes an idle client stop waiting for a message.
+func (c *Client) wakeUpIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.idle {
+		c.SetReadDeadline(timeInPast)
+	}
+}
+
+// Subject returns the subject of the certificate presented by the client, an
+// empty string is returned if the connection is not TLS or the client didn't
+// present any certificate.
+func (c *Client) Subject() string {
+	if c.tls == nil || len(c.tls.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return c.tls.PeerCertificates[0].Subject.String()
+}
+
+// ConnectionState returns the state of the TLS connection, ok is false if the
+// client is not using TLS.
+func (c *Client) ConnectionState() (state tls.ConnectionState, ok bool) {
+	if c.tls == nil {
+		return state, false
+	}
+
+	return *c.tls, true
+}
+
+// handshake reads the PROXY protocol header and completes the TLS handshake,
+// if any, so the client address and certificate are known before the first
+// message is handled.
+func (c *Client) handshake() error {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		if pc, ok := c.Conn.(*proxyProtoConn); ok {
+			return pc.readHeader()
+		}
+
+		return nil
+	}
+
+	// the PROXY protocol header, if any, is read by the first read of the
+	// handshake.
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+
+	state := tc.ConnectionState()
+	c.tls = &state
+	return nil
+}
+
+// forceClose closes both the client and the server connections.
+func (c *Client) forceClose() {
+	c.Conn.Close()
+	if c.server != nil {
+		c.server.Close()
+	}
+}
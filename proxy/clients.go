@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+// ClientInfo is a snapshot of a connected client.
+type ClientInfo struct {
+	// ID is the id of the connection, unique in the process.
+	ID   uint64
+	Addr string
+	// Connected is when the client connected.
+	Connected time.Time
+	// Op, Namespace and Command describe the message being handled, Op is
+	// empty if the client is idle.
+	Op        string
+	Namespace string
+	Command   string
+	// OpStarted is when the message being handled was read.
+	OpStarted time.Time
+	// BytesReceived and BytesSent count the traffic with the client.
+	BytesReceived uint64
+	BytesSent     uint64
+	// User is the user of the last authentication command sent by the
+	// client as user@db, whether it succeeded or not is not checked.
+	User string
+	// Subject is the subject of the TLS client certificate, if any.
+	Subject string
+	// ServerAddr is the address of the backend connection of the client.
+	ServerAddr string
+}
+
+// Clients returns a snapshot of the connected clients, sorted by id.
+func (p *Proxy) Clients() []ClientInfo {
+	p.mu.Lock()
+	clients := make([]*Client, 0, len(p.clients))
+	for c := range p.clients {
+		clients = append(clients, c)
+	}
+	p.mu.Unlock()
+
+	infos := make([]ClientInfo, len(clients))
+	for i, c := range clients {
+		infos[i] = c.info()
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Disconnect closes the client with the given id, and its backend connection,
+// right away. It returns false if no such client is connected.
+func (p *Proxy) Disconnect(id uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for c := range p.clients {
+		if c.id == id {
+			c.log.Warn("disconnecting client")
+			c.forceClose()
+			return true
+		}
+	}
+
+	return false
+}
+
+// BackendInfo is the state of the connections to the backend. There is no
+// pool, every client has its own backend connection.
+type BackendInfo struct {
+	Addr string
+	// Conns is the number of open backend connections.
+	Conns int
+	// DialFailures counts the failed connection attempts.
+	DialFailures uint64
+	// LastDialError is the error of the last failed attempt, if any.
+	LastDialError   string
+	LastDialErrorAt time.Time
+	// Probed is false until the first probe, or if probing is disabled.
+	Probed bool
+	// Healthy is true if the last probe succeeded.
+	Healthy   bool
+	LastProbe time.Time
+	// LastProbeError is the error of the last probe, if it failed.
+	LastProbeError string
+	// ProbeFailures counts the consecutive failed probes.
+	ProbeFailures int
+}
+
+// Backend returns the state of the connections to the backend.
+func (p *Proxy) Backend() BackendInfo {
+	p.init()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return BackendInfo{
+		Addr:            p.MongoAddr,
+		Conns:           len(p.clients),
+		DialFailures:    p.dialFailures,
+		LastDialError:   p.lastDialErr,
+		LastDialErrorAt: p.lastDialErrAt,
+		Probed:          p.probeState.probed,
+		Healthy:         p.probeState.healthy,
+		LastProbe:       p.probeState.at,
+		LastProbeError:  p.probeState.err,
+		ProbeFailures:   p.probeState.failures,
+	}
+}
+
+func (p *Proxy) dialFailed(err error) {
+	p.metrics.dialFailures.Inc(p.Name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dialFailures++
+	p.lastDialErr = err.Error()
+	p.lastDialErrAt = time.Now()
+}
+
+func (c *Client) info() ClientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := ClientInfo{
+		ID:            c.id,
+		Addr:          c.RemoteAddr().String(),
+		Connected:     c.connected,
+		Namespace:     c.current.ns,
+		Command:       c.current.command,
+		OpStarted:     c.opStarted,
+		BytesReceived: atomic.LoadUint64(&c.received),
+		BytesSent:     atomic.LoadUint64(&c.sent),
+		User:          c.user,
+		Subject:       c.Subject(),
+	}
+
+	if c.op != 0 {
+		i.Op = c.op.String()
+	}
+
+	if c.server != nil {
+		i.ServerAddr = c.server.RemoteAddr().String()
+	}
+
+	return i
+}
+
+// handling records the message being handled, until done is called.
+func (c *Client) handling(h *protocol.MsgHeader, r request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.op, c.current, c.opStarted = h.OpCode, r, time.Now()
+	if r.user != "" {
+		c.user = r.user
+	}
+}
+
+func (c *Client) handled() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.op, c.current, c.opStarted = 0, request{}, time.Time{}
+}
+
+// authUser returns the user of an authentication command as user@db, the
+// body must hold the whole message.
+func authUser(h *protocol.MsgHeader, body []byte, r request) string {
+	if r.command != "authenticate" && r.command != "saslStart" {
+		return ""
+	}
+
+	if int64(len(body)) < h.BodyLen() {
+		return ""
+	}
+
+	q, err := protocol.ReadOpQuery(h, bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	doc, err := q.Query.ToBSON()
+	if err != nil {
+		return ""
+	}
+
+	m := doc.Map()
+
+	var user string
+	switch r.command {
+	case "authenticate":
+		user, _ = m["user"].(string)
+	case "saslStart":
+		mechanism, _ := m["mechanism"].(string)
+		payload, _ := m["payload"].([]byte)
+		user = saslUser(mechanism, payload)
+	}
+
+	if user == "" {
+		return ""
+	}
+
+	return user + "@" + strings.TrimSuffix(r.ns, ".$cmd")
+}
+
+// saslUser returns the user of the first message of a SASL conversation.
+func saslUser(mechanism string, payload []byte) string {
+	switch {
+	case mechanism == "PLAIN":
+		// authzid NUL authcid NUL passwd
+		parts := bytes.Split(payload, []byte{0})
+		if len(parts) == 3 {
+			return string(parts[1])
+		}
+	case strings.HasPrefix(mechanism, "SCRAM-"):
+		// gs2-header, then n=user,r=nonce
+		for _, attr := range strings.Split(string(payload), ",") {
+			if strings.HasPrefix(attr, "n=") {
+				return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attr[2:])
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/mcuadros/lemondb/middlewares"
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ClientsSuite struct{}
+
+var _ = Suite(&ClientsSuite{})
+
+func (s *ClientsSuite) TestProxy_Clients(c *C) {
+	handling, release := make(chan struct{}), make(chan struct{})
+	p := newPipeProxy(echoBackend)
+	p.Middleware = middlewareFunc(func(m protocol.Message, client, server io.ReadWriter) error {
+		handling <- struct{}{}
+		<-release
+		return (&middlewares.ProxyMiddleware{}).Handle(m, client, server)
+	})
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+	defer close(release)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	doc, err := bson.Marshal(bson.D{
+		{Name: "authenticate", Value: 1},
+		{Name: "user", Value: "bob"},
+		{Name: "mechanism", Value: "MONGODB-CR"},
+	})
+	c.Assert(err, IsNil)
+
+	q := &protocol.OpQuery{
+		MsgHeader:          &protocol.MsgHeader{RequestID: 1, OpCode: protocol.OpQueryCode},
+		FullCollectionName: protocol.CSString("admin.$cmd\x00"),
+		NumberToReturn:     -1,
+		Query:              doc,
+	}
+
+	_, err = q.WriteTo(conn)
+	c.Assert(err, IsNil)
+	<-handling
+
+	clients := p.Clients()
+	c.Assert(clients, HasLen, 1)
+
+	info := clients[0]
+	c.Assert(info.Addr, Equals, conn.LocalAddr().String())
+	c.Assert(info.Op, Equals, "QUERY")
+	c.Assert(info.Namespace, Equals, "admin.$cmd")
+	c.Assert(info.Command, Equals, "authenticate")
+	c.Assert(info.User, Equals, "bob@admin")
+	c.Assert(info.BytesReceived, Equals, uint64(q.MsgHeader.MessageLength))
+	c.Assert(time.Since(info.OpStarted) < time.Minute, Equals, true)
+	c.Assert(p.Backend().Conns, Equals, 1)
+
+	release <- struct{}{}
+	_, err = protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+
+	// the proxy finishes the message after the reply is written.
+	for i := 0; i < 100 && p.Clients()[0].Op != ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	info = p.Clients()[0]
+	c.Assert(info.Op, Equals, "")
+	c.Assert(info.User, Equals, "bob@admin")
+	c.Assert(info.BytesReceived, Equals, uint64(q.MsgHeader.MessageLength))
+	c.Assert(info.BytesSent > 0, Equals, true)
+
+	c.Assert(p.Disconnect(info.ID+1), Equals, false)
+	c.Assert(p.Disconnect(info.ID), Equals, true)
+
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+}
+
+func (s *ClientsSuite) TestProxy_BackendDialFailures(c *C) {
+	p := newPipeProxy(echoBackend)
+	p.Dialer = &TCPDialer{}
+	p.MongoAddr = "127.0.0.1:1"
+	p.DialRetries = 2
+	p.DialBackoff = time.Millisecond
+	p.init()
+
+	_, err := p.newServerConn(nopLogger{})
+	c.Assert(err, NotNil)
+
+	b := p.Backend()
+	c.Assert(b.Addr, Equals, "127.0.0.1:1")
+	c.Assert(b.DialFailures, Equals, uint64(2))
+	c.Assert(b.LastDialError, Not(Equals), "")
+}
+
+func (s *ClientsSuite) TestSaslUser(c *C) {
+	c.Assert(saslUser("PLAIN", []byte("\x00bob\x00secret")), Equals, "bob")
+	c.Assert(saslUser("SCRAM-SHA-1", []byte("n,,n=b=2Co=3Db,r=abc")), Equals, "b,o=b")
+	c.Assert(saslUser("SCRAM-SHA-256", []byte("n,,r=abc")), Equals, "")
+	c.Assert(saslUser("GSSAPI", []byte("foo")), Equals, "")
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dialer opens the connections to the mongo server, a zero timeout means no
+// timeout at all.
+type Dialer interface {
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// DialerFunc is an adapter to allow the use of ordinary functions as Dialer.
+type DialerFunc func(addr string, timeout time.Duration) (net.Conn, error)
+
+// Dial calls f(addr, timeout).
+func (f DialerFunc) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return f(addr, timeout)
+}
+
+// TCPDialer connects to the server using plain TCP, it is the default Dialer.
+type TCPDialer struct{}
+
+// Dial connects to the given host:port address.
+func (d *TCPDialer) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// UnixDialer connects to a server listening on a Unix domain socket, the
+// address is the path to the socket file.
+type UnixDialer struct{}
+
+// Dial connects to the given socket path.
+func (d *UnixDialer) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", addr, timeout)
+}
+
+// TLSDialer connects to the server using TLS.
+type TLSDialer struct {
+	// CAFile is a PEM bundle used to verify the server certificate, if empty
+	// the system roots are used.
+	CAFile string
+	// CertFile and KeyFile are the client certificate presented to the
+	// server, they are optional.
+	CertFile string
+	KeyFile  string
+	// ServerName is used to verify the server certificate, by default the
+	// host part of the address is used.
+	ServerName string
+	// InsecureSkipVerify disables any verification of the server certificate.
+	InsecureSkipVerify bool
+
+	once   sync.Once
+	config *tls.Config
+	err    error
+}
+
+// Dial connects to the given host:port address and completes the handshake.
+func (d *TLSDialer) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	d.once.Do(d.loadConfig)
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	config := d.config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ServerName = host
+	}
+
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, config)
+}
+
+func (d *TLSDialer) loadConfig() {
+	d.config = &tls.Config{
+		ServerName:         d.ServerName,
+		InsecureSkipVerify: d.InsecureSkipVerify,
+	}
+
+	if d.CAFile != "" {
+		var pool *x509.CertPool
+		if pool, d.err = loadCertPool(d.CAFile); d.err != nil {
+			return
+		}
+
+		d.config.RootCAs = pool
+	}
+
+	if d.CertFile != "" || d.KeyFile != "" {
+		var cert tls.Certificate
+		if cert, d.err = tls.LoadX509KeyPair(d.CertFile, d.KeyFile); d.err != nil {
+			return
+		}
+
+		d.config.Certificates = []tls.Certificate{cert}
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcuadros/lemondb/middlewares"
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+)
+
+type DialerSuite struct{}
+
+var _ = Suite(&DialerSuite{})
+
+func (s *DialerSuite) TestProxy_PipeBackend(c *C) {
+	p := newPipeProxy(echoBackend)
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	msg := &protocol.MsgHeader{
+		MessageLength: protocol.HeaderLen + 3,
+		RequestID:     42,
+		OpCode:        protocol.OpQueryCode,
+		Message:       []byte("foo"),
+	}
+
+	_, err = msg.WriteTo(conn)
+	c.Assert(err, IsNil)
+
+	reply, err := protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(reply.OpCode, Equals, protocol.OpReplyCode)
+	c.Assert(reply.ResponseTo, Equals, int32(42))
+	c.Assert(string(reply.Message), Equals, "foo")
+}
+
+func (s *DialerSuite) TestProxy_DialRetries(c *C) {
+	var attempts int32
+	p := newPipeProxy(nil)
+	p.DialRetries = 3
+	p.DialBackoff = time.Millisecond
+	p.Dialer = DialerFunc(func(addr string, timeout time.Duration) (net.Conn, error) {
+		atomic.AddInt32(&attempts, 1)
+		return nil, errors.New("foo")
+	})
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// the client is disconnected once we give up.
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+	c.Assert(atomic.LoadInt32(&attempts), Equals, int32(3))
+}
+
+func (s *DialerSuite) TestProxy_DialTimeout(c *C) {
+	timeouts := make(chan time.Duration, 1)
+	p := newPipeProxy(nil)
+	p.DialRetries = 1
+	p.DialTimeout = 42 * time.Second
+	p.Dialer = DialerFunc(func(addr string, timeout time.Duration) (net.Conn, error) {
+		timeouts <- timeout
+		return nil, errors.New("foo")
+	})
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	c.Assert(<-timeouts, Equals, 42*time.Second)
+}
+
+func (s *DialerSuite) TestUnixDialer(c *C) {
+	path := filepath.Join(c.MkDir(), "mongo.sock")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	conn, err := (&UnixDialer{}).Dial(path, time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(conn.RemoteAddr().String(), Equals, path)
+	conn.Close()
+}
+
+func (s *DialerSuite) TestTLSDialer(c *C) {
+	dir := c.MkDir()
+	ca := newTestCert(c, "ca", nil)
+	ca.write(c, filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+
+	server := newTestCert(c, "mongo.local", ca)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.pair()},
+	})
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	d := &TLSDialer{CAFile: filepath.Join(dir, "ca.crt"), ServerName: "mongo.local"}
+	conn, err := d.Dial(l.Addr().String(), time.Second)
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	// the server name is taken from the address by default
+	d = &TLSDialer{CAFile: filepath.Join(dir, "ca.crt")}
+	_, err = d.Dial(l.Addr().String(), time.Second)
+	c.Assert(err, NotNil)
+
+	d = &TLSDialer{InsecureSkipVerify: true}
+	conn, err = d.Dial(l.Addr().String(), time.Second)
+	c.Assert(err, IsNil)
+	conn.Close()
+}
+
+func (s *DialerSuite) TestTLSDialer_InvalidCA(c *C) {
+	d := &TLSDialer{CAFile: filepath.Join(c.MkDir(), "missing.crt")}
+	_, err := d.Dial("127.0.0.1:27017", time.Second)
+	c.Assert(err, NotNil)
+}
+
+// newPipeProxy returns a proxy whose server connections are in-memory pipes
+// served by backend.
+func newPipeProxy(backend func(net.Conn)) *Proxy {
+	return &Proxy{
+		Log:               nopLogger{},
+		ProxyAddr:         "127.0.0.1:0",
+		MongoAddr:         "pipe",
+		ClientIdleTimeout: time.Minute,
+		MessageTimeout:    time.Minute,
+		Middleware:        &middlewares.ProxyMiddleware{},
+		Dialer:            pipeDialer(backend),
+	}
+}
+
+func pipeDialer(backend func(net.Conn)) Dialer {
+	return DialerFunc(func(addr string, timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		go backend(server)
+
+		return client, nil
+	})
+}
+
+// echoBackend replies every message with an OP_REPLY carrying the same body.
+func echoBackend(conn net.Conn) {
+	defer conn.Close()
+	for {
+		h, err := protocol.ReadMsgHeader(conn)
+		if err != nil {
+			return
+		}
+
+		if !h.OpCode.HasResponse() {
+			continue
+		}
+
+		reply := &protocol.MsgHeader{
+			MessageLength: h.MessageLength,
+			ResponseTo:    h.RequestID,
+			OpCode:        protocol.OpReplyCode,
+			Message:       h.Message,
+		}
+
+		if _, err := reply.WriteTo(conn); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+)
+
+type DrainSuite struct{}
+
+var _ = Suite(&DrainSuite{})
+
+func (s *DrainSuite) TestProxy_DrainIdleClient(c *C) {
+	p := newPipeProxy(echoBackend)
+	c.Assert(p.Start(), IsNil)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	writeTestQuery(c, conn)
+
+	start := time.Now()
+	c.Assert(p.Drain(time.Minute), IsNil)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+
+	_, err = net.Dial("tcp", p.Addr().String())
+	c.Assert(err, NotNil)
+}
+
+func (s *DrainSuite) TestProxy_DrainWaitsInFlight(c *C) {
+	p := newPipeProxy(slowBackend(100 * time.Millisecond))
+	c.Assert(p.Start(), IsNil)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	replies := make(chan error, 1)
+	go func() {
+		_, err := protocol.ReadMsgHeader(conn)
+		replies <- err
+	}()
+
+	writeSlowQuery(c, conn)
+	waitInFlight(p, 1)
+
+	c.Assert(p.Drain(time.Minute), IsNil)
+	c.Assert(<-replies, IsNil)
+	c.Assert(p.Usage().Clients, Equals, 0)
+}
+
+func (s *DrainSuite) TestProxy_DrainTimeout(c *C) {
+	p := newPipeProxy(slowBackend(time.Hour))
+	c.Assert(p.Start(), IsNil)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	writeSlowQuery(c, conn)
+	waitInFlight(p, 1)
+
+	start := time.Now()
+	c.Assert(p.Drain(50*time.Millisecond), IsNil)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+}
+
+func (s *DrainSuite) TestProxy_DrainTimeoutHandshake(c *C) {
+	p := newPipeProxy(echoBackend)
+	p.ProxyAddr = ""
+	p.Listeners = []ListenerConfig{{
+		Addr:           "127.0.0.1:0",
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"127.0.0.0/8"},
+	}}
+
+	c.Assert(p.Start(), IsNil)
+
+	// the client never sends the PROXY protocol header, so it is not
+	// tracked as a client yet.
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	start := time.Now()
+	c.Assert(p.Drain(200*time.Millisecond), IsNil)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+}
+
+func (s *DrainSuite) TestProxy_CloseDuringDrain(c *C) {
+	p := newPipeProxy(slowBackend(time.Hour))
+	c.Assert(p.Start(), IsNil)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	writeSlowQuery(c, conn)
+	waitInFlight(p, 1)
+
+	drained := make(chan error, 1)
+	go func() { drained <- p.Drain(0) }()
+
+	c.Assert(p.Close(), IsNil)
+	c.Assert(<-drained, IsNil)
+	c.Assert(p.Usage().Clients, Equals, 0)
+}
+
+// slowBackend works as echoBackend but waits before every reply.
+func slowBackend(wait time.Duration) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			h, err := protocol.ReadMsgHeader(conn)
+			if err != nil {
+				return
+			}
+
+			time.Sleep(wait)
+
+			reply := &protocol.MsgHeader{
+				MessageLength: h.MessageLength,
+				ResponseTo:    h.RequestID,
+				OpCode:        protocol.OpReplyCode,
+				Message:       h.Message,
+			}
+
+			if _, err := reply.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeSlowQuery(c *C, conn net.Conn) {
+	msg := &protocol.MsgHeader{
+		MessageLength: protocol.HeaderLen + 3,
+		OpCode:        protocol.OpQueryCode,
+		Message:       []byte("foo"),
+	}
+
+	_, err := msg.WriteTo(conn)
+	c.Assert(err, IsNil)
+}
+
+func waitInFlight(p *Proxy, n int) {
+	for p.Usage().InFlight != n {
+		time.Sleep(time.Millisecond)
+	}
+}
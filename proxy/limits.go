@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+var (
+	errTooManyClients      = errors.New("proxy: too many connections")
+	errTooManyClientsPerIP = errors.New("proxy: too many connections from this address")
+	errTooManyRequests     = errors.New("proxy: too many requests in flight")
+	errQueueTimeout        = errors.New("proxy: timeout waiting for a request slot")
+)
+
+// errCodeTooManyConnections is the code sent to the clients when a limit is
+// hit, the same used by mongod for socket errors so drivers retry.
+const errCodeTooManyConnections = 9001
+
+// Usage is a snapshot of the resources in use by a proxy.
+type Usage struct {
+	// Clients is the number of connected clients.
+	Clients int
+	// InFlight is the number of messages being handled.
+	InFlight int
+	// Queued is the number of messages waiting for an in flight slot.
+	Queued int
+}
+
+// limiter enforces the connection and request limits of a proxy.
+type limiter struct {
+	maxClients      int
+	maxClientsPerIP int
+	maxQueue        int
+	queueTimeout    time.Duration
+
+	mu      sync.Mutex
+	clients int
+	perIP   map[string]int
+
+	slots    chan struct{}
+	inFlight int32
+	queued   int32
+}
+
+func newLimiter(p *Proxy) *limiter {
+	l := &limiter{
+		maxClients:      p.MaxClients,
+		maxClientsPerIP: p.MaxClientsPerIP,
+		maxQueue:        p.MaxQueue,
+		queueTimeout:    p.QueueTimeout,
+		perIP:           make(map[string]int),
+	}
+
+	if p.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, p.MaxInFlight)
+	}
+
+	if l.queueTimeout <= 0 {
+		l.queueTimeout = p.MessageTimeout
+	}
+
+	return l
+}
+
+// admit registers a new client, if any limit is reached the client is not
+// registered and an error is returned.
+func (l *limiter) admit(addr net.Addr) error {
+	ip := addrIP(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxClients > 0 && l.clients >= l.maxClients {
+		return errTooManyClients
+	}
+
+	if ip != "" && l.maxClientsPerIP > 0 && l.perIP[ip] >= l.maxClientsPerIP {
+		return errTooManyClientsPerIP
+	}
+
+	l.clients++
+	if ip != "" {
+		l.perIP[ip]++
+	}
+
+	return nil
+}
+
+// release unregisters a client previously admitted.
+func (l *limiter) release(addr net.Addr) {
+	ip := addrIP(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.clients--
+	if ip == "" {
+		return
+	}
+
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+		return
+	}
+
+	l.perIP[ip]--
+}
+
+// acquire waits for an in flight slot, queueing at most maxQueue messages,
+// done must be called once the message is handled.
+func (l *limiter) acquire(closed <-chan struct{}) (done func(), err error) {
+	if l.slots == nil {
+		atomic.AddInt32(&l.inFlight, 1)
+		return l.done, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		atomic.AddInt32(&l.inFlight, 1)
+		return l.done, nil
+	default:
+	}
+
+	if int(atomic.AddInt32(&l.queued, 1)) > l.maxQueue {
+		atomic.AddInt32(&l.queued, -1)
+		return nil, errTooManyRequests
+	}
+
+	defer atomic.AddInt32(&l.queued, -1)
+
+	t := time.NewTimer(l.queueTimeout)
+	defer t.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		atomic.AddInt32(&l.inFlight, 1)
+		return l.done, nil
+	case <-t.C:
+		return nil, errQueueTimeout
+	case <-closed:
+		return nil, errNormalClose
+	}
+}
+
+func (l *limiter) done() {
+	atomic.AddInt32(&l.inFlight, -1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *limiter) usage() Usage {
+	l.mu.Lock()
+	clients := l.clients
+	l.mu.Unlock()
+
+	return Usage{
+		Clients:  clients,
+		InFlight: int(atomic.LoadInt32(&l.inFlight)),
+		Queued:   int(atomic.LoadInt32(&l.queued)),
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UnixAddr:
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+
+	return host
+}
+
+// rejectClient waits for the first message of a client that didn't pass the
+// admission, so it can be answered with a proper error instead of a closed
+// connection. Only the header is read, the length announced by the client is
+// not trusted.
+func (p *Proxy) rejectClient(c *Client, reason error) {
+	c.SetDeadline(time.Now().Add(rejectTimeout))
+
+	h, err := protocol.ReadHeader(c)
+	if err != nil {
+		return
+	}
+
+	// a small body is discarded, closing the connection with unread data
+	// could reset it before the client reads the reply.
+	if n := h.BodyLen(); n <= rejectMaxBodyLen {
+		io.CopyN(ioutil.Discard, c, n)
+	}
+
+	p.replyError(c, h, errCodeTooManyConnections, reason)
+}
+
+// replyError answers the message with an error, if the message expects a
+// response at all.
+func (p *Proxy) replyError(c *Client, h *protocol.MsgHeader, code int32, reason error) {
+	if !h.OpCode.HasResponse() {
+		return
+	}
+
+	op := protocol.NewOpReplyError(h, p.nextRequestID(), code, reason.Error())
+	if _, err := op.WriteTo(c); err != nil {
+		c.log.Error("error replying", "op", h.OpCode, "err", err)
+	}
+}
+
+const (
+	// rejectTimeout is how long we wait for the first message of a rejected
+	// client.
+	rejectTimeout = time.Second
+	// rejectMaxBodyLen is the longest body read from a rejected client.
+	rejectMaxBodyLen = 16 * 1024
+)
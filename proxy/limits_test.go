@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+)
+
+type LimitsSuite struct{}
+
+var _ = Suite(&LimitsSuite{})
+
+func (s *LimitsSuite) TestLimiter_MaxClients(c *C) {
+	l := newLimiter(&Proxy{MaxClients: 2})
+
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	b := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}
+
+	c.Assert(l.admit(a), IsNil)
+	c.Assert(l.admit(b), IsNil)
+	c.Assert(l.admit(a), Equals, errTooManyClients)
+	c.Assert(l.usage().Clients, Equals, 2)
+
+	l.release(a)
+	c.Assert(l.admit(b), IsNil)
+}
+
+func (s *LimitsSuite) TestLimiter_MaxClientsPerIP(c *C) {
+	l := newLimiter(&Proxy{MaxClientsPerIP: 1})
+
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	b := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2}
+	u := &net.UnixAddr{Net: "unix"}
+
+	c.Assert(l.admit(a), IsNil)
+	c.Assert(l.admit(b), Equals, errTooManyClientsPerIP)
+	c.Assert(l.admit(u), IsNil)
+	c.Assert(l.admit(u), IsNil)
+
+	l.release(a)
+	c.Assert(l.perIP, HasLen, 0)
+	c.Assert(l.admit(b), IsNil)
+}
+
+func (s *LimitsSuite) TestLimiter_InFlight(c *C) {
+	l := newLimiter(&Proxy{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Minute})
+
+	done, err := l.acquire(nil)
+	c.Assert(err, IsNil)
+	c.Assert(l.usage().InFlight, Equals, 1)
+
+	queued := make(chan error)
+	go func() {
+		done, err := l.acquire(nil)
+		if err == nil {
+			done()
+		}
+
+		queued <- err
+	}()
+
+	for l.usage().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = l.acquire(nil)
+	c.Assert(err, Equals, errTooManyRequests)
+
+	done()
+	c.Assert(<-queued, IsNil)
+	c.Assert(l.usage(), DeepEquals, Usage{})
+}
+
+func (s *LimitsSuite) TestLimiter_QueueTimeout(c *C) {
+	l := newLimiter(&Proxy{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Millisecond})
+
+	_, err := l.acquire(nil)
+	c.Assert(err, IsNil)
+
+	_, err = l.acquire(nil)
+	c.Assert(err, Equals, errQueueTimeout)
+	c.Assert(l.usage().Queued, Equals, 0)
+}
+
+func (s *LimitsSuite) TestLimiter_QueueClosed(c *C) {
+	l := newLimiter(&Proxy{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Minute})
+
+	_, err := l.acquire(nil)
+	c.Assert(err, IsNil)
+
+	closed := make(chan struct{})
+	close(closed)
+
+	_, err = l.acquire(closed)
+	c.Assert(err, Equals, errNormalClose)
+}
+
+func (s *LimitsSuite) TestProxy_TooManyClients(c *C) {
+	p := newPipeProxy(echoBackend)
+	p.MaxClients = 1
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	first, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer first.Close()
+	writeTestQuery(c, first)
+	c.Assert(p.Usage().Clients, Equals, 1)
+
+	second, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer second.Close()
+
+	query := &protocol.OpQuery{
+		MsgHeader:          &protocol.MsgHeader{RequestID: 42, OpCode: protocol.OpQueryCode},
+		FullCollectionName: protocol.CSString("test.$cmd\x00"),
+	}
+	_, err = query.WriteTo(second)
+	c.Assert(err, IsNil)
+
+	h, err := protocol.ReadMsgHeader(second)
+	c.Assert(err, IsNil)
+	c.Assert(h.ResponseTo, Equals, int32(42))
+
+	reply, err := protocol.ReadOpReply(h, bytes.NewReader(h.Message))
+	c.Assert(err, IsNil)
+	c.Assert(reply.ResponseFlags, Equals, protocol.QueryFailure)
+
+	doc, err := reply.Documents[0].ToBSON()
+	c.Assert(err, IsNil)
+	c.Assert(doc.Map()["errmsg"], Equals, errTooManyClients.Error())
+
+	// the rejected client is disconnected
+	_, err = second.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+	c.Assert(p.Usage().Clients, Equals, 1)
+}
+
+func (s *LimitsSuite) TestProxy_RejectedClientLength(c *C) {
+	p := newPipeProxy(echoBackend)
+	p.MaxClients = 1
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	first, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer first.Close()
+	writeTestQuery(c, first)
+
+	second, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer second.Close()
+
+	// the body announced is never read, the error is replied to the header.
+	header := &protocol.MsgHeader{MessageLength: 1 << 30, RequestID: 42, OpCode: protocol.OpQueryCode}
+	_, err = header.WriteTo(second)
+	c.Assert(err, IsNil)
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	h, err := protocol.ReadMsgHeader(second)
+	c.Assert(err, IsNil)
+	c.Assert(h.ResponseTo, Equals, int32(42))
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ListenerConfig describes an additional address where the proxy accepts
+// clients. All the listeners of a proxy share the same middleware and server.
+type ListenerConfig struct {
+	// Network is "tcp" or "unix", by default "tcp".
+	Network string
+	// Addr is a host:port address for tcp or the socket path for unix.
+	Addr string
+	// Mode is the file mode of the unix socket, by default 0666.
+	Mode os.FileMode
+	// TLS if not nil the client connections on this listener are expected
+	// to be TLS.
+	TLS *TLSConfig
+	// ProxyProtocol enables the HAProxy PROXY protocol, v1 and v2, so the
+	// address of the real client is known when running behind a balancer.
+	ProxyProtocol bool
+	// TrustedProxies are the networks, in CIDR notation, allowed to send the
+	// PROXY protocol header. Connections from any other address are handled
+	// as if ProxyProtocol was disabled. Required if ProxyProtocol is enabled.
+	TrustedProxies []string
+}
+
+// String returns the address as network://addr.
+func (cfg ListenerConfig) String() string {
+	return fmt.Sprintf("%s://%s", cfg.network(), cfg.Addr)
+}
+
+func (cfg ListenerConfig) network() string {
+	if cfg.Network == "" {
+		return "tcp"
+	}
+
+	return cfg.Network
+}
+
+// ListenFunc creates the raw listeners of a proxy, net.Listen by default.
+type ListenFunc func(network, addr string) (net.Listener, error)
+
+// listen creates the listener described by the config.
+func (cfg ListenerConfig) listen(fn ListenFunc) (net.Listener, error) {
+	if fn == nil {
+		fn = net.Listen
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		if tlsConfig, err = cfg.TLS.serverConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	var l net.Listener
+	var err error
+	switch cfg.network() {
+	case "tcp", "tcp4", "tcp6":
+		l, err = fn(cfg.network(), cfg.Addr)
+	case "unix":
+		l, err = listenUnix(fn, cfg.Addr, cfg.Mode)
+	default:
+		err = fmt.Errorf("proxy: unsupported listener network %q", cfg.Network)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ProxyProtocol {
+		pl, err := newProxyProtoListener(l, cfg.TrustedProxies)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+
+		l = pl
+	}
+
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	return l, nil
+}
+
+func listenUnix(fn ListenFunc, path string, mode os.FileMode) (net.Listener, error) {
+	l, err := fn("unix", path)
+	if err != nil {
+		if _, serr := os.Stat(path); serr != nil {
+			return nil, err
+		}
+
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+
+		if l, err = fn("unix", path); err != nil {
+			return nil, err
+		}
+	}
+
+	if mode == 0 {
+		mode = 0666
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file left behind by a previous process
+// that didn't exit cleanly, as long as nobody is listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("proxy: %s already exists and is not a socket", path)
+	}
+
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("proxy: %s is already in use", path)
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+)
+
+type ListenerSuite struct{}
+
+var _ = Suite(&ListenerSuite{})
+
+func (s *ListenerSuite) TestProxy_MultipleListeners(c *C) {
+	path := filepath.Join(c.MkDir(), "lemondb.sock")
+
+	p := newPipeProxy(echoBackend)
+	p.Listeners = []ListenerConfig{
+		{Addr: "127.0.0.1:0"},
+		{Network: "unix", Addr: path, Mode: 0600},
+	}
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+	c.Assert(p.Addrs(), HasLen, 3)
+
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	for _, addr := range p.Addrs() {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		c.Assert(err, IsNil)
+
+		msg := &protocol.MsgHeader{
+			MessageLength: protocol.HeaderLen + 3,
+			OpCode:        protocol.OpQueryCode,
+			Message:       []byte("foo"),
+		}
+
+		_, err = msg.WriteTo(conn)
+		c.Assert(err, IsNil)
+
+		reply, err := protocol.ReadMsgHeader(conn)
+		c.Assert(err, IsNil)
+		c.Assert(reply.OpCode, Equals, protocol.OpReplyCode)
+		conn.Close()
+	}
+}
+
+func (s *ListenerSuite) TestProxy_Unlisten(c *C) {
+	path := filepath.Join(c.MkDir(), "lemondb.sock")
+
+	p := newPipeProxy(echoBackend)
+	p.ProxyAddr = ""
+	p.Listeners = []ListenerConfig{{Network: "unix", Addr: path}}
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("unix", path)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	roundTrip := func() {
+		msg := &protocol.MsgHeader{
+			MessageLength: protocol.HeaderLen + 3,
+			OpCode:        protocol.OpQueryCode,
+			Message:       []byte("foo"),
+		}
+
+		_, err := msg.WriteTo(conn)
+		c.Assert(err, IsNil)
+
+		reply, err := protocol.ReadMsgHeader(conn)
+		c.Assert(err, IsNil)
+		c.Assert(reply.OpCode, Equals, protocol.OpReplyCode)
+	}
+
+	roundTrip()
+	c.Assert(p.Unlisten(), IsNil)
+	c.Assert(p.Addrs(), HasLen, 0)
+
+	_, err = net.Dial("unix", path)
+	c.Assert(err, NotNil)
+
+	// the connected clients are still served
+	roundTrip()
+
+	c.Assert(p.Start(), IsNil)
+	again, err := net.Dial("unix", path)
+	c.Assert(err, IsNil)
+	again.Close()
+}
+
+func (s *ListenerSuite) TestProxy_NoListeners(c *C) {
+	p := newPipeProxy(echoBackend)
+	p.ProxyAddr = ""
+
+	c.Assert(p.Start(), Equals, errNoListeners)
+}
+
+func (s *ListenerSuite) TestProxy_ListenerError(c *C) {
+	p := newPipeProxy(echoBackend)
+	p.Listeners = []ListenerConfig{{Network: "udp", Addr: "127.0.0.1:0"}}
+
+	c.Assert(p.Start(), ErrorMatches, ".*unsupported listener network.*")
+	c.Assert(p.Addrs(), HasLen, 0)
+}
+
+func (s *ListenerSuite) TestListenUnix_StaleSocket(c *C) {
+	path := filepath.Join(c.MkDir(), "lemondb.sock")
+
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	l, err = ListenerConfig{Network: "unix", Addr: path}.listen(nil)
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	_, err = ListenerConfig{Network: "unix", Addr: path}.listen(nil)
+	c.Assert(err, ErrorMatches, ".* is already in use")
+}
+
+func (s *ListenerSuite) TestListenUnix_NotASocket(c *C) {
+	path := filepath.Join(c.MkDir(), "lemondb.sock")
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	f.Close()
+
+	_, err = ListenerConfig{Network: "unix", Addr: path}.listen(nil)
+	c.Assert(err, ErrorMatches, ".* is not a socket")
+}
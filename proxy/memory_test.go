@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/mcuadros/lemondb/memdb"
+	"github.com/mcuadros/lemondb/middlewares"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemorySuite runs mgo against the memory middleware, the backend is never
+// used.
+type MemorySuite struct {
+	proxy   *Proxy
+	session *mgo.Session
+}
+
+var _ = Suite(&MemorySuite{})
+
+func (s *MemorySuite) SetUpTest(c *C) {
+	s.proxy = newPipeProxy(echoBackend)
+	s.proxy.Middleware = &middlewares.MemoryMiddleware{Store: memdb.NewStore()}
+	c.Assert(s.proxy.Start(), IsNil)
+
+	var err error
+	s.session, err = mgo.DialWithTimeout(s.proxy.Addr().String(), 5*time.Second)
+	c.Assert(err, IsNil)
+}
+
+func (s *MemorySuite) TearDownTest(c *C) {
+	s.session.Close()
+	s.proxy.Stop()
+}
+
+func (s *MemorySuite) TestCRUD(c *C) {
+	coll := s.session.DB("test").C("people")
+	c.Assert(coll.Insert(bson.M{"_id": 1, "name": "foo", "age": 20}), IsNil)
+	c.Assert(coll.Insert(bson.M{"_id": 2, "name": "bar", "age": 30}), IsNil)
+
+	var result bson.M
+	c.Assert(coll.Find(bson.M{"age": bson.M{"$gt": 25}}).One(&result), IsNil)
+	c.Assert(result["name"], Equals, "bar")
+
+	c.Assert(coll.Update(bson.M{"_id": 1}, bson.M{"$inc": bson.M{"age": 1}}), IsNil)
+	c.Assert(coll.FindId(1).One(&result), IsNil)
+	c.Assert(result["age"], Equals, 21)
+
+	info, err := coll.Upsert(bson.M{"_id": 3}, bson.M{"$set": bson.M{"name": "qux"}})
+	c.Assert(err, IsNil)
+	c.Assert(info.UpsertedId, Equals, 3)
+
+	c.Assert(coll.Remove(bson.M{"name": "bar"}), IsNil)
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	c.Assert(coll.FindId(2).One(&result), Equals, mgo.ErrNotFound)
+}
+
+func (s *MemorySuite) TestDuplicateKey(c *C) {
+	coll := s.session.DB("test").C("people")
+	c.Assert(coll.Insert(bson.M{"_id": 1}), IsNil)
+
+	err := coll.Insert(bson.M{"_id": 1})
+	c.Assert(mgo.IsDup(err), Equals, true)
+}
+
+func (s *MemorySuite) TestUniqueIndex(c *C) {
+	coll := s.session.DB("test").C("people")
+	c.Assert(coll.EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true}), IsNil)
+	c.Assert(coll.Insert(bson.M{"email": "foo@example.com"}), IsNil)
+
+	err := coll.Insert(bson.M{"email": "foo@example.com"})
+	c.Assert(mgo.IsDup(err), Equals, true)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, HasLen, 2)
+	c.Assert(indexes[1].Key, DeepEquals, []string{"email"})
+	c.Assert(indexes[1].Unique, Equals, true)
+}
+
+func (s *MemorySuite) TestCursor(c *C) {
+	coll := s.session.DB("test").C("numbers")
+	for i := 0; i < 250; i++ {
+		c.Assert(coll.Insert(bson.M{"n": i}), IsNil)
+	}
+
+	iter := coll.Find(bson.M{"n": bson.M{"$gte": 10}}).Sort("-n").Batch(20).Iter()
+	var doc struct{ N int }
+	var got []int
+	for iter.Next(&doc) {
+		got = append(got, doc.N)
+	}
+
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(got, HasLen, 240)
+	c.Assert(got[0], Equals, 249)
+	c.Assert(got[239], Equals, 10)
+
+	n, err := coll.Find(nil).Skip(5).Limit(10).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 10)
+}
+
+func (s *MemorySuite) TestDistinct(c *C) {
+	coll := s.session.DB("test").C("people")
+	c.Assert(coll.Insert(bson.M{"city": "a"}, bson.M{"city": "b"}, bson.M{"city": "a"}), IsNil)
+
+	var cities []string
+	c.Assert(coll.Find(nil).Distinct("city", &cities), IsNil)
+	c.Assert(cities, DeepEquals, []string{"a", "b"})
+}
+
+func (s *MemorySuite) TestCollections(c *C) {
+	db := s.session.DB("test")
+	c.Assert(db.C("foo").Insert(bson.M{}), IsNil)
+	c.Assert(db.C("bar").Insert(bson.M{}), IsNil)
+
+	names, err := db.CollectionNames()
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"bar", "foo"})
+
+	c.Assert(db.C("foo").DropCollection(), IsNil)
+	names, err = db.CollectionNames()
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"bar"})
+}
+
+func (s *MemorySuite) TestBackend(c *C) {
+	store := memdb.NewStore()
+	p := newPipeProxy(echoBackend)
+	p.Dialer = store
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	session, err := mgo.DialWithTimeout(p.Addr().String(), 5*time.Second)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("test").C("people")
+	c.Assert(coll.Insert(bson.M{"_id": 1, "name": "foo"}), IsNil)
+
+	var result bson.M
+	c.Assert(coll.FindId(1).One(&result), IsNil)
+	c.Assert(result["name"], Equals, "foo")
+
+	c.Assert(p.probe(), IsNil)
+}
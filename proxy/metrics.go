@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/mcuadros/lemondb/metrics"
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+const (
+	// maxNamespaceLabels and maxCommandLabels bound the label values taken
+	// from the messages, per proxy.
+	maxNamespaceLabels = 100
+	maxCommandLabels   = 64
+)
+
+// proxyMetrics are the metrics of a proxy, every one of them is labelled with
+// the name of the proxy.
+type proxyMetrics struct {
+	name string
+
+	clients          *metrics.Gauge
+	inFlight         *metrics.Gauge
+	queued           *metrics.Gauge
+	accepted         *metrics.Counter
+	rejected         *metrics.Counter
+	messages         *metrics.Counter
+	namespaces       *metrics.Counter
+	rejectedMessages *metrics.Counter
+	duration         *metrics.Histogram
+	received         *metrics.Counter
+	sent             *metrics.Counter
+	dialFailures     *metrics.Counter
+	backendUp        *metrics.Gauge
+	middlewareErrors *metrics.Counter
+
+	namespaceLabels *metrics.LabelLimit
+	commandLabels   *metrics.LabelLimit
+}
+
+func newProxyMetrics(r *metrics.Registry, name string) *proxyMetrics {
+	return &proxyMetrics{
+		name: name,
+
+		clients:          r.Gauge("lemondb_clients", "Clients connected.", "proxy"),
+		inFlight:         r.Gauge("lemondb_messages_in_flight", "Messages being handled.", "proxy"),
+		queued:           r.Gauge("lemondb_messages_queued", "Messages waiting for an in flight slot.", "proxy"),
+		accepted:         r.Counter("lemondb_clients_accepted_total", "Clients accepted.", "proxy"),
+		rejected:         r.Counter("lemondb_clients_rejected_total", "Clients rejected by the connection limits.", "proxy"),
+		messages:         r.Counter("lemondb_messages_total", "Messages handled by opcode and command.", "proxy", "op", "command"),
+		namespaces:       r.Counter("lemondb_namespace_messages_total", "Messages handled by namespace.", "proxy", "ns"),
+		rejectedMessages: r.Counter("lemondb_messages_rejected_total", "Messages rejected by the request limits.", "proxy"),
+		duration:         r.Histogram("lemondb_message_duration_seconds", "Time to handle a message.", nil, "proxy", "op", "command"),
+		received:         r.Counter("lemondb_client_received_bytes_total", "Bytes received from the clients.", "proxy"),
+		sent:             r.Counter("lemondb_client_sent_bytes_total", "Bytes sent to the clients.", "proxy"),
+		dialFailures:     r.Counter("lemondb_backend_dial_failures_total", "Failed attempts to connect to the backend.", "proxy"),
+		backendUp:        r.Gauge("lemondb_backend_up", "Whether the last probe of the backend succeeded.", "proxy"),
+		middlewareErrors: r.Counter("lemondb_middleware_errors_total", "Messages the middleware failed to handle.", "proxy", "op"),
+
+		namespaceLabels: metrics.NewLabelLimit(maxNamespaceLabels),
+		commandLabels:   metrics.NewLabelLimit(maxCommandLabels),
+	}
+}
+
+func (m *proxyMetrics) usage(u Usage) {
+	m.clients.Set(float64(u.Clients), m.name)
+	m.inFlight.Set(float64(u.InFlight), m.name)
+	m.queued.Set(float64(u.Queued), m.name)
+}
+
+// handled records a message handled, successfully or not.
+func (m *proxyMetrics) handled(h *protocol.MsgHeader, r request, d time.Duration, err error) {
+	op := h.OpCode.String()
+	if err != nil {
+		m.middlewareErrors.Inc(m.name, op)
+	}
+
+	command := m.commandLabels.Value(r.command)
+	m.messages.Inc(m.name, op, command)
+	m.duration.Observe(d.Seconds(), m.name, op, command)
+	if r.ns != "" {
+		m.namespaces.Inc(m.name, m.namespaceLabels.Value(r.ns))
+	}
+}
+
+// traffic records the bytes transferred with the client since the last call.
+func (m *proxyMetrics) traffic(c *Client) {
+	received, sent := c.traffic()
+	m.received.Add(float64(received), m.name)
+	m.sent.Add(float64(sent), m.name)
+}
@@ -3,9 +3,28 @@ package proxy
 import (
 	"io"
 
+	"github.com/mcuadros/lemondb/logging"
 	"github.com/mcuadros/lemondb/protocol"
 )
 
 type Middleware interface {
 	Handle(m protocol.Message, c io.ReadWriter, s io.ReadWriter) error
 }
+
+// Streamer is implemented by the middlewares that can handle some messages
+// without their body. Those messages are given to Handle as a
+// protocol.StreamedMessage, so the body can be copied straight from the
+// client to the server without buffering it.
+type Streamer interface {
+	// NeedsBody returns false if the message can be handled without its body.
+	NeedsBody(h *protocol.MsgHeader) bool
+}
+
+// Service is implemented by the middlewares with work of their own, such as
+// saving snapshots. The middleware is started once the proxy is serving, or
+// when it is set by SetMiddleware, and stopped once it is replaced and done
+// with its messages in flight, or the proxy is drained or closed.
+type Service interface {
+	Start(log logging.Logger) error
+	Stop() error
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+)
+
+type MiddlewareSuite struct{}
+
+var _ = Suite(&MiddlewareSuite{})
+
+func (s *MiddlewareSuite) TestProxy_SetMiddleware(c *C) {
+	release := make(chan struct{})
+	handling := make(chan struct{})
+
+	p := newPipeProxy(echoBackend)
+	p.Middleware = replyMiddleware("old", func() {
+		close(handling)
+		<-release
+	})
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	replies := make(chan string, 2)
+	go func() {
+		for {
+			reply, err := protocol.ReadMsgHeader(conn)
+			if err != nil {
+				return
+			}
+
+			replies <- string(reply.Message)
+		}
+	}()
+
+	writeMessage(c, conn, 1)
+	<-handling
+
+	// the message in flight finishes with the old middleware.
+	set := make(chan struct{})
+	go func() {
+		p.SetMiddleware(replyMiddleware("new", nil))
+		close(set)
+	}()
+
+	select {
+	case <-set:
+		c.Fatal("SetMiddleware returned with a message in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	c.Assert(<-replies, Equals, "old")
+	<-set
+
+	writeMessage(c, conn, 2)
+	c.Assert(<-replies, Equals, "new")
+}
+
+func (s *MiddlewareSuite) TestProxy_SetMiddlewareNil(c *C) {
+	p := newPipeProxy(echoBackend)
+	p.Middleware = replyMiddleware("old", nil)
+	p.SetMiddleware(nil)
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	writeMessage(c, conn, 1)
+
+	reply, err := protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(reply.Message), Equals, "foo")
+}
+
+func (s *MiddlewareSuite) TestProxy_Service(c *C) {
+	var events []string
+	old := &serviceMiddleware{name: "old", events: &events}
+	p := newPipeProxy(echoBackend)
+	p.Middleware = old
+
+	// nothing is started until the proxy serves
+	p.SetMiddleware(old)
+	c.Assert(events, HasLen, 0)
+
+	c.Assert(p.Start(), IsNil)
+	c.Assert(events, DeepEquals, []string{"start old"})
+
+	p.SetMiddleware(&serviceMiddleware{name: "new", events: &events})
+	c.Assert(events, DeepEquals, []string{"start old", "start new", "stop old"})
+
+	c.Assert(p.Stop(), IsNil)
+	c.Assert(p.Close(), IsNil)
+	c.Assert(events, DeepEquals, []string{"start old", "start new", "stop old", "stop new"})
+}
+
+func (s *MiddlewareSuite) TestProxy_ServiceInFlight(c *C) {
+	release := make(chan struct{})
+	handling := make(chan struct{})
+
+	var events []string
+	p := newPipeProxy(echoBackend)
+	p.Middleware = &serviceMiddleware{
+		Middleware: replyMiddleware("old", func() {
+			close(handling)
+			<-release
+		}),
+		name:   "old",
+		events: &events,
+	}
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	writeMessage(c, conn, 1)
+	<-handling
+
+	set := make(chan struct{})
+	go func() {
+		p.SetMiddleware(&serviceMiddleware{
+			Middleware: replyMiddleware("new", nil),
+			name:       "new",
+			events:     &events,
+		})
+		close(set)
+	}()
+
+	// the old middleware is not stopped while handling the message.
+	select {
+	case <-set:
+		c.Fatal("SetMiddleware returned with a message in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	reply, err := protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(reply.Message), Equals, "old")
+
+	<-set
+	c.Assert(events, DeepEquals, []string{"start old", "start new", "stop old"})
+}
+
+// serviceMiddleware records when it is started and stopped into events.
+type serviceMiddleware struct {
+	Middleware
+	name   string
+	events *[]string
+}
+
+func (m *serviceMiddleware) Start(log logging.Logger) error {
+	*m.events = append(*m.events, "start "+m.name)
+	return nil
+}
+
+func (m *serviceMiddleware) Stop() error {
+	*m.events = append(*m.events, "stop "+m.name)
+	return nil
+}
+
+// replyMiddleware answers every message with body, calling fn before.
+func replyMiddleware(body string, fn func()) Middleware {
+	return middlewareFunc(func(m protocol.Message, cl, sv io.ReadWriter) error {
+		if fn != nil {
+			fn()
+		}
+
+		reply := &protocol.MsgHeader{
+			MessageLength: int32(protocol.HeaderLen + len(body)),
+			ResponseTo:    m.GetMsgHeader().RequestID,
+			OpCode:        protocol.OpReplyCode,
+			Message:       []byte(body),
+		}
+
+		_, err := reply.WriteTo(cl)
+		return err
+	})
+}
+
+func writeMessage(c *C, conn net.Conn, id int32) {
+	msg := &protocol.MsgHeader{
+		MessageLength: protocol.HeaderLen + 3,
+		RequestID:     id,
+		OpCode:        protocol.OpQueryCode,
+		Message:       []byte("foo"),
+	}
+
+	_, err := msg.WriteTo(conn)
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const defaultProbeTimeout = 5 * time.Second
+
+var errProbeNotOK = errors.New("proxy: backend replied ok: 0 to isMaster")
+
+// probeState is the result of the last probe of the backend, guarded by the
+// proxy mu.
+type probeState struct {
+	probed  bool
+	healthy bool
+	at      time.Time
+	err     string
+	// failures counts the consecutive failed probes.
+	failures int
+}
+
+// startProber probes the backend every ProbeInterval until the proxy is
+// closed, the first probe is done right away.
+func (p *Proxy) startProber() {
+	if p.ProbeInterval <= 0 {
+		return
+	}
+
+	p.probeOnce.Do(func() {
+		go func() {
+			t := time.NewTicker(p.ProbeInterval)
+			defer t.Stop()
+
+			for {
+				p.recordProbe(p.probe())
+
+				select {
+				case <-t.C:
+				case <-p.closed:
+					return
+				}
+			}
+		}()
+	})
+}
+
+func (p *Proxy) recordProbe(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wasHealthy := p.probeState.healthy || !p.probeState.probed
+	p.probeState.probed, p.probeState.at = true, time.Now()
+	p.probeState.healthy = err == nil
+
+	if err == nil {
+		p.probeState.err, p.probeState.failures = "", 0
+		p.metrics.backendUp.Set(1, p.Name)
+		if !wasHealthy {
+			p.log.Info("backend is healthy again", "server_addr", p.MongoAddr)
+		}
+
+		return
+	}
+
+	p.probeState.err = err.Error()
+	p.probeState.failures++
+	p.metrics.backendUp.Set(0, p.Name)
+	if wasHealthy {
+		p.log.Warn("backend probe failed", "server_addr", p.MongoAddr, "err", err)
+	}
+}
+
+// probe sends an isMaster to the backend over a new connection and checks
+// the reply, the request id is taken from the ones of the proxy.
+func (p *Proxy) probe() error {
+	timeout := p.ProbeTimeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	conn, err := p.Dialer.Dial(p.MongoAddr, timeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	doc, err := bson.Marshal(bson.D{{Name: "isMaster", Value: 1}})
+	if err != nil {
+		return err
+	}
+
+	id := p.nextRequestID()
+	q := &protocol.OpQuery{
+		MsgHeader:          &protocol.MsgHeader{RequestID: id, OpCode: protocol.OpQueryCode},
+		FullCollectionName: protocol.CSString("admin.$cmd\x00"),
+		NumberToReturn:     -1,
+		Query:              doc,
+	}
+
+	if _, err := q.WriteTo(conn); err != nil {
+		return err
+	}
+
+	h, err := protocol.ReadMsgHeader(conn)
+	if err != nil {
+		return err
+	}
+
+	if h.OpCode != protocol.OpReplyCode || h.ResponseTo != id {
+		return fmt.Errorf("proxy: unexpected reply to isMaster: %s", h)
+	}
+
+	reply, err := protocol.ReadOpReply(h, bytes.NewReader(h.Message))
+	if err != nil {
+		return err
+	}
+
+	if len(reply.Documents) == 0 {
+		return errProbeNotOK
+	}
+
+	var result struct {
+		OK float64 `bson:"ok"`
+	}
+
+	if err := bson.Unmarshal(reply.Documents[0], &result); err != nil {
+		return err
+	}
+
+	if result.OK != 1 {
+		return errProbeNotOK
+	}
+
+	return nil
+}
+
+// Healthy returns false if the proxy is closed or the last probe of the
+// backend failed. Until the first probe is done the backend is considered
+// unhealthy, without ProbeInterval it is always considered healthy.
+func (p *Proxy) Healthy() bool {
+	p.init()
+	if p.isClosed() {
+		return false
+	}
+
+	if p.ProbeInterval <= 0 {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.probeState.healthy
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ProbeSuite struct{}
+
+var _ = Suite(&ProbeSuite{})
+
+func (s *ProbeSuite) TestProbe_Healthy(c *C) {
+	p := newPipeProxy(isMasterBackend(1))
+	p.ProbeInterval = 10 * time.Millisecond
+
+	c.Assert(p.Start(), IsNil)
+	waitHealthy(p, true)
+	c.Assert(p.Healthy(), Equals, true)
+
+	b := p.Backend()
+	c.Assert(b.Probed, Equals, true)
+	c.Assert(b.Healthy, Equals, true)
+	c.Assert(b.LastProbeError, Equals, "")
+	c.Assert(b.LastProbe.IsZero(), Equals, false)
+
+	c.Assert(p.Stop(), IsNil)
+	c.Assert(p.Healthy(), Equals, false)
+}
+
+func (s *ProbeSuite) TestProbe_Unhealthy(c *C) {
+	p := newPipeProxy(isMasterBackend(0))
+	p.ProbeInterval = 10 * time.Millisecond
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+	c.Assert(p.Healthy(), Equals, false)
+
+	for i := 0; i < 100 && p.Backend().ProbeFailures < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b := p.Backend()
+	c.Assert(b.Healthy, Equals, false)
+	c.Assert(b.ProbeFailures >= 2, Equals, true)
+	c.Assert(b.LastProbeError, Equals, errProbeNotOK.Error())
+}
+
+func (s *ProbeSuite) TestProbe_ResponseTo(c *C) {
+	p := newPipeProxy(func(conn net.Conn) {
+		defer conn.Close()
+
+		h, err := protocol.ReadMsgHeader(conn)
+		if err != nil {
+			return
+		}
+
+		reply := protocol.NewOpReplay(h, 1)
+		reply.MsgHeader.ResponseTo++
+		reply.AddDocument(bson.M{"ok": 1})
+		reply.WriteTo(conn)
+	})
+	p.init()
+
+	c.Assert(p.probe(), ErrorMatches, "proxy: unexpected reply to isMaster: .*")
+}
+
+func (s *ProbeSuite) TestProbe_Disabled(c *C) {
+	p := newPipeProxy(isMasterBackend(0))
+	c.Assert(p.Start(), IsNil)
+	c.Assert(p.Healthy(), Equals, true)
+	c.Assert(p.Backend().Probed, Equals, false)
+
+	c.Assert(p.Stop(), IsNil)
+	c.Assert(p.Healthy(), Equals, false)
+}
+
+// isMasterBackend answers every message with an {ok: ok} document.
+func isMasterBackend(ok int) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			h, err := protocol.ReadMsgHeader(conn)
+			if err != nil {
+				return
+			}
+
+			reply := protocol.NewOpReplay(h, 1)
+			reply.AddDocument(bson.M{"ok": ok})
+			if _, err := reply.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func waitHealthy(p *Proxy, healthy bool) {
+	for i := 0; i < 100 && p.Healthy() != healthy; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
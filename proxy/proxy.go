@@ -1,15 +1,20 @@
 package proxy
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mcuadros/lemondb/capture"
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/metrics"
+	"github.com/mcuadros/lemondb/middlewares"
 	"github.com/mcuadros/lemondb/protocol"
 )
 
@@ -17,241 +22,902 @@ var (
 	errRSChanged         = errors.New("proxy: replset config changed")
 	errNormalClose       = errors.New("proxy: normal close")
 	errClientReadTimeout = errors.New("proxy: client read timeout")
+	errNoListeners       = errors.New("proxy: no address to listen on")
 
 	timeInPast = time.Now()
 )
 
-// Proxy sends stuff from clients to mongo servers.
+const (
+	defaultDialRetries       = 7
+	defaultDialBackoff       = 50 * time.Millisecond
+	defaultMessageTimeout    = 2 * time.Minute
+	defaultClientIdleTimeout = 60 * time.Minute
+
+	clientReadBufferSize = 4096
+	// requestPeekSize is how much of the body is peeked to find the
+	// namespace and command of the messages, without consuming it.
+	requestPeekSize = 512
+)
+
+// Proxy sends stuff from clients to mongo servers. The zero value is ready to
+// be used with Serve once MongoAddr is set, Log, Middleware, Dialer and the
+// timeouts all have sensible defaults.
 type Proxy struct {
-	Log Logger
+	// Name identifies the proxy when many run in the same process, it is the
+	// proxy label of the metrics and a field of the logged lines.
+	Name string
+	// Log is used for every message of the proxy, by default nothing is
+	// logged. The lines about a client carry the conn_id and client_addr
+	// fields.
+	Log logging.Logger
 	// Address for incoming client connections
 	ProxyAddr string
 	// Address for destination Mongo server
 	MongoAddr string
 	// ClientIdleTimeout is how long until we'll consider a client connection
-	// idle and disconnect and release it's resources.
+	// idle and disconnect and release it's resources, by default 60 minutes.
 	ClientIdleTimeout time.Duration
-	// MessageTimeout is used to determine the timeout for a single message.
+	// MessageTimeout is used to determine the timeout for a single message,
+	// by default 2 minutes.
 	MessageTimeout time.Duration
-	Middleware     Middleware
-
-	listener net.Listener
-	closed   chan struct{}
+	// Middleware handles every message, by default the messages are just
+	// proxied to the server. Once the proxy is running it can be replaced
+	// with SetMiddleware.
+	Middleware Middleware
+	// TLS if not nil the client connections on ProxyAddr are expected to be
+	// TLS.
+	TLS *TLSConfig
+	// Listeners are additional addresses for incoming client connections,
+	// such as Unix domain sockets.
+	Listeners []ListenerConfig
+	// Listen creates the listeners for ProxyAddr and Listeners, by default
+	// net.Listen. It allows to reuse listeners inherited from other process.
+	Listen ListenFunc
+	// Dialer is used to connect to MongoAddr, by default TCPDialer.
+	Dialer Dialer
+	// DialTimeout is the connect timeout for every dial attempt.
+	DialTimeout time.Duration
+	// DialRetries is how many times we try to connect to the server before
+	// giving up, by default 7.
+	DialRetries int
+	// DialBackoff is the sleep after the first failed attempt, it is doubled
+	// after each attempt, by default 50ms.
+	DialBackoff time.Duration
+	// MaxClients is the maximum number of clients connected at the same time,
+	// zero means no limit.
+	MaxClients int
+	// MaxClientsPerIP is the maximum number of clients connected at the same
+	// time from the same address, zero means no limit.
+	MaxClientsPerIP int
+	// MaxInFlight is the maximum number of messages being handled at the same
+	// time, zero means no limit.
+	MaxInFlight int
+	// MaxQueue is how many messages can wait for a slot when MaxInFlight is
+	// reached, any message beyond it is rejected.
+	MaxQueue int
+	// QueueTimeout is how long a message can wait for a slot, by default
+	// MessageTimeout.
+	QueueTimeout time.Duration
+	// Metrics if not nil receives the metrics of the proxy, it can be shared
+	// by many proxies with different names.
+	Metrics *metrics.Registry
+	// DrainTimeout is how long Stop waits for the clients to finish their
+	// messages before disconnecting them, zero means no limit.
+	DrainTimeout time.Duration
+	// ProbeInterval is how often the backend is probed with an isMaster once
+	// the proxy is serving, zero disables the probes.
+	ProbeInterval time.Duration
+	// ProbeTimeout is the timeout of every probe, by default 5 seconds.
+	ProbeTimeout time.Duration
+	// Capture if not nil records the messages matching its options, and
+	// their replies, while it is started.
+	Capture *capture.Capture
+
+	initOnce  sync.Once
+	closeOnce sync.Once
+	mu        sync.Mutex
+	listeners []net.Listener
+	clients   map[*Client]struct{}
+	// accepted are the connections not tracked as clients yet, in the
+	// handshake, the admission or the dial of the server.
+	accepted  map[net.Conn]struct{}
+	closed    chan struct{}
+	limiter   *limiter
+	requestID int32
+	pipeline  atomic.Value
+	// pipelineMu guards serving, true while the middleware is started.
+	pipelineMu sync.Mutex
+	serving    bool
+	log        logging.Logger
+	metrics    *proxyMetrics
+	// dialFailures, lastDialErr, lastDialErrAt and probeState are guarded
+	// by mu.
+	dialFailures  uint64
+	lastDialErr   string
+	lastDialErrAt time.Time
+	probeOnce     sync.Once
+	probeState    probeState
 	sync.WaitGroup
 }
 
 // String representation for debugging.
 func (p *Proxy) String() string {
-	return fmt.Sprintf("proxy %s => mongo %s", p.ProxyAddr, p.MongoAddr)
+	addrs := make([]string, 0, len(p.Listeners)+1)
+	for _, cfg := range p.listenerConfigs() {
+		addrs = append(addrs, cfg.Addr)
+	}
+
+	s := fmt.Sprintf("proxy %s => mongo %s", strings.Join(addrs, ","), p.MongoAddr)
+	if p.Name != "" {
+		s = fmt.Sprintf("%s (%s)", s, p.Name)
+	}
+
+	return s
 }
 
-// Start the proxy.
-func (p *Proxy) Start() error {
-	if err := p.createListener(); err != nil {
-		return err
+// init sets the defaults, it is called by both Start and Serve.
+func (p *Proxy) init() {
+	p.initOnce.Do(func() {
+		p.closed = make(chan struct{})
+		p.clients = make(map[*Client]struct{})
+		p.accepted = make(map[net.Conn]struct{})
+
+		if p.Log == nil {
+			p.Log = logging.Discard
+		}
+
+		p.log = p.Log
+		if p.Name != "" {
+			p.log = p.Log.With("proxy", p.Name)
+		}
+
+		if p.Middleware == nil {
+			p.Middleware = &middlewares.ProxyMiddleware{}
+		}
+
+		p.pipeline.Store(newPipeline(p.Middleware))
+
+		if p.Dialer == nil {
+			p.Dialer = &TCPDialer{}
+		}
+
+		if p.DialRetries <= 0 {
+			p.DialRetries = defaultDialRetries
+		}
+
+		if p.DialBackoff <= 0 {
+			p.DialBackoff = defaultDialBackoff
+		}
+
+		if p.MessageTimeout <= 0 {
+			p.MessageTimeout = defaultMessageTimeout
+		}
+
+		if p.ClientIdleTimeout <= 0 {
+			p.ClientIdleTimeout = defaultClientIdleTimeout
+		}
+
+		registry := p.Metrics
+		if registry == nil {
+			registry = metrics.NewRegistry()
+		}
+
+		p.metrics = newProxyMetrics(registry, p.Name)
+		p.limiter = newLimiter(p)
+	})
+}
+
+// pipeline wraps the middleware counting the messages it is handling, so it
+// is only stopped once they are done.
+type pipeline struct {
+	Middleware
+	// mu guards inflight and retired.
+	mu       sync.Mutex
+	inflight int
+	// retired is set once the middleware was replaced, idle is closed when
+	// it is retired and no message is in flight.
+	retired bool
+	idle    chan struct{}
+}
+
+func newPipeline(m Middleware) *pipeline {
+	return &pipeline{Middleware: m, idle: make(chan struct{})}
+}
+
+// acquire counts a new message in flight, it fails if the pipeline was
+// retired in the meantime.
+func (pl *pipeline) acquire() bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if pl.retired {
+		return false
+	}
+
+	pl.inflight++
+	return true
+}
+
+// release is called once a message acquired is handled.
+func (pl *pipeline) release() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.inflight--
+	if pl.inflight == 0 && pl.retired {
+		close(pl.idle)
+	}
+}
+
+// retire stops new messages from acquiring the pipeline, the returned channel
+// is closed once the messages in flight are handled.
+func (pl *pipeline) retire() <-chan struct{} {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.retired = true
+	if pl.inflight == 0 {
+		close(pl.idle)
+	}
+
+	return pl.idle
+}
+
+// SetMiddleware replaces the middleware while the proxy is running. The
+// messages already being handled finish with the previous middleware, any
+// message read after SetMiddleware returns is handled by m. While serving, m
+// is started and, once its messages in flight are handled, the previous
+// middleware is stopped if they are a Service. SetMiddleware waits for it.
+func (p *Proxy) SetMiddleware(m Middleware) {
+	p.init()
+	if m == nil {
+		m = &middlewares.ProxyMiddleware{}
+	}
+
+	p.pipelineMu.Lock()
+	serving := p.serving
+	if serving {
+		p.startMiddleware(m)
+	}
+
+	old := p.pipeline.Load().(*pipeline)
+	p.pipeline.Store(newPipeline(m))
+	p.pipelineMu.Unlock()
+
+	<-old.retire()
+	if serving {
+		p.stopMiddleware(old.Middleware)
+	}
+}
+
+// acquirePipeline returns the current pipeline, counting a message in flight
+// on it until release is called.
+func (p *Proxy) acquirePipeline() *pipeline {
+	for {
+		pl := p.pipeline.Load().(*pipeline)
+		if pl.acquire() {
+			return pl
+		}
 	}
+}
 
-	p.closed = make(chan struct{})
+// startPipeline starts the middleware, if it is a Service, the first time the
+// proxy serves.
+func (p *Proxy) startPipeline() error {
+	p.pipelineMu.Lock()
+	defer p.pipelineMu.Unlock()
+
+	if p.serving {
+		return nil
+	}
 
-	go p.clientAcceptLoop()
+	if s, ok := p.CurrentMiddleware().(Service); ok {
+		if err := s.Start(p.log); err != nil {
+			return err
+		}
+	}
 
+	p.serving = true
 	return nil
 }
 
-func (p *Proxy) createListener() error {
-	var err error
-	if p.listener, err = net.Listen("tcp", p.ProxyAddr); err != nil {
+// stopPipeline stops the middleware, if it is a Service, once the proxy is
+// stopped.
+func (p *Proxy) stopPipeline() error {
+	p.pipelineMu.Lock()
+	defer p.pipelineMu.Unlock()
+
+	if !p.serving {
+		return nil
+	}
+
+	p.serving = false
+	if s, ok := p.CurrentMiddleware().(Service); ok {
+		return s.Stop()
+	}
+
+	return nil
+}
+
+func (p *Proxy) startMiddleware(m Middleware) {
+	if s, ok := m.(Service); ok {
+		if err := s.Start(p.log); err != nil {
+			p.log.Error("error starting middleware", "err", err)
+		}
+	}
+}
+
+func (p *Proxy) stopMiddleware(m Middleware) {
+	if s, ok := m.(Service); ok {
+		if err := s.Stop(); err != nil {
+			p.log.Error("error stopping middleware", "err", err)
+		}
+	}
+}
+
+// CurrentMiddleware returns the middleware handling the new messages.
+func (p *Proxy) CurrentMiddleware() Middleware {
+	p.init()
+	return p.pipeline.Load().(*pipeline).Middleware
+}
+
+// Usage returns the number of clients and messages currently handled.
+func (p *Proxy) Usage() Usage {
+	p.init()
+	return p.limiter.usage()
+}
+
+// nextRequestID returns a request id for the messages generated by the proxy
+// itself.
+func (p *Proxy) nextRequestID() int32 {
+	return atomic.AddInt32(&p.requestID, 1)
+}
+
+func (p *Proxy) updateUsage() {
+	p.metrics.usage(p.limiter.usage())
+}
+
+// Start the proxy, listening on ProxyAddr and Listeners.
+func (p *Proxy) Start() error {
+	p.init()
+
+	cfgs := p.listenerConfigs()
+	if len(cfgs) == 0 {
+		return errNoListeners
+	}
+
+	listeners := make([]net.Listener, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		l, err := cfg.listen(p.Listen)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if err := p.startPipeline(); err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+
 		return err
 	}
 
+	for _, l := range listeners {
+		p.Serve(l)
+	}
+
 	return nil
 }
 
+// Serve accepts clients on the given listener, it can be called any number of
+// times and together with Start. The listener is closed by Stop. The returned
+// channel receives nil once the listener is closed or the error that made the
+// proxy stop accepting, and it is closed afterwards.
+func (p *Proxy) Serve(l net.Listener) <-chan error {
+	p.init()
+
+	p.mu.Lock()
+	p.listeners = append(p.listeners, l)
+	p.mu.Unlock()
+
+	if err := p.startPipeline(); err != nil {
+		p.log.Error("error starting middleware", "err", err)
+	}
+
+	p.startProber()
+
+	// the loop is counted before it starts, so a Wait right after Serve
+	// waits for it.
+	p.Add(1)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- p.clientAcceptLoop(l)
+		close(errc)
+	}()
+
+	return errc
+}
+
+// Addr returns the address of the first listener, nil if the proxy is not
+// listening yet. Useful when ProxyAddr uses the port 0.
+func (p *Proxy) Addr() net.Addr {
+	addrs := p.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	return addrs[0]
+}
+
+// Addrs returns the addresses of all the listeners, in the order they were
+// created.
+func (p *Proxy) Addrs() []net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addrs := make([]net.Addr, len(p.listeners))
+	for i, l := range p.listeners {
+		addrs[i] = l.Addr()
+	}
+
+	return addrs
+}
+
+// Unlisten closes the listeners without disconnecting the clients, so their
+// addresses can be taken by other proxies. Start listens again.
+func (p *Proxy) Unlisten() error {
+	p.init()
+
+	p.mu.Lock()
+	listeners := p.listeners
+	p.listeners = nil
+	p.mu.Unlock()
+
+	var first error
+	for _, l := range listeners {
+		err := l.Close()
+		if err != nil && !isClosedErr(err) && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// listenerConfigs returns the config of every listener, ProxyAddr included.
+func (p *Proxy) listenerConfigs() []ListenerConfig {
+	var cfgs []ListenerConfig
+	if p.ProxyAddr != "" {
+		cfgs = append(cfgs, ListenerConfig{Addr: p.ProxyAddr, TLS: p.TLS})
+	}
+
+	return append(cfgs, p.Listeners...)
+}
+
+func (p *Proxy) closeListeners() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var first error
+	for _, l := range p.listeners {
+		err := l.Close()
+		if err != nil && !isClosedErr(err) && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
 // clientAcceptLoop accepts new clients and creates a clientServeLoop for each
-// new client that connects to the proxy.
-func (p *Proxy) clientAcceptLoop() {
+// new client that connects to the proxy. It returns nil once the listener is
+// closed. Serve counts it in the WaitGroup, the loop is done when it returns.
+func (p *Proxy) clientAcceptLoop(l net.Listener) error {
+	defer p.Done()
+
 	for {
-		p.Add(1)
-		c, err := p.listener.Accept()
+		c, err := l.Accept()
 		if err != nil {
-			p.Done()
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				break
+			if isClosedErr(err) {
+				return nil
 			}
-			p.Log.Error(err)
-			continue
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				p.log.Error("error accepting client", "err", err)
+				continue
+			}
+
+			return err
 		}
 
+		p.Add(1)
 		go p.clientServeLoop(c)
 	}
 }
 
 // clientServeLoop loops on a single client connected to the proxy and
 // dispatches its requests.
-func (p *Proxy) clientServeLoop(c net.Conn) {
-	c = teeIf(fmt.Sprintf("client %s <=> %s", c.RemoteAddr(), p), c)
-	p.Log.Infof("client %s connected to %s", c.RemoteAddr(), p)
+func (p *Proxy) clientServeLoop(conn net.Conn) {
+	p.trackAccepted(conn)
+	c := newClient(conn, p.log)
+	c.SetDeadline(time.Now().Add(p.MessageTimeout))
+	err := c.handshake()
+	c.log = c.log.With("client_addr", c.RemoteAddr())
+	if err != nil {
+		c.log.Error("handshake failed", "err", err)
+		p.untrackAccepted(conn)
+		c.Close()
+		p.Done()
+		return
+	}
+
+	c.reader = bufio.NewReaderSize(c.Conn, clientReadBufferSize)
+	if subject := c.Subject(); subject != "" {
+		c.log = c.log.With("subject", subject)
+	}
+
+	c.log.Info("client connected")
+	if err := p.limiter.admit(c.RemoteAddr()); err != nil {
+		c.log.Warn("client rejected", "err", err)
+		p.metrics.rejected.Inc(p.Name)
+		p.rejectClient(c, err)
+		p.untrackAccepted(conn)
+		c.Close()
+		p.Done()
+		return
+	}
 
-	s, err := p.newServerConn()
-	p.Log.Infof("server %s connected to %s", s.RemoteAddr(), p)
+	p.metrics.accepted.Inc(p.Name)
+	p.updateUsage()
+
+	s, err := p.newServerConn(c.log)
 	if err != nil {
-		p.Log.Error(err)
+		c.log.Error("error connecting to the server", "err", err)
+		p.limiter.release(c.RemoteAddr())
+		p.updateUsage()
+		p.untrackAccepted(conn)
+		c.Close()
+		p.Done()
+		return
 	}
 
+	c.log.Info("server connected", "server_addr", s.RemoteAddr())
+	c.server = s
+	p.trackClient(c)
+
 	defer func() {
-		p.Log.Infof("client %s disconnected from %s", c.RemoteAddr(), p)
+		c.log.Info("client disconnected", "duration", time.Since(c.connected))
+		p.untrackClient(c)
+		p.limiter.release(c.RemoteAddr())
+		p.updateUsage()
+		p.metrics.traffic(c)
 		p.Done()
 
-		if err := s.Close(); err != nil {
-			p.Log.Error(err)
+		if err := s.Close(); err != nil && !isClosedErr(err) {
+			c.log.Error("error closing the server connection", "err", err)
 		}
 
-		if err := c.Close(); err != nil {
-			p.Log.Error(err)
+		if err := c.Close(); err != nil && !isClosedErr(err) {
+			c.log.Error("error closing the client connection", "err", err)
 		}
 	}()
 
 	for {
-		h, err := p.idleClientReadMsgHeader(c)
+		m, pl, r, err := p.readMessage(c)
 		if err != nil {
 			if err != errNormalClose {
-				p.Log.Error(err)
+				c.log.Error("error reading message", "err", err)
 			}
 			return
 		}
 
+		h := m.GetMsgHeader()
+		c.handling(h, r)
+		start := time.Now()
+		done, err := p.limiter.acquire(p.closed)
+		if err != nil {
+			pl.release()
+			if err == errNormalClose {
+				return
+			}
+
+			if err := discardBody(m); err != nil {
+				c.log.Error("error reading message", "op", h.OpCode, "err", err)
+				return
+			}
+
+			c.log.Warn("message rejected", "op", h.OpCode, "ns", r.ns, "err", err)
+			p.metrics.rejectedMessages.Inc(p.Name)
+			p.replyError(c, h, errCodeTooManyConnections, err)
+			if !h.OpCode.HasResponse() {
+				return
+			}
+
+			c.handled()
+			continue
+		}
+
+		p.updateUsage()
 		deadline := time.Now().Add(p.MessageTimeout)
 		c.SetDeadline(deadline)
 		s.SetDeadline(deadline)
 
-		p.Log.Debugf("handling message %s from %s for %s", h, c.RemoteAddr(), p)
-		if err := p.Middleware.Handle(h, c, s); err != nil {
-			p.Log.Error(err)
+		if r.capture {
+			err = p.handleCapture(pl.Middleware, h, c, s, start)
+		} else {
+			err = pl.Handle(m, c, s)
+		}
+
+		if err == nil {
+			err = discardBody(m)
+		}
+		pl.release()
+		done()
+		c.handled()
+
+		duration := time.Since(start)
+		p.updateUsage()
+		p.metrics.handled(h, r, duration, err)
+		p.metrics.traffic(c)
+		if err != nil {
+			c.log.Error("error handling message",
+				"op", h.OpCode, "ns", r.ns, "request_id", h.RequestID, "err", err,
+			)
 			return
 		}
-	}
 
-}
+		c.log.Debug("message handled",
+			"op", h.OpCode, "ns", r.ns, "command", r.command, "request_id", h.RequestID,
+			"duration", duration,
+		)
+	}
 
-// We wait for upto ClientIdleTimeout in MessageTimeout increments and keep
-// checking if we're waiting to be closed. This ensures that at worse we
-// wait for MessageTimeout when closing even when we're idling.
-func (p *Proxy) idleClientReadMsgHeader(c net.Conn) (*protocol.MsgHeader, error) {
-	return p.clientReadMsgHeader(c, p.ClientIdleTimeout)
 }
 
-func (p *Proxy) clientReadMsgHeader(c net.Conn, timeout time.Duration) (*protocol.MsgHeader, error) {
-	type headerError struct {
-		header *protocol.MsgHeader
-		error  error
+// readMessage waits up to ClientIdleTimeout for the next message of the
+// client. While waiting the client is idle, so it can be woken up by stop
+// moving its read deadline to the past, without needing a goroutine to watch
+// for the proxy being closed.
+//
+// The pipeline that must handle the message is returned along with it,
+// acquired until the message is handled. The body is only read if its
+// middleware needs it, otherwise the message is
+// returned as a protocol.StreamedMessage. Either way the namespace and command
+// of the message are peeked from the body.
+func (p *Proxy) readMessage(c *Client) (protocol.Message, *pipeline, request, error) {
+	var r request
+	if !c.waitIdle(p.closed, p.ClientIdleTimeout) {
+		return nil, nil, r, errNormalClose
 	}
-	resChan := make(chan headerError)
 
-	c.SetReadDeadline(time.Now().Add(timeout))
-	go func() {
-		h, err := protocol.ReadMsgHeader(c)
-		resChan <- headerError{header: h, error: err}
-	}()
+	_, err := c.reader.Peek(1)
+	c.wakeUp(p.MessageTimeout)
 
-	closed := false
-	var response headerError
-
-	select {
-	case response = <-resChan:
-		// all good
-	case <-p.closed:
-		closed = true
-		c.SetReadDeadline(timeInPast)
-		response = <-resChan
+	var h *protocol.MsgHeader
+	if err == nil {
+		h, err = protocol.ReadHeader(c)
 	}
 
-	// Successfully read a header.
-	if response.error == nil {
-		return response.header, nil
+	if err == nil {
+		pl := p.acquirePipeline()
+		r = c.peekRequest(h)
+		r.capture = p.Capture != nil && p.Capture.Match(r.ns, c.RemoteAddr())
+		if st, ok := pl.Middleware.(Streamer); ok && !r.capture && !st.NeedsBody(h) {
+			return &protocol.StreamedMessage{MsgHeader: h, Body: c}, pl, r, nil
+		}
+
+		// Successfully read a message.
+		if err = h.ReadBody(c); err == nil {
+			return h, pl, r, nil
+		}
+
+		pl.release()
 	}
 
 	// Client side disconnected.
-	if response.error == io.EOF {
-		return nil, errNormalClose
+	if err == io.EOF {
+		return nil, nil, r, errNormalClose
 	}
 
 	// We hit our ReadDeadline.
-	if ne, ok := response.error.(net.Error); ok && ne.Timeout() {
-		if closed {
-			return nil, errNormalClose
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if p.isClosed() {
+			return nil, nil, r, errNormalClose
 		}
-		return nil, errClientReadTimeout
+		return nil, nil, r, errClientReadTimeout
 	}
 
 	// Some other unknown error.
-	p.Log.Error(response.error)
-	return nil, response.error
+	return nil, nil, r, err
 }
 
-// Stop the proxy.
-func (p *Proxy) Stop() error {
-	return p.stop(false)
+// request is what is known about a message from the first bytes of its body.
+type request struct {
+	ns      string
+	command string
+	// user is set for the authentication commands.
+	user string
+	// capture is true if the message has to be captured, its body is always
+	// read.
+	capture bool
 }
 
-func (p *Proxy) stop(hard bool) error {
-	if err := p.listener.Close(); err != nil {
-		return err
+// discardBody drops what is left of the body of a streamed message, in case
+// the middleware didn't write it.
+func discardBody(m protocol.Message) error {
+	if sm, ok := m.(*protocol.StreamedMessage); ok {
+		return sm.Discard()
 	}
-	close(p.closed)
-	if !hard {
+
+	return nil
+}
+
+func (p *Proxy) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the proxy, draining it for up to DrainTimeout.
+func (p *Proxy) Stop() error {
+	return p.Drain(p.DrainTimeout)
+}
+
+// Drain stops accepting new clients and disconnects the idle ones right away,
+// the clients with a message in flight are disconnected once it is handled.
+// When the timeout passes, the remaining clients are forcibly disconnected. A
+// zero timeout waits as long as needed.
+func (p *Proxy) Drain(timeout time.Duration) error {
+	err := p.stop()
+
+	done := make(chan struct{})
+	go func() {
 		p.Wait()
+		close(done)
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
 	}
-	return nil
+
+	select {
+	case <-done:
+	case <-deadline:
+		p.log.Warn("drain timeout reached, disconnecting the clients", "clients", p.Usage().Clients)
+		p.closeClients()
+		<-done
+	}
+
+	if serr := p.stopPipeline(); err == nil {
+		err = serr
+	}
+
+	return err
 }
 
-// Open up a new connection to the server. Retry 7 times, doubling the sleep
-// each time. This means we'll a total of 12.75 seconds with the last wait
-// being 6.4 seconds.
-func (p *Proxy) newServerConn() (net.Conn, error) {
-	retrySleep := 50 * time.Millisecond
-	for retryCount := 7; retryCount > 0; retryCount-- {
-		c, err := net.Dial("tcp", p.MongoAddr)
-		if err == nil {
-			return c, nil
-		}
-		p.Log.Error(err)
+// Close stops accepting new clients and disconnects all the clients right
+// away, without waiting for the messages in flight. It can be called while
+// Drain is waiting, to cut it short.
+func (p *Proxy) Close() error {
+	err := p.stop()
+	p.closeClients()
+	p.Wait()
 
-		time.Sleep(retrySleep)
-		retrySleep = retrySleep * 2
+	if serr := p.stopPipeline(); err == nil {
+		err = serr
 	}
 
-	return nil, fmt.Errorf("could not connect to %s", p.MongoAddr)
+	return err
 }
 
-var teeIfEnable = os.Getenv("MONGOPROXY_TEE") == "1"
+// stop closes the listeners and tells the clients that we are closing, it is
+// safe to call it more than once.
+func (p *Proxy) stop() error {
+	p.init()
+
+	err := p.closeListeners()
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wakeUpIdleClients()
+	})
 
-type teeConn struct {
-	context string
-	net.Conn
+	return err
 }
 
-func (t teeConn) Read(b []byte) (int, error) {
-	n, err := t.Conn.Read(b)
-	if n > 0 {
-		fmt.Fprintf(os.Stdout, "READ %s: %s %v\n", t.context, b[0:n], b[0:n])
+// trackAccepted registers a connection just accepted, so it can be closed on
+// Close or at the drain deadline before it is tracked as a client.
+func (p *Proxy) trackAccepted(conn net.Conn) {
+	p.mu.Lock()
+	p.accepted[conn] = struct{}{}
+	p.mu.Unlock()
+}
+
+func (p *Proxy) untrackAccepted(conn net.Conn) {
+	p.mu.Lock()
+	delete(p.accepted, conn)
+	p.mu.Unlock()
+}
+
+// trackClient registers a client, so it can be disconnected on Close.
+func (p *Proxy) trackClient(c *Client) {
+	p.mu.Lock()
+	delete(p.accepted, c.Conn)
+	p.clients[c] = struct{}{}
+	p.mu.Unlock()
+}
+
+func (p *Proxy) untrackClient(c *Client) {
+	p.mu.Lock()
+	delete(p.clients, c)
+	p.mu.Unlock()
+}
+
+// wakeUpIdleClients makes the clients waiting for a message to give up.
+func (p *Proxy) wakeUpIdleClients() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for c := range p.clients {
+		c.wakeUpIfIdle()
 	}
-	return n, err
 }
 
-func (t teeConn) Write(b []byte) (int, error) {
-	n, err := t.Conn.Write(b)
-	if n > 0 {
-		fmt.Fprintf(os.Stdout, "WRIT %s: %s %v\n", t.context, b[0:n], b[0:n])
+// closeClients closes the client and server connections of every client,
+// and the connections not tracked as clients yet, unblocking any read or
+// write on them.
+func (p *Proxy) closeClients() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for conn := range p.accepted {
+		conn.Close()
+	}
+
+	for c := range p.clients {
+		c.forceClose()
 	}
-	return n, err
 }
 
-func teeIf(context string, c net.Conn) net.Conn {
-	if teeIfEnable {
-		return teeConn{
-			context: context,
-			Conn:    c,
+// Open up a new connection to the server. Try DialRetries times, doubling the
+// sleep between attempts each time. With the defaults this means we'll wait a
+// total of 3.15 seconds with the last wait being 1.6 seconds.
+func (p *Proxy) newServerConn(log logging.Logger) (net.Conn, error) {
+	retrySleep := p.DialBackoff
+	for retryCount := p.DialRetries; retryCount > 0; retryCount-- {
+		c, err := p.Dialer.Dial(p.MongoAddr, p.DialTimeout)
+		if err == nil {
+			return c, nil
+		}
+		log.Warn("error dialing the server", "server_addr", p.MongoAddr, "err", err)
+		p.dialFailed(err)
+
+		if retryCount > 1 {
+			select {
+			case <-time.After(retrySleep):
+			case <-p.closed:
+				return nil, errNormalClose
+			}
+
+			retrySleep = retrySleep * 2
 		}
 	}
-	return c
+
+	return nil, fmt.Errorf("could not connect to %s", p.MongoAddr)
+}
+
+func isClosedErr(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
 }
@@ -1,9 +1,13 @@
 package proxy
 
 import (
+	"flag"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/mcuadros/lemondb/cassette"
+	"github.com/mcuadros/lemondb/logging"
 	"github.com/mcuadros/lemondb/middlewares"
 
 	"github.com/facebookgo/mgotest"
@@ -12,31 +16,60 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+var recordCassettes = flag.Bool("cassette.record", false, "record the cassettes of ProxySuite again, against a mongod started by the tests")
+
 func Test(t *testing.T) {
 	Suite(&ProxySuite{testing: t})
 	TestingT(t)
 }
 
+// ProxySuite runs against the replies of a real mongod recorded in
+// testdata/cassettes, the tests without cassette fail. With -cassette.record
+// they are run against a mongod and their cassettes written.
 type ProxySuite struct {
-	testing *testing.T
-	server  *mgotest.Server
-	session *mgo.Session
-	proxy   *Proxy
+	testing   *testing.T
+	server    *mgotest.Server
+	player    *cassette.Player
+	session   *mgo.Session
+	proxy     *Proxy
+	recording *cassette.Cassette
 }
 
 func (s *ProxySuite) SetUpTest(c *C) {
-	s.server = mgotest.NewStartedServer(s.testing)
-	s.proxy = s.getNewProxy(s.server.URL())
-	s.proxy.Start()
+	s.server, s.player, s.proxy, s.session, s.recording = nil, nil, nil, nil, nil
+
+	file := s.cassetteFile(c)
+	switch {
+	case !*recordCassettes:
+		if !cassette.Exists(file) {
+			c.Fatalf("no cassette at %s, record it with -cassette.record against a mongod", file)
+		}
+
+		cst, err := cassette.Load(file)
+		c.Assert(err, IsNil)
+
+		s.player = &cassette.Player{Cassette: cst}
+		s.proxy = s.getNewProxy("cassette")
+		s.proxy.Dialer = s.player
+	default:
+		s.server = mgotest.NewStartedServer(s.testing)
+		s.recording = cassette.New()
+		s.proxy = s.getNewProxy(s.server.URL())
+		s.proxy.Dialer = &cassette.Recorder{Dialer: &TCPDialer{}, Cassette: s.recording}
+	}
 
-	s.session, _ = mgo.Dial(s.proxy.ProxyAddr)
+	c.Assert(s.proxy.Start(), IsNil)
+
+	var err error
+	s.session, err = mgo.DialWithTimeout(s.proxy.ProxyAddr, 5*time.Second)
+	c.Assert(err, IsNil)
 }
 
 func (s *ProxySuite) TestProxy_SimpleCRUD(c *C) {
 	collection := s.session.DB("test").C("coll1")
-	data := map[string]interface{}{
-		"_id":  1,
-		"name": "abc",
+	data := bson.D{
+		{Name: "_id", Value: 1},
+		{Name: "name", Value: "abc"},
 	}
 	err := collection.Insert(data)
 	c.Assert(err, IsNil)
@@ -55,9 +88,9 @@ func (s *ProxySuite) TestProxy_SimpleCRUD(c *C) {
 
 func (s *ProxySuite) TestProxy_IDConstraint(c *C) {
 	collection := s.session.DB("test").C("coll1")
-	data := map[string]interface{}{
-		"_id":  1,
-		"name": "abc",
+	data := bson.D{
+		{Name: "_id", Value: 1},
+		{Name: "name", Value: "abc"},
 	}
 
 	err := collection.Insert(data)
@@ -81,17 +114,17 @@ func (s *ProxySuite) TestProxy_EnsureIndex(c *C) {
 	c.Assert(err, IsNil)
 
 	err = collection.Insert(
-		map[string]string{
-			"firstname": "harvey",
-			"lastname":  "dent",
+		bson.D{
+			{Name: "firstname", Value: "harvey"},
+			{Name: "lastname", Value: "dent"},
 		},
 	)
 	c.Assert(err, IsNil)
 
 	err = collection.Insert(
-		map[string]string{
-			"firstname": "harvey",
-			"lastname":  "dent",
+		bson.D{
+			{Name: "firstname", Value: "harvey"},
+			{Name: "lastname", Value: "dent"},
 		},
 	)
 	c.Assert(err, NotNil)
@@ -111,9 +144,9 @@ func (s *ProxySuite) TestProxy_DropIndex(c *C) {
 	c.Assert(err, IsNil)
 
 	err = collection.Insert(
-		map[string]string{
-			"firstname": "harvey",
-			"lastname":  "dent",
+		bson.D{
+			{Name: "firstname", Value: "harvey"},
+			{Name: "lastname", Value: "dent"},
 		},
 	)
 	c.Assert(err, IsNil)
@@ -122,9 +155,9 @@ func (s *ProxySuite) TestProxy_DropIndex(c *C) {
 	c.Assert(err, IsNil)
 
 	err = collection.Insert(
-		map[string]string{
-			"firstname": "harvey",
-			"lastname":  "dent",
+		bson.D{
+			{Name: "firstname", Value: "harvey"},
+			{Name: "lastname", Value: "dent"},
 		},
 	)
 	c.Assert(err, IsNil)
@@ -133,23 +166,23 @@ func (s *ProxySuite) TestProxy_DropIndex(c *C) {
 
 func (s *ProxySuite) TestProxy_Remove(c *C) {
 	collection := s.session.DB("test").C("coll1")
-	err := collection.Insert(bson.M{"S": "hello", "I": 24})
+	err := collection.Insert(bson.D{{Name: "S", Value: "hello"}, {Name: "I", Value: 24}})
 	c.Assert(err, IsNil)
 
-	err = collection.Remove(bson.M{"S": "hello", "I": 24})
+	err = collection.Remove(bson.D{{Name: "S", Value: "hello"}, {Name: "I", Value: 24}})
 	c.Assert(err, IsNil)
 
 	var res []interface{}
-	collection.Find(bson.M{"S": "hello", "I": 24}).All(&res)
+	collection.Find(bson.D{{Name: "S", Value: "hello"}, {Name: "I", Value: 24}}).All(&res)
 	c.Assert(res, IsNil)
 
-	err = collection.Remove(bson.M{"S": "hello", "I": 24})
+	err = collection.Remove(bson.D{{Name: "S", Value: "hello"}, {Name: "I", Value: 24}})
 	c.Assert(res, IsNil)
 }
 
 func (s *ProxySuite) TestProxy_Update(c *C) {
 	collection := s.session.DB("test").C("coll1")
-	err := collection.Insert(bson.M{"_id": "1234", "name": "Alfred"})
+	err := collection.Insert(bson.D{{Name: "_id", Value: "1234"}, {Name: "name", Value: "Alfred"}})
 	c.Assert(err, IsNil)
 
 	var result map[string]interface{}
@@ -171,8 +204,14 @@ func (s *ProxySuite) TestProxy_GoingAwayAndReturning(c *C) {
 	err := collection.Insert(bson.M{"value": 1})
 	c.Assert(err, IsNil)
 
-	s.server.Stop()
-	s.server.Start()
+	// played from a cassette the outage is simulated by the player.
+	if s.server != nil {
+		s.server.Stop()
+		s.server.Start()
+	} else {
+		s.player.Outage()
+		s.player.Restore()
+	}
 
 	// For now we can only gurantee that eventually things will work again. In an
 	// ideal world the very first client connection after mongo returns should
@@ -186,9 +225,25 @@ func (s *ProxySuite) TestProxy_GoingAwayAndReturning(c *C) {
 }
 
 func (s *ProxySuite) TearDownTest(c *C) {
-	s.session.Close()
-	s.proxy.Stop()
-	s.server.Stop()
+	if s.session != nil {
+		s.session.Close()
+	}
+
+	if s.proxy != nil {
+		s.proxy.Stop()
+	}
+
+	if s.server != nil {
+		s.server.Stop()
+	}
+
+	if s.recording != nil && !c.Failed() && s.recording.Len() > 0 {
+		c.Assert(s.recording.Save(s.cassetteFile(c)), IsNil)
+	}
+}
+
+func (s *ProxySuite) cassetteFile(c *C) string {
+	return filepath.Join("testdata", "cassettes", c.TestName()+".json")
 }
 
 func (s *ProxySuite) getNewProxy(mongoAddr string) *Proxy {
@@ -204,11 +259,8 @@ func (s *ProxySuite) getNewProxy(mongoAddr string) *Proxy {
 
 type nopLogger struct{}
 
-func (n nopLogger) Error(args ...interface{})                 {}
-func (n nopLogger) Errorf(format string, args ...interface{}) {}
-func (n nopLogger) Warn(args ...interface{})                  {}
-func (n nopLogger) Warnf(format string, args ...interface{})  {}
-func (n nopLogger) Info(args ...interface{})                  {}
-func (n nopLogger) Infof(format string, args ...interface{})  {}
-func (n nopLogger) Debug(args ...interface{})                 {}
-func (n nopLogger) Debugf(format string, args ...interface{}) {}
+func (n nopLogger) Debug(msg string, kv ...interface{})   {}
+func (n nopLogger) Info(msg string, kv ...interface{})    {}
+func (n nopLogger) Warn(msg string, kv ...interface{})    {}
+func (n nopLogger) Error(msg string, kv ...interface{})   {}
+func (n nopLogger) With(kv ...interface{}) logging.Logger { return n }
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The PROXY protocol allows a load balancer to send the address of the real
+// client before the connection payload, for the spec see:
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+var (
+	errProxyProtoMissing   = errors.New("proxy: missing PROXY protocol header")
+	errProxyProtoMalformed = errors.New("proxy: malformed PROXY protocol header")
+
+	proxyProtoV1Prefix = []byte("PROXY ")
+	proxyProtoV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyProtoV1MaxLen = 107
+)
+
+// proxyProtoListener wraps the accepted connections from the trusted
+// networks, so the PROXY protocol header is read before anything else.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyProtoListener(l net.Listener, cidrs []string) (net.Listener, error) {
+	if len(cidrs) == 0 {
+		return nil, errors.New("proxy: PROXY protocol requires at least one trusted network")
+	}
+
+	pl := &proxyProtoListener{Listener: l}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		pl.trusted = append(pl.trusted, ipnet)
+	}
+
+	return pl, nil
+}
+
+// Accept waits for the next connection, the header is not read here to avoid
+// blocking the accept loop with slow clients.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(c.RemoteAddr()) {
+		return c, nil
+	}
+
+	return &proxyProtoConn{Conn: c, r: bufio.NewReaderSize(c, 256)}, nil
+}
+
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipnet := range l.trusted {
+		if ipnet.Contains(tcp.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyProtoHeaderTimeout bounds the read of the PROXY protocol header, if
+// no earlier deadline is set on the connection.
+const proxyProtoHeaderTimeout = 10 * time.Second
+
+// proxyProtoConn reads the PROXY protocol header on the first Read or
+// readHeader call and reports the address found on it as RemoteAddr.
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+
+	mu sync.Mutex
+	// deadline is the read deadline set by the user of the connection.
+	deadline time.Time
+}
+
+// readHeader reads the header, a client sending nothing fails once the
+// deadline of the connection or proxyProtoHeaderTimeout is reached.
+func (c *proxyProtoConn) readHeader() error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := time.Now().Add(proxyProtoHeaderTimeout)
+		if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+			deadline = c.deadline
+		}
+
+		c.Conn.SetReadDeadline(deadline)
+		c.mu.Unlock()
+
+		remote, err := readProxyProtoHeader(c.r)
+
+		c.mu.Lock()
+		c.remote, c.err = remote, err
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+	})
+
+	return c.err
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client given by the balancer, until
+// the header is read, if it is invalid or it carries no address, the
+// balancer address is returned.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+
+	return c.remote
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readProxyProtoHeader reads a v1 or v2 header, a nil address without error
+// is returned for the LOCAL and UNKNOWN commands.
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyProtoV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(b, proxyProtoV1Prefix) {
+		return readProxyProtoV1(r)
+	}
+
+	b, err = r.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(b, proxyProtoV2Sig) {
+		return readProxyProtoV2(r)
+	}
+
+	return nil, errProxyProtoMissing
+}
+
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+
+		if len(line) >= proxyProtoV1MaxLen {
+			return nil, errProxyProtoMalformed
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyProtoMalformed
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyProtoMalformed
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyProtoMalformed
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+
+	version, command := head[12]>>4, head[12]&0x0f
+	family := head[13] >> 4
+	length := int(binary.BigEndian.Uint16(head[14:16]))
+	if version != 2 || command > 1 {
+		return nil, errProxyProtoMalformed
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL, the connection was made by the balancer itself (health checks).
+	if command == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x1:
+		if length < 12 {
+			return nil, errProxyProtoMalformed
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2:
+		if length < 36 {
+			return nil, errProxyProtoMalformed
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	case 0x0, 0x3:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("proxy: unsupported PROXY protocol family %d", family)
+	}
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProxyProtoSuite struct{}
+
+var _ = Suite(&ProxyProtoSuite{})
+
+func (s *ProxyProtoSuite) TestReadHeader_V1(c *C) {
+	r := bufio.NewReader(bytes.NewBufferString(
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nfoo",
+	))
+
+	addr, err := readProxyProtoHeader(r)
+	c.Assert(err, IsNil)
+	c.Assert(addr.String(), Equals, "192.168.0.1:56324")
+
+	rest, _ := ioutil.ReadAll(r)
+	c.Assert(string(rest), Equals, "foo")
+}
+
+func (s *ProxyProtoSuite) TestReadHeader_V1TCP6(c *C) {
+	r := bufio.NewReader(bytes.NewBufferString(
+		"PROXY TCP6 2001:db8::1 2001:db8::2 4242 27017\r\n",
+	))
+
+	addr, err := readProxyProtoHeader(r)
+	c.Assert(err, IsNil)
+	c.Assert(addr.String(), Equals, "[2001:db8::1]:4242")
+}
+
+func (s *ProxyProtoSuite) TestReadHeader_V1Unknown(c *C) {
+	r := bufio.NewReader(bytes.NewBufferString("PROXY UNKNOWN\r\n"))
+
+	addr, err := readProxyProtoHeader(r)
+	c.Assert(err, IsNil)
+	c.Assert(addr, IsNil)
+}
+
+func (s *ProxyProtoSuite) TestReadHeader_V1Malformed(c *C) {
+	for _, header := range []string{
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 foo 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 99999 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n",
+		"PROXY " + string(bytes.Repeat([]byte("a"), 200)),
+	} {
+		r := bufio.NewReader(bytes.NewBufferString(header))
+		_, err := readProxyProtoHeader(r)
+		c.Assert(err, Equals, errProxyProtoMalformed, Commentf(header))
+	}
+}
+
+func (s *ProxyProtoSuite) TestReadHeader_V2TCP4(c *C) {
+	// PROXY TCP4 127.0.0.1:4242 => 127.0.0.2:27017
+	fixture, _ := hex.DecodeString(
+		"0d0a0d0a000d0a515549540a" + "21" + "11" + "000c" +
+			"7f000001" + "7f000002" + "1092" + "6989" + "666f6f",
+	)
+
+	r := bufio.NewReader(bytes.NewReader(fixture))
+	addr, err := readProxyProtoHeader(r)
+	c.Assert(err, IsNil)
+	c.Assert(addr.String(), Equals, "127.0.0.1:4242")
+
+	rest, _ := ioutil.ReadAll(r)
+	c.Assert(string(rest), Equals, "foo")
+}
+
+func (s *ProxyProtoSuite) TestReadHeader_V2TCP6WithTLV(c *C) {
+	fixture, _ := hex.DecodeString(
+		"0d0a0d0a000d0a515549540a" + "21" + "21" + "0029" +
+			"20010db8000000000000000000000001" +
+			"20010db8000000000000000000000002" +
+			"1092" + "6989" + "0400026869",
+	)
+
+	r := bufio.NewReader(bytes.NewReader(fixture))
+	addr, err := readProxyProtoHeader(r)
+	c.Assert(err, IsNil)
+	c.Assert(addr.String(), Equals, "[2001:db8::1]:4242")
+	c.Assert(r.Buffered(), Equals, 0)
+}
+
+func (s *ProxyProtoSuite) TestReadHeader_V2Local(c *C) {
+	fixture, _ := hex.DecodeString("0d0a0d0a000d0a515549540a" + "20" + "00" + "0000")
+
+	addr, err := readProxyProtoHeader(bufio.NewReader(bytes.NewReader(fixture)))
+	c.Assert(err, IsNil)
+	c.Assert(addr, IsNil)
+}
+
+func (s *ProxyProtoSuite) TestReadHeader_V2BadVersion(c *C) {
+	fixture, _ := hex.DecodeString("0d0a0d0a000d0a515549540a" + "11" + "11" + "0000")
+
+	_, err := readProxyProtoHeader(bufio.NewReader(bytes.NewReader(fixture)))
+	c.Assert(err, Equals, errProxyProtoMalformed)
+}
+
+func (s *ProxyProtoSuite) TestReadHeader_Missing(c *C) {
+	fixture, _ := hex.DecodeString("880000009900000000000000d4070000")
+
+	_, err := readProxyProtoHeader(bufio.NewReader(bytes.NewReader(fixture)))
+	c.Assert(err, Equals, errProxyProtoMissing)
+}
+
+func (s *ProxyProtoSuite) TestListener_RequiresTrustedNetworks(c *C) {
+	_, err := ListenerConfig{Addr: "127.0.0.1:0", ProxyProtocol: true}.listen(nil)
+	c.Assert(err, NotNil)
+
+	_, err = ListenerConfig{
+		Addr:           "127.0.0.1:0",
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"foo"},
+	}.listen(nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *ProxyProtoSuite) TestProxy_TrustedClient(c *C) {
+	addrs := make(chan string, 1)
+	p := newPipeProxy(echoBackend)
+	p.ProxyAddr = ""
+	p.Listeners = []ListenerConfig{{
+		Addr:           "127.0.0.1:0",
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"127.0.0.0/8"},
+	}}
+	p.Middleware = middlewareFunc(func(m protocol.Message, cl, sv io.ReadWriter) error {
+		addrs <- cl.(net.Conn).RemoteAddr().String()
+		_, err := m.WriteTo(cl)
+		return err
+	})
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("PROXY TCP4 10.0.0.42 10.0.0.1 4242 27017\r\n"))
+	c.Assert(err, IsNil)
+	writeTestQuery(c, conn)
+
+	c.Assert(<-addrs, Equals, "10.0.0.42:4242")
+}
+
+func (s *ProxyProtoSuite) TestProxy_UntrustedClient(c *C) {
+	addrs := make(chan string, 1)
+	p := newPipeProxy(echoBackend)
+	p.ProxyAddr = ""
+	p.Listeners = []ListenerConfig{{
+		Addr:           "127.0.0.1:0",
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}}
+	p.Middleware = middlewareFunc(func(m protocol.Message, cl, sv io.ReadWriter) error {
+		addrs <- cl.(net.Conn).RemoteAddr().String()
+		_, err := m.WriteTo(cl)
+		return err
+	})
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	writeTestQuery(c, conn)
+	c.Assert(<-addrs, Equals, conn.LocalAddr().String())
+}
+
+func (s *ProxyProtoSuite) TestProxy_SilentClient(c *C) {
+	p := newPipeProxy(echoBackend)
+	p.ProxyAddr = ""
+	p.MessageTimeout = 100 * time.Millisecond
+	p.Listeners = []ListenerConfig{{
+		Addr:           "127.0.0.1:0",
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"127.0.0.0/8"},
+	}}
+
+	c.Assert(p.Start(), IsNil)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// the header is never sent, the client is disconnected at the deadline.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	start := time.Now()
+	c.Assert(p.Drain(200*time.Millisecond), IsNil)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func writeTestQuery(c *C, conn net.Conn) {
+	msg := &protocol.MsgHeader{
+		MessageLength: protocol.HeaderLen + 3,
+		OpCode:        protocol.OpQueryCode,
+		Message:       []byte("foo"),
+	}
+
+	_, err := msg.WriteTo(conn)
+	c.Assert(err, IsNil)
+
+	_, err = protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+}
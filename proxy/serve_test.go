@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/mcuadros/lemondb/logging"
+	"github.com/mcuadros/lemondb/metrics"
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ServeSuite struct{}
+
+var _ = Suite(&ServeSuite{})
+
+func (s *ServeSuite) TestProxy_ServeZeroValue(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	p := &Proxy{Dialer: pipeDialer(echoBackend)}
+	errc := p.Serve(l)
+	c.Assert(p.Addr(), Equals, l.Addr())
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+
+	msg := &protocol.MsgHeader{
+		MessageLength: protocol.HeaderLen + 3,
+		OpCode:        protocol.OpQueryCode,
+		Message:       []byte("foo"),
+	}
+
+	_, err = msg.WriteTo(conn)
+	c.Assert(err, IsNil)
+
+	reply, err := protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(reply.Message), Equals, "foo")
+	conn.Close()
+
+	c.Assert(p.Stop(), IsNil)
+	c.Assert(<-errc, IsNil)
+
+	_, open := <-errc
+	c.Assert(open, Equals, false)
+}
+
+func (s *ServeSuite) TestProxy_ServeWithStart(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	p := newPipeProxy(echoBackend)
+	c.Assert(p.Start(), IsNil)
+
+	errc := p.Serve(l)
+	c.Assert(p.Addrs(), HasLen, 2)
+	c.Assert(p.Addrs()[1], Equals, l.Addr())
+
+	c.Assert(p.Stop(), IsNil)
+	c.Assert(<-errc, IsNil)
+}
+
+func (s *ServeSuite) TestProxy_ServeAcceptError(c *C) {
+	p := &Proxy{Dialer: pipeDialer(echoBackend)}
+	errc := p.Serve(&failingListener{err: errAccept})
+	c.Assert(<-errc, Equals, errAccept)
+
+	c.Assert(p.Stop(), IsNil)
+}
+
+func (s *ServeSuite) TestProxy_AddrNotListening(c *C) {
+	p := &Proxy{}
+	c.Assert(p.Addr(), IsNil)
+}
+
+var errAccept = &net.OpError{Op: "accept", Net: "tcp", Err: net.UnknownNetworkError("foo")}
+
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (s *ServeSuite) TestProxy_Metrics(c *C) {
+	r := metrics.NewRegistry()
+	p := newPipeProxy(echoBackend)
+	p.Name = "foo"
+	p.Metrics = r
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+	c.Assert(p.String(), Matches, `proxy 127.0.0.1:0 => mongo pipe \(foo\)`)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	writeTestQuery(c, conn)
+
+	var buf bytes.Buffer
+	_, err = r.WriteTo(&buf)
+	c.Assert(err, IsNil)
+
+	out := buf.String()
+	c.Assert(out, Matches, `(?s).*\nlemondb_clients_accepted_total\{proxy="foo"\} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\nlemondb_clients\{proxy="foo"\} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\nlemondb_messages_total\{proxy="foo",op="QUERY",command=""\} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\nlemondb_message_duration_seconds_count\{proxy="foo",op="QUERY",command=""\} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\nlemondb_client_received_bytes_total\{proxy="foo"\} [1-9]\d*\n.*`)
+}
+
+func (s *ServeSuite) TestProxy_MetricsCommand(c *C) {
+	r := metrics.NewRegistry()
+	p := newPipeProxy(echoBackend)
+	p.Metrics = r
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	doc, err := bson.Marshal(bson.D{{Name: "isMaster", Value: 1}})
+	c.Assert(err, IsNil)
+
+	q := &protocol.OpQuery{
+		MsgHeader:          &protocol.MsgHeader{RequestID: 1, OpCode: protocol.OpQueryCode},
+		FullCollectionName: protocol.CSString("admin.$cmd\x00"),
+		NumberToReturn:     -1,
+		Query:              doc,
+	}
+
+	_, err = q.WriteTo(conn)
+	c.Assert(err, IsNil)
+	_, err = protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+
+	messages := r.Counter("lemondb_messages_total", "", "proxy", "op", "command")
+	namespaces := r.Counter("lemondb_namespace_messages_total", "", "proxy", "ns")
+	c.Assert(messages.Value("", "QUERY", "isMaster"), Equals, float64(1))
+	c.Assert(namespaces.Value("", "admin.$cmd"), Equals, float64(1))
+}
+
+func (s *ServeSuite) TestProxy_LogConnectionFields(c *C) {
+	out := &syncBuffer{}
+	p := newPipeProxy(echoBackend)
+	p.Name = "foo"
+	p.Log = logging.New(out, logging.LogfmtEncoder, logging.DebugLevel)
+
+	c.Assert(p.Start(), IsNil)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+
+	writeTestQuery(c, conn)
+	conn.Close()
+	c.Assert(p.Stop(), IsNil)
+
+	var handled string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, `msg="message handled"`) {
+			handled = line
+		}
+	}
+
+	c.Assert(handled, Matches, `.* proxy=foo conn_id=\d+ client_addr=127.0.0.1:\d+ op=QUERY .*duration=.*`)
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func (l *failingListener) Accept() (net.Conn, error) { return nil, l.err }
+func (l *failingListener) Close() error              { return nil }
+func (l *failingListener) Addr() net.Addr            { return nil }
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mcuadros/lemondb/middlewares"
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+)
+
+type StreamSuite struct{}
+
+var _ = Suite(&StreamSuite{})
+
+func (s *StreamSuite) TestProxy_StreamLargeMessage(c *C) {
+	var streamed bool
+	p := newPipeProxy(echoBackend)
+	p.Middleware = &streamerFunc{
+		needsBody: func(h *protocol.MsgHeader) bool { return false },
+		handle: func(m protocol.Message, cl, sv io.ReadWriter) error {
+			_, streamed = m.(*protocol.StreamedMessage)
+			return (&middlewares.ProxyMiddleware{}).Handle(m, cl, sv)
+		},
+	}
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	body := bytes.Repeat([]byte("foo"), 4*1024*1024)
+	msg := &protocol.MsgHeader{
+		MessageLength: int32(protocol.HeaderLen + len(body)),
+		RequestID:     42,
+		OpCode:        protocol.OpQueryCode,
+		Message:       body,
+	}
+
+	go msg.WriteTo(conn)
+
+	reply, err := protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(reply.ResponseTo, Equals, int32(42))
+	c.Assert(bytes.Equal(reply.Message, body), Equals, true)
+	c.Assert(streamed, Equals, true)
+}
+
+func (s *StreamSuite) TestProxy_StreamSpliced(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go echoBackend(conn)
+		}
+	}()
+
+	// between two TCP connections the bodies are spliced, and still counted.
+	p := newPipeProxy(echoBackend)
+	p.MongoAddr = l.Addr().String()
+	p.Dialer = &TCPDialer{}
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	body := bytes.Repeat([]byte("foo"), 1024*1024)
+	msg := &protocol.MsgHeader{
+		MessageLength: int32(protocol.HeaderLen + len(body)),
+		RequestID:     42,
+		OpCode:        protocol.OpQueryCode,
+		Message:       body,
+	}
+
+	go msg.WriteTo(conn)
+
+	reply, err := protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(reply.Message, body), Equals, true)
+
+	// the bytes are counted once the copy returns, maybe after the reply is
+	// read.
+	var info ClientInfo
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if info = p.Clients()[0]; info.BytesSent == uint64(msg.MessageLength) {
+			break
+		}
+	}
+
+	c.Assert(info.BytesReceived, Equals, uint64(msg.MessageLength))
+	c.Assert(info.BytesSent, Equals, uint64(msg.MessageLength))
+}
+
+func (s *StreamSuite) TestProxy_StreamDiscardsBody(c *C) {
+	p := newPipeProxy(echoBackend)
+	p.Middleware = &streamerFunc{
+		needsBody: func(h *protocol.MsgHeader) bool { return h.RequestID != 1 },
+		handle: func(m protocol.Message, cl, sv io.ReadWriter) error {
+			// the first message is answered without touching its body.
+			if m.GetMsgHeader().RequestID == 1 {
+				reply := &protocol.MsgHeader{
+					MessageLength: protocol.HeaderLen + 3,
+					ResponseTo:    1,
+					OpCode:        protocol.OpReplyCode,
+					Message:       []byte("bar"),
+				}
+
+				_, err := reply.WriteTo(cl)
+				return err
+			}
+
+			return (&middlewares.ProxyMiddleware{}).Handle(m, cl, sv)
+		},
+	}
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	for _, id := range []int32{1, 2} {
+		msg := &protocol.MsgHeader{
+			MessageLength: protocol.HeaderLen + 3,
+			RequestID:     id,
+			OpCode:        protocol.OpQueryCode,
+			Message:       []byte("foo"),
+		}
+
+		_, err := msg.WriteTo(conn)
+		c.Assert(err, IsNil)
+	}
+
+	reply, err := protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(reply.ResponseTo, Equals, int32(1))
+	c.Assert(string(reply.Message), Equals, "bar")
+
+	reply, err = protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(reply.ResponseTo, Equals, int32(2))
+	c.Assert(string(reply.Message), Equals, "foo")
+}
+
+func (s *StreamSuite) TestProxy_NoStreamer(c *C) {
+	var streamed bool
+	p := newPipeProxy(echoBackend)
+	p.Middleware = middlewareFunc(func(m protocol.Message, cl, sv io.ReadWriter) error {
+		_, streamed = m.(*protocol.StreamedMessage)
+		return (&middlewares.ProxyMiddleware{}).Handle(m, cl, sv)
+	})
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	writeTestQuery(c, conn)
+	c.Assert(streamed, Equals, false)
+}
+
+type streamerFunc struct {
+	needsBody func(h *protocol.MsgHeader) bool
+	handle    func(m protocol.Message, c, s io.ReadWriter) error
+}
+
+func (f *streamerFunc) NeedsBody(h *protocol.MsgHeader) bool {
+	return f.needsBody(h)
+}
+
+func (f *streamerFunc) Handle(m protocol.Message, c, s io.ReadWriter) error {
+	return f.handle(m, c, s)
+}
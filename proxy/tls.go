@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+var errTLSMissingKeyPair = errors.New("proxy: tls requires a certificate and a key file")
+
+// TLSConfig describes how the TLS connections from the clients are terminated
+// by the proxy.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded key pair presented to the
+	// clients.
+	CertFile string
+	KeyFile  string
+	// MinVersion is the minimum TLS version accepted, by default TLS 1.2.
+	MinVersion uint16
+	// CipherSuites is the list of enabled cipher suites, if empty the Go
+	// defaults are used.
+	CipherSuites []uint16
+	// ClientCAFile is a PEM bundle used to verify the client certificates, if
+	// empty the clients are not asked for a certificate.
+	ClientCAFile string
+	// ClientAuth is the policy for the client certificates when ClientCAFile
+	// is given, by default a valid certificate is required.
+	ClientAuth tls.ClientAuthType
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+// ReloadTLS reads again the certificates of every TLS listener, ProxyAddr
+// included, see TLSConfig.Reload. All of them are reloaded even if one fails,
+// the first error is returned.
+func (p *Proxy) ReloadTLS() error {
+	var first error
+	for _, cfg := range p.listenerConfigs() {
+		if cfg.TLS == nil {
+			continue
+		}
+
+		if err := cfg.TLS.Reload(); err != nil && first == nil {
+			first = fmt.Errorf("%s: %s", cfg.Addr, err)
+		}
+	}
+
+	return first
+}
+
+// Reload reads again the certificate, key and CA files. The new files are used
+// for every handshake after Reload returns, established connections are not
+// affected. If any of the files is invalid, the previous ones are kept.
+func (t *TLSConfig) Reload() error {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return errTLSMissingKeyPair
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   t.MinVersion,
+		CipherSuites: t.CipherSuites,
+	}
+
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if t.ClientCAFile != "" {
+		pool, err := loadCertPool(t.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = t.ClientAuth
+		if config.ClientAuth == tls.NoClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	t.mu.Lock()
+	t.config = config
+	t.mu.Unlock()
+
+	return nil
+}
+
+// serverConfig returns a tls.Config that always uses the last loaded
+// certificates, loading them if this was never done before.
+func (t *TLSConfig) serverConfig() (*tls.Config, error) {
+	t.mu.RLock()
+	loaded := t.config != nil
+	t.mu.RUnlock()
+
+	if !loaded {
+		if err := t.Reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+
+			return t.config, nil
+		},
+	}, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("proxy: no valid certificates found in %s", file)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+)
+
+type TLSSuite struct {
+	dir string
+	ca  *testCert
+}
+
+var _ = Suite(&TLSSuite{})
+
+func (s *TLSSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.ca = newTestCert(c, "ca", nil)
+}
+
+func (s *TLSSuite) TestTLSConfig_Reload(c *C) {
+	cfg := &TLSConfig{
+		CertFile: filepath.Join(s.dir, "server.crt"),
+		KeyFile:  filepath.Join(s.dir, "server.key"),
+	}
+
+	first := newTestCert(c, "first", s.ca)
+	first.write(c, cfg.CertFile, cfg.KeyFile)
+
+	server, err := cfg.serverConfig()
+	c.Assert(err, IsNil)
+	c.Assert(currentCertificate(c, server), DeepEquals, first.der)
+
+	second := newTestCert(c, "second", s.ca)
+	second.write(c, cfg.CertFile, cfg.KeyFile)
+	c.Assert(currentCertificate(c, server), DeepEquals, first.der)
+
+	c.Assert(cfg.Reload(), IsNil)
+	c.Assert(currentCertificate(c, server), DeepEquals, second.der)
+}
+
+func (s *TLSSuite) TestProxy_ReloadTLSListener(c *C) {
+	cfg := &TLSConfig{
+		CertFile: filepath.Join(s.dir, "server.crt"),
+		KeyFile:  filepath.Join(s.dir, "server.key"),
+	}
+
+	first := newTestCert(c, "localhost", s.ca)
+	first.write(c, cfg.CertFile, cfg.KeyFile)
+
+	p := newPipeProxy(echoBackend)
+	p.ProxyAddr = ""
+	p.Listeners = []ListenerConfig{{Addr: "127.0.0.1:0", TLS: cfg}}
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	peer := func() []byte {
+		pool := x509.NewCertPool()
+		pool.AddCert(s.ca.cert)
+
+		conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		c.Assert(err, IsNil)
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	c.Assert(peer(), DeepEquals, first.der)
+
+	second := newTestCert(c, "localhost", s.ca)
+	second.write(c, cfg.CertFile, cfg.KeyFile)
+	c.Assert(peer(), DeepEquals, first.der)
+
+	c.Assert(p.ReloadTLS(), IsNil)
+	c.Assert(peer(), DeepEquals, second.der)
+}
+
+func (s *TLSSuite) TestTLSConfig_ReloadKeepsPreviousOnError(c *C) {
+	cfg := &TLSConfig{
+		CertFile: filepath.Join(s.dir, "server.crt"),
+		KeyFile:  filepath.Join(s.dir, "server.key"),
+	}
+
+	cert := newTestCert(c, "server", s.ca)
+	cert.write(c, cfg.CertFile, cfg.KeyFile)
+
+	server, err := cfg.serverConfig()
+	c.Assert(err, IsNil)
+
+	err = ioutil.WriteFile(cfg.CertFile, []byte("foo"), 0600)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Reload(), NotNil)
+	c.Assert(currentCertificate(c, server), DeepEquals, cert.der)
+}
+
+func (s *TLSSuite) TestTLSConfig_MinVersionDefault(c *C) {
+	cfg := &TLSConfig{
+		CertFile: filepath.Join(s.dir, "server.crt"),
+		KeyFile:  filepath.Join(s.dir, "server.key"),
+	}
+
+	newTestCert(c, "server", s.ca).write(c, cfg.CertFile, cfg.KeyFile)
+	c.Assert(cfg.Reload(), IsNil)
+	c.Assert(cfg.config.MinVersion, Equals, uint16(tls.VersionTLS12))
+}
+
+func (s *TLSSuite) TestProxy_ClientSubject(c *C) {
+	cfg := &TLSConfig{
+		CertFile:     filepath.Join(s.dir, "server.crt"),
+		KeyFile:      filepath.Join(s.dir, "server.key"),
+		ClientCAFile: filepath.Join(s.dir, "ca.crt"),
+	}
+
+	newTestCert(c, "localhost", s.ca).write(c, cfg.CertFile, cfg.KeyFile)
+	s.ca.write(c, cfg.ClientCAFile, filepath.Join(s.dir, "ca.key"))
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer backend.Close()
+
+	subjects := make(chan string, 1)
+	p := &Proxy{
+		Log:               nopLogger{},
+		ProxyAddr:         "127.0.0.1:0",
+		MongoAddr:         backend.Addr().String(),
+		ClientIdleTimeout: time.Minute,
+		MessageTimeout:    time.Minute,
+		TLS:               cfg,
+		Middleware: middlewareFunc(func(m protocol.Message, cl, sv io.ReadWriter) error {
+			subjects <- cl.(interface {
+				Subject() string
+			}).Subject()
+
+			_, err := m.WriteTo(cl)
+			return err
+		}),
+	}
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	client := newTestCert(c, "reporting", s.ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(s.ca.cert)
+
+	conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{
+		RootCAs:      pool,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{client.pair()},
+	})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	msg := &protocol.MsgHeader{MessageLength: protocol.HeaderLen, OpCode: protocol.OpQueryCode}
+	_, err = msg.WriteTo(conn)
+	c.Assert(err, IsNil)
+
+	reply, err := protocol.ReadMsgHeader(conn)
+	c.Assert(err, IsNil)
+	c.Assert(reply.OpCode, Equals, protocol.OpQueryCode)
+	c.Assert(<-subjects, Equals, "CN=reporting")
+}
+
+func (s *TLSSuite) TestProxy_ClientWithoutCertificate(c *C) {
+	cfg := &TLSConfig{
+		CertFile:     filepath.Join(s.dir, "server.crt"),
+		KeyFile:      filepath.Join(s.dir, "server.key"),
+		ClientCAFile: filepath.Join(s.dir, "ca.crt"),
+	}
+
+	newTestCert(c, "localhost", s.ca).write(c, cfg.CertFile, cfg.KeyFile)
+	s.ca.write(c, cfg.ClientCAFile, filepath.Join(s.dir, "ca.key"))
+
+	p := &Proxy{
+		Log:               nopLogger{},
+		ProxyAddr:         "127.0.0.1:0",
+		ClientIdleTimeout: time.Minute,
+		MessageTimeout:    time.Minute,
+		TLS:               cfg,
+	}
+
+	c.Assert(p.Start(), IsNil)
+	defer p.Stop()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.ca.cert)
+
+	conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{
+		RootCAs:    pool,
+		ServerName: "localhost",
+	})
+	if err == nil {
+		// With TLS 1.3 the client certificate is verified after the client
+		// handshake is done, so the error arrives on the first read.
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	c.Assert(err, NotNil)
+}
+
+type middlewareFunc func(m protocol.Message, c, s io.ReadWriter) error
+
+func (f middlewareFunc) Handle(m protocol.Message, c, s io.ReadWriter) error {
+	return f(m, c, s)
+}
+
+func currentCertificate(c *C, server *tls.Config) []byte {
+	cfg, err := server.GetConfigForClient(nil)
+	c.Assert(err, IsNil)
+
+	return cfg.Certificates[0].Certificate[0]
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(c *C, cn string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	c.Assert(err, IsNil)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+	}
+
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	c.Assert(err, IsNil)
+
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (t *testCert) pair() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{t.der},
+		PrivateKey:  t.key,
+	}
+}
+
+func (t *testCert) write(c *C, certFile, keyFile string) {
+	key, err := x509.MarshalECPrivateKey(t.key)
+	c.Assert(err, IsNil)
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: t.der,
+	}), 0600)
+	c.Assert(err, IsNil)
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: key,
+	}), 0600)
+	c.Assert(err, IsNil)
+}
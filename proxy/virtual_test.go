@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/mcuadros/lemondb/memdb"
+	"github.com/mcuadros/lemondb/middlewares"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// VirtualSuite runs mgo against a virtual collection, the rest of the
+// messages are answered by the memory middleware.
+type VirtualSuite struct {
+	proxy   *Proxy
+	session *mgo.Session
+}
+
+var _ = Suite(&VirtualSuite{})
+
+func (s *VirtualSuite) SetUpTest(c *C) {
+	store := memdb.NewStore()
+	store.Mount("app.numbers", memdb.Documents(func() ([]bson.D, error) {
+		var docs []bson.D
+		for i := 0; i < 250; i++ {
+			docs = append(docs, bson.D{{Name: "_id", Value: i}, {Name: "even", Value: i%2 == 0}})
+		}
+
+		return docs, nil
+	}))
+
+	s.proxy = newPipeProxy(echoBackend)
+	s.proxy.Middleware = &middlewares.VirtualMiddleware{
+		Store: store,
+		Next:  &middlewares.MemoryMiddleware{Store: memdb.NewStore()},
+	}
+
+	c.Assert(s.proxy.Start(), IsNil)
+
+	var err error
+	s.session, err = mgo.DialWithTimeout(s.proxy.Addr().String(), 5*time.Second)
+	c.Assert(err, IsNil)
+}
+
+func (s *VirtualSuite) TearDownTest(c *C) {
+	s.session.Close()
+	s.proxy.Stop()
+}
+
+func (s *VirtualSuite) TestFind(c *C) {
+	coll := s.session.DB("app").C("numbers")
+
+	iter := coll.Find(bson.M{"even": true}).Sort("-_id").Skip(5).Limit(100).Batch(30).Select(bson.M{"even": 0}).Iter()
+	var doc bson.M
+	var got []int
+	for iter.Next(&doc) {
+		c.Assert(doc, HasLen, 1)
+		got = append(got, doc["_id"].(int))
+	}
+
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(got, HasLen, 100)
+	c.Assert(got[0], Equals, 238)
+	c.Assert(got[99], Equals, 40)
+
+	n, err := coll.Find(bson.M{"even": false}).Skip(100).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 25)
+}
+
+func (s *VirtualSuite) TestKillCursor(c *C) {
+	iter := s.session.DB("app").C("numbers").Find(nil).Batch(10).Iter()
+	var doc bson.M
+	c.Assert(iter.Next(&doc), Equals, true)
+	c.Assert(iter.Close(), IsNil)
+
+	n, err := s.session.DB("app").C("numbers").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 250)
+}
+
+func (s *VirtualSuite) TestAggregate(c *C) {
+	var result []bson.M
+	err := s.session.DB("app").C("numbers").Pipe([]bson.M{
+		{"$match": bson.M{"_id": bson.M{"$lt": 10}}},
+		{"$count": "n"},
+	}).All(&result)
+
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, []bson.M{{"n": 10}})
+}
+
+func (s *VirtualSuite) TestReadOnly(c *C) {
+	err := s.session.DB("app").C("numbers").Insert(bson.M{"_id": 1000})
+	c.Assert(err, ErrorMatches, ".*read only")
+	c.Assert(s.session.DB("app").C("numbers").DropCollection(), ErrorMatches, ".*not supported")
+
+	// the other collections are not virtual.
+	coll := s.session.DB("app").C("people")
+	c.Assert(coll.Insert(bson.M{"_id": 1}), IsNil)
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
@@ -0,0 +1,197 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// matcher tells if a document, a bson.D or bson.M, matches a filter.
+type matcher func(doc interface{}) bool
+
+func matchAll(interface{}) bool { return true }
+
+func compileFilter(filter bson.D) (matcher, error) {
+	var ms []matcher
+	for _, e := range filter {
+		m, err := compileElem(e)
+		if err != nil {
+			return nil, err
+		}
+
+		ms = append(ms, m)
+	}
+
+	switch len(ms) {
+	case 0:
+		return matchAll, nil
+	case 1:
+		return ms[0], nil
+	}
+
+	return and(ms), nil
+}
+
+func and(ms []matcher) matcher {
+	return func(doc interface{}) bool {
+		for _, m := range ms {
+			if !m(doc) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+func compileElem(e bson.DocElem) (matcher, error) {
+	switch e.Name {
+	case "$and", "$or", "$nor":
+		ms, err := compileList(e)
+		if err != nil {
+			return nil, err
+		}
+
+		return logical(e.Name, ms), nil
+	case "$comment":
+		return matchAll, nil
+	case "$where", "$expr", "$text", "$jsonSchema":
+		return nil, errorf(codeBadValue, "unsupported operator: %s", e.Name)
+	}
+
+	if strings.HasPrefix(e.Name, "$") {
+		return nil, errorf(codeBadValue, "unknown top level operator: %s", e.Name)
+	}
+
+	cond, err := compileCondition(e.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(e.Name, ".")
+	return func(doc interface{}) bool {
+		return cond(walk(doc, parts, nil))
+	}, nil
+}
+
+func compileList(e bson.DocElem) ([]matcher, error) {
+	list, ok := e.Value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, errorf(codeBadValue, "%s must be a nonempty array", e.Name)
+	}
+
+	ms := make([]matcher, len(list))
+	for i, f := range list {
+		if !isDoc(f) {
+			return nil, errorf(codeBadValue, "%s entries need to be full objects", e.Name)
+		}
+
+		var err error
+		if ms[i], err = compileFilter(toDoc(f)); err != nil {
+			return nil, err
+		}
+	}
+
+	return ms, nil
+}
+
+func logical(op string, ms []matcher) matcher {
+	return func(doc interface{}) bool {
+		for _, m := range ms {
+			matched := m(doc)
+			switch {
+			case op == "$and" && !matched:
+				return false
+			case op == "$or" && matched:
+				return true
+			case op == "$nor" && matched:
+				return false
+			}
+		}
+
+		return op != "$or"
+	}
+}
+
+// leaf is what a path leads to in one of the branches of the traversal.
+type leaf struct {
+	value interface{}
+	// missing is true if the path doesn't exist in the branch.
+	missing bool
+}
+
+// walk appends to leaves what the path leads to. The arrays are traversed
+// looking for the rest of the path in their documents, unless the part is an
+// index of the array, the path is missing in an array without documents.
+func walk(v interface{}, parts []string, leaves []leaf) []leaf {
+	if len(parts) == 0 {
+		return append(leaves, leaf{value: v})
+	}
+
+	switch cur := v.(type) {
+	case bson.D, bson.M:
+		child, ok := get(cur, parts[0])
+		if !ok {
+			return append(leaves, leaf{missing: true})
+		}
+
+		return walk(child, parts[1:], leaves)
+	case []interface{}:
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 {
+			n := len(leaves)
+			if i < len(cur) {
+				leaves = walk(cur[i], parts[1:], leaves)
+			}
+
+			// the documents of the array may have a field named as the
+			// index too.
+			for _, e := range cur {
+				if child, ok := get(e, parts[0]); ok {
+					leaves = walk(child, parts[1:], leaves)
+				}
+			}
+
+			if len(leaves) == n {
+				leaves = append(leaves, leaf{missing: true})
+			}
+
+			return leaves
+		}
+
+		// an array without documents has nothing at the rest of the path.
+		docs := false
+		for _, e := range cur {
+			if isDoc(e) {
+				docs = true
+				leaves = walk(e, parts, leaves)
+			}
+		}
+
+		if !docs {
+			leaves = append(leaves, leaf{missing: true})
+		}
+
+		return leaves
+	}
+
+	return append(leaves, leaf{missing: true})
+}
+
+// values returns the values of the leaves and the elements of the arrays
+// among them, the values most of the operators look at.
+func values(leaves []leaf) []interface{} {
+	var vs []interface{}
+	for _, l := range leaves {
+		if l.missing {
+			continue
+		}
+
+		vs = append(vs, l.value)
+		if a, ok := l.value.([]interface{}); ok {
+			vs = append(vs, a...)
+		}
+	}
+
+	return vs
+}
@@ -0,0 +1,631 @@
+package query
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// condition tells if the leaves found at a path match an operator.
+type condition func(leaves []leaf) bool
+
+// compileCondition compiles the value of a field in a filter: a document of
+// operators, a regular expression or a value to be equal to.
+func compileCondition(v interface{}) (condition, error) {
+	if isOperators(v) {
+		return compileOperators(toDoc(v))
+	}
+
+	if re, ok := v.(bson.RegEx); ok {
+		return compileRegex(re.Pattern, re.Options)
+	}
+
+	return eq(v), nil
+}
+
+// isOperators tells if v is a document of operators, the DBRefs and the
+// documents not starting by an operator are values.
+func isOperators(v interface{}) bool {
+	d := toDoc(v)
+	if len(d) == 0 || !strings.HasPrefix(d[0].Name, "$") {
+		return false
+	}
+
+	switch d[0].Name {
+	case "$ref", "$id", "$db":
+		return false
+	}
+
+	return true
+}
+
+func compileOperators(ops bson.D) (condition, error) {
+	var conds []condition
+	options, hasOptions := get(ops, "$options")
+	if _, hasRegex := get(ops, "$regex"); hasOptions && !hasRegex {
+		return nil, errorf(codeBadValue, "$options needs a $regex")
+	}
+
+	for _, op := range ops {
+		var c condition
+		var err error
+
+		switch op.Name {
+		case "$eq":
+			c = eq(op.Value)
+		case "$ne":
+			c = not(eq(op.Value))
+		case "$gt", "$gte", "$lt", "$lte":
+			c, err = comparison(op.Name, op.Value)
+		case "$in":
+			c, err = in(op.Name, op.Value)
+		case "$nin":
+			if c, err = in(op.Name, op.Value); err == nil {
+				c = not(c)
+			}
+		case "$exists":
+			c = exists(truthy(op.Value))
+		case "$type":
+			c, err = compileType(op.Value)
+		case "$size":
+			c, err = size(op.Value)
+		case "$all":
+			c, err = all(op.Value)
+		case "$elemMatch":
+			c, err = elemMatch(op.Value)
+		case "$mod":
+			c, err = mod(op.Value)
+		case "$regex":
+			c, err = compileRegexOperator(op.Value, options)
+		case "$options":
+			continue
+		case "$not":
+			if c, err = compileNot(op.Value); err == nil {
+				c = not(c)
+			}
+		case "$comment":
+			continue
+		default:
+			return nil, errorf(codeBadValue, "unknown operator: %s", op.Name)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		conds = append(conds, c)
+	}
+
+	if len(conds) == 1 {
+		return conds[0], nil
+	}
+
+	return func(leaves []leaf) bool {
+		for _, c := range conds {
+			if !c(leaves) {
+				return false
+			}
+		}
+
+		return true
+	}, nil
+}
+
+func not(c condition) condition {
+	return func(leaves []leaf) bool { return !c(leaves) }
+}
+
+// eq matches a value equal to v, or an array holding it. A null matches the
+// null values and the missing fields. A regular expression is a value here,
+// it only matches the same regular expression.
+func eq(v interface{}) condition {
+	if typeOrder(v) == orderNull {
+		return func(leaves []leaf) bool {
+			for _, l := range leaves {
+				if l.missing {
+					return true
+				}
+			}
+
+			for _, e := range values(leaves) {
+				if typeOrder(e) == orderNull {
+					return true
+				}
+			}
+
+			return false
+		}
+	}
+
+	return func(leaves []leaf) bool {
+		for _, e := range values(leaves) {
+			if equal(e, v) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// comparison matches a value of the same type than v greater or less than
+// it, the MinKey and MaxKey are compared with any type.
+func comparison(op string, v interface{}) (condition, error) {
+	if _, ok := v.(bson.RegEx); ok {
+		return nil, errorf(codeBadValue, "%s can't have a regex", op)
+	}
+
+	t := typeOrder(v)
+	if t == orderNull {
+		if op == "$gte" || op == "$lte" {
+			return eq(v), nil
+		}
+
+		return func([]leaf) bool { return false }, nil
+	}
+
+	return func(leaves []leaf) bool {
+		for _, e := range values(leaves) {
+			if typeOrder(e) != t && t != orderMinKey && t != orderMaxKey {
+				continue
+			}
+
+			c := Compare(e, v)
+			switch {
+			case op == "$gt" && c > 0,
+				op == "$gte" && c >= 0,
+				op == "$lt" && c < 0,
+				op == "$lte" && c <= 0:
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// in matches a value equal to any of the array, its regular expressions
+// match the strings.
+func in(op string, v interface{}) (condition, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errorf(codeBadValue, "%s needs an array", op)
+	}
+
+	conds := make([]condition, len(list))
+	for i, e := range list {
+		if isOperators(e) {
+			return nil, errorf(codeBadValue, "cannot nest $ under %s", op)
+		}
+
+		if re, ok := e.(bson.RegEx); ok {
+			c, err := compileRegex(re.Pattern, re.Options)
+			if err != nil {
+				return nil, err
+			}
+
+			conds[i] = c
+			continue
+		}
+
+		conds[i] = eq(e)
+	}
+
+	return anyOf(conds), nil
+}
+
+func anyOf(conds []condition) condition {
+	return func(leaves []leaf) bool {
+		for _, c := range conds {
+			if c(leaves) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func exists(want bool) condition {
+	return func(leaves []leaf) bool {
+		for _, l := range leaves {
+			if !l.missing {
+				return want
+			}
+		}
+
+		return !want
+	}
+}
+
+// types are the names of the types accepted by $type, the aliases of the
+// BSON type numbers.
+var types = map[string]int{
+	"double":              1,
+	"string":              2,
+	"object":              3,
+	"array":               4,
+	"binData":             5,
+	"undefined":           6,
+	"objectId":            7,
+	"bool":                8,
+	"date":                9,
+	"null":                10,
+	"regex":               11,
+	"dbPointer":           12,
+	"javascript":          13,
+	"symbol":              14,
+	"javascriptWithScope": 15,
+	"int":                 16,
+	"timestamp":           17,
+	"long":                18,
+	"decimal":             19,
+	"minKey":              -1,
+	"maxKey":              127,
+}
+
+// typeNumber returns the BSON type number of a value.
+func typeNumber(v interface{}) int {
+	switch v {
+	case bson.MinKey:
+		return -1
+	case bson.MaxKey:
+		return 127
+	case bson.Undefined:
+		return 6
+	}
+
+	switch t := v.(type) {
+	case float64:
+		return 1
+	case string:
+		return 2
+	case bson.D, bson.M:
+		return 3
+	case []interface{}:
+		return 4
+	case []byte, bson.Binary:
+		return 5
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case nil:
+		return 10
+	case bson.RegEx:
+		return 11
+	case bson.DBPointer:
+		return 12
+	case bson.JavaScript:
+		if t.Scope != nil {
+			return 15
+		}
+
+		return 13
+	case bson.Symbol:
+		return 14
+	case int, int32:
+		return 16
+	case bson.MongoTimestamp:
+		return 17
+	case int64:
+		return 18
+	case bson.Decimal128:
+		return 19
+	}
+
+	return 0
+}
+
+// compileType matches the values of any of the types given by number or by
+// name, "number" stands for all the numeric types.
+func compileType(v interface{}) (condition, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+
+	want := make(map[int]bool)
+	numbers := false
+	for _, t := range list {
+		switch {
+		case t == "number":
+			numbers = true
+		case isNumber(t):
+			f := toFloat(t)
+			if f != math.Trunc(f) {
+				return nil, errorf(codeBadValue, "invalid numerical type code: %v", t)
+			}
+
+			want[int(f)] = true
+		default:
+			name, _ := t.(string)
+			n, ok := types[name]
+			if !ok {
+				return nil, errorf(codeBadValue, "unknown type name alias: %v", t)
+			}
+
+			want[n] = true
+		}
+	}
+
+	return func(leaves []leaf) bool {
+		for _, e := range values(leaves) {
+			if want[typeNumber(e)] || numbers && isNumber(e) {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// size matches the arrays of the given length.
+func size(v interface{}) (condition, error) {
+	f := toFloat(v)
+	if !isNumber(v) || f != math.Trunc(f) {
+		return nil, errorf(codeBadValue, "$size needs a whole number")
+	}
+
+	if f < 0 {
+		return nil, errorf(codeBadValue, "$size may not be negative")
+	}
+
+	return func(leaves []leaf) bool {
+		for _, l := range leaves {
+			if a, ok := l.value.([]interface{}); ok && len(a) == int(f) {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// all matches the arrays holding all the values, or with an element matching
+// all the $elemMatch. An empty list matches nothing.
+func all(v interface{}) (condition, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errorf(codeBadValue, "$all needs an array")
+	}
+
+	if len(list) == 0 {
+		return func([]leaf) bool { return false }, nil
+	}
+
+	conds := make([]condition, len(list))
+	for i, e := range list {
+		var err error
+		switch {
+		case isOperators(e):
+			d := toDoc(e)
+			if len(d) != 1 || d[0].Name != "$elemMatch" {
+				return nil, errorf(codeBadValue, "no $ expressions in $all")
+			}
+
+			conds[i], err = elemMatch(d[0].Value)
+		case typeOrder(e) == orderRegex:
+			re := e.(bson.RegEx)
+			conds[i], err = compileRegex(re.Pattern, re.Options)
+		default:
+			conds[i] = eq(e)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(leaves []leaf) bool {
+		for _, c := range conds {
+			if !c(leaves) {
+				return false
+			}
+		}
+
+		return true
+	}, nil
+}
+
+// elemMatch matches the arrays with an element matching all the conditions,
+// either operators applied to the element or a filter of a document.
+func elemMatch(v interface{}) (condition, error) {
+	if !isDoc(v) {
+		return nil, errorf(codeBadValue, "$elemMatch needs an object")
+	}
+
+	d := toDoc(v)
+	var match func(e interface{}) bool
+	if isOperators(d) && d[0].Name != "$and" && d[0].Name != "$or" && d[0].Name != "$nor" {
+		c, err := compileOperators(d)
+		if err != nil {
+			return nil, err
+		}
+
+		match = func(e interface{}) bool { return c([]leaf{{value: e}}) }
+	} else {
+		m, err := compileFilter(d)
+		if err != nil {
+			return nil, err
+		}
+
+		match = func(e interface{}) bool { return isDoc(e) && m(e) }
+	}
+
+	return func(leaves []leaf) bool {
+		for _, l := range leaves {
+			a, _ := l.value.([]interface{})
+			for _, e := range a {
+				if match(e) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// mod matches the numbers with the given remainder of the division by the
+// divisor, both truncated to integers.
+func mod(v interface{}) (condition, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) != 2 || !isNumber(list[0]) || !isNumber(list[1]) {
+		return nil, errorf(codeBadValue, "malformed mod, needs to be an array of the divisor and the remainder")
+	}
+
+	divisor, remainder := int64(toFloat(list[0])), int64(toFloat(list[1]))
+	if divisor == 0 {
+		return nil, errorf(codeBadValue, "divisor cannot be 0")
+	}
+
+	return func(leaves []leaf) bool {
+		for _, e := range values(leaves) {
+			if !isNumber(e) {
+				continue
+			}
+
+			n, ok := toInt64(e)
+			if !ok {
+				f := toFloat(e)
+				if math.IsNaN(f) || math.IsInf(f, 0) {
+					continue
+				}
+
+				n = int64(f)
+			}
+
+			if n%divisor == remainder {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+func compileRegexOperator(v, options interface{}) (condition, error) {
+	opts, ok := options.(string)
+	if options != nil && !ok {
+		return nil, errorf(codeBadValue, "$options has to be a string")
+	}
+
+	switch re := v.(type) {
+	case string:
+		return compileRegex(re, opts)
+	case bson.RegEx:
+		if opts == "" {
+			opts = re.Options
+		}
+
+		return compileRegex(re.Pattern, opts)
+	}
+
+	return nil, errorf(codeBadValue, "$regex has to be a string")
+}
+
+// compileRegex matches the strings and symbols matching the regular
+// expression, the options i, m, s and x are supported.
+func compileRegex(pattern, options string) (condition, error) {
+	var flags string
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'x':
+			pattern = stripExtended(pattern)
+		default:
+			return nil, errorf(codeBadValue, "invalid flag in regex options: %c", o)
+		}
+	}
+
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errorf(codeBadValue, "invalid regular expression: %s", err)
+	}
+
+	return regex(re), nil
+}
+
+// stripExtended removes the whitespace and the comments of a pattern with
+// the x option, the escaped ones are kept.
+func stripExtended(pattern string) string {
+	var b bytes.Buffer
+	escaped, comment := false, false
+	for _, r := range pattern {
+		switch {
+		case comment:
+			comment = r != '\n'
+			continue
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '#':
+			comment = true
+			continue
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func regex(re *regexp.Regexp) condition {
+	return func(leaves []leaf) bool {
+		for _, e := range values(leaves) {
+			switch e.(type) {
+			case string, bson.Symbol:
+				if re.MatchString(toString(e)) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+}
+
+// compileNot compiles the operand of $not, a regular expression or a
+// document of operators.
+func compileNot(v interface{}) (condition, error) {
+	if re, ok := v.(bson.RegEx); ok {
+		return compileRegex(re.Pattern, re.Options)
+	}
+
+	if isOperators(v) {
+		return compileOperators(toDoc(v))
+	}
+
+	return nil, errorf(codeBadValue, "$not needs a regex or a document")
+}
+
+// truthy tells if v is true as a boolean option.
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	}
+
+	if isNumber(v) {
+		return toFloat(v) != 0
+	}
+
+	return true
+}
@@ -0,0 +1,82 @@
+// Package query evaluates the mongo query filters, the same that mongod
+// does, so the documents can be matched in the proxy without asking the
+// server. It supports the comparison, logical, element, array and
+// evaluation operators but $where, $expr, $text and the geospatial ones.
+//
+// The paths of the filters traverse the arrays as mongo does: {"a.b": 1}
+// matches {a: [{b: 1}, {b: 2}]}, and a value matches an array holding it.
+// The values of different types are never equal nor ordered in a
+// comparison, but the numbers which are compared by value.
+package query
+
+import (
+	"fmt"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The error codes of mongo for the invalid filters.
+const (
+	codeBadValue      = 2
+	codeFailedToParse = 9
+)
+
+// Error is an invalid filter, with the code mongo replies it with.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func errorf(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Matcher is a compiled filter, safe for concurrent use.
+type Matcher struct {
+	match matcher
+}
+
+// Compile compiles a filter, an empty one matches every document.
+func Compile(filter protocol.Document) (*Matcher, error) {
+	if len(filter) == 0 {
+		return CompileBSON(nil)
+	}
+
+	d, err := filter.ToBSON()
+	if err != nil {
+		return nil, errorf(codeFailedToParse, "invalid filter: %s", err)
+	}
+
+	return CompileBSON(d)
+}
+
+// CompileBSON compiles a filter already decoded, nil matches every document.
+func CompileBSON(filter bson.D) (*Matcher, error) {
+	m, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Matcher{match: m}, nil
+}
+
+// Match returns true if the document matches the filter.
+func (m *Matcher) Match(doc protocol.Document) (bool, error) {
+	d, err := doc.ToBSON()
+	if err != nil {
+		return false, err
+	}
+
+	return m.match(d), nil
+}
+
+// MatchBSON returns true if the decoded document matches the filter.
+func (m *Matcher) MatchBSON(doc bson.D) bool {
+	return m.match(doc)
+}
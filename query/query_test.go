@@ -0,0 +1,370 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type QuerySuite struct{}
+
+var _ = Suite(&QuerySuite{})
+
+// conformance are filters and the documents they match or not, most of them
+// from the examples of the mongo manual.
+var conformance = []struct {
+	filter  string
+	match   []string
+	noMatch []string
+}{
+	// equality, an array matches if any of its elements or itself is equal.
+	{`{"qty": 20}`, []string{`{"qty": 20}`, `{"qty": 20.0}`, `{"qty": [5, 20]}`}, []string{`{"qty": 21}`, `{"qty": "20"}`, `{"qty": [[20]]}`, `{}`}},
+	{`{"tags": ["red", "blank"]}`, []string{`{"tags": ["red", "blank"]}`, `{"tags": [["red", "blank"], "plain"]}`}, []string{`{"tags": ["blank", "red"]}`, `{"tags": ["red", "blank", "plain"]}`}},
+	{`{"size": {"h": 14, "w": 21}}`, []string{`{"size": {"h": 14, "w": 21}}`, `{"size": [{"h": 14, "w": 21}]}`}, []string{`{"size": {"w": 21, "h": 14}}`, `{"size": {"h": 14}}`}},
+	{`{"size.uom": "in"}`, []string{`{"size": {"uom": "in"}}`, `{"size": [{"uom": "cm"}, {"uom": "in"}]}`}, []string{`{"size": {"uom": "cm"}}`, `{"size": "in"}`, `{"size": [[{"uom": "in"}]]}`}},
+	{`{"a.b.c": 1}`, []string{`{"a": {"b": {"c": 1}}}`, `{"a": [{"b": [{"c": 2}, {"c": 1}]}]}`}, []string{`{"a": {"b": {"c": 2}}}`, `{"a": {"b": 1}}`}},
+
+	// comparison, only values of the same type are compared.
+	{`{"qty": {"$gt": 20}}`, []string{`{"qty": 25}`, `{"qty": 20.5}`, `{"qty": [1, 30]}`}, []string{`{"qty": 20}`, `{"qty": "25"}`, `{"qty": [1, 2]}`, `{}`}},
+	{`{"qty": {"$gte": 20}}`, []string{`{"qty": 20}`, `{"qty": 21}`}, []string{`{"qty": 19}`}},
+	{`{"qty": {"$lt": 20}}`, []string{`{"qty": 19}`, `{"qty": -1.5}`}, []string{`{"qty": 20}`, `{"qty": null}`, `{"qty": "1"}`}},
+	{`{"qty": {"$lte": 20}}`, []string{`{"qty": 20}`}, []string{`{"qty": 21}`}},
+	{`{"name": {"$gt": "b"}}`, []string{`{"name": "c"}`, `{"name": "ba"}`}, []string{`{"name": "a"}`, `{"name": 3}`}},
+	{`{"dim": {"$gt": 15, "$lt": 20}}`, []string{`{"dim": 18}`, `{"dim": [14, 21]}`}, []string{`{"dim": [10, 12]}`, `{"dim": 20}`}},
+	{`{"dim.1": {"$gt": 25}}`, []string{`{"dim": [14, 30]}`}, []string{`{"dim": [30, 14]}`, `{"dim": [30]}`}},
+	{`{"a.0.b": 1}`, []string{`{"a": [{"b": 1}]}`, `{"a": [{"0": {"b": 1}}]}`}, []string{`{"a": [{"b": 2}, {"b": 1}]}`}},
+	{`{"qty": {"$eq": 20}}`, []string{`{"qty": 20}`, `{"qty": [20]}`}, []string{`{"qty": 2}`}},
+	{`{"qty": {"$ne": 20}}`, []string{`{"qty": 2}`, `{}`, `{"qty": [1, 2]}`}, []string{`{"qty": 20}`, `{"qty": [1, 20]}`}},
+	{`{"qty": {"$in": [5, 15]}}`, []string{`{"qty": 5}`, `{"qty": [1, 15]}`}, []string{`{"qty": 10}`, `{}`}},
+	{`{"qty": {"$in": [null]}}`, []string{`{"qty": null}`, `{}`}, []string{`{"qty": 0}`}},
+	{`{"qty": {"$nin": [5, 15]}}`, []string{`{"qty": 10}`, `{}`}, []string{`{"qty": 5}`, `{"qty": [1, 15]}`}},
+
+	// null matches the null and missing fields.
+	{`{"item": null}`, []string{`{"item": null}`, `{}`, `{"item": [1, null]}`}, []string{`{"item": 0}`, `{"item": false}`}},
+	{`{"a.b": null}`, []string{`{"a": {}}`, `{"a": 1}`, `{"a": [{"b": 1}, {"c": 1}]}`}, []string{`{"a": {"b": 1}}`, `{"a": [{"b": 1}]}`}},
+	{`{"item": {"$ne": null}}`, []string{`{"item": 1}`}, []string{`{"item": null}`, `{}`}},
+	// an array without documents has no fields.
+	{`{"a.b": null}`, []string{`{"a": [1, 2]}`, `{"a": []}`, `{"a": [1, {"c": 1}]}`}, []string{`{"a": [1, {"b": 1}]}`}},
+	{`{"a.b": {"$ne": null}}`, []string{`{"a": [1, {"b": 1}]}`}, []string{`{"a": [1, 2]}`, `{"a": []}`}},
+	{`{"a.b": {"$exists": false}}`, []string{`{"a": [1, 2]}`}, []string{`{"a": [{"b": null}]}`}},
+	{`{"item": {"$gte": null}}`, []string{`{"item": null}`, `{}`}, []string{`{"item": 1}`}},
+	{`{"item": {"$gt": null}}`, []string{}, []string{`{"item": null}`, `{}`, `{"item": 1}`}},
+
+	// element.
+	{`{"item": {"$exists": true}}`, []string{`{"item": null}`, `{"item": 0}`}, []string{`{}`}},
+	{`{"item": {"$exists": false}}`, []string{`{}`, `{"other": 1}`}, []string{`{"item": null}`}},
+	{`{"a.b": {"$exists": false}}`, []string{`{"a": [{"c": 1}]}`, `{"a": 1}`}, []string{`{"a": [{"b": 1}, {"c": 1}]}`}},
+	{`{"item": {"$type": 10}}`, []string{`{"item": null}`}, []string{`{}`, `{"item": 0}`}},
+	{`{"zip": {"$type": "string"}}`, []string{`{"zip": "43"}`, `{"zip": [1, "43"]}`}, []string{`{"zip": 43}`, `{}`}},
+	{`{"zip": {"$type": "number"}}`, []string{`{"zip": 43}`, `{"zip": 4.3}`}, []string{`{"zip": "43"}`}},
+	{`{"zip": {"$type": ["string", "double"]}}`, []string{`{"zip": "43"}`, `{"zip": 4.3}`}, []string{`{"zip": 43}`}},
+	{`{"zip": {"$type": "array"}}`, []string{`{"zip": []}`, `{"zip": [1]}`}, []string{`{"zip": 1}`}},
+	{`{"zip": {"$type": "object"}}`, []string{`{"zip": {}}`, `{"zip": [{"a": 1}]}`}, []string{`{"zip": []}`}},
+
+	// array.
+	{`{"tags": {"$size": 2}}`, []string{`{"tags": [1, 2]}`, `{"tags": [[1, 2, 3], 4]}`}, []string{`{"tags": [1]}`, `{"tags": 2}`, `{}`}},
+	{`{"tags": {"$size": 0}}`, []string{`{"tags": []}`}, []string{`{}`, `{"tags": null}`}},
+	{`{"tags": {"$all": ["ssl", "security"]}}`, []string{`{"tags": ["ssl", "x", "security"]}`}, []string{`{"tags": ["ssl"]}`, `{"tags": "ssl"}`}},
+	{`{"tags": {"$all": ["ssl"]}}`, []string{`{"tags": "ssl"}`, `{"tags": ["ssl"]}`}, []string{`{"tags": "x"}`}},
+	{`{"tags": {"$all": [["ssl", "security"]]}}`, []string{`{"tags": ["ssl", "security"]}`, `{"tags": [["ssl", "security"], "x"]}`}, []string{`{"tags": ["security", "ssl"]}`}},
+	{`{"tags": {"$all": []}}`, []string{}, []string{`{"tags": []}`, `{"tags": [1]}`}},
+	{`{"results": {"$elemMatch": {"$gte": 80, "$lt": 85}}}`, []string{`{"results": [82, 90]}`}, []string{`{"results": [75, 88]}`, `{"results": 82}`}},
+	{`{"results": {"$elemMatch": {"product": "xyz", "score": {"$gte": 8}}}}`, []string{`{"results": [{"product": "abc", "score": 10}, {"product": "xyz", "score": 8}]}`}, []string{`{"results": [{"product": "abc", "score": 10}, {"product": "xyz", "score": 5}]}`, `{"results": {"product": "xyz", "score": 8}}`}},
+	{`{"results": {"$elemMatch": {"$or": [{"a": 1}, {"b": 1}]}}}`, []string{`{"results": [{"b": 1}]}`}, []string{`{"results": [{"c": 1}]}`}},
+	{`{"instock": {"$elemMatch": {"qty": {"$gt": 10, "$lte": 20}}}}`, []string{`{"instock": [{"qty": 15}]}`}, []string{`{"instock": [{"qty": 5}, {"qty": 25}]}`}},
+	{`{"instock.qty": {"$gt": 10, "$lte": 20}}`, []string{`{"instock": [{"qty": 15}]}`, `{"instock": [{"qty": 5}, {"qty": 25}]}`}, []string{`{"instock": [{"qty": 5}, {"qty": 8}]}`}},
+	{`{"qty": {"$all": [{"$elemMatch": {"size": "M", "num": {"$gt": 50}}}, {"$elemMatch": {"num": 100, "color": "green"}}]}}`, []string{`{"qty": [{"size": "M", "num": 100, "color": "green"}]}`, `{"qty": [{"size": "M", "num": 60}, {"num": 100, "color": "green"}]}`}, []string{`{"qty": [{"size": "M", "num": 60}]}`}},
+
+	// evaluation.
+	{`{"qty": {"$mod": [4, 0]}}`, []string{`{"qty": 0}`, `{"qty": 12}`, `{"qty": 8.5}`, `{"qty": [1, 4]}`}, []string{`{"qty": 5}`, `{"qty": "4"}`, `{}`}},
+	{`{"sku": {"$regex": "^ABC", "$options": "i"}}`, []string{`{"sku": "abc123"}`, `{"sku": ["x", "ABC"]}`}, []string{`{"sku": "xabc"}`, `{"sku": 1}`}},
+	{`{"sku": {"$regex": "^abc . 3$", "$options": "x"}}`, []string{`{"sku": "abc13"}`}, []string{`{"sku": "abc 13"}`}},
+	{`{"sku": {"$regex": "^b", "$options": "m"}}`, []string{`{"sku": "a\nb"}`}, []string{`{"sku": "a b"}`}},
+	{`{"sku": {"$not": {"$gt": 5}}}`, []string{`{"sku": 1}`, `{}`, `{"sku": "9"}`}, []string{`{"sku": 9}`}},
+
+	// logical.
+	{`{"$and": [{"a": 1}, {"b": 2}]}`, []string{`{"a": 1, "b": 2}`}, []string{`{"a": 1}`}},
+	{`{"$or": [{"a": 1}, {"b": 2}]}`, []string{`{"a": 1}`, `{"b": 2}`}, []string{`{"a": 2}`}},
+	{`{"$nor": [{"price": 1.99}, {"sale": true}]}`, []string{`{"price": 2}`, `{}`}, []string{`{"price": 1.99}`, `{"sale": true}`}},
+	{`{"a": 1, "$or": [{"b": 1}, {"c": 1}], "$comment": "x"}`, []string{`{"a": 1, "c": 1}`}, []string{`{"a": 1}`, `{"c": 1}`}},
+	{`{}`, []string{`{}`, `{"a": 1}`}, []string{}},
+}
+
+func (s *QuerySuite) TestConformance(c *C) {
+	for _, t := range conformance {
+		m, err := CompileBSON(parse(c, t.filter))
+		c.Assert(err, IsNil, Commentf("filter: %s", t.filter))
+
+		for _, doc := range t.match {
+			c.Assert(m.MatchBSON(parse(c, doc)), Equals, true, Commentf("filter: %s doc: %s", t.filter, doc))
+		}
+
+		for _, doc := range t.noMatch {
+			c.Assert(m.MatchBSON(parse(c, doc)), Equals, false, Commentf("filter: %s doc: %s", t.filter, doc))
+		}
+	}
+}
+
+func (s *QuerySuite) TestTypes(c *C) {
+	id := bson.NewObjectId()
+	now := time.Now()
+	for _, t := range []struct {
+		value interface{}
+		alias string
+	}{
+		{1.5, "double"},
+		{"foo", "string"},
+		{bson.D{}, "object"},
+		{[]interface{}{}, "array"},
+		{[]byte("foo"), "binData"},
+		{bson.Undefined, "undefined"},
+		{id, "objectId"},
+		{true, "bool"},
+		{now, "date"},
+		{nil, "null"},
+		{bson.RegEx{Pattern: "a"}, "regex"},
+		{bson.JavaScript{Code: "x"}, "javascript"},
+		{bson.Symbol("foo"), "symbol"},
+		{bson.JavaScript{Code: "x", Scope: bson.M{}}, "javascriptWithScope"},
+		{1, "int"},
+		{bson.MongoTimestamp(1), "timestamp"},
+		{int64(1), "long"},
+		{bson.MinKey, "minKey"},
+		{bson.MaxKey, "maxKey"},
+	} {
+		m, err := CompileBSON(bson.D{{Name: "a", Value: bson.D{{Name: "$type", Value: t.alias}}}})
+		c.Assert(err, IsNil)
+		c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: t.value}}), Equals, true, Commentf("type %s", t.alias))
+
+		m, err = CompileBSON(bson.D{{Name: "a", Value: bson.D{{Name: "$type", Value: types[t.alias]}}}})
+		c.Assert(err, IsNil)
+		c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: t.value}}), Equals, true, Commentf("type %d", types[t.alias]))
+	}
+}
+
+func (s *QuerySuite) TestRegexValue(c *C) {
+	m, err := CompileBSON(bson.D{{Name: "a", Value: bson.RegEx{Pattern: "^fo+$", Options: "i"}}})
+	c.Assert(err, IsNil)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: "FOO"}}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: bson.Symbol("foo")}}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: "bar"}}), Equals, false)
+
+	m, err = CompileBSON(bson.D{{Name: "a", Value: bson.D{{Name: "$in", Value: []interface{}{bson.RegEx{Pattern: "^b"}, 1}}}}})
+	c.Assert(err, IsNil)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: []interface{}{"x", "bar"}}}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: 1}}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: "foo"}}), Equals, false)
+
+	m, err = CompileBSON(bson.D{{Name: "a", Value: bson.D{{Name: "$not", Value: bson.RegEx{Pattern: "^b"}}}}})
+	c.Assert(err, IsNil)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: "foo"}}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: "bar"}}), Equals, false)
+
+	// $eq compares the regular expressions as values.
+	re := bson.RegEx{Pattern: "^b"}
+	m, err = CompileBSON(bson.D{{Name: "a", Value: bson.D{{Name: "$eq", Value: re}}}})
+	c.Assert(err, IsNil)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: re}}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: "bar"}}), Equals, false)
+}
+
+func (s *QuerySuite) TestNumbers(c *C) {
+	m, err := CompileBSON(bson.D{{Name: "a", Value: int64(1) << 60}})
+	c.Assert(err, IsNil)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: int64(1)<<60 + 1}}), Equals, false)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: float64(int64(1) << 60)}}), Equals, true)
+
+	m, err = CompileBSON(bson.D{{Name: "a", Value: bson.D{{Name: "$lt", Value: 1}}}})
+	c.Assert(err, IsNil)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: math.NaN()}}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: math.Inf(-1)}}), Equals, true)
+}
+
+func (s *QuerySuite) TestMinMaxKey(c *C) {
+	m, err := CompileBSON(bson.D{{Name: "a", Value: bson.D{{Name: "$gt", Value: bson.MinKey}}}})
+	c.Assert(err, IsNil)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: "foo"}}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: nil}}), Equals, true)
+
+	m, err = CompileBSON(bson.D{{Name: "a", Value: bson.D{{Name: "$lt", Value: bson.MaxKey}}}})
+	c.Assert(err, IsNil)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: 1}}), Equals, true)
+	c.Assert(m.MatchBSON(bson.D{{Name: "a", Value: bson.MaxKey}}), Equals, false)
+}
+
+func (s *QuerySuite) TestDBRef(c *C) {
+	ref := bson.D{{Name: "$ref", Value: "users"}, {Name: "$id", Value: 1}}
+	m, err := CompileBSON(bson.D{{Name: "owner", Value: ref}})
+	c.Assert(err, IsNil)
+	c.Assert(m.MatchBSON(bson.D{{Name: "owner", Value: ref}}), Equals, true)
+}
+
+func (s *QuerySuite) TestErrors(c *C) {
+	for _, t := range []struct {
+		filter string
+		err    string
+	}{
+		{`{"$foo": 1}`, "unknown top level operator: \\$foo"},
+		{`{"$where": "true"}`, "unsupported operator: \\$where"},
+		{`{"a": {"$foo": 1}}`, "unknown operator: \\$foo"},
+		{`{"a": {"$gt": 1, "b": 1}}`, "unknown operator: b"},
+		{`{"$and": []}`, "\\$and must be a nonempty array"},
+		{`{"$or": [1]}`, "\\$or entries need to be full objects"},
+		{`{"a": {"$in": 1}}`, "\\$in needs an array"},
+		{`{"a": {"$in": [{"$gt": 1}]}}`, "cannot nest \\$ under \\$in"},
+		{`{"a": {"$size": -1}}`, "\\$size may not be negative"},
+		{`{"a": {"$size": 1.5}}`, "\\$size needs a whole number"},
+		{`{"a": {"$type": "foo"}}`, "unknown type name alias: foo"},
+		{`{"a": {"$all": 1}}`, "\\$all needs an array"},
+		{`{"a": {"$all": [{"$gt": 1}]}}`, "no \\$ expressions in \\$all"},
+		{`{"a": {"$elemMatch": 1}}`, "\\$elemMatch needs an object"},
+		{`{"a": {"$mod": [0, 1]}}`, "divisor cannot be 0"},
+		{`{"a": {"$mod": [1]}}`, "malformed mod.*"},
+		{`{"a": {"$options": "i"}}`, "\\$options needs a \\$regex"},
+		{`{"a": {"$regex": "(", "$options": ""}}`, "invalid regular expression.*"},
+		{`{"a": {"$regex": "a", "$options": "q"}}`, "invalid flag in regex options: q"},
+		{`{"a": {"$not": 1}}`, "\\$not needs a regex or a document"},
+	} {
+		_, err := CompileBSON(parse(c, t.filter))
+		c.Assert(err, ErrorMatches, t.err, Commentf("filter: %s", t.filter))
+		c.Assert(err.(*Error).Code, Equals, codeBadValue)
+	}
+}
+
+func (s *QuerySuite) TestCompare(c *C) {
+	id := bson.NewObjectId()
+	now := time.Now()
+	ordered := []interface{}{
+		bson.MinKey,
+		nil,
+		-1.5,
+		1,
+		int64(2),
+		"a",
+		"b",
+		bson.D{{Name: "a", Value: 1}},
+		bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 1}},
+		[]interface{}{1},
+		[]byte("a"),
+		id,
+		false,
+		true,
+		now,
+		bson.MongoTimestamp(1),
+		bson.RegEx{Pattern: "a"},
+		bson.MaxKey,
+	}
+
+	shuffled := make([]interface{}, len(ordered))
+	for i := range ordered {
+		shuffled[i] = ordered[len(ordered)-1-i]
+	}
+
+	sort.SliceStable(shuffled, func(i, j int) bool { return Compare(shuffled[i], shuffled[j]) < 0 })
+	c.Assert(shuffled, DeepEquals, ordered)
+
+	c.Assert(Compare(1, 1.0), Equals, 0)
+	c.Assert(Compare(bson.M{"b": 1, "a": 2}, bson.D{{Name: "a", Value: 2}, {Name: "b", Value: 1}}), Equals, 0)
+}
+
+func (s *QuerySuite) TestCompileDocument(c *C) {
+	filter, err := bson.Marshal(bson.M{"a": bson.M{"$gt": 1}})
+	c.Assert(err, IsNil)
+
+	m, err := Compile(protocol.Document(filter))
+	c.Assert(err, IsNil)
+
+	doc, err := bson.Marshal(bson.M{"a": 2})
+	c.Assert(err, IsNil)
+
+	matched, err := m.Match(protocol.Document(doc))
+	c.Assert(err, IsNil)
+	c.Assert(matched, Equals, true)
+
+	m, err = Compile(nil)
+	c.Assert(err, IsNil)
+
+	matched, err = m.Match(protocol.Document(doc))
+	c.Assert(err, IsNil)
+	c.Assert(matched, Equals, true)
+
+	_, err = Compile(protocol.Document("foo"))
+	c.Assert(err, NotNil)
+}
+
+// parse decodes a JSON document into a bson.D keeping the order of its
+// fields, the integers are decoded as int and the rest of numbers as float64.
+func parse(c *C, s string) bson.D {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+
+	v, err := parseValue(d)
+	c.Assert(err, IsNil, Commentf("json: %s", s))
+	return v.(bson.D)
+}
+
+func parseValue(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := t.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			doc := bson.D{}
+			for d.More() {
+				name, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+
+				v, err := parseValue(d)
+				if err != nil {
+					return nil, err
+				}
+
+				doc = append(doc, bson.DocElem{Name: name.(string), Value: v})
+			}
+
+			_, err := d.Token()
+			return doc, err
+		case '[':
+			list := []interface{}{}
+			for d.More() {
+				v, err := parseValue(d)
+				if err != nil {
+					return nil, err
+				}
+
+				list = append(list, v)
+			}
+
+			_, err := d.Token()
+			return list, err
+		}
+	case json.Number:
+		if bytes.ContainsAny([]byte(t), ".eE") {
+			return t.Float64()
+		}
+
+		n, err := t.Int64()
+		return int(n), err
+	}
+
+	return t, nil
+}
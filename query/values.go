@@ -0,0 +1,319 @@
+package query
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The values are expected as decoded by mgo into a bson.D: the nested
+// documents are bson.D, the arrays []interface{}, the int32 int and the int64
+// int64.
+
+// The positions of the types in the order mongo compares the values of
+// different types, the numbers are compared by value among them.
+const (
+	orderMinKey = iota
+	orderNull
+	orderNumber
+	orderString
+	orderObject
+	orderArray
+	orderBinary
+	orderObjectID
+	orderBool
+	orderDate
+	orderTimestamp
+	orderRegex
+	orderOther
+	orderMaxKey
+)
+
+func typeOrder(v interface{}) int {
+	switch v {
+	case bson.MinKey:
+		return orderMinKey
+	case bson.MaxKey:
+		return orderMaxKey
+	case bson.Undefined:
+		return orderNull
+	}
+
+	switch v.(type) {
+	case nil:
+		return orderNull
+	case int, int32, int64, float64, bson.Decimal128:
+		return orderNumber
+	case string, bson.Symbol:
+		return orderString
+	case bson.D, bson.M:
+		return orderObject
+	case []interface{}:
+		return orderArray
+	case []byte, bson.Binary:
+		return orderBinary
+	case bson.ObjectId:
+		return orderObjectID
+	case bool:
+		return orderBool
+	case time.Time:
+		return orderDate
+	case bson.MongoTimestamp:
+		return orderTimestamp
+	case bson.RegEx:
+		return orderRegex
+	}
+
+	return orderOther
+}
+
+// Compare returns -1, 0 or 1 if a is less, equal or greater than b. As mongo
+// does, the values of different types are ordered by their type, the numbers
+// of any type are compared by value and the documents field by field, names
+// included.
+func Compare(a, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return sign(ta - tb)
+	}
+
+	switch ta {
+	case orderNumber:
+		return compareNumbers(a, b)
+	case orderString:
+		return strings.Compare(toString(a), toString(b))
+	case orderObject:
+		return compareDocs(toDoc(a), toDoc(b))
+	case orderArray:
+		va, vb := a.([]interface{}), b.([]interface{})
+		for i := 0; i < len(va) && i < len(vb); i++ {
+			if c := Compare(va[i], vb[i]); c != 0 {
+				return c
+			}
+		}
+
+		return sign(len(va) - len(vb))
+	case orderBinary:
+		va, vb := toBinary(a), toBinary(b)
+		if len(va.Data) != len(vb.Data) {
+			return sign(len(va.Data) - len(vb.Data))
+		}
+
+		if va.Kind != vb.Kind {
+			return sign(int(va.Kind) - int(vb.Kind))
+		}
+
+		return bytes.Compare(va.Data, vb.Data)
+	case orderObjectID:
+		return strings.Compare(string(a.(bson.ObjectId)), string(b.(bson.ObjectId)))
+	case orderBool:
+		va, vb := a.(bool), b.(bool)
+		switch {
+		case va == vb:
+			return 0
+		case !va:
+			return -1
+		}
+
+		return 1
+	case orderDate:
+		va, vb := a.(time.Time), b.(time.Time)
+		switch {
+		case va.Before(vb):
+			return -1
+		case va.After(vb):
+			return 1
+		}
+
+		return 0
+	case orderTimestamp:
+		va, vb := a.(bson.MongoTimestamp), b.(bson.MongoTimestamp)
+		switch {
+		case va < vb:
+			return -1
+		case va > vb:
+			return 1
+		}
+
+		return 0
+	case orderRegex:
+		va, vb := a.(bson.RegEx), b.(bson.RegEx)
+		if c := strings.Compare(va.Pattern, vb.Pattern); c != 0 {
+			return c
+		}
+
+		return strings.Compare(va.Options, vb.Options)
+	}
+
+	return 0
+}
+
+// compareNumbers compares the integers exactly and the rest as float64, NaN
+// is less than any other number.
+func compareNumbers(a, b interface{}) int {
+	ia, aInt := toInt64(a)
+	ib, bInt := toInt64(b)
+	if aInt && bInt {
+		switch {
+		case ia < ib:
+			return -1
+		case ia > ib:
+			return 1
+		}
+
+		return 0
+	}
+
+	fa, fb := toFloat(a), toFloat(b)
+	switch {
+	case fa < fb, math.IsNaN(fa) && !math.IsNaN(fb):
+		return -1
+	case fa > fb, !math.IsNaN(fa) && math.IsNaN(fb):
+		return 1
+	}
+
+	return 0
+}
+
+func compareDocs(a, b bson.D) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := typeOrder(a[i].Value) - typeOrder(b[i].Value); c != 0 {
+			return sign(c)
+		}
+
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+
+		if c := Compare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+
+	return sign(len(a) - len(b))
+}
+
+// equal is the equality of the filters, the values compare equal and are of
+// the same type but for the numbers.
+func equal(a, b interface{}) bool {
+	return typeOrder(a) == typeOrder(b) && Compare(a, b) == 0
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(n.String(), 64)
+		if err != nil {
+			return math.NaN()
+		}
+
+		return f
+	}
+
+	return math.NaN()
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case bson.Symbol:
+		return string(s)
+	}
+
+	return ""
+}
+
+// toDoc returns a document as a bson.D, the bson.M are sorted by name since
+// they have no order.
+func toDoc(v interface{}) bson.D {
+	switch d := v.(type) {
+	case bson.D:
+		return d
+	case bson.M:
+		names := make([]string, 0, len(d))
+		for name := range d {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		doc := make(bson.D, len(names))
+		for i, name := range names {
+			doc[i] = bson.DocElem{Name: name, Value: d[name]}
+		}
+
+		return doc
+	}
+
+	return nil
+}
+
+func toBinary(v interface{}) bson.Binary {
+	if b, ok := v.([]byte); ok {
+		return bson.Binary{Data: b}
+	}
+
+	return v.(bson.Binary)
+}
+
+func isNumber(v interface{}) bool {
+	return typeOrder(v) == orderNumber
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+
+	return 0
+}
+
+// get returns the value of a field of a document.
+func get(doc interface{}, name string) (interface{}, bool) {
+	switch d := doc.(type) {
+	case bson.D:
+		for _, e := range d {
+			if e.Name == name {
+				return e.Value, true
+			}
+		}
+	case bson.M:
+		v, ok := d[name]
+		return v, ok
+	}
+
+	return nil, false
+}
+
+func isDoc(v interface{}) bool {
+	return typeOrder(v) == orderObject
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/mcuadros/lemondb/config"
+	"github.com/mcuadros/lemondb/logging"
+)
+
+// reloader applies a new version of the configuration file to the running
+// proxies.
+type reloader struct {
+	file  string
+	log   logging.Logger
+	group *proxyGroup
+
+	mu sync.Mutex
+}
+
+// Reload reloads the TLS certificates and, if the proxies were configured
+// from a file, the configuration. If the new configuration is not valid the
+// current one is kept.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reloadTLS()
+	if r.file == "" {
+		return nil
+	}
+
+	if err := r.reloadConfig(); err != nil {
+		r.log.Error("error reloading the configuration, keeping the current one", "file", r.file, "err", err)
+		return err
+	}
+
+	r.log.Info("configuration reloaded", "file", r.file)
+	return nil
+}
+
+func (r *reloader) reloadTLS() {
+	for _, p := range r.group.Proxies() {
+		if err := p.ReloadTLS(); err != nil {
+			r.log.Error("error reloading tls certificates", "proxy", p.Name, "err", err)
+		}
+	}
+}
+
+func (r *reloader) reloadConfig() error {
+	cfg, err := config.Load(r.file)
+	if err != nil {
+		return err
+	}
+
+	return r.group.update(cfg)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/lemondb/capture"
+	"github.com/mcuadros/lemondb/replay"
+)
+
+const unixScheme = "unix://"
+
+// Replay implements the replay command: the binary captures given as
+// arguments are sent to a server and its replies compared with the recorded
+// ones.
+func Replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: lemondb replay [flags] capture.bin.N ... capture.bin")
+		fs.PrintDefaults()
+	}
+
+	target := fs.String("target", "localhost:27017", "address of the server, unix:///path for a unix domain socket")
+	speed := fs.Float64("speed", 1, "pace of the replay relative to the capture, 0 sends the messages as fast as possible")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for each reply")
+	ignore := fs.String("ignore", "", "comma separated fields not compared besides the volatile ones")
+	maxDiffs := fs.Int("max-diffs", 100, "number of mismatches kept in the report")
+	reportFile := fs.String("report", "", "file to write the report as JSON, besides the summary printed")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no capture files given")
+	}
+
+	network, addr := "tcp", *target
+	if strings.HasPrefix(addr, unixScheme) {
+		network, addr = "unix", strings.TrimPrefix(addr, unixScheme)
+	}
+
+	r := &replay.Replayer{
+		Dial: func() (net.Conn, error) {
+			return net.DialTimeout(network, addr, *timeout)
+		},
+		Speed:    *speed,
+		Timeout:  *timeout,
+		MaxDiffs: *maxDiffs,
+	}
+
+	if *ignore != "" {
+		r.Ignore = strings.Split(*ignore, ",")
+	}
+
+	src := &fileSource{files: fs.Args()}
+	defer src.Close()
+
+	report, err := r.Replay(src)
+	if report != nil {
+		report.WriteText(os.Stdout)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		if err := report.WriteJSON(f); err != nil {
+			return err
+		}
+	}
+
+	if !report.OK() {
+		return fmt.Errorf("%d replies differ, %d messages failed", report.Mismatched, report.Errors+report.Skipped)
+	}
+
+	return nil
+}
+
+// fileSource reads the records of several capture files, one after another.
+type fileSource struct {
+	files []string
+
+	f *os.File
+	r *capture.Reader
+}
+
+func (s *fileSource) Next() (*capture.Record, error) {
+	for {
+		if s.r == nil {
+			if len(s.files) == 0 {
+				return nil, io.EOF
+			}
+
+			if err := s.open(s.files[0]); err != nil {
+				return nil, err
+			}
+
+			s.files = s.files[1:]
+		}
+
+		rec, err := s.r.Next()
+		if err != io.EOF {
+			return rec, err
+		}
+
+		s.Close()
+	}
+}
+
+func (s *fileSource) open(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	r, err := capture.NewReader(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	s.f, s.r = f, r
+	return nil
+}
+
+func (s *fileSource) Close() error {
+	if s.f == nil {
+		return nil
+	}
+
+	err := s.f.Close()
+	s.f, s.r = nil, nil
+	return err
+}
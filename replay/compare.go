@@ -0,0 +1,223 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// VolatileFields are the fields of the replies that change from one run to
+// another, they are never compared.
+var VolatileFields = []string{
+	"$clusterTime",
+	"$gleStats",
+	"connectionId",
+	"electionId",
+	"lastWrite",
+	"localTime",
+	"opTime",
+	"operationTime",
+}
+
+// maxValueLen is how much of a value is shown in a difference.
+const maxValueLen = 80
+
+// comparedFlags are the response flags that have to match, the rest depend on
+// the server.
+const comparedFlags = protocol.QueryFailure | protocol.CursorNotFound
+
+// comparer finds the differences between a recorded reply and the replayed
+// one. ObjectIds, dates and timestamps are only compared by type and cursor
+// ids only by whether the cursor is still open.
+type comparer struct {
+	ignore map[string]bool
+}
+
+func newComparer(ignore []string) *comparer {
+	c := &comparer{ignore: make(map[string]bool)}
+	for _, f := range VolatileFields {
+		c.ignore[f] = true
+	}
+
+	for _, f := range ignore {
+		c.ignore[f] = true
+	}
+
+	return c
+}
+
+// compare returns the differences, none if the replies match.
+func (c *comparer) compare(was, is *protocol.OpReply) []string {
+	var diffs []string
+	if was.ResponseFlags&comparedFlags != is.ResponseFlags&comparedFlags {
+		diffs = append(diffs, fmt.Sprintf("flags: recorded %d, replayed %d",
+			was.ResponseFlags&comparedFlags, is.ResponseFlags&comparedFlags))
+	}
+
+	if (was.CursorID == 0) != (is.CursorID == 0) {
+		diffs = append(diffs, fmt.Sprintf("cursor: recorded %s, replayed %s",
+			cursorState(was.CursorID), cursorState(is.CursorID)))
+	}
+
+	if len(was.Documents) != len(is.Documents) {
+		diffs = append(diffs, fmt.Sprintf("documents: recorded %d, replayed %d",
+			len(was.Documents), len(is.Documents)))
+	}
+
+	for i := 0; i < len(was.Documents) && i < len(is.Documents); i++ {
+		path := "[" + strconv.Itoa(i) + "]"
+
+		var a, b bson.M
+		if err := bson.Unmarshal(was.Documents[i], &a); err != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: recorded invalid document: %s", path, err))
+			continue
+		}
+
+		if err := bson.Unmarshal(is.Documents[i], &b); err != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: replayed invalid document: %s", path, err))
+			continue
+		}
+
+		diffs = c.compareDocs(diffs, path, a, b)
+	}
+
+	return diffs
+}
+
+func (c *comparer) compareDocs(diffs []string, path string, a, b bson.M) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if c.ignore[k] {
+			continue
+		}
+
+		p := path + "." + k
+		va, inA := a[k]
+		vb, inB := b[k]
+		switch {
+		case !inB:
+			diffs = append(diffs, fmt.Sprintf("%s: recorded %s, missing in replay", p, formatValue(va)))
+		case !inA:
+			diffs = append(diffs, fmt.Sprintf("%s: not recorded, replayed %s", p, formatValue(vb)))
+		case k == "id" && isCursorPath(path):
+			if isZero(va) != isZero(vb) {
+				diffs = append(diffs, fmt.Sprintf("%s: recorded %s, replayed %s", p, formatValue(va), formatValue(vb)))
+			}
+		default:
+			diffs = c.compareValues(diffs, p, va, vb)
+		}
+	}
+
+	return diffs
+}
+
+func (c *comparer) compareValues(diffs []string, path string, a, b interface{}) []string {
+	switch va := a.(type) {
+	case bson.M:
+		if vb, ok := b.(bson.M); ok {
+			return c.compareDocs(diffs, path, va, vb)
+		}
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+
+		if len(va) != len(vb) {
+			diffs = append(diffs, fmt.Sprintf("%s: recorded %d elements, replayed %d", path, len(va), len(vb)))
+		}
+
+		for i := 0; i < len(va) && i < len(vb); i++ {
+			diffs = c.compareValues(diffs, path+"."+strconv.Itoa(i), va[i], vb[i])
+		}
+
+		return diffs
+	case bson.ObjectId, time.Time, bson.MongoTimestamp:
+		if reflect.TypeOf(a) == reflect.TypeOf(b) {
+			return diffs
+		}
+	}
+
+	if equalValues(a, b) {
+		return diffs
+	}
+
+	return append(diffs, fmt.Sprintf("%s: recorded %s, replayed %s", path, formatValue(a), formatValue(b)))
+}
+
+// equalValues compares the numbers by value, as a server may reply an int
+// where another replies a double.
+func equalValues(a, b interface{}) bool {
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		return fa == fb
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+func isZero(v interface{}) bool {
+	f, ok := toFloat(v)
+	return ok && f == 0
+}
+
+// isCursorPath tells if path is the cursor document of a command reply.
+func isCursorPath(path string) bool {
+	const suffix = ".cursor"
+	return len(path) >= len(suffix) && path[len(path)-len(suffix):] == suffix
+}
+
+func cursorState(id int64) string {
+	if id == 0 {
+		return "exhausted"
+	}
+
+	return "open"
+}
+
+func formatValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if b, err := json.Marshal(v); err == nil {
+		s = string(b)
+	}
+
+	if len(s) > maxValueLen {
+		s = s[:maxValueLen] + "..."
+	}
+
+	return s
+}
@@ -0,0 +1,169 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// cursors maps the cursor ids of the capture to the ones of the replay, so
+// the getMores and killCursors reach the cursors opened by the replay. The
+// map is shared by every connection, as the drivers may continue a cursor
+// over any connection of their pool.
+type cursors struct {
+	mu  sync.Mutex
+	ids map[int64]int64
+}
+
+func newCursors() *cursors {
+	return &cursors{ids: make(map[int64]int64)}
+}
+
+// learn maps the cursor of the recorded reply to the one of the replayed
+// reply, both as the cursor id of the reply and as the cursor.id field of the
+// command replies.
+func (c *cursors) learn(was, is *protocol.OpReply) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if was.CursorID != 0 {
+		c.ids[was.CursorID] = is.CursorID
+	}
+
+	if len(was.Documents) == 0 || len(is.Documents) == 0 {
+		return
+	}
+
+	if id := commandCursor(was.Documents[0]); id != 0 {
+		c.ids[id] = commandCursor(is.Documents[0])
+	}
+}
+
+func (c *cursors) get(id int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if replayed, ok := c.ids[id]; ok {
+		return replayed
+	}
+
+	return id
+}
+
+// rewrite returns the message with its cursor ids replaced by the replayed
+// ones.
+func (c *cursors) rewrite(h *protocol.MsgHeader) ([]byte, error) {
+	body := append([]byte(nil), h.Message...)
+
+	switch h.OpCode {
+	case protocol.OpGetMoreCode:
+		// int32 zero, cstring ns, int32 numberToReturn, int64 cursorID
+		if i := bytes.IndexByte(body[min(4, len(body)):], 0); i >= 0 {
+			c.rewriteIDs(body[min(4+i+1+4, len(body)):], 1)
+		}
+	case protocol.OpKillCursorsCode:
+		// int32 zero, int32 numberOfCursorIDs, int64* cursorIDs
+		if len(body) >= 8 {
+			n := int(int32(binary.LittleEndian.Uint32(body[4:])))
+			c.rewriteIDs(body[8:], n)
+		}
+	case protocol.OpQueryCode:
+		return c.rewriteCommand(h)
+	}
+
+	return encode(h, body), nil
+}
+
+// rewriteIDs replaces the first n little endian int64 of b.
+func (c *cursors) rewriteIDs(b []byte, n int) {
+	for i := 0; i < n && len(b) >= 8; i++ {
+		id := int64(binary.LittleEndian.Uint64(b))
+		binary.LittleEndian.PutUint64(b, uint64(c.get(id)))
+		b = b[8:]
+	}
+}
+
+// rewriteCommand replaces the cursor ids of the getMore and killCursors
+// commands, any other query is returned as is.
+func (c *cursors) rewriteCommand(h *protocol.MsgHeader) ([]byte, error) {
+	_, cmd := protocol.ParseRequest(h.OpCode, h.Message)
+	if cmd != "getMore" && cmd != "killCursors" {
+		return encode(h, h.Message), nil
+	}
+
+	q, err := protocol.ReadOpQuery(h, bytes.NewReader(h.Message))
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := q.Query.ToBSON()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range doc {
+		switch {
+		case cmd == "getMore" && doc[i].Name == "getMore":
+			if id, ok := doc[i].Value.(int64); ok {
+				doc[i].Value = c.get(id)
+			}
+		case cmd == "killCursors" && doc[i].Name == "cursors":
+			ids, _ := doc[i].Value.([]interface{})
+			for j := range ids {
+				if id, ok := ids[j].(int64); ok {
+					ids[j] = c.get(id)
+				}
+			}
+		}
+	}
+
+	if q.Query, err = bson.Marshal(doc); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	hc := *h
+	q.MsgHeader = &hc
+	if _, err := q.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// commandCursor returns the cursor.id of a command reply, zero if there is
+// none.
+func commandCursor(d protocol.Document) int64 {
+	var reply struct {
+		Cursor struct {
+			ID int64 `bson:"id"`
+		} `bson:"cursor"`
+	}
+
+	if err := bson.Unmarshal(d, &reply); err != nil {
+		return 0
+	}
+
+	return reply.Cursor.ID
+}
+
+func encode(h *protocol.MsgHeader, body []byte) []byte {
+	var buf bytes.Buffer
+	hc := *h
+	hc.Message = body
+	hc.WriteTo(&buf)
+
+	return buf.Bytes()
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,246 @@
+// Package replay sends the messages of a capture to a server again and
+// compares its replies with the recorded ones. Every captured connection is
+// replayed over its own connection, its messages in the same order and, if
+// requested, at the same pace, so the concurrency of the capture is kept.
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mcuadros/lemondb/capture"
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+const (
+	defaultMaxDiffs = 100
+	// connQueue is how many records of a connection are read ahead.
+	connQueue = 64
+)
+
+var errNoDial = errors.New("replay: Dial is required")
+
+// Source returns the records to replay in the order they were captured,
+// io.EOF once there are no more. It is implemented by capture.Reader.
+type Source interface {
+	Next() (*capture.Record, error)
+}
+
+// Replayer replays captures against a server.
+type Replayer struct {
+	// Dial opens a connection to the target server, it is called once for
+	// every connection of the capture.
+	Dial func() (net.Conn, error)
+	// Speed is how much faster than captured the messages are sent, 1 keeps
+	// the original pace and 2 replays twice as fast. Zero sends every message
+	// as soon as the previous one of its connection was replied.
+	Speed float64
+	// Timeout is how long to wait for each reply, zero means no timeout.
+	Timeout time.Duration
+	// Ignore are field names, at any depth of the replies, not compared
+	// besides the volatile ones always ignored.
+	Ignore []string
+	// MaxDiffs is how many mismatches are kept in the report, the rest are
+	// only counted. By default 100.
+	MaxDiffs int
+}
+
+// Replay sends every record of src and waits for all the replies. The report
+// is returned even if src fails halfway.
+func (r *Replayer) Replay(src Source) (*Report, error) {
+	if r.Dial == nil {
+		return nil, errNoDial
+	}
+
+	if r.Speed < 0 {
+		return nil, fmt.Errorf("replay: invalid speed %v", r.Speed)
+	}
+
+	rep := &Report{maxDiffs: r.MaxDiffs}
+	if rep.maxDiffs <= 0 {
+		rep.maxDiffs = defaultMaxDiffs
+	}
+
+	cmp := newComparer(r.Ignore)
+	cur := newCursors()
+	start := time.Now()
+	conns := make(map[connKey]chan *capture.Record)
+	var first time.Time
+	var wg sync.WaitGroup
+
+	var err error
+	for {
+		var rec *capture.Record
+		rec, err = src.Next()
+		if err != nil {
+			break
+		}
+
+		if first.IsZero() {
+			first = rec.Time
+		}
+
+		key := connKey{rec.Proxy, rec.ConnID}
+		ch, ok := conns[key]
+		if !ok {
+			ch = make(chan *capture.Record, connQueue)
+			conns[key] = ch
+			rep.addConnection()
+
+			c := &conn{Replayer: r, cmp: cmp, cursors: cur, report: rep, start: start, first: first}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.run(ch)
+			}()
+		}
+
+		ch <- rec
+	}
+
+	for _, ch := range conns {
+		close(ch)
+	}
+
+	wg.Wait()
+	rep.Elapsed = time.Since(start)
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	return rep, err
+}
+
+// connKey identifies a captured connection, the ids are only unique within a
+// proxy.
+type connKey struct {
+	proxy string
+	id    uint64
+}
+
+// conn replays the records of a captured connection.
+type conn struct {
+	*Replayer
+	cmp     *comparer
+	cursors *cursors
+	report  *Report
+	// start is when the replay started and first the time of the first
+	// record of the capture, used to pace the messages.
+	start time.Time
+	first time.Time
+
+	conn net.Conn
+	err  error
+}
+
+func (c *conn) run(records <-chan *capture.Record) {
+	defer func() {
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	}()
+
+	for rec := range records {
+		// once the connection failed its remaining messages are skipped, the
+		// server state they depend on is unknown.
+		if c.err != nil {
+			c.report.addSkipped()
+			continue
+		}
+
+		c.wait(rec)
+		if err := c.replay(rec); err != nil {
+			c.err = err
+			c.report.addError(newDiff(rec), err)
+		}
+	}
+}
+
+// wait sleeps until the record is due, relative to the start of the replay.
+func (c *conn) wait(rec *capture.Record) {
+	if c.Speed == 0 {
+		return
+	}
+
+	offset := time.Duration(float64(rec.Time.Sub(c.first)) / c.Speed)
+	if d := c.start.Add(offset).Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (c *conn) replay(rec *capture.Record) error {
+	h := rec.RequestHeader()
+	if h == nil {
+		return fmt.Errorf("replay: invalid request")
+	}
+
+	if c.conn == nil {
+		conn, err := c.Dial()
+		if err != nil {
+			return err
+		}
+
+		c.conn = conn
+	}
+
+	msg, err := c.cursors.rewrite(h)
+	if err != nil {
+		return err
+	}
+
+	if c.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if _, err := c.conn.Write(msg); err != nil {
+		return err
+	}
+
+	c.report.addSent()
+	if !h.OpCode.HasResponse() {
+		return nil
+	}
+
+	reply, err := protocol.ReadMsgHeader(c.conn)
+	if err != nil {
+		return err
+	}
+
+	if reply.ResponseTo != h.RequestID {
+		return fmt.Errorf("replay: reply to %d, expecting %d", reply.ResponseTo, h.RequestID)
+	}
+
+	recorded := rec.ReplyHeader()
+	if recorded == nil {
+		// the client went away before the reply, nothing to compare.
+		return nil
+	}
+
+	was, err := readReply(recorded)
+	if err != nil {
+		return fmt.Errorf("replay: recorded reply: %s", err)
+	}
+
+	is, err := readReply(reply)
+	if err != nil {
+		return err
+	}
+
+	c.cursors.learn(was, is)
+	c.report.addCompared(newDiff(rec), c.cmp.compare(was, is))
+	return nil
+}
+
+func readReply(h *protocol.MsgHeader) (*protocol.OpReply, error) {
+	if h.OpCode != protocol.OpReplyCode {
+		return nil, fmt.Errorf("replay: unexpected %s instead of a reply", h.OpCode)
+	}
+
+	return protocol.ReadOpReply(h, bytes.NewReader(h.Message))
+}
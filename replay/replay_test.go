@@ -0,0 +1,407 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mcuadros/lemondb/capture"
+	"github.com/mcuadros/lemondb/protocol"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type ReplaySuite struct{}
+
+var _ = Suite(&ReplaySuite{})
+
+var epoch = time.Unix(1500000000, 0)
+
+func (s *ReplaySuite) TestReplay_Match(c *C) {
+	t := &target{handle: func(q *protocol.OpQuery) *protocol.OpReply {
+		return reply(q, 0, bson.M{
+			"ok":           1.0,
+			"n":            int64(3),
+			"localTime":    time.Now(),
+			"lastId":       bson.NewObjectId(),
+			"$clusterTime": bson.M{"clusterTime": bson.MongoTimestamp(2)},
+		})
+	}}
+
+	rec := record(c, 1, 0, command(c, 1, "test.$cmd", bson.D{{Name: "count", Value: "foo"}}), reply(nil, 0, bson.M{
+		"ok":           1,
+		"n":            3,
+		"localTime":    epoch,
+		"lastId":       bson.NewObjectId(),
+		"$clusterTime": bson.M{"clusterTime": bson.MongoTimestamp(1)},
+	}))
+
+	r := &Replayer{Dial: t.Dial}
+	rep, err := r.Replay(&records{rec})
+	c.Assert(err, IsNil)
+	c.Assert(rep.OK(), Equals, true)
+	c.Assert(rep.Connections, Equals, 1)
+	c.Assert(rep.Sent, Equals, 1)
+	c.Assert(rep.Compared, Equals, 1)
+	c.Assert(rep.Matched, Equals, 1)
+	c.Assert(rep.Diffs, HasLen, 0)
+}
+
+func (s *ReplaySuite) TestReplay_Mismatch(c *C) {
+	t := &target{handle: func(q *protocol.OpQuery) *protocol.OpReply {
+		return reply(q, 0, bson.M{"ok": 1, "n": 4, "values": []interface{}{1}})
+	}}
+
+	recorded := reply(nil, 0, bson.M{"ok": 1, "n": 3, "values": []interface{}{1, 2}, "removed": true})
+	rec := record(c, 1, 0, command(c, 1, "test.$cmd", bson.D{{Name: "count", Value: "foo"}}), recorded)
+
+	r := &Replayer{Dial: t.Dial}
+	rep, err := r.Replay(&records{rec})
+	c.Assert(err, IsNil)
+	c.Assert(rep.OK(), Equals, false)
+	c.Assert(rep.Mismatched, Equals, 1)
+	c.Assert(rep.Diffs, HasLen, 1)
+
+	d := rep.Diffs[0]
+	c.Assert(d.RequestID, Equals, int32(1))
+	c.Assert(d.Namespace, Equals, "test.$cmd")
+	c.Assert(d.Command, Equals, "count")
+	c.Assert(d.Differences, DeepEquals, []string{
+		"[0].n: recorded 3, replayed 4",
+		"[0].removed: recorded true, missing in replay",
+		"[0].values: recorded 2 elements, replayed 1",
+	})
+
+	var buf bytes.Buffer
+	c.Assert(rep.WriteText(&buf), IsNil)
+	c.Assert(buf.String(), Matches, "(?s)connections: 1, sent: 1, compared: 1, matched: 0, mismatched: 1.*conn 1 request 1 QUERY test.\\$cmd count\n  \\[0\\].n: recorded 3, replayed 4\n.*")
+}
+
+func (s *ReplaySuite) TestReplay_Ignore(c *C) {
+	t := &target{handle: func(q *protocol.OpQuery) *protocol.OpReply {
+		return reply(q, 0, bson.M{"ok": 1, "host": "b"})
+	}}
+
+	rec := record(c, 1, 0, command(c, 1, "admin.$cmd", bson.D{{Name: "isMaster", Value: 1}}), reply(nil, 0, bson.M{"ok": 1, "host": "a"}))
+
+	r := &Replayer{Dial: t.Dial, Ignore: []string{"host"}}
+	rep, err := r.Replay(&records{rec})
+	c.Assert(err, IsNil)
+	c.Assert(rep.Matched, Equals, 1)
+}
+
+func (s *ReplaySuite) TestReplay_CommandCursor(c *C) {
+	var getMore interface{}
+	t := &target{handle: func(q *protocol.OpQuery) *protocol.OpReply {
+		doc, _ := q.Query.ToBSON()
+		if doc[0].Name == "getMore" {
+			getMore = doc[0].Value
+			return reply(q, 0, bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "nextBatch": []interface{}{2}}})
+		}
+
+		return reply(q, 0, bson.M{"ok": 1, "cursor": bson.M{"id": int64(7), "firstBatch": []interface{}{1}}})
+	}}
+
+	find := record(c, 1, 0,
+		command(c, 1, "test.$cmd", bson.D{{Name: "find", Value: "foo"}}),
+		reply(nil, 0, bson.M{"ok": 1, "cursor": bson.M{"id": int64(42), "firstBatch": []interface{}{1}}}),
+	)
+
+	more := record(c, 1, time.Millisecond,
+		command(c, 2, "test.$cmd", bson.D{{Name: "getMore", Value: int64(42)}, {Name: "collection", Value: "foo"}}),
+		reply(nil, 0, bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "nextBatch": []interface{}{2}}}),
+	)
+
+	r := &Replayer{Dial: t.Dial}
+	rep, err := r.Replay(&records{find, more})
+	c.Assert(err, IsNil)
+	c.Assert(rep.Diffs, HasLen, 0)
+	c.Assert(rep.Matched, Equals, 2)
+	c.Assert(getMore, Equals, int64(7))
+}
+
+func (s *ReplaySuite) TestReplay_GetMore(c *C) {
+	var cursorID int64
+	t := &target{
+		handle: func(q *protocol.OpQuery) *protocol.OpReply {
+			return reply(q, 7, bson.M{"a": 1})
+		},
+		getMore: func(h *protocol.MsgHeader) *protocol.OpReply {
+			cursorID = int64(binary.LittleEndian.Uint64(h.Message[len(h.Message)-8:]))
+			r := &protocol.OpReply{MsgHeader: &protocol.MsgHeader{ResponseTo: h.RequestID, OpCode: protocol.OpReplyCode}}
+			r.AddDocument(bson.M{"a": 2})
+			return r
+		},
+	}
+
+	query := &protocol.OpQuery{
+		MsgHeader:          &protocol.MsgHeader{RequestID: 1, OpCode: protocol.OpQueryCode},
+		FullCollectionName: protocol.CSString("test.foo\x00"),
+		NumberToReturn:     1,
+		Query:              marshal(c, bson.M{}),
+	}
+
+	var buf bytes.Buffer
+	_, err := query.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	find := record(c, 1, 0, buf.Bytes(), reply(nil, 42, bson.M{"a": 1}))
+
+	body := []byte{0, 0, 0, 0}
+	body = append(body, "test.foo\x00"...)
+	body = append(body, 1, 0, 0, 0, 42, 0, 0, 0, 0, 0, 0, 0)
+	h := &protocol.MsgHeader{MessageLength: int32(protocol.HeaderLen + len(body)), RequestID: 2, OpCode: protocol.OpGetMoreCode, Message: body}
+	var getMore bytes.Buffer
+	_, err = h.WriteTo(&getMore)
+	c.Assert(err, IsNil)
+	more := record(c, 1, time.Millisecond, getMore.Bytes(), reply(nil, 0, bson.M{"a": 2}))
+
+	r := &Replayer{Dial: t.Dial}
+	rep, err := r.Replay(&records{find, more})
+	c.Assert(err, IsNil)
+	c.Assert(rep.Diffs, HasLen, 0)
+	c.Assert(rep.Matched, Equals, 2)
+	c.Assert(cursorID, Equals, int64(7))
+}
+
+func (s *ReplaySuite) TestReplay_Connections(c *C) {
+	t := &target{handle: func(q *protocol.OpQuery) *protocol.OpReply {
+		return reply(q, 0, bson.M{"ok": 1})
+	}}
+
+	ok := reply(nil, 0, bson.M{"ok": 1})
+	var recs records
+	for i := 0; i < 10; i++ {
+		req := command(c, int32(i), "admin.$cmd", bson.D{{Name: "ping", Value: 1}})
+		recs = append(recs, record(c, uint64(i%2), time.Duration(i), req, ok))
+	}
+
+	r := &Replayer{Dial: t.Dial}
+	rep, err := r.Replay(&recs)
+	c.Assert(err, IsNil)
+	c.Assert(rep.Connections, Equals, 2)
+	c.Assert(rep.Matched, Equals, 10)
+	c.Assert(t.requests, HasLen, 2)
+
+	for _, ids := range t.requests {
+		c.Assert(ids, HasLen, 5)
+		for i := 1; i < len(ids); i++ {
+			c.Assert(ids[i], Equals, ids[i-1]+2)
+		}
+	}
+}
+
+func (s *ReplaySuite) TestReplay_Speed(c *C) {
+	t := &target{handle: func(q *protocol.OpQuery) *protocol.OpReply {
+		return reply(q, 0, bson.M{"ok": 1})
+	}}
+
+	ok := reply(nil, 0, bson.M{"ok": 1})
+	recs := records{
+		record(c, 1, 0, command(c, 1, "admin.$cmd", bson.D{{Name: "ping", Value: 1}}), ok),
+		record(c, 1, 200*time.Millisecond, command(c, 2, "admin.$cmd", bson.D{{Name: "ping", Value: 1}}), ok),
+	}
+
+	r := &Replayer{Dial: t.Dial, Speed: 4}
+	rep, err := r.Replay(&recs)
+	c.Assert(err, IsNil)
+	c.Assert(rep.Matched, Equals, 2)
+	c.Assert(rep.Elapsed >= 50*time.Millisecond, Equals, true)
+	c.Assert(rep.Elapsed < 200*time.Millisecond, Equals, true)
+}
+
+func (s *ReplaySuite) TestReplay_Error(c *C) {
+	t := &target{handle: func(q *protocol.OpQuery) *protocol.OpReply {
+		r := reply(q, 0, bson.M{"ok": 1})
+		r.MsgHeader.ResponseTo = 99
+		return r
+	}}
+
+	ok := reply(nil, 0, bson.M{"ok": 1})
+	recs := records{
+		record(c, 1, 0, command(c, 1, "admin.$cmd", bson.D{{Name: "ping", Value: 1}}), ok),
+		record(c, 1, 0, command(c, 2, "admin.$cmd", bson.D{{Name: "ping", Value: 1}}), ok),
+	}
+
+	r := &Replayer{Dial: t.Dial}
+	rep, err := r.Replay(&recs)
+	c.Assert(err, IsNil)
+	c.Assert(rep.OK(), Equals, false)
+	c.Assert(rep.Errors, Equals, 1)
+	c.Assert(rep.Skipped, Equals, 1)
+	c.Assert(rep.Diffs, HasLen, 1)
+	c.Assert(rep.Diffs[0].Error, Equals, "replay: reply to 99, expecting 1")
+}
+
+func (s *ReplaySuite) TestReplay_MaxDiffs(c *C) {
+	t := &target{handle: func(q *protocol.OpQuery) *protocol.OpReply {
+		return reply(q, 0, bson.M{"ok": 0})
+	}}
+
+	ok := reply(nil, 0, bson.M{"ok": 1})
+	var recs records
+	for i := 0; i < 5; i++ {
+		recs = append(recs, record(c, 1, 0, command(c, int32(i), "admin.$cmd", bson.D{{Name: "ping", Value: 1}}), ok))
+	}
+
+	r := &Replayer{Dial: t.Dial, MaxDiffs: 2}
+	rep, err := r.Replay(&recs)
+	c.Assert(err, IsNil)
+	c.Assert(rep.Mismatched, Equals, 5)
+	c.Assert(rep.Diffs, HasLen, 2)
+
+	var buf bytes.Buffer
+	c.Assert(rep.WriteText(&buf), IsNil)
+	c.Assert(buf.String(), Matches, "(?s).*\n3 more not shown\n")
+}
+
+func (s *ReplaySuite) TestCompare(c *C) {
+	cmp := newComparer(nil)
+
+	was := reply(nil, 1, bson.M{"cursor": bson.M{"id": int64(1)}, "ok": 1})
+	is := reply(nil, 0, bson.M{"cursor": bson.M{"id": int64(0)}, "ok": 1.0})
+	is.ResponseFlags = protocol.QueryFailure | protocol.AwaitCapable
+	is.AddDocument(bson.M{"ok": 1})
+
+	c.Assert(cmp.compare(was, is), DeepEquals, []string{
+		"flags: recorded 0, replayed 2",
+		"cursor: recorded open, replayed exhausted",
+		"documents: recorded 1, replayed 2",
+		"[0].cursor.id: recorded 1, replayed 0",
+	})
+
+	was = reply(nil, 0, bson.M{"cursor": bson.M{"id": int64(1)}, "_id": bson.NewObjectId()})
+	is = reply(nil, 0, bson.M{"cursor": bson.M{"id": int64(2)}, "_id": "foo"})
+	c.Assert(cmp.compare(was, is), HasLen, 1)
+}
+
+// target is a fake server, the queries are replied by handle and the
+// OP_GET_MOREs by getMore.
+type target struct {
+	handle  func(q *protocol.OpQuery) *protocol.OpReply
+	getMore func(h *protocol.MsgHeader) *protocol.OpReply
+
+	mu sync.Mutex
+	// requests are the request ids received by every connection.
+	requests [][]int32
+}
+
+func (t *target) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+
+	t.mu.Lock()
+	n := len(t.requests)
+	t.requests = append(t.requests, nil)
+	t.mu.Unlock()
+
+	go t.serve(n, server)
+	return client, nil
+}
+
+func (t *target) serve(n int, conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		h, err := protocol.ReadMsgHeader(conn)
+		if err != nil {
+			return
+		}
+
+		t.mu.Lock()
+		t.requests[n] = append(t.requests[n], h.RequestID)
+		t.mu.Unlock()
+
+		var r *protocol.OpReply
+		switch h.OpCode {
+		case protocol.OpQueryCode:
+			q, err := protocol.ReadOpQuery(h, bytes.NewReader(h.Message))
+			if err != nil {
+				return
+			}
+
+			r = t.handle(q)
+		case protocol.OpGetMoreCode:
+			r = t.getMore(h)
+		}
+
+		if r == nil {
+			return
+		}
+
+		if _, err := r.WriteTo(conn); err != nil {
+			return
+		}
+	}
+}
+
+// records is a Source of the records in the slice.
+type records []*capture.Record
+
+func (r *records) Next() (*capture.Record, error) {
+	if len(*r) == 0 {
+		return nil, io.EOF
+	}
+
+	rec := (*r)[0]
+	*r = (*r)[1:]
+	return rec, nil
+}
+
+func record(c *C, conn uint64, at time.Duration, req []byte, rep *protocol.OpReply) *capture.Record {
+	var buf bytes.Buffer
+	_, err := rep.WriteTo(&buf)
+	c.Assert(err, IsNil)
+
+	return &capture.Record{
+		Time:    epoch.Add(at),
+		Proxy:   "main",
+		ConnID:  conn,
+		Request: req,
+		Reply:   buf.Bytes(),
+	}
+}
+
+func command(c *C, id int32, ns string, cmd bson.D) []byte {
+	q := &protocol.OpQuery{
+		MsgHeader:          &protocol.MsgHeader{RequestID: id, OpCode: protocol.OpQueryCode},
+		FullCollectionName: protocol.CSString(ns + "\x00"),
+		NumberToReturn:     -1,
+		Query:              marshal(c, cmd),
+	}
+
+	var buf bytes.Buffer
+	_, err := q.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	return buf.Bytes()
+}
+
+// reply returns a reply to q, or to nothing if q is nil.
+func reply(q *protocol.OpQuery, cursorID int64, docs ...interface{}) *protocol.OpReply {
+	r := &protocol.OpReply{
+		MsgHeader: &protocol.MsgHeader{OpCode: protocol.OpReplyCode},
+		CursorID:  cursorID,
+	}
+
+	if q != nil {
+		r.MsgHeader.ResponseTo = q.MsgHeader.RequestID
+	}
+
+	for _, d := range docs {
+		r.AddDocument(d)
+	}
+
+	return r
+}
+
+func marshal(c *C, v interface{}) []byte {
+	b, err := bson.Marshal(v)
+	c.Assert(err, IsNil)
+	return b
+}
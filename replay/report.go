@@ -0,0 +1,157 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mcuadros/lemondb/capture"
+	"github.com/mcuadros/lemondb/protocol"
+)
+
+// Report is the result of a replay.
+type Report struct {
+	// Connections is the number of captured connections replayed.
+	Connections int `json:"connections"`
+	// Sent is the number of messages sent to the target.
+	Sent int `json:"sent"`
+	// Compared is the number of replies compared with the recorded ones,
+	// Matched of them were equal and Mismatched were not.
+	Compared   int `json:"compared"`
+	Matched    int `json:"matched"`
+	Mismatched int `json:"mismatched"`
+	// Errors is the number of messages that failed to be replayed, the rest
+	// of the messages of their connection are Skipped.
+	Errors  int `json:"errors"`
+	Skipped int `json:"skipped"`
+	// Diffs are the mismatches and errors, up to MaxDiffs of the Replayer.
+	Diffs   []*Diff       `json:"diffs,omitempty"`
+	Elapsed time.Duration `json:"-"`
+
+	mu       sync.Mutex
+	maxDiffs int
+}
+
+// Diff is a message whose reply differs from the recorded one or that failed
+// to be replayed.
+type Diff struct {
+	Time        time.Time `json:"time"`
+	Proxy       string    `json:"proxy,omitempty"`
+	ConnID      uint64    `json:"conn_id"`
+	RequestID   int32     `json:"request_id"`
+	Op          string    `json:"op"`
+	Namespace   string    `json:"ns,omitempty"`
+	Command     string    `json:"command,omitempty"`
+	Differences []string  `json:"differences,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func newDiff(rec *capture.Record) *Diff {
+	d := &Diff{Time: rec.Time, Proxy: rec.Proxy, ConnID: rec.ConnID}
+	if h := rec.RequestHeader(); h != nil {
+		d.RequestID, d.Op = h.RequestID, h.OpCode.String()
+		d.Namespace, d.Command = protocol.ParseRequest(h.OpCode, h.Message)
+	}
+
+	return d
+}
+
+// OK tells if every reply matched and no message failed.
+func (r *Report) OK() bool {
+	return r.Mismatched == 0 && r.Errors == 0 && r.Skipped == 0
+}
+
+func (r *Report) addConnection() {
+	r.mu.Lock()
+	r.Connections++
+	r.mu.Unlock()
+}
+
+func (r *Report) addSent() {
+	r.mu.Lock()
+	r.Sent++
+	r.mu.Unlock()
+}
+
+func (r *Report) addSkipped() {
+	r.mu.Lock()
+	r.Skipped++
+	r.mu.Unlock()
+}
+
+func (r *Report) addCompared(d *Diff, differences []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Compared++
+	if len(differences) == 0 {
+		r.Matched++
+		return
+	}
+
+	r.Mismatched++
+	d.Differences = differences
+	r.addDiff(d)
+}
+
+func (r *Report) addError(d *Diff, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Errors++
+	d.Error = err.Error()
+	r.addDiff(d)
+}
+
+func (r *Report) addDiff(d *Diff) {
+	if len(r.Diffs) < r.maxDiffs {
+		r.Diffs = append(r.Diffs, d)
+	}
+}
+
+// WriteText writes the report for people to read.
+func (r *Report) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w,
+		"connections: %d, sent: %d, compared: %d, matched: %d, mismatched: %d, errors: %d, skipped: %d, elapsed: %s\n",
+		r.Connections, r.Sent, r.Compared, r.Matched, r.Mismatched, r.Errors, r.Skipped,
+		r.Elapsed.Round(time.Millisecond),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range r.Diffs {
+		_, err := fmt.Fprintf(w, "\n%s conn %d request %d %s %s %s\n",
+			d.Time.Format(time.RFC3339Nano), d.ConnID, d.RequestID, d.Op, d.Namespace, d.Command)
+		if err != nil {
+			return err
+		}
+
+		lines := d.Differences
+		if d.Error != "" {
+			lines = []string{"error: " + d.Error}
+		}
+
+		for _, l := range lines {
+			if _, err := fmt.Fprintf(w, "  %s\n", l); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n := r.Mismatched + r.Errors - len(r.Diffs); n > 0 {
+		_, err = fmt.Fprintf(w, "\n%d more not shown\n", n)
+	}
+
+	return err
+}
+
+// WriteJSON writes the report as a JSON object.
+func (r *Report) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(struct {
+		*Report
+		ElapsedMS float64 `json:"elapsed_ms"`
+	}{r, float64(r.Elapsed) / float64(time.Millisecond)})
+}
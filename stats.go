@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mcuadros/lemondb/admin"
+	"github.com/mcuadros/lemondb/memdb"
+	"github.com/mcuadros/lemondb/middlewares"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// registerStats serves the state shown by the admin interface as virtual
+// collections of the lemondb database, to the proxies with the virtual
+// middleware.
+func registerStats(p admin.Proxies) {
+	middlewares.RegisterCollection("lemondb.proxies", memdb.Documents(func() ([]bson.D, error) {
+		var docs []bson.D
+		for _, s := range p.Status() {
+			docs = append(docs, bson.D{
+				{Name: "_id", Value: s.Name},
+				{Name: "listen", Value: s.Listen},
+				{Name: "backend", Value: s.Backend},
+				{Name: "running", Value: s.Running},
+				{Name: "middlewares", Value: s.Middlewares},
+			})
+		}
+
+		return docs, nil
+	}))
+
+	middlewares.RegisterCollection("lemondb.connections", memdb.Documents(func() ([]bson.D, error) {
+		var docs []bson.D
+		for _, s := range p.Connections() {
+			docs = append(docs, bson.D{
+				{Name: "_id", Value: int64(s.ID)},
+				{Name: "proxy", Value: s.Proxy},
+				{Name: "addr", Value: s.Addr},
+				{Name: "age_ms", Value: int64(time.Duration(s.Age) / time.Millisecond)},
+				{Name: "op", Value: s.Op},
+				{Name: "ns", Value: s.Namespace},
+				{Name: "command", Value: s.Command},
+				{Name: "op_duration_ms", Value: int64(time.Duration(s.OpDuration) / time.Millisecond)},
+				{Name: "bytes_received", Value: int64(s.BytesReceived)},
+				{Name: "bytes_sent", Value: int64(s.BytesSent)},
+				{Name: "user", Value: s.User},
+				{Name: "server_addr", Value: s.ServerAddr},
+			})
+		}
+
+		return docs, nil
+	}))
+
+	middlewares.RegisterCollection("lemondb.backends", memdb.Documents(func() ([]bson.D, error) {
+		var docs []bson.D
+		for _, s := range p.Backends() {
+			docs = append(docs, bson.D{
+				{Name: "_id", Value: s.Proxy},
+				{Name: "addr", Value: s.Addr},
+				{Name: "conns", Value: s.Conns},
+				{Name: "dial_failures", Value: int64(s.DialFailures)},
+				{Name: "last_dial_error", Value: s.LastDialError},
+				{Name: "healthy", Value: s.Healthy},
+				{Name: "last_probe", Value: s.LastProbe},
+				{Name: "last_probe_error", Value: s.LastProbeError},
+			})
+		}
+
+		return docs, nil
+	}))
+}
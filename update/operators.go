@@ -0,0 +1,469 @@
+package update
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/mcuadros/lemondb/query"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// compileFunc compiles the argument of an operator for a path.
+type compileFunc func(path string, arg interface{}) (leafFunc, error)
+
+// operators are the operators but $set, $setOnInsert, $unset and $rename,
+// which don't look at the current value.
+var operators = map[string]compileFunc{
+	"$inc":         compileArith("$inc"),
+	"$mul":         compileArith("$mul"),
+	"$min":         compileMinMax("$min"),
+	"$max":         compileMinMax("$max"),
+	"$currentDate": compileCurrentDate,
+	"$push":        compilePush,
+	"$addToSet":    compileAddToSet,
+	"$pop":         compilePop,
+	"$pull":        compilePull,
+	"$pullAll":     compilePullAll,
+}
+
+func setValue(v interface{}) leafFunc {
+	return func(a *applier, cur interface{}, exists bool) (interface{}, action, error) {
+		return copyValue(v), replace, nil
+	}
+}
+
+func unset(a *applier, cur interface{}, exists bool) (interface{}, action, error) {
+	if !exists {
+		return nil, keep, nil
+	}
+
+	return nil, remove, nil
+}
+
+func compileArith(op string) compileFunc {
+	verb := map[string]string{"$inc": "increment", "$mul": "multiply"}[op]
+	return func(path string, arg interface{}) (leafFunc, error) {
+		if !isNumber(arg) {
+			return nil, errorf(codeTypeMismatch, "Cannot %s with non-numeric argument: {%s: %s}", verb, path, formatValue(arg))
+		}
+
+		return func(a *applier, cur interface{}, exists bool) (interface{}, action, error) {
+			if !exists {
+				if op == "$mul" {
+					// the missing fields are multiplied as a zero of the
+					// type of the argument.
+					cur = zero(arg)
+				} else {
+					cur = zero(0)
+				}
+			}
+
+			if !isNumber(cur) {
+				return nil, keep, errorf(codeTypeMismatch, "Cannot apply %s to a value of non-numeric type. The field '%s' has non-numeric type %s",
+					op, path, typeName(cur))
+			}
+
+			v, err := arith(op, cur, arg)
+			if err != nil {
+				return nil, keep, err
+			}
+
+			return v, replace, nil
+		}, nil
+	}
+}
+
+// zero returns the zero of the type of the number n.
+func zero(n interface{}) interface{} {
+	switch n.(type) {
+	case float64:
+		return 0.0
+	case int64:
+		return int64(0)
+	}
+
+	return 0
+}
+
+// arith adds or multiplies two numbers keeping the widest type of both, an
+// int that overflows becomes an int64. The int64 overflows are errors.
+func arith(op string, a, b interface{}) (interface{}, error) {
+	_, fa := a.(float64)
+	_, fb := b.(float64)
+	if fa || fb {
+		if op == "$mul" {
+			return toFloat(a) * toFloat(b), nil
+		}
+
+		return toFloat(a) + toFloat(b), nil
+	}
+
+	x, _ := toInt64(a)
+	y, _ := toInt64(b)
+	var r int64
+	var overflow bool
+	if op == "$mul" {
+		r = x * y
+		overflow = x != 0 && (r/x != y || (x == -1 && y == math.MinInt64))
+	} else {
+		r = x + y
+		overflow = (x > 0 && y > 0 && r < 0) || (x < 0 && y < 0 && r >= 0)
+	}
+
+	if overflow {
+		return nil, errorf(codeBadValue, "Failed to apply %s operations to current value (%s) with %s: the result overflows a long",
+			op, formatValue(a), formatValue(b))
+	}
+
+	_, la := a.(int64)
+	_, lb := b.(int64)
+	if la || lb || r != int64(int32(r)) {
+		return r, nil
+	}
+
+	return int(r), nil
+}
+
+func compileMinMax(op string) compileFunc {
+	return func(path string, arg interface{}) (leafFunc, error) {
+		return func(a *applier, cur interface{}, exists bool) (interface{}, action, error) {
+			c := query.Compare(arg, cur)
+			if exists && ((op == "$min" && c >= 0) || (op == "$max" && c <= 0)) {
+				return nil, keep, nil
+			}
+
+			return copyValue(arg), replace, nil
+		}, nil
+	}
+}
+
+func compileCurrentDate(path string, arg interface{}) (leafFunc, error) {
+	timestamp := false
+	switch v := arg.(type) {
+	case bool:
+	case bson.D:
+		t, _ := get(v, "$type")
+		if len(v) != 1 || (t != "date" && t != "timestamp") {
+			return nil, errorf(codeBadValue, "The '$type' string field of $currentDate for '%s' must be 'date' or 'timestamp': %s", path, formatValue(arg))
+		}
+
+		timestamp = t == "timestamp"
+	default:
+		return nil, errorf(codeBadValue, "%s is not valid type for $currentDate. Please use a boolean ('true') or a $type expression ({$type: 'timestamp/date'}).",
+			typeName(arg))
+	}
+
+	return func(a *applier, cur interface{}, exists bool) (interface{}, action, error) {
+		if timestamp {
+			return bson.MongoTimestamp(a.options.Now.Unix()<<32 | 1), replace, nil
+		}
+
+		return a.options.Now, replace, nil
+	}, nil
+}
+
+// push are the modifiers of $push.
+type push struct {
+	each     []interface{}
+	position int
+	// positioned is true if the $position modifier is given.
+	positioned bool
+	slice      int
+	sliced     bool
+	sort       interface{}
+}
+
+func compilePush(path string, arg interface{}) (leafFunc, error) {
+	p, err := parsePush(path, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(a *applier, cur interface{}, exists bool) (interface{}, action, error) {
+		l, err := array("$push", path, cur, exists)
+		if err != nil {
+			return nil, keep, err
+		}
+
+		pos := len(l)
+		if p.positioned {
+			pos = p.position
+			if pos < 0 {
+				pos += len(l)
+			}
+
+			if pos < 0 {
+				pos = 0
+			} else if pos > len(l) {
+				pos = len(l)
+			}
+		}
+
+		out := make([]interface{}, 0, len(l)+len(p.each))
+		out = append(out, l[:pos]...)
+		for _, v := range p.each {
+			out = append(out, copyValue(v))
+		}
+
+		out = append(out, l[pos:]...)
+		if p.sort != nil {
+			sortArray(out, p.sort)
+		}
+
+		if p.sliced {
+			if p.slice >= 0 && p.slice < len(out) {
+				out = out[:p.slice]
+			} else if p.slice < 0 && -p.slice < len(out) {
+				out = out[len(out)+p.slice:]
+			}
+		}
+
+		return out, replace, nil
+	}, nil
+}
+
+// parsePush parses the argument of $push, a value or the modifiers if it
+// holds $each.
+func parsePush(path string, arg interface{}) (*push, error) {
+	d, ok := arg.(bson.D)
+	if _, each := get(d, "$each"); !ok || !each {
+		return &push{each: []interface{}{arg}}, nil
+	}
+
+	p := &push{}
+	for _, e := range d {
+		var ok bool
+		switch e.Name {
+		case "$each":
+			p.each, ok = e.Value.([]interface{})
+			if !ok {
+				return nil, errorf(codeBadValue, "The argument to $each in $push must be an array but it was of type: %s", typeName(e.Value))
+			}
+		case "$position":
+			if p.position, ok = toInt(e.Value); !ok {
+				return nil, errorf(codeBadValue, "The value for $position must be an integer value, not of type: %s", typeName(e.Value))
+			}
+
+			p.positioned = true
+		case "$slice":
+			if p.slice, ok = toInt(e.Value); !ok {
+				return nil, errorf(codeBadValue, "The value for $slice must be an integer value but was given type: %s", typeName(e.Value))
+			}
+
+			p.sliced = true
+		case "$sort":
+			if err := checkSort(e.Value); err != nil {
+				return nil, err
+			}
+
+			p.sort = e.Value
+		default:
+			return nil, errorf(codeBadValue, "Unrecognized clause in $push: %s", e.Name)
+		}
+	}
+
+	return p, nil
+}
+
+// checkSort checks the $sort modifier, 1 or -1 to sort by the elements or a
+// document with the order of their fields.
+func checkSort(spec interface{}) error {
+	if d, ok := spec.(bson.D); ok {
+		if len(d) == 0 {
+			return errorf(codeBadValue, "The $sort pattern is empty when it should be a set of fields.")
+		}
+
+		for _, e := range d {
+			if e.Name == "" || strings.HasPrefix(e.Name, "$") {
+				return errorf(codeBadValue, "The $sort field is a special '$' field or empty: %s", e.Name)
+			}
+
+			if n, ok := toInt(e.Value); !ok || (n != 1 && n != -1) {
+				return errorf(codeBadValue, "The $sort element value must be either 1 or -1: %s", formatValue(e.Value))
+			}
+		}
+
+		return nil
+	}
+
+	if n, ok := toInt(spec); !ok || (n != 1 && n != -1) {
+		return errorf(codeBadValue, "The $sort element value must be either 1 or -1: %s", formatValue(spec))
+	}
+
+	return nil
+}
+
+func sortArray(l []interface{}, spec interface{}) {
+	sort.SliceStable(l, func(i, j int) bool {
+		if d, ok := spec.(bson.D); ok {
+			for _, e := range d {
+				a, _ := lookup(l[i], e.Name)
+				b, _ := lookup(l[j], e.Name)
+				if c := query.Compare(a, b); c != 0 {
+					n, _ := toInt(e.Value)
+					return c*n < 0
+				}
+			}
+
+			return false
+		}
+
+		n, _ := toInt(spec)
+		return query.Compare(l[i], l[j])*n < 0
+	})
+}
+
+func compileAddToSet(path string, arg interface{}) (leafFunc, error) {
+	values := []interface{}{arg}
+	if d, ok := arg.(bson.D); ok && len(d) > 0 && d[0].Name == "$each" {
+		if values, ok = d[0].Value.([]interface{}); !ok || len(d) > 1 {
+			return nil, errorf(codeBadValue, "The argument to $each in $addToSet must be an array with no other modifiers: %s", formatValue(arg))
+		}
+	}
+
+	return func(a *applier, cur interface{}, exists bool) (interface{}, action, error) {
+		l, err := array("$addToSet", path, cur, exists)
+		if err != nil {
+			return nil, keep, err
+		}
+
+		added := !exists
+		for _, v := range values {
+			if indexOf(l, v) < 0 {
+				l, added = append(l, copyValue(v)), true
+			}
+		}
+
+		if !added {
+			return nil, keep, nil
+		}
+
+		return l, replace, nil
+	}, nil
+}
+
+func compilePop(path string, arg interface{}) (leafFunc, error) {
+	n, ok := toInt(arg)
+	if !ok || (n != 1 && n != -1) {
+		return nil, errorf(codeFailedToParse, "$pop expects 1 or -1, found: %s", formatValue(arg))
+	}
+
+	return func(a *applier, cur interface{}, exists bool) (interface{}, action, error) {
+		if !exists {
+			return nil, keep, nil
+		}
+
+		l, err := array("$pop", path, cur, exists)
+		if err != nil || len(l) == 0 {
+			return nil, keep, err
+		}
+
+		if n == 1 {
+			return l[:len(l)-1], replace, nil
+		}
+
+		return l[1:], replace, nil
+	}, nil
+}
+
+func compilePull(path string, arg interface{}) (leafFunc, error) {
+	match, err := compilePullCondition(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	return pull("$pull", path, match), nil
+}
+
+// compilePullCondition returns what tells if an element is pulled: the
+// operators are a condition on the element, a document a filter matching
+// the documents and any other value is compared by equality.
+func compilePullCondition(arg interface{}) (func(interface{}) bool, error) {
+	wrapped := func(v interface{}) bson.D { return bson.D{{Name: "v", Value: v}} }
+	d, isDoc := arg.(bson.D)
+	_, isRegex := arg.(bson.RegEx)
+	switch {
+	case isRegex || (isDoc && len(d) > 0 && strings.HasPrefix(d[0].Name, "$")):
+		m, err := query.CompileBSON(wrapped(arg))
+		if err != nil {
+			return nil, fromQuery(err)
+		}
+
+		return func(v interface{}) bool { return m.MatchBSON(wrapped(v)) }, nil
+	case isDoc:
+		m, err := query.CompileBSON(d)
+		if err != nil {
+			return nil, fromQuery(err)
+		}
+
+		return func(v interface{}) bool {
+			e, ok := v.(bson.D)
+			return ok && m.MatchBSON(e)
+		}, nil
+	}
+
+	return func(v interface{}) bool { return equal(v, arg) }, nil
+}
+
+func compilePullAll(path string, arg interface{}) (leafFunc, error) {
+	values, ok := arg.([]interface{})
+	if !ok {
+		return nil, errorf(codeBadValue, "$pullAll requires an array argument but was given a %s", typeName(arg))
+	}
+
+	return pull("$pullAll", path, func(v interface{}) bool {
+		return indexOf(values, v) >= 0
+	}), nil
+}
+
+func pull(op, path string, match func(interface{}) bool) leafFunc {
+	return func(a *applier, cur interface{}, exists bool) (interface{}, action, error) {
+		if !exists {
+			return nil, keep, nil
+		}
+
+		l, err := array(op, path, cur, exists)
+		if err != nil {
+			return nil, keep, err
+		}
+
+		out := make([]interface{}, 0, len(l))
+		for _, v := range l {
+			if !match(v) {
+				out = append(out, v)
+			}
+		}
+
+		if len(out) == len(l) {
+			return nil, keep, nil
+		}
+
+		return out, replace, nil
+	}
+}
+
+// array returns the array the operator is applied to, an empty one if the
+// field doesn't exist.
+func array(op, path string, cur interface{}, exists bool) ([]interface{}, error) {
+	if !exists {
+		return []interface{}{}, nil
+	}
+
+	l, ok := cur.([]interface{})
+	if !ok {
+		return nil, errorf(codeBadValue, "Cannot apply %s to a non-array field. Field named '%s' has non-array type %s", op, path, typeName(cur))
+	}
+
+	return l, nil
+}
+
+// fromQuery returns a query error as an update one.
+func fromQuery(err error) error {
+	if e, ok := err.(*query.Error); ok {
+		return errorf(e.Code, "%s", e.Message)
+	}
+
+	return err
+}
@@ -0,0 +1,254 @@
+package update
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mcuadros/lemondb/query"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// action is what an operator does with the value at its path.
+type action int
+
+const (
+	keep action = iota
+	replace
+	remove
+)
+
+// leafFunc returns the new value at the path of an operator given the
+// current one, exists is false if the path doesn't exist in the document.
+type leafFunc func(a *applier, cur interface{}, exists bool) (interface{}, action, error)
+
+// applier applies the operators of an update to a document.
+type applier struct {
+	options Options
+	// positions are the elements matched by the filter for $, by path of
+	// the array.
+	positions map[string]int
+}
+
+func (a *applier) applyMod(doc bson.D, m *mod) (bson.D, error) {
+	if m.to != nil {
+		return a.rename(doc, m)
+	}
+
+	v, act, err := a.update(doc, true, m, 0)
+	if err != nil || act == keep {
+		return doc, err
+	}
+
+	return v.(bson.D), nil
+}
+
+// update applies m to v, the value at the first i parts of the path. The
+// missing documents are created only if the operator sets a value.
+func (a *applier) update(v interface{}, exists bool, m *mod, i int) (interface{}, action, error) {
+	if i == len(m.parts) {
+		return m.apply(a, v, exists)
+	}
+
+	part := m.parts[i]
+	positional := part == "$" || part == "$[]"
+	if !exists {
+		if positional {
+			return nil, keep, errorf(codeBadValue, "The path '%s' must exist in the document in order to apply array updates.", strings.Join(m.parts[:i], "."))
+		}
+
+		child, act, err := a.update(nil, false, m, i+1)
+		if err != nil || act != replace {
+			return nil, keep, err
+		}
+
+		return bson.D{{Name: part, Value: child}}, replace, nil
+	}
+
+	switch cur := v.(type) {
+	case bson.D:
+		if positional {
+			break
+		}
+
+		child, ok := get(cur, part)
+		nv, act, err := a.update(child, ok, m, i+1)
+		switch {
+		case err != nil:
+			return nil, keep, err
+		case act == replace:
+			return set(cur, part, nv), replace, nil
+		case act == remove:
+			return unsetField(cur, part), replace, nil
+		}
+
+		return cur, keep, nil
+	case []interface{}:
+		return a.updateArray(cur, m, i)
+	}
+
+	if positional {
+		return nil, keep, errorf(codeBadValue, "Cannot apply array updates to non-array element %s: %s", m.parts[i-1], formatValue(v))
+	}
+
+	if _, act, err := a.update(nil, false, m, i+1); err != nil || act != replace {
+		return nil, keep, err
+	}
+
+	return nil, keep, errorf(codePathNotViable, "Cannot create field '%s' in element {%s: %s}", part, m.parts[i-1], formatValue(v))
+}
+
+// updateArray applies m to the elements of an array selected by the i part
+// of the path: an index, $ or $[]. The arrays grow with nulls to set an
+// index past their end, and the elements unset become null.
+func (a *applier) updateArray(l []interface{}, m *mod, i int) (interface{}, action, error) {
+	part := m.parts[i]
+	if part == "$[]" {
+		changed := keep
+		for j := range l {
+			nv, act, err := a.update(l[j], true, m, i+1)
+			if err != nil {
+				return nil, keep, err
+			}
+
+			if act != keep {
+				l[j], changed = nv, replace
+			}
+		}
+
+		return l, changed, nil
+	}
+
+	j, err := strconv.Atoi(part)
+	if part == "$" {
+		if j, err = a.position(l, m, i); err != nil {
+			return nil, keep, err
+		}
+	} else if err != nil || j < 0 {
+		if _, act, err := a.update(nil, false, m, i+1); err != nil || act != replace {
+			return nil, keep, err
+		}
+
+		return nil, keep, errorf(codePathNotViable, "Cannot create field '%s' in element {%s: %s}", part, m.parts[i-1], formatValue(l))
+	}
+
+	exists := j < len(l)
+	var cur interface{}
+	if exists {
+		cur = l[j]
+	}
+
+	nv, act, err := a.update(cur, exists, m, i+1)
+	if err != nil || act == keep || (act == remove && !exists) {
+		return nil, keep, err
+	}
+
+	for len(l) <= j {
+		l = append(l, nil)
+	}
+
+	l[j] = nv
+	return l, replace, nil
+}
+
+// position returns the index of the first element of l, the array at the
+// first i parts of the path of m, matched by the conditions of the filter
+// on the array.
+func (a *applier) position(l []interface{}, m *mod, i int) (int, error) {
+	path := strings.Join(m.parts[:i], ".")
+	if j, ok := a.positions[path]; ok {
+		return j, nil
+	}
+
+	notFound := errorf(codeBadValue, "The positional operator did not find the match needed from the query.")
+	conds := arrayConditions(a.options.Filter, path, nil)
+	if len(conds) == 0 {
+		return 0, notFound
+	}
+
+	matcher, err := query.CompileBSON(conds)
+	if err != nil {
+		return 0, fromQuery(err)
+	}
+
+	for j, e := range l {
+		// the conditions are checked against the element alone in the array.
+		var doc interface{} = []interface{}{e}
+		for k := i - 1; k >= 0; k-- {
+			doc = bson.D{{Name: m.parts[k], Value: doc}}
+		}
+
+		if matcher.MatchBSON(doc.(bson.D)) {
+			if a.positions == nil {
+				a.positions = make(map[string]int)
+			}
+
+			a.positions[path] = j
+			return j, nil
+		}
+	}
+
+	return 0, notFound
+}
+
+// arrayConditions appends to conds the conditions of the filter on the path
+// and its children, looking into the $and too.
+func arrayConditions(filter bson.D, path string, conds bson.D) bson.D {
+	for _, e := range filter {
+		switch {
+		case e.Name == path || strings.HasPrefix(e.Name, path+"."):
+			conds = append(conds, e)
+		case e.Name == "$and":
+			list, _ := e.Value.([]interface{})
+			for _, f := range list {
+				if d, ok := f.(bson.D); ok {
+					conds = arrayConditions(d, path, conds)
+				}
+			}
+		}
+	}
+
+	return conds
+}
+
+// rename moves the value of a field to another path, none of them can be in
+// an array.
+func (a *applier) rename(doc bson.D, m *mod) (bson.D, error) {
+	v, ok, err := lookupField(doc, m.parts, "source")
+	if err != nil || !ok {
+		return doc, err
+	}
+
+	if _, _, err := lookupField(doc, m.to, "destination"); err != nil {
+		return nil, err
+	}
+
+	doc, err = a.applyMod(doc, &mod{parts: m.parts, apply: unset})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.applyMod(doc, &mod{parts: m.to, apply: setValue(v)})
+}
+
+// lookupField returns the value at the path, failing if the path goes
+// through an array.
+func lookupField(doc bson.D, parts []string, role string) (interface{}, bool, error) {
+	var v interface{} = doc
+	for i, part := range parts {
+		switch cur := v.(type) {
+		case bson.D:
+			var ok bool
+			if v, ok = get(cur, part); !ok {
+				return nil, false, nil
+			}
+		case []interface{}:
+			return nil, false, errorf(codeBadValue, "The %s field cannot be an array element, '%s' has an array at '%s'",
+				role, strings.Join(parts, "."), strings.Join(parts[:i], "."))
+		default:
+			return nil, false, nil
+		}
+	}
+
+	return v, true, nil
+}
@@ -0,0 +1,344 @@
+// Package update applies the mongo update documents, the same that mongod
+// does, so the proxy can tell what a document looks like after an update
+// without asking the server. It supports the replacement documents and the
+// field and array operators: $set, $unset, $setOnInsert, $inc, $mul, $min,
+// $max, $rename, $currentDate, $push, $addToSet, $pop, $pull and $pullAll.
+//
+// The paths may hold the positional operators: $ is the first element of the
+// array matched by the filter of the update and $[] every element of it.
+package update
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/lemondb/protocol"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The error codes of mongo for the invalid updates.
+const (
+	codeBadValue                   = 2
+	codeFailedToParse              = 9
+	codeTypeMismatch               = 14
+	codePathNotViable              = 28
+	codeConflictingUpdateOperators = 40
+	codeDollarPrefixedFieldName    = 52
+	codeImmutableField             = 66
+)
+
+// Error is an invalid update or one that can't be applied to a document, with
+// the code mongo replies it with.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func errorf(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Options are the context an update is applied in.
+type Options struct {
+	// Filter is the filter that selected the document, the positional
+	// operator $ needs it to find the matched element of the array.
+	Filter bson.D
+	// Upsert is true when the document is being inserted by an upsert, the
+	// only case $setOnInsert is applied.
+	Upsert bool
+	// Now is the time set by $currentDate, the current one if zero.
+	Now time.Time
+}
+
+// Update is a compiled update document, safe for concurrent use.
+type Update struct {
+	// replacement is the replacement document, nil if the update is made of
+	// operators.
+	replacement bson.D
+	mods        []*mod
+}
+
+// mod is an operator applied to a path.
+type mod struct {
+	op    string
+	path  string
+	parts []string
+	apply leafFunc
+	// to is the destination of $rename.
+	to []string
+}
+
+// Compile compiles an update, an operator update or a replacement document.
+func Compile(update protocol.Document) (*Update, error) {
+	if len(update) == 0 {
+		return CompileBSON(nil)
+	}
+
+	d, err := update.ToBSON()
+	if err != nil {
+		return nil, errorf(codeFailedToParse, "invalid update: %s", err)
+	}
+
+	return CompileBSON(d)
+}
+
+// CompileBSON compiles an update already decoded, nil is an empty replacement.
+func CompileBSON(update bson.D) (*Update, error) {
+	if len(update) == 0 || !strings.HasPrefix(update[0].Name, "$") {
+		for _, e := range update {
+			if strings.HasPrefix(e.Name, "$") {
+				return nil, errorf(codeDollarPrefixedFieldName,
+					"the dollar ($) prefixed field '%s' in '%s' is not valid for storage", e.Name, e.Name)
+			}
+		}
+
+		if update == nil {
+			update = bson.D{}
+		}
+
+		return &Update{replacement: update}, nil
+	}
+
+	u := &Update{}
+	for _, e := range update {
+		if !strings.HasPrefix(e.Name, "$") {
+			return nil, errorf(codeFailedToParse, "Unknown modifier: %s", e.Name)
+		}
+
+		fields, ok := e.Value.(bson.D)
+		if !ok {
+			return nil, errorf(codeFailedToParse, "Modifiers operate on fields but we found type %s instead. For example: {$mod: {<field>: ...}} not {%s: %s}",
+				typeName(e.Value), e.Name, typeName(e.Value))
+		}
+
+		for _, f := range fields {
+			m, err := compileMod(e.Name, f)
+			if err != nil {
+				return nil, err
+			}
+
+			u.mods = append(u.mods, m)
+		}
+	}
+
+	if err := checkConflicts(u.mods); err != nil {
+		return nil, err
+	}
+
+	// mongo applies the operators in the order of the paths, so the new
+	// fields are added sorted whatever the order of the update.
+	sort.SliceStable(u.mods, func(i, j int) bool {
+		return u.mods[i].path < u.mods[j].path
+	})
+
+	return u, nil
+}
+
+func compileMod(op string, f bson.DocElem) (*mod, error) {
+	if f.Name == "" {
+		return nil, errorf(codeBadValue, "An empty update path is not valid.")
+	}
+
+	m := &mod{op: op, path: f.Name, parts: strings.Split(f.Name, ".")}
+	positional := 0
+	for i, p := range m.parts {
+		switch {
+		case p == "":
+			return nil, errorf(codeBadValue, "The update path '%s' contains an empty field name, which is not allowed.", f.Name)
+		case i == 0 && strings.HasPrefix(p, "$"):
+			return nil, errorf(codeDollarPrefixedFieldName, "The dollar ($) prefixed field '%s' in '%s' is not valid for storage.", p, f.Name)
+		case p == "$":
+			if positional++; positional > 1 {
+				return nil, errorf(codeBadValue, "Too many positional (i.e. '$') elements found in path '%s'", f.Name)
+			}
+		case p == "$[]":
+		case strings.HasPrefix(p, "$["):
+			return nil, errorf(codeBadValue, "The array filters of '%s' are not supported", f.Name)
+		case strings.HasPrefix(p, "$"):
+			return nil, errorf(codeDollarPrefixedFieldName, "The dollar ($) prefixed field '%s' in '%s' is not valid for storage.", p, f.Name)
+		}
+	}
+
+	var err error
+	switch op {
+	case "$rename":
+		m.to, err = compileRename(m, f.Value)
+	case "$set", "$setOnInsert":
+		m.apply = setValue(f.Value)
+	case "$unset":
+		m.apply = unset
+	default:
+		compile, ok := operators[op]
+		if !ok {
+			return nil, errorf(codeFailedToParse, "Unknown modifier: %s. Expected a valid update modifier", op)
+		}
+
+		m.apply, err = compile(f.Name, f.Value)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func compileRename(m *mod, to interface{}) ([]string, error) {
+	s, ok := to.(string)
+	if !ok {
+		return nil, errorf(codeBadValue, "The 'to' field for $rename must be a string: %s: %s", m.path, formatValue(to))
+	}
+
+	if s == m.path {
+		return nil, errorf(codeBadValue, "The source and target field for $rename must differ: %s: %s", m.path, formatValue(to))
+	}
+
+	parts := strings.Split(s, ".")
+	for _, p := range append(parts, m.parts...) {
+		if p == "" || strings.HasPrefix(p, "$") {
+			return nil, errorf(codeBadValue, "The $rename paths can't be empty nor have positional operators: %s: %s", m.path, formatValue(to))
+		}
+	}
+
+	if isPrefix(m.parts, parts) || isPrefix(parts, m.parts) {
+		return nil, errorf(codeBadValue, "The source and target field for $rename must not be on the same path: %s: %s", m.path, formatValue(to))
+	}
+
+	return parts, nil
+}
+
+// checkConflicts fails if a path is updated twice or by two operators in
+// the same update, or if a path is updated along with one of its parents.
+func checkConflicts(mods []*mod) error {
+	var paths [][]string
+	for _, m := range mods {
+		paths = append(paths, m.parts)
+		if m.to != nil {
+			paths = append(paths, m.to)
+		}
+	}
+
+	for i, a := range paths {
+		for _, b := range paths[:i] {
+			if isPrefix(a, b) || isPrefix(b, a) {
+				return errorf(codeConflictingUpdateOperators, "Updating the path '%s' would create a conflict at '%s'",
+					strings.Join(a, "."), strings.Join(shortest(a, b), "."))
+			}
+		}
+	}
+
+	return nil
+}
+
+// isPrefix tells if prefix is the same path as path or one of its parents.
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func shortest(a, b []string) []string {
+	if len(a) < len(b) {
+		return a
+	}
+
+	return b
+}
+
+// IsReplacement tells if the update is a replacement document instead of
+// being made of operators.
+func (u *Update) IsReplacement() bool {
+	return u.replacement != nil
+}
+
+// Apply returns the document with the update applied, the given one is left
+// untouched. The _id of the document can't be changed.
+func (u *Update) Apply(doc protocol.Document, o *Options) (protocol.Document, error) {
+	var d bson.D
+	if len(doc) > 0 {
+		var err error
+		if d, err = doc.ToBSON(); err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := u.ApplyBSON(d, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.Marshal(d)
+}
+
+// ApplyBSON is Apply for a decoded document, o may be nil.
+func (u *Update) ApplyBSON(doc bson.D, o *Options) (bson.D, error) {
+	id, hasID := get(doc, "_id")
+	if u.IsReplacement() {
+		return u.replace(id, hasID)
+	}
+
+	a := &applier{}
+	if o != nil {
+		a.options = *o
+	}
+
+	if a.options.Now.IsZero() {
+		a.options.Now = time.Now()
+	}
+
+	out := copyDoc(doc)
+	for _, m := range u.mods {
+		if m.op == "$setOnInsert" && !a.options.Upsert {
+			continue
+		}
+
+		var err error
+		if out, err = a.applyMod(out, m); err != nil {
+			return nil, err
+		}
+	}
+
+	if newID, ok := get(out, "_id"); hasID && (!ok || !equal(id, newID)) {
+		return nil, errorf(codeImmutableField, "Performing an update on the path '_id' would modify the immutable field '_id'")
+	}
+
+	return out, nil
+}
+
+func (u *Update) replace(id interface{}, hasID bool) (bson.D, error) {
+	newID, hasNewID := get(u.replacement, "_id")
+	if hasID && hasNewID && !equal(id, newID) {
+		return nil, errorf(codeImmutableField, "After applying the update, the (immutable) field '_id' was found to have been altered to _id: %s", formatValue(newID))
+	}
+
+	// the _id goes first, as in the inserted documents.
+	out := bson.D{}
+	if hasID {
+		out = append(out, bson.DocElem{Name: "_id", Value: copyValue(id)})
+	} else if hasNewID {
+		out = append(out, bson.DocElem{Name: "_id", Value: copyValue(newID)})
+	}
+
+	for _, e := range u.replacement {
+		if e.Name != "_id" {
+			out = append(out, bson.DocElem{Name: e.Name, Value: copyValue(e.Value)})
+		}
+	}
+
+	return out, nil
+}
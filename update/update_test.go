@@ -0,0 +1,342 @@
+package update
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type UpdateSuite struct{}
+
+var _ = Suite(&UpdateSuite{})
+
+// conformance are updates applied to a document and the document they
+// result in, most of them from the examples of the mongo manual. The filter
+// is the one selecting the document, used by the positional operator.
+var conformance = []struct {
+	doc    string
+	filter string
+	update string
+	result string
+}{
+	// replacement, the _id is kept first.
+	{`{"_id": 1, "a": 1}`, ``, `{"b": 2}`, `{"_id": 1, "b": 2}`},
+	{`{"_id": 1, "a": 1}`, ``, `{"b": 2, "_id": 1}`, `{"_id": 1, "b": 2}`},
+	{`{"a": 1}`, ``, `{}`, `{}`},
+
+	// fields, the missing documents are created and the new fields are added
+	// in the order of their names.
+	{`{"_id": 1, "a": 1}`, ``, `{"$set": {"a": 2, "b.c": 3}}`, `{"_id": 1, "a": 2, "b": {"c": 3}}`},
+	{`{}`, ``, `{"$set": {"z": 1, "b": 1}}`, `{"b": 1, "z": 1}`},
+	{`{"a": [1, 2]}`, ``, `{"$set": {"a.3": 4}}`, `{"a": [1, 2, null, 4]}`},
+	{`{"a": [{"b": 1}]}`, ``, `{"$set": {"a.0.b": 2, "a.1.b": 3}}`, `{"a": [{"b": 2}, {"b": 3}]}`},
+	{`{"a": 1}`, ``, `{"$set": {}}`, `{"a": 1}`},
+	{`{"a": 1, "b": {"c": 1, "d": 2}}`, ``, `{"$unset": {"a": "", "b.c": "", "x.y": ""}}`, `{"b": {"d": 2}}`},
+	{`{"a": [1, 2, 3]}`, ``, `{"$unset": {"a.1": "", "a.5": ""}}`, `{"a": [1, null, 3]}`},
+	{`{"a": 1}`, ``, `{"$setOnInsert": {"b": 1}}`, `{"a": 1}`},
+	{`{"a": 1, "n": {"f": "x"}}`, ``, `{"$rename": {"a": "b", "n.f": "n.g", "x": "y"}}`, `{"n": {"g": "x"}, "b": 1}`},
+
+	// numbers, the widest type of both is kept.
+	{`{"a": 1, "b": 1.5}`, ``, `{"$inc": {"a": 2, "b": 1, "c": 5}}`, `{"a": 3, "b": 2.5, "c": 5}`},
+	{`{"a": 1}`, ``, `{"$inc": {"a": 0.5}}`, `{"a": 1.5}`},
+	{`{"a": 2}`, ``, `{"$mul": {"a": 3, "b": 2.5, "c": 2}}`, `{"a": 6, "b": 0.0, "c": 0}`},
+	{`{"lo": 5, "hi": 5}`, ``, `{"$min": {"lo": 3}, "$max": {"hi": 4}}`, `{"lo": 3, "hi": 5}`},
+	{`{"lo": 5, "hi": 5}`, ``, `{"$min": {"lo": 8, "x": 1}, "$max": {"hi": 9}}`, `{"lo": 5, "hi": 9, "x": 1}`},
+	{`{"a": "x"}`, ``, `{"$max": {"a": 1}}`, `{"a": "x"}`},
+
+	// arrays.
+	{`{"s": [1]}`, ``, `{"$push": {"s": 2, "t": 1, "u": [1, 2]}}`, `{"s": [1, 2], "t": [1], "u": [[1, 2]]}`},
+	{`{"s": [89, 90]}`, ``, `{"$push": {"s": {"$each": [40, 60, 100], "$sort": -1, "$slice": 3}}}`, `{"s": [100, 90, 89]}`},
+	{`{"s": [1, 2, 3]}`, ``, `{"$push": {"s": {"$each": [4], "$slice": -2}}}`, `{"s": [3, 4]}`},
+	{`{"s": [1, 2, 3]}`, ``, `{"$push": {"s": {"$each": [], "$slice": 0}}}`, `{"s": []}`},
+	{`{"s": [50, 60, 70]}`, ``, `{"$push": {"s": {"$each": [20, 30], "$position": 0}}}`, `{"s": [20, 30, 50, 60, 70]}`},
+	{`{"s": [50, 60, 70]}`, ``, `{"$push": {"s": {"$each": [80], "$position": -1}}}`, `{"s": [50, 60, 80, 70]}`},
+	{`{"s": [50]}`, ``, `{"$push": {"s": {"$each": [80], "$position": 9}}}`, `{"s": [50, 80]}`},
+	{
+		`{"q": [{"id": 1, "score": 6}, {"id": 2, "score": 9}]}`, ``,
+		`{"$push": {"q": {"$each": [{"id": 3, "score": 8}], "$sort": {"score": 1}}}}`,
+		`{"q": [{"id": 1, "score": 6}, {"id": 3, "score": 8}, {"id": 2, "score": 9}]}`,
+	},
+	{`{"tags": ["a", "b"]}`, ``, `{"$addToSet": {"tags": "c"}}`, `{"tags": ["a", "b", "c"]}`},
+	{`{"tags": ["a", "b"]}`, ``, `{"$addToSet": {"tags": {"$each": ["a", "d", "d"]}}}`, `{"tags": ["a", "b", "d"]}`},
+	{`{"n": [1, {"a": 1}]}`, ``, `{"$addToSet": {"n": {"$each": [1.0, {"a": 1}, {"a": 1, "b": 1}]}}}`, `{"n": [1, {"a": 1}, {"a": 1, "b": 1}]}`},
+	{`{}`, ``, `{"$addToSet": {"n": 1}}`, `{"n": [1]}`},
+	{`{"a": [1, 2, 3], "b": [1, 2, 3], "c": []}`, ``, `{"$pop": {"a": 1, "b": -1, "c": 1, "d": 1}}`, `{"a": [1, 2], "b": [2, 3], "c": []}`},
+	{
+		`{"fruits": ["apple", "pear", "grape"], "v": [1, 5, 8, 3]}`, ``,
+		`{"$pull": {"fruits": {"$in": ["apple", "grape"]}, "v": {"$gte": 5}}}`,
+		`{"fruits": ["pear"], "v": [1, 3]}`,
+	},
+	{
+		`{"results": [{"item": "A", "score": 5}, {"item": "B", "score": 8}]}`, ``,
+		`{"$pull": {"results": {"score": 8, "item": "B"}}}`,
+		`{"results": [{"item": "A", "score": 5}]}`,
+	},
+	{`{"a": [1, [1], 2, 1.0]}`, ``, `{"$pull": {"a": 1, "b": 1}}`, `{"a": [[1], 2]}`},
+	{`{"s": [0, 2, 5, 5, 1, 0]}`, ``, `{"$pullAll": {"s": [0, 5]}}`, `{"s": [2, 1]}`},
+
+	// positional operators.
+	{`{"grades": [80, 85, 90]}`, `{"grades": 85}`, `{"$set": {"grades.$": 82}}`, `{"grades": [80, 82, 90]}`},
+	{`{"grades": [80, 85, 90]}`, `{"grades": {"$gt": 80}}`, `{"$inc": {"grades.$": 1}}`, `{"grades": [80, 86, 90]}`},
+	{
+		`{"grades": [{"grade": 80}, {"grade": 85}]}`, `{"_id": 1, "grades.grade": 85}`,
+		`{"$inc": {"grades.$.std": 1}}`,
+		`{"grades": [{"grade": 80}, {"grade": 85, "std": 1}]}`,
+	},
+	{
+		`{"a": [{"b": 1, "c": 1}, {"b": 2, "c": 2}]}`, `{"$and": [{"a": {"$elemMatch": {"b": 2}}}]}`,
+		`{"$unset": {"a.$.c": ""}}`,
+		`{"a": [{"b": 1, "c": 1}, {"b": 2}]}`,
+	},
+	{`{"grades": [1, 2]}`, ``, `{"$inc": {"grades.$[]": 10}}`, `{"grades": [11, 12]}`},
+	{`{"a": [{"b": 1}, {"b": 2}]}`, ``, `{"$set": {"a.$[].c": 0}}`, `{"a": [{"b": 1, "c": 0}, {"b": 2, "c": 0}]}`},
+	{`{"a": [{"b": [1, 2]}, {"b": [3]}]}`, ``, `{"$pull": {"a.$[].b": {"$lt": 3}}}`, `{"a": [{"b": []}, {"b": [3]}]}`},
+}
+
+func (s *UpdateSuite) TestConformance(c *C) {
+	for _, t := range conformance {
+		comment := Commentf("update %s of %s", t.update, t.doc)
+		u, err := CompileBSON(parse(c, t.update))
+		c.Assert(err, IsNil, comment)
+
+		var filter bson.D
+		if t.filter != "" {
+			filter = parse(c, t.filter)
+		}
+
+		doc := parse(c, t.doc)
+		before := copyDoc(doc)
+		out, err := u.ApplyBSON(doc, &Options{Filter: filter})
+		c.Assert(err, IsNil, comment)
+		c.Assert(out, DeepEquals, parse(c, t.result), comment)
+		c.Assert(doc, DeepEquals, before, comment)
+	}
+}
+
+func (s *UpdateSuite) TestUpsert(c *C) {
+	u, err := CompileBSON(bson.D{
+		{Name: "$set", Value: bson.D{{Name: "a", Value: 1}}},
+		{Name: "$setOnInsert", Value: bson.D{{Name: "b", Value: 2}}},
+	})
+	c.Assert(err, IsNil)
+
+	out, err := u.ApplyBSON(bson.D{{Name: "_id", Value: 1}}, &Options{Upsert: true})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, bson.D{{Name: "_id", Value: 1}, {Name: "a", Value: 1}, {Name: "b", Value: 2}})
+
+	out, err = u.ApplyBSON(bson.D{{Name: "_id", Value: 1}}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, bson.D{{Name: "_id", Value: 1}, {Name: "a", Value: 1}})
+}
+
+func (s *UpdateSuite) TestCurrentDate(c *C) {
+	now := time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC)
+	u, err := CompileBSON(parse(c, `{"$currentDate": {"d": true, "t": {"$type": "timestamp"}, "x": {"$type": "date"}}}`))
+	c.Assert(err, IsNil)
+
+	out, err := u.ApplyBSON(nil, &Options{Now: now})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, bson.D{
+		{Name: "d", Value: now},
+		{Name: "t", Value: bson.MongoTimestamp(now.Unix()<<32 | 1)},
+		{Name: "x", Value: now},
+	})
+
+	out, err = u.ApplyBSON(nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(out[0].Value.(time.Time).IsZero(), Equals, false)
+}
+
+func (s *UpdateSuite) TestNumbers(c *C) {
+	for _, t := range []struct {
+		op       string
+		cur, arg interface{}
+		result   interface{}
+	}{
+		{"$inc", 1, 2, 3},
+		{"$inc", math.MaxInt32, 1, int64(math.MaxInt32) + 1},
+		{"$inc", int64(1), 2, int64(3)},
+		{"$inc", 1, int64(2), int64(3)},
+		{"$inc", 1, 2.5, 3.5},
+		{"$mul", 1 << 20, 1 << 20, int64(1) << 40},
+		{"$mul", int64(3), -1, int64(-3)},
+		{"$mul", 3, 0.5, 1.5},
+	} {
+		comment := Commentf("%s %v by %v", t.op, t.cur, t.arg)
+		u, err := CompileBSON(bson.D{{Name: t.op, Value: bson.D{{Name: "n", Value: t.arg}}}})
+		c.Assert(err, IsNil, comment)
+
+		out, err := u.ApplyBSON(bson.D{{Name: "n", Value: t.cur}}, nil)
+		c.Assert(err, IsNil, comment)
+		c.Assert(out[0].Value, Equals, t.result, comment)
+	}
+}
+
+func (s *UpdateSuite) TestErrors(c *C) {
+	for _, t := range []struct {
+		doc    string
+		update string
+		code   int
+	}{
+		{`{}`, `{"$foo": {"a": 1}}`, codeFailedToParse},
+		{`{}`, `{"$set": {"a": 1}, "b": 1}`, codeFailedToParse},
+		{`{}`, `{"$set": 1}`, codeFailedToParse},
+		{`{}`, `{"a": 1, "$set": {"b": 1}}`, codeDollarPrefixedFieldName},
+		{`{}`, `{"$set": {"$a": 1}}`, codeDollarPrefixedFieldName},
+		{`{}`, `{"$set": {"a..b": 1}}`, codeBadValue},
+		{`{}`, `{"$set": {"a": 1}, "$inc": {"a": 1}}`, codeConflictingUpdateOperators},
+		{`{}`, `{"$set": {"a": 1, "a.b": 1}}`, codeConflictingUpdateOperators},
+		{`{}`, `{"$rename": {"a": "b"}, "$set": {"b.c": 1}}`, codeConflictingUpdateOperators},
+		{`{}`, `{"$inc": {"a": "x"}}`, codeTypeMismatch},
+		{`{}`, `{"$pop": {"a": 2}}`, codeFailedToParse},
+		{`{}`, `{"$push": {"a": {"$each": 1}}}`, codeBadValue},
+		{`{}`, `{"$push": {"a": {"$each": [1], "$sort": 2}}}`, codeBadValue},
+		{`{}`, `{"$push": {"a": {"$each": [1], "$foo": 2}}}`, codeBadValue},
+		{`{}`, `{"$pullAll": {"a": 1}}`, codeBadValue},
+		{`{}`, `{"$pull": {"a": {"$foo": 1}}}`, codeBadValue},
+		{`{}`, `{"$currentDate": {"a": {"$type": "int"}}}`, codeBadValue},
+		{`{}`, `{"$rename": {"a": "a"}}`, codeBadValue},
+		{`{}`, `{"$rename": {"a": "a.b"}}`, codeBadValue},
+		{`{}`, `{"$rename": {"a": 1}}`, codeBadValue},
+		{`{}`, `{"$set": {"a.$.b.$": 1}}`, codeBadValue},
+		{`{}`, `{"$set": {"a.$[x]": 1}}`, codeBadValue},
+		{`{"_id": 1}`, `{"$set": {"_id": 2}}`, codeImmutableField},
+		{`{"_id": 1}`, `{"$unset": {"_id": ""}}`, codeImmutableField},
+		{`{"_id": {"a": 1}}`, `{"$set": {"_id.a": 2}}`, codeImmutableField},
+		{`{"_id": 1}`, `{"_id": 2}`, codeImmutableField},
+		{`{"a": "x"}`, `{"$inc": {"a": 1}}`, codeTypeMismatch},
+		{`{"a": 1}`, `{"$set": {"a.b": 1}}`, codePathNotViable},
+		{`{"a": [1]}`, `{"$set": {"a.b": 1}}`, codePathNotViable},
+		{`{"a": 1}`, `{"$push": {"a": 1}}`, codeBadValue},
+		{`{"a": 1}`, `{"$pull": {"a": 1}}`, codeBadValue},
+		{`{"a": [1]}`, `{"$set": {"a.$": 1}}`, codeBadValue},
+		{`{}`, `{"$set": {"a.$[]": 1}}`, codeBadValue},
+		{`{"a": 1}`, `{"$set": {"a.$[]": 1}}`, codeBadValue},
+		{`{"a": [1]}`, `{"$rename": {"a.0": "b"}}`, codeBadValue},
+		{`{"a": 1, "b": []}`, `{"$rename": {"a": "b.c"}}`, codeBadValue},
+		{`{"a": 9223372036854775807}`, `{"$inc": {"a": 1}}`, codeBadValue},
+	} {
+		comment := Commentf("update %s of %s", t.update, t.doc)
+		u, err := CompileBSON(parse(c, t.update))
+		if err == nil {
+			_, err = u.ApplyBSON(parse(c, t.doc), nil)
+		}
+
+		c.Assert(err, NotNil, comment)
+		c.Assert(err.(*Error).Code, Equals, t.code, comment)
+	}
+}
+
+func (s *UpdateSuite) TestIsReplacement(c *C) {
+	for _, t := range []struct {
+		update      string
+		replacement bool
+	}{
+		{`{}`, true},
+		{`{"a": 1}`, true},
+		{`{"$set": {}}`, false},
+		{`{"$inc": {"a": 1}}`, false},
+	} {
+		u, err := CompileBSON(parse(c, t.update))
+		c.Assert(err, IsNil)
+		c.Assert(u.IsReplacement(), Equals, t.replacement, Commentf("update %s", t.update))
+	}
+}
+
+func (s *UpdateSuite) TestCompileDocument(c *C) {
+	update, err := bson.Marshal(bson.D{{Name: "$inc", Value: bson.D{{Name: "n", Value: 1}}}})
+	c.Assert(err, IsNil)
+
+	u, err := Compile(update)
+	c.Assert(err, IsNil)
+
+	doc, err := bson.Marshal(bson.D{{Name: "_id", Value: 1}, {Name: "n", Value: 1}})
+	c.Assert(err, IsNil)
+
+	out, err := u.Apply(doc, nil)
+	c.Assert(err, IsNil)
+
+	d, err := out.ToBSON()
+	c.Assert(err, IsNil)
+	c.Assert(d, DeepEquals, bson.D{{Name: "_id", Value: 1}, {Name: "n", Value: 2}})
+
+	_, err = Compile([]byte{1, 2, 3})
+	c.Assert(err, NotNil)
+}
+
+func parse(c *C, s string) bson.D {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+
+	v, err := parseValue(d)
+	c.Assert(err, IsNil, Commentf("json: %s", s))
+	return v.(bson.D)
+}
+
+// parseValue decodes a json value keeping the order of the documents, the
+// numbers without decimals are ints and the rest float64.
+func parseValue(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := t.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			doc := bson.D{}
+			for d.More() {
+				name, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+
+				v, err := parseValue(d)
+				if err != nil {
+					return nil, err
+				}
+
+				doc = append(doc, bson.DocElem{Name: name.(string), Value: v})
+			}
+
+			_, err := d.Token()
+			return doc, err
+		case '[':
+			list := []interface{}{}
+			for d.More() {
+				v, err := parseValue(d)
+				if err != nil {
+					return nil, err
+				}
+
+				list = append(list, v)
+			}
+
+			_, err := d.Token()
+			return list, err
+		}
+	case json.Number:
+		if bytes.ContainsAny([]byte(t), ".eE") {
+			return t.Float64()
+		}
+
+		n, err := t.Int64()
+		if err == nil && n != int64(int32(n)) {
+			return n, nil
+		}
+
+		return int(n), err
+	}
+
+	return t, nil
+}
@@ -0,0 +1,212 @@
+package update
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/lemondb/query"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The documents are expected as decoded by mgo into a bson.D: the nested
+// documents are bson.D, the arrays []interface{}, the int32 int and the int64
+// int64.
+
+// get returns the value of a field of doc.
+func get(doc bson.D, name string) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Name == name {
+			return e.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// set sets the value of a field of doc, appending it if it doesn't exist.
+func set(doc bson.D, name string, value interface{}) bson.D {
+	for i := range doc {
+		if doc[i].Name == name {
+			doc[i].Value = value
+			return doc
+		}
+	}
+
+	return append(doc, bson.DocElem{Name: name, Value: value})
+}
+
+// unsetField removes a field of doc.
+func unsetField(doc bson.D, name string) bson.D {
+	for i := range doc {
+		if doc[i].Name == name {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+	}
+
+	return doc
+}
+
+// lookup returns the value at the dotted path of a document.
+func lookup(v interface{}, path string) (interface{}, bool) {
+	for _, part := range strings.Split(path, ".") {
+		d, ok := v.(bson.D)
+		if !ok {
+			return nil, false
+		}
+
+		if v, ok = get(d, part); !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// indexOf returns the position of the first element of l equal to v, or -1.
+func indexOf(l []interface{}, v interface{}) int {
+	for i, e := range l {
+		if equal(e, v) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// equal tells if two values are the same, the numbers are compared by value
+// whatever their type.
+func equal(a, b interface{}) bool {
+	return query.Compare(a, b) == 0
+}
+
+// copyValue returns a deep copy of v, so the updated documents never share
+// their values with the update nor the original one.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		return copyDoc(v)
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = copyValue(e)
+		}
+
+		return l
+	}
+
+	return v
+}
+
+func copyDoc(doc bson.D) bson.D {
+	if doc == nil {
+		return bson.D{}
+	}
+
+	c := make(bson.D, len(doc))
+	for i, e := range doc {
+		c[i] = bson.DocElem{Name: e.Name, Value: copyValue(e.Value)}
+	}
+
+	return c
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int32, int64, float64:
+		return true
+	}
+
+	return false
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+// toInt returns the value of a number without decimals.
+func toInt(v interface{}) (int, bool) {
+	if n, ok := toInt64(v); ok {
+		return int(n), true
+	}
+
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) {
+		return 0, false
+	}
+
+	return int(f), true
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+
+	return math.NaN()
+}
+
+// typeName is the name of the type of v used in the error messages.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case int, int32:
+		return "int"
+	case int64:
+		return "long"
+	case float64:
+		return "double"
+	case bson.Decimal128:
+		return "decimal"
+	case string:
+		return "string"
+	case bson.D, bson.M:
+		return "object"
+	case []interface{}:
+		return "array"
+	case bool:
+		return "bool"
+	case bson.ObjectId:
+		return "objectId"
+	case time.Time:
+		return "date"
+	case bson.MongoTimestamp:
+		return "timestamp"
+	}
+
+	return "unknown"
+}
+
+// formatValue formats v for the error messages.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case nil:
+		return "null"
+	case bson.ObjectId:
+		return "ObjectId('" + v.Hex() + "')"
+	}
+
+	return fmt.Sprint(v)
+}
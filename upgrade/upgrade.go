@@ -0,0 +1,315 @@
+// Package upgrade allows a running lemondb to be replaced by a new binary
+// without refusing any connection. The running process starts the new one
+// handing over its listening sockets, once the new process is accepting
+// clients, the old one can drain its connections and exit.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EnvListeners holds the names of the inherited listeners, in the same
+	// order as the file descriptors starting at 3.
+	EnvListeners = "LEMONDB_LISTEN_FDS"
+	// EnvReady holds the file descriptor used to tell the parent that the
+	// process is ready.
+	EnvReady = "LEMONDB_READY_FD"
+
+	firstFD = 3
+)
+
+var (
+	errUpgrading   = errors.New("upgrade: an upgrade is already in progress")
+	errChildExited = errors.New("upgrade: new process exited before being ready")
+)
+
+// Upgrader keeps track of the listeners of the process, inheriting them from
+// the parent process when possible, so they can be handed over to a new
+// process.
+type Upgrader struct {
+	// ReadyTimeout is how long Upgrade waits for the new process to be ready,
+	// by default 1 minute.
+	ReadyTimeout time.Duration
+
+	mu        sync.Mutex
+	inherited map[string]net.Listener
+	active    map[string]net.Listener
+	order     []string
+	ready     *os.File
+	upgrading bool
+}
+
+// New returns an Upgrader, taking over the listeners and the ready pipe given
+// by the parent process if any.
+func New() (*Upgrader, error) {
+	u := &Upgrader{
+		inherited: make(map[string]net.Listener),
+		active:    make(map[string]net.Listener),
+	}
+
+	names := os.Getenv(EnvListeners)
+	if names != "" {
+		var files []*os.File
+		for i, name := range strings.Split(names, ",") {
+			files = append(files, os.NewFile(uintptr(firstFD+i), name))
+		}
+
+		if err := u.inherit(strings.Split(names, ","), files); err != nil {
+			return nil, err
+		}
+	}
+
+	if fd := os.Getenv(EnvReady); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("upgrade: invalid %s: %s", EnvReady, err)
+		}
+
+		u.ready = os.NewFile(uintptr(n), "ready")
+	}
+
+	os.Unsetenv(EnvListeners)
+	os.Unsetenv(EnvReady)
+
+	return u, nil
+}
+
+func (u *Upgrader) inherit(names []string, files []*os.File) error {
+	for i, name := range names {
+		l, err := net.FileListener(files[i])
+		if err != nil {
+			return fmt.Errorf("upgrade: inheriting %s: %s", name, err)
+		}
+
+		files[i].Close()
+		u.inherited[name] = l
+	}
+
+	return nil
+}
+
+// Listen returns the listener inherited from the parent for the given
+// address, or creates a new one. It can be used as proxy.ListenFunc. Once the
+// listener is closed it is not handed over anymore.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	name := network + "://" + addr
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	l, ok := u.inherited[name]
+	if ok {
+		delete(u.inherited, name)
+	} else {
+		var err error
+		if l, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := u.active[name]; !ok {
+		u.order = append(u.order, name)
+	}
+
+	u.active[name] = l
+	return &listener{Listener: l, u: u, name: name}, nil
+}
+
+// forget stops tracking the listener of name, as long as it is still l.
+func (u *Upgrader) forget(name string, l net.Listener) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.active[name] != l {
+		return
+	}
+
+	delete(u.active, name)
+	for i, n := range u.order {
+		if n == name {
+			u.order = append(u.order[:i], u.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// listener removes itself from the upgrader when closed, so a proxy stopped
+// on its own doesn't break the upgrades.
+type listener struct {
+	net.Listener
+	u    *Upgrader
+	name string
+}
+
+func (l *listener) Close() error {
+	l.u.forget(l.name, l.Listener)
+	return l.Listener.Close()
+}
+
+// Ready tells the parent process, if any, that we are accepting clients. Any
+// inherited listener not claimed by Listen is closed.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for name, l := range u.inherited {
+		l.Close()
+		delete(u.inherited, name)
+	}
+
+	if u.ready == nil {
+		return nil
+	}
+
+	defer func() {
+		u.ready.Close()
+		u.ready = nil
+	}()
+
+	_, err := u.ready.Write([]byte{1})
+	return err
+}
+
+// HasParent returns true if the process was started by Upgrade.
+func (u *Upgrader) HasParent() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.ready != nil
+}
+
+// Upgrade starts a new process with the same binary path and arguments,
+// handing over every listener created with Listen, and waits until it is
+// ready. Once Upgrade returns without error, the listeners belong to the new
+// process, the caller is expected to drain its clients and exit.
+func (u *Upgrader) Upgrade() (*os.Process, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.upgrading {
+		return nil, errUpgrading
+	}
+
+	u.upgrading = true
+	defer func() { u.upgrading = false }()
+
+	files, err := u.files()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+	files = append(files, w)
+
+	bin, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(bin, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		EnvListeners+"="+strings.Join(u.order, ","),
+		EnvReady+"="+strconv.Itoa(firstFD+len(files)-1),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// our copy of the write end must be closed, so the read fails if the new
+	// process dies.
+	w.Close()
+	files = files[:len(files)-1]
+
+	if err := u.waitReady(r); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	// The socket files now belong to the new process, they must survive
+	// when our listeners are closed.
+	for _, l := range u.active {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	return cmd.Process, nil
+}
+
+// files returns a copy of the active listeners in order, the ones returned
+// before an error are returned along with it. It must be called with mu held.
+func (u *Upgrader) files() ([]*os.File, error) {
+	var files []*os.File
+	for _, name := range u.order {
+		f, err := listenerFile(u.active[name])
+		if err != nil {
+			return files, fmt.Errorf("upgrade: %s: %s", name, err)
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+func (u *Upgrader) waitReady(r *os.File) error {
+	timeout := u.ReadyTimeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if n, _ := r.Read(b[:]); n == 0 {
+			done <- errChildExited
+			return
+		}
+
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("upgrade: new process not ready after %s", timeout)
+	}
+}
+
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch l := l.(type) {
+	case *listener:
+		return listenerFile(l.Listener)
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	}
+
+	return nil, fmt.Errorf("unsupported listener %T", l)
+}
@@ -0,0 +1,165 @@
+package upgrade
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mcuadros/lemondb/admin"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type UpgradeSuite struct{}
+
+var _ = Suite(&UpgradeSuite{})
+
+func (s *UpgradeSuite) TestListen_New(c *C) {
+	u, err := New()
+	c.Assert(err, IsNil)
+
+	l, err := u.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	c.Assert(u.order, DeepEquals, []string{"tcp://127.0.0.1:0"})
+	c.Assert(u.HasParent(), Equals, false)
+	c.Assert(u.Ready(), IsNil)
+}
+
+func (s *UpgradeSuite) TestListen_Close(c *C) {
+	u, err := New()
+	c.Assert(err, IsNil)
+
+	l, err := u.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	other, err := u.Listen("tcp", "127.0.0.2:0")
+	c.Assert(err, IsNil)
+	defer other.Close()
+
+	c.Assert(l.Close(), IsNil)
+	c.Assert(u.order, DeepEquals, []string{"tcp://127.0.0.2:0"})
+	c.Assert(u.active, HasLen, 1)
+
+	f, err := listenerFile(other)
+	c.Assert(err, IsNil)
+	f.Close()
+}
+
+func (s *UpgradeSuite) TestListen_Inherited(c *C) {
+	path := filepath.Join(c.MkDir(), "lemondb.sock")
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer tcp.Close()
+
+	unix, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer unix.Close()
+
+	tcpFile, err := tcp.(*net.TCPListener).File()
+	c.Assert(err, IsNil)
+
+	unixFile, err := unix.(*net.UnixListener).File()
+	c.Assert(err, IsNil)
+
+	u := &Upgrader{
+		inherited: make(map[string]net.Listener),
+		active:    make(map[string]net.Listener),
+	}
+
+	names := []string{"tcp://foo:7000", "unix://" + path}
+	c.Assert(u.inherit(names, []*os.File{tcpFile, unixFile}), IsNil)
+
+	l, err := u.Listen("tcp", "foo:7000")
+	c.Assert(err, IsNil)
+	c.Assert(l.Addr().String(), Equals, tcp.Addr().String())
+
+	// the inherited listener accepts the connections of the original one
+	conn, err := net.Dial("tcp", tcp.Addr().String())
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	accepted, err := l.Accept()
+	c.Assert(err, IsNil)
+	accepted.Close()
+	l.Close()
+
+	// listeners not claimed are closed on Ready
+	c.Assert(u.inherited, HasLen, 1)
+	c.Assert(u.Ready(), IsNil)
+	c.Assert(u.inherited, HasLen, 0)
+}
+
+func (s *UpgradeSuite) TestHandOver_Admin(c *C) {
+	parent, err := New()
+	c.Assert(err, IsNil)
+
+	old := &admin.Server{Addr: "127.0.0.1:0", Listen: parent.Listen}
+	c.Assert(old.Start(), IsNil)
+	defer old.Stop()
+
+	addr := parent.active["tcp://127.0.0.1:0"].Addr().String()
+
+	// the new process inherits the admin listener as Upgrade hands it over
+	parent.mu.Lock()
+	files, err := parent.files()
+	parent.mu.Unlock()
+	c.Assert(err, IsNil)
+
+	child := &Upgrader{
+		inherited: make(map[string]net.Listener),
+		active:    make(map[string]net.Listener),
+	}
+
+	c.Assert(child.inherit(parent.order, files), IsNil)
+
+	srv := &admin.Server{Addr: "127.0.0.1:0", Listen: child.Listen}
+	c.Assert(srv.Start(), IsNil)
+	defer srv.Stop()
+
+	c.Assert(child.Ready(), IsNil)
+	c.Assert(child.order, DeepEquals, []string{"tcp://127.0.0.1:0"})
+
+	// once the old process is gone, the new one answers on the same address
+	c.Assert(old.Stop(), IsNil)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addr + "/healthz")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *UpgradeSuite) TestReady(c *C) {
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	u := &Upgrader{ready: w}
+	c.Assert(u.HasParent(), Equals, true)
+	c.Assert(u.Ready(), IsNil)
+	c.Assert(u.HasParent(), Equals, false)
+
+	c.Assert(u.waitReady(r), IsNil)
+}
+
+func (s *UpgradeSuite) TestWaitReady_ChildExited(c *C) {
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	w.Close()
+
+	u := &Upgrader{}
+	c.Assert(u.waitReady(r), Equals, errChildExited)
+}
+
+func (s *UpgradeSuite) TestListenerFile_Unsupported(c *C) {
+	_, err := listenerFile(nil)
+	c.Assert(err, NotNil)
+}